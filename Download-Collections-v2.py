@@ -1,75 +1,896 @@
 import argparse
+import json
 import logging
+import shlex
 import sys
 import os
-from typing import Optional
+import time
+from datetime import datetime, timezone
+from typing import Dict, List, Optional, Tuple
 
 import internetarchive
+import requests
 
+from ia_common import (GLOB_HELP, LOG_FORMATS, SORT_KEYS, ArchiveError, Dark, NotFound, RateLimited, add_auth_args,
+                       add_breaker_args, add_file_filter_args, add_request_rate_args, add_transport_args, check_breaker_args,
+                       check_file_filter_args, check_metadata, circuit_breaker, default_excludes, default_user_agent, digest_mismatch, download_url,
+                       format_size, full_version, is_otf, log_context, metadata_digests, metadata_url, parse_args, parse_duration,
+                       parse_human_size, parse_size, raise_for_status, select_files, session_from_args, setup_logging)
+from ia_download import (DRAIN_SECONDS, PART_SUFFIX, REQUEST_TIMEOUT, STOP, Budget, ChecksumDB, Downloader, Interrupted, RateLimiter,
+                         Shutdown, StatsFile, TerminalProgress, add_checksum_db_args, add_lock_args, add_stats_args, check_stats_args,
+                         hash_file, local_names, lock_destination, long_path, open_checksum_db, safe_relpath)
+from ia_notify import Notifier, add_notify_args, check_notify_args
+
+TOOL_NAME = "Download-Collections"
+TOOL_VERSION = "2.0"
 DEFAULT_DEST = "S:/Linux-FUCKIN-ISOs"
+# On-the-fly derivatives (EPUB, MP3 from FLAC, ...) are generated when requested, which can take a while
+OTF_TIMEOUT = 300
+# --if-exists policies; --ignore-existing, --no-ignore-existing and --checksum-existing are aliases
+IF_EXISTS_POLICIES = ("skip", "overwrite", "checksum", "resume")
+EXIT_OK = 0
+EXIT_METADATA_ERROR = 2
+EXIT_SOME_FAILED = 3
+EXIT_ALL_FAILED = 4
+EXIT_VERIFY_FAILED = 5
+# --max-elapsed stopped the run before every file was started
+EXIT_PARTIAL = 6
+# archive.org still answered 429 after the retries; running again right away won't help
+EXIT_RATE_LIMITED = 7
+# SIGINT/SIGTERM, the shell's usual 128 + SIGINT
+EXIT_INTERRUPTED = 130
+
+EXIT_CODES_HELP = """\
+exit codes (when several apply, the first one listed wins):
+  130  interrupted by Ctrl-C or SIGTERM
+  8    another run is writing to the destination directory (see --lock-wait); nothing was done
+  7    rate limited by archive.org (HTTP 429) after the retries; wait before running again
+  2    item metadata could not be fetched or the identifier does not exist
+  4    every selected file failed to download or verify
+  3    some files failed to download
+  5    md5 verification failed after download (--checksum, --segments), no other failures
+  6    --max-elapsed ran out before every file was started
+  0    all selected files downloaded or already present"""
+# Per-item cache of digests computed by --if-exists checksum, keyed by name and trusted while size+mtime match
+CHECKSUM_CACHE = ".checksums.json"
+# Per-item high-water mark of metadata mtimes already mirrored, kept by --newer-only
+NEWER_ONLY_STATE = ".newer-only.json"
+# Per-item copy of the last /metadata response with its ETag, revalidated with If-None-Match
+METADATA_CACHE = ".metadata-cache.json"
+
+
+def load_checksum_cache(path: str) -> Dict[str, dict]:
+    try:
+        with open(path, "r", encoding="utf-8") as f:
+            return json.load(f)
+    except (OSError, ValueError):
+        return {}
+
+
+def save_checksum_cache(path: str, cache: Dict[str, dict]):
+    tmp = f"{path}.tmp"
+    with open(tmp, "w", encoding="utf-8") as f:
+        json.dump(cache, f, indent=2, sort_keys=True)
+    os.replace(tmp, path)
+
+
+def verify_existing(files: List[dict], item_dir: str, local: Optional[Dict[str, str]] = None,
+                    db: Optional[ChecksumDB] = None, identifier: Optional[str] = None) -> List[str]:
+    """Hash files already on disk against their metadata digests and return the names that differ.
+
+    Digests are cached in the item directory, or in db (--checksum-db) when there is one, and reused
+    while size and mtime are unchanged.
+    """
+    cache_path = os.path.join(item_dir, CHECKSUM_CACHE)
+    cache = load_checksum_cache(cache_path)
+    local = local or {}
+
+    def path_of(f):
+        return long_path(os.path.join(item_dir, local.get(f["name"], f["name"])))
+
+    existing = [f for f in files if os.path.isfile(path_of(f))]
+    mismatched = []
+    for idx, f in enumerate(existing, start=1):
+        name = f["name"]
+        expected = metadata_digests(f)
+        algos = "+".join(expected)
+        if is_otf(f):
+            logging.debug(f"On-the-fly file has no stable checksum, keeping as is: {name}")
+            continue
+        if not expected:
+            logging.debug(f"No checksum in metadata, keeping as is: {name}")
+            continue
+        path = path_of(f)
+        st = os.stat(path)
+        cached = cache.get(name)
+        known = db.digests(path, list(expected)) if db is not None else None
+        if known is not None:
+            logging.debug(f"Reusing {algos} from --checksum-db for unchanged {name}")
+            digests = known
+        elif db is not None:
+            digests = hash_file(path, list(expected), TerminalProgress(f"[verify {idx}/{len(existing)}] {name}"))
+            db.record(path, digests, identifier)
+        elif (cached and cached.get("size") == st.st_size and cached.get("mtime") == st.st_mtime
+                and set(expected) <= set(cached.get("digests") or {})):
+            logging.debug(f"Reusing cached {algos} for unchanged {name}")
+            digests = cached["digests"]
+        else:
+            digests = hash_file(path, list(expected), TerminalProgress(f"[verify {idx}/{len(existing)}] {name}"))
+            cache[name] = {"size": st.st_size, "mtime": st.st_mtime, "digests": digests}
+        mismatch = digest_mismatch(expected, digests)
+        if mismatch is None:
+            logging.info(f"Verified existing ({algos}): {name}")
+            continue
+        logging.warning(f"Checksum mismatch ({mismatch}), re-downloading: {name}")
+        cache.pop(name, None)
+        mismatched.append(name)
+    if existing and db is None:
+        save_checksum_cache(cache_path, cache)
+    return mismatched
+
+
+def existing_action(policy: str, path: str, part: str, f: dict, mismatched: bool) -> Tuple[str, str]:
+    """Apply an --if-exists policy to one file and return (action, reason) for the per-file log line.
+
+    action is "skip", "fetch" (download, resuming a leftover .part), "fresh" (download from
+    scratch, dropping any .part) or "continue" (the existing file is a truncated copy to extend).
+    mismatched says whether the checksum pass found the existing file different from metadata.
+    """
+    exists = os.path.isfile(path)
+    if policy == "overwrite":
+        return "fresh", "re-downloading existing file" if exists else "new file"
+    if not exists:
+        return "fetch", "resuming partial download" if os.path.exists(part) else "new file"
+    if policy == "skip":
+        return "skip", "already exists"
+    if policy == "checksum":
+        if mismatched:
+            return "fetch", "checksum mismatch, repairing"
+        if not metadata_digests(f):
+            return "skip", "already exists, no checksum in metadata to compare"
+        return "skip", "checksum matches"
+    expected = None if is_otf(f) else parse_size(f.get("size"))
+    have = os.path.getsize(path)
+    if expected is None:
+        return "skip", "already exists, no size in metadata to compare"
+    if have == expected:
+        return "skip", "already complete"
+    if have < expected:
+        return "continue", f"continuing from {format_size(have)} of {format_size(expected)}"
+    return "fresh", f"larger than metadata size ({format_size(have)} > {format_size(expected)}), re-downloading"
+
+
+def newer_reason(path: str, f: dict, high_water: Optional[int], tolerance: float) -> Tuple[bool, str]:
+    """Decide for --newer-only whether an existing file's metadata mtime is newer than what we have.
+
+    The remote mtime has to beat both the local file's mtime and the item's high-water mark from
+    the last run (when there is one) by more than tolerance, so clock skew and copied files with
+    reset mtimes don't cause re-downloads. Files without an mtime in metadata are kept.
+    """
+    remote = parse_size(f.get("mtime"))
+    if remote is None:
+        return False, "no mtime in metadata, keeping the local copy"
+    local = os.stat(path).st_mtime
+    if remote <= local + tolerance:
+        return False, "not newer than the local copy"
+    if high_water is not None and remote <= high_water + tolerance:
+        return False, "not newer than the last run's high-water mark"
+    return True, f"changed {format_age(remote - local)} after the local copy"
+
+
+def load_high_water(item_dir: str) -> Optional[int]:
+    try:
+        with open(os.path.join(item_dir, NEWER_ONLY_STATE), "r", encoding="utf-8") as f:
+            return json.load(f).get("high_water")
+    except (OSError, ValueError):
+        return None
+
+
+def save_high_water(item_dir: str, high_water: int):
+    path = os.path.join(item_dir, NEWER_ONLY_STATE)
+    tmp = f"{path}.tmp"
+    with open(tmp, "w", encoding="utf-8") as f:
+        json.dump({"high_water": high_water}, f)
+    os.replace(tmp, path)
+
+
+def ia_skip_reason(path: str, f: dict, checksum: bool) -> Optional[str]:
+    """Decide like the internetarchive library's File.download whether an existing file counts as done.
+
+    With checksum the md5 decides; otherwise size and mtime must both equal the metadata (any
+    non-empty <id>_files.xml counts). Returns the reason to skip, or None to (re)download.
+    """
+    if not os.path.isfile(path):
+        return None
+    if checksum:
+        if f.get("md5") and hash_file(path, ["md5"], TerminalProgress(f"[md5] {f['name']}"))["md5"] == f["md5"].lower():
+            return "md5 matches"
+        return None
+    st = os.stat(path)
+    if f["name"].endswith("_files.xml") and st.st_size != 0:
+        return "non-empty _files.xml"
+    mtime = parse_size(f.get("mtime"))
+    if st.st_size == parse_size(f.get("size")) and mtime is not None and int(st.st_mtime) == mtime:
+        return "size and mtime match"
+    return None
+
+
+def set_ia_mtime(path: str, f: dict):
+    # the library stamps downloads with the metadata mtime and later compares against it
+    mtime = parse_size(f.get("mtime"))
+    if mtime is not None:
+        os.utime(path, (os.stat(path).st_atime, mtime))
+
+
+def limit_files(files: List[dict], max_files: Optional[int], prefer: Optional[str]) -> List[dict]:
+    """Keep at most max_files, ordered by size when a preference is given (unknown sizes last)."""
+    if prefer:
+        known = [f for f in files if parse_size(f.get("size")) is not None]
+        unknown = [f for f in files if parse_size(f.get("size")) is None]
+        known.sort(key=lambda f: parse_size(f.get("size")), reverse=prefer == "largest")
+        files = known + unknown
+    if max_files is None:
+        return files
+    return files[:max_files]
+
+
+def format_age(seconds: float) -> str:
+    minutes, hours, days = int(seconds // 60), int(seconds // 3600), int(seconds // 86400)
+    if days:
+        return f"{days}d{hours % 24}h"
+    if hours:
+        return f"{hours}h{minutes % 60}m"
+    if minutes:
+        return f"{minutes}m"
+    return f"{int(seconds)}s"
+
+
+def list_partials(item_dir: str):
+    """Log leftover .part files from earlier runs; they are resumed if the file is still selected."""
+    now = time.time()
+    for root, _, names in os.walk(item_dir):
+        for n in sorted(names):
+            if n.endswith(PART_SUFFIX):
+                path = os.path.join(root, n)
+                st = os.stat(path)
+                logging.warning(f"Leftover partial download: {os.path.relpath(path, item_dir)} "
+                                f"({format_size(st.st_size)}, {format_age(now - st.st_mtime)} old)")
+
+
+def curl_command(url: str, path: str, user_agent: str, retries: int) -> str:
+    return " ".join([
+        "curl", "--location", "--fail", "--continue-at", "-", "--create-dirs",
+        "--retry", str(retries),
+        "--user-agent", shlex.quote(user_agent),
+        "--output", shlex.quote(path),
+        shlex.quote(url),
+    ])
+
+
+def print_file_table(files: List[dict], suppressed: List[dict], output: str, sort_by: Optional[str]):
+    """Print the dry-run listing as aligned columns or TSV, with totals at the bottom.
+
+    Files the default excludes suppressed are listed after the selection, marked in the note column.
+    """
+    if sort_by:
+        files = sorted(files, key=SORT_KEYS[sort_by])
+        suppressed = sorted(suppressed, key=SORT_KEYS[sort_by])
+    header = ["name", "size", "format", "source", "md5", "sha1", "note"]
+    rows = []
+    for f, note in [(f, "on-the-fly" if is_otf(f) else "") for f in files] + [(f, "excluded by default") for f in suppressed]:
+        size = parse_size(f.get("size"))
+        rows.append([
+            f.get("name") or "",
+            ("" if size is None else str(size)) if output == "tsv" else format_size(size),
+            f.get("format") or "",
+            f.get("source") or "",
+            "yes" if f.get("md5") else "no",
+            "yes" if f.get("sha1") else "no",
+            note,
+        ])
+    total_bytes = sum(parse_size(f.get("size")) or 0 for f in files)
+    unknown = sum(1 for f in files if parse_size(f.get("size")) is None)
+    totals = f"{len(files)} files, {format_size(total_bytes)} total"
+    if unknown:
+        totals += f" ({unknown} without size)"
+    if suppressed:
+        totals += f"; {len(suppressed)} excluded by default"
+
+    if output == "tsv":
+        for row in [header] + rows:
+            print("\t".join(row))
+        # keep stdout machine-readable
+        print(totals, file=sys.stderr)
+        return
+
+    widths = [max(len(r[i]) for r in [header] + rows) for i in range(len(header))]
+    for row in [header] + rows:
+        # size is right-aligned, everything else left-aligned
+        print("  ".join(c.rjust(w) if i == 1 else c.ljust(w) for i, (c, w) in enumerate(zip(row, widths))).rstrip())
+    print(totals)
+
+
+def load_metadata_cache(item_dir: str) -> Optional[dict]:
+    cache_path = os.path.join(item_dir, METADATA_CACHE)
+    if not os.path.exists(cache_path):
+        return None
+    try:
+        with open(cache_path, "r", encoding="utf-8") as f:
+            return json.load(f)
+    except (OSError, ValueError) as e:
+        logging.warning(f"Ignoring unreadable metadata cache {cache_path}: {e}")
+        return None
+
+
+def plan_totals(groups: Dict[str, Optional[List[str]]], args) -> Tuple[int, int, int]:
+    """Count the files and bytes the run will select, from each item's cached metadata.
+
+    Returns (files, bytes, uncached) where uncached is the number of items with no usable cache;
+    their files are only known once their metadata is fetched.
+    """
+    nfiles = nbytes = uncached = 0
+    for identifier, wanted in groups.items():
+        cached = load_metadata_cache(os.path.join(args.destdir, identifier))
+        if not cached or not cached.get("metadata"):
+            uncached += 1
+            continue
+        available = cached["metadata"].get("files", [])
+        if wanted is not None:
+            available = [f for f in available if f.get("name") in wanted]
+        files = limit_files(select_files(available, args, identifier)[0], args.max_files, args.prefer)
+        nfiles += len(files)
+        nbytes += sum(parse_size(f.get("size")) or 0 for f in files)
+    return nfiles, nbytes, uncached
+
 
+def fetch_item_metadata(session, identifier: str, item_dir: str, refresh: bool, store: bool) -> dict:
+    """Return the item's /metadata JSON, revalidating the cached copy in item_dir with its ETag.
 
-def setup_logging(verbosity: int, log_file: Optional[str] = None):
-    level = logging.WARNING
-    if verbosity == 1:
-        level = logging.INFO
-    elif verbosity >= 2:
-        level = logging.DEBUG
+    A 304 reuses the cache; a failed request falls back to it with a warning. refresh skips the
+    conditional request, and store=False (listing modes) leaves the disk alone.
+    """
+    cache_path = os.path.join(item_dir, METADATA_CACHE)
+    cached = load_metadata_cache(item_dir)
+    headers = {}
+    if cached and cached.get("etag") and not refresh:
+        headers["If-None-Match"] = cached["etag"]
+    try:
+        r = session.get(metadata_url(identifier), headers=headers, timeout=REQUEST_TIMEOUT)
+        if r.status_code == 304 and cached:
+            logging.info(f"{identifier}: metadata unchanged since {cached.get('fetched')}, using the cached copy")
+            return cached["metadata"]
+        raise_for_status(r)
+        metadata = r.json()
+    except (requests.RequestException, ValueError) as e:
+        if not cached:
+            raise
+        logging.warning(f"{identifier}: could not fetch metadata ({e}), using the copy cached at {cached.get('fetched')}")
+        return cached["metadata"]
+    if store and metadata:
+        os.makedirs(item_dir, exist_ok=True)
+        entry = {
+            "etag": r.headers.get("ETag"),
+            "item_last_updated": metadata.get("item_last_updated"),
+            "fetched": datetime.now(timezone.utc).isoformat(),
+            "metadata": metadata,
+        }
+        tmp = f"{cache_path}.tmp"
+        with open(tmp, "w", encoding="utf-8") as f:
+            json.dump(entry, f)
+        os.replace(tmp, cache_path)
+    return metadata
 
-    handlers = [logging.StreamHandler(sys.stdout)]
-    if log_file:
-        handlers.append(logging.FileHandler(log_file, encoding="utf-8"))
 
-    logging.basicConfig(
-        level=level,
-        format="%(asctime)s | %(levelname)-8s | %(message)s",
-        datefmt="%H:%M:%S",
-        handlers=handlers,
-    )
+def write_json_sidecar(path: str, data):
+    # pretty-printed with sorted keys so unchanged metadata gives an identical file
+    tmp = f"{path}.tmp"
+    with open(tmp, "w", encoding="utf-8") as f:
+        json.dump(data, f, indent=2, sort_keys=True, ensure_ascii=False)
+        f.write("\n")
+    os.replace(tmp, path)
+
+
+def save_sidecars(item, item_dir: str, metadata: bool, reviews: bool):
+    """Write <id>.metadata.json (the full /metadata response) and <id>.reviews.json when asked."""
+    os.makedirs(item_dir, exist_ok=True)
+    if metadata:
+        write_json_sidecar(os.path.join(item_dir, f"{item.identifier}.metadata.json"), item.item_metadata)
+    if reviews:
+        found = item.item_metadata.get("reviews") or []
+        write_json_sidecar(os.path.join(item_dir, f"{item.identifier}.reviews.json"), found)
+        logging.info(f"{item.identifier}: saved {len(found)} review(s)")
+
+
+def save_item_metadata(downloader: Downloader, item, item_dir: str) -> List[str]:
+    """Refresh <id>_files.xml, <id>_meta.xml and <id>_metadata.json regardless of filters.
+
+    Returns the names written so the normal download pass leaves them alone.
+    """
+    ident = item.identifier
+    written = []
+    os.makedirs(item_dir, exist_ok=True)
+    for name in (f"{ident}_files.xml", f"{ident}_meta.xml"):
+        path = os.path.join(item_dir, name)
+        try:
+            downloader.fetch_file(download_url(ident, name), path + PART_SUFFIX, None, f"[metadata] {name}")
+        except (requests.RequestException, OSError) as e:
+            logging.warning(f"Could not refresh {name}: {e}")
+            continue
+        os.replace(path + PART_SUFFIX, path)
+        written.append(name)
+    name = f"{ident}_metadata.json"
+    write_json_sidecar(os.path.join(item_dir, name), item.item_metadata)
+    written.append(name)
+    logging.info(f"Refreshed item metadata files: {', '.join(written)}")
+    return written
+
+
+class RunStats:
+    """Per-file outcomes grouped by identifier, for the closing summary and --report."""
+
+    STATUSES = ("downloaded", "skipped", "failed")
+
+    def __init__(self, user_agent: Optional[str] = None):
+        self.started = time.time()
+        # in the report, so a run's traffic can be told apart in archive.org's logs
+        self.user_agent = user_agent
+        self.items: Dict[str, List[dict]] = {}
+        self.notes: Dict[str, dict] = {}
+
+    def note(self, identifier: str, **fields):
+        """Attach item-level facts (e.g. files left behind by --max-files) to the report."""
+        self.items.setdefault(identifier, [])
+        self.notes.setdefault(identifier, {}).update(fields)
+
+    def record(self, identifier: str, name: str, status: str, nbytes: int = 0, seconds: float = 0.0, **extra):
+        entry = {"name": name, "status": status, "bytes": nbytes, "seconds": round(seconds, 3)}
+        entry.update(extra)
+        self.items.setdefault(identifier, []).append(entry)
+
+    @staticmethod
+    def totals(entries: List[dict]) -> dict:
+        totals = {status: sum(1 for e in entries if e["status"] == status) for status in RunStats.STATUSES}
+        transferred = [e for e in entries if e["status"] == "downloaded"]
+        nbytes = sum(e["bytes"] for e in transferred)
+        seconds = sum(e["seconds"] for e in transferred)
+        rates = [e["bytes"] / e["seconds"] for e in transferred if e["seconds"] > 0]
+        totals.update({
+            "bytes": nbytes,
+            "avg_bytes_per_sec": round(nbytes / seconds) if seconds > 0 else None,
+            "peak_bytes_per_sec": round(max(rates)) if rates else None,
+        })
+        return totals
+
+    def report(self) -> dict:
+        finished = time.time()
+        every = [e for entries in self.items.values() for e in entries]
+        return {
+            "tool": TOOL_NAME,
+            "version": full_version(TOOL_VERSION),
+            "user_agent": self.user_agent,
+            "started": datetime.fromtimestamp(self.started, timezone.utc).isoformat(),
+            "finished": datetime.fromtimestamp(finished, timezone.utc).isoformat(),
+            "elapsed_seconds": round(finished - self.started, 3),
+            "totals": self.totals(every),
+            "items": {ident: {"totals": self.totals(entries), **self.notes.get(ident, {}), "files": entries}
+                      for ident, entries in self.items.items()},
+        }
+
+    def print_summary(self):
+        report = self.report()
+        t = report["totals"]
+
+        def rate(value):
+            return f"{format_size(value)}/s" if value is not None else "n/a"
+
+        print(f"Summary: {t['downloaded']} downloaded, {t['skipped']} skipped, {t['failed']} failed; "
+              f"{format_size(t['bytes'])} in {report['elapsed_seconds']:.1f}s "
+              f"(avg {rate(t['avg_bytes_per_sec'])}, peak {rate(t['peak_bytes_per_sec'])})")
+        if len(self.items) > 1:
+            for ident, item in report["items"].items():
+                it = item["totals"]
+                if "metadata_error" in item:
+                    print(f"  {ident}: metadata error: {item['metadata_error']}")
+                    continue
+                print(f"  {ident}: {it['downloaded']} downloaded, {it['skipped']} skipped, {it['failed']} failed, {format_size(it['bytes'])}")
+
+
+def exit_code(selected: int, failed: int, verify_failed: int, metadata_errors: int = 0,
+              partial: bool = False, interrupted: bool = False, rate_limited: bool = False) -> int:
+    """Map run outcomes to an exit status; failed counts download errors, verify_failed md5 mismatches."""
+    if interrupted:
+        return EXIT_INTERRUPTED
+    if rate_limited:
+        return EXIT_RATE_LIMITED
+    if metadata_errors:
+        return EXIT_METADATA_ERROR
+    if selected and failed + verify_failed == selected:
+        return EXIT_ALL_FAILED
+    if failed:
+        return EXIT_SOME_FAILED
+    if verify_failed:
+        return EXIT_VERIFY_FAILED
+    if partial:
+        return EXIT_PARTIAL
+    return EXIT_OK
+
+
+def write_report(path: str, report: dict):
+    tmp = f"{path}.tmp"
+    with open(tmp, "w", encoding="utf-8") as f:
+        json.dump(report, f, indent=2)
+    os.replace(tmp, path)
+
+
+def load_json_entries(path: str) -> Dict[str, List[str]]:
+    """Group IA-Advanced-Search-v2 output (a JSON array of identifier/file_name entries) by identifier."""
+    with open(path, "r", encoding="utf-8") as f:
+        entries = json.load(f)
+    groups: Dict[str, List[str]] = {}
+    skipped = 0
+    for entry in entries:
+        identifier = entry.get("identifier") if isinstance(entry, dict) else None
+        name = entry.get("file_name") if identifier else None
+        if not name:
+            skipped += 1
+            continue
+        names = groups.setdefault(identifier, [])
+        if name not in names:
+            names.append(name)
+    if skipped:
+        logging.warning(f"Ignored {skipped} entries without identifier and file_name in {path}")
+    return groups
+
+
+def mirror_item(session, downloader: Downloader, identifier: str, args, stats: "RunStats",
+                wanted: Optional[List[str]] = None, run_deadline: Optional[float] = None, position: str = "",
+                db: Optional[ChecksumDB] = None) -> int:
+    """Download one item's selected files into <destdir>/<identifier> and return how many --max-files left behind.
+
+    wanted limits the item to those file names (from --from-json); names the item no longer has are reported.
+    No new file is started once run_deadline (--max-elapsed) has passed. position ("item 3/12") prefixes
+    the progress lines when there are several items. Files verified on the way are recorded in db (--checksum-db).
+    """
+    logging.info(f"Starting download for '{identifier}'{f' ({position})' if position else ''} -> {args.destdir}")
+
+    item_dir = os.path.join(args.destdir, identifier)
+    listing = args.dry_run or args.print_urls or args.print_curl
+    try:
+        metadata = fetch_item_metadata(session, identifier, item_dir, args.refresh_metadata, store=not listing)
+        check_metadata(identifier, metadata)
+    except (NotFound, Dark) as e:
+        logging.error(str(e))
+        stats.note(identifier, metadata_error=str(e), error_kind=e.kind)
+        return 0
+    except (requests.RequestException, ValueError) as e:
+        logging.error(f"Failed to fetch metadata for '{identifier}': {e}")
+        stats.note(identifier, metadata_error=str(e), error_kind=getattr(e, "kind", "error"))
+        return 0
+    item = session.get_item(identifier, item_metadata=metadata)
+    available = item.files
+    if wanted is not None:
+        present = {f.get("name") for f in item.files}
+        missing = [name for name in wanted if name not in present]
+        if missing:
+            logging.warning(f"{identifier}: {len(missing)} file(s) from --from-json are no longer in the item: {', '.join(missing)}")
+            stats.note(identifier, missing=missing)
+        available = [f for f in item.files if f.get("name") in wanted]
+
+    matching, suppressed = select_files(available, args, identifier)
+    files = limit_files(matching, args.max_files, args.prefer)
+    left_behind = len(matching) - len(files)
+    total_bytes = sum(parse_size(f.get("size")) or 0 for f in files)
+    logging.info(f"{len(files)} of {len(available)} files selected ({format_size(total_bytes)})")
+    if suppressed:
+        logging.info(f"{len(suppressed)} housekeeping file(s) left out by the default excludes (--include-housekeeping to keep them)")
+
+    # ia keeps each name as is, so compat mode skips the collision suffixes
+    local = {f["name"]: safe_relpath(f["name"]) for f in files} if args.ia_compat else local_names(files)
+
+    if args.print_urls or args.print_curl:
+        for f in files:
+            url = download_url(identifier, f["name"])
+            if args.print_curl:
+                path = os.path.join(item_dir, *local[f["name"]].split("/"))
+                print(curl_command(url, path, session.headers["User-Agent"], args.retries))
+            else:
+                print(url)
+        return left_behind
+
+    if args.dry_run:
+        print_file_table(files, suppressed, args.output, args.sort_by)
+        if left_behind:
+            print(f"Left behind {left_behind} matching file(s) because of --max-files", file=sys.stderr if args.output == "tsv" else sys.stdout)
+        return left_behind
+
+    os.makedirs(args.destdir, exist_ok=True)
+    list_partials(item_dir)
+    refreshed = save_item_metadata(downloader, item, item_dir) if args.save_item_metadata else []
+    files = [f for f in files if f["name"] not in refreshed]
+    if args.save_metadata or args.save_reviews:
+        save_sidecars(item, item_dir, args.save_metadata, args.save_reviews)
+
+    mismatched = []
+    if args.if_exists == "checksum" and not args.ia_compat:
+        started = time.time()
+        mismatched = verify_existing(files, item_dir, local, db, identifier)
+        logging.info(f"Verification pass took {time.time() - started:.1f}s, {len(mismatched)} file(s) to re-download")
+
+    if args.max_files is not None:
+        stats.note(identifier, left_behind=left_behind)
+    high_water = load_high_water(item_dir) if args.newer_only else None
+    for idx, f in enumerate(files, start=1):
+        if STOP.is_set() or run_deadline is not None and time.time() >= run_deadline:
+            if not STOP.is_set():
+                logging.warning(f"--max-elapsed used up, not starting the last {len(files) - idx + 1} file(s) of {identifier}")
+            stats.note(identifier, not_started=len(files) - idx + 1)
+            break
+        name = f["name"]
+        path = long_path(os.path.join(item_dir, local[name]))
+        part = path + PART_SUFFIX
+        # only the final name counts as existing; a .part is resumed unless the policy says otherwise
+        if args.newer_only and os.path.isfile(path):
+            newer, reason = newer_reason(path, f, high_water, args.mtime_tolerance)
+            action, tag = ("fresh" if newer else "skip"), "newer-only"
+        elif args.ia_compat and args.if_exists != "overwrite":
+            reason = ia_skip_reason(path, f, args.checksum or args.if_exists == "checksum")
+            action, reason = ("skip", reason) if reason else ("fresh", "ia would re-download") if os.path.exists(path) else ("fetch", "new file")
+            tag = "if-exists ia-compat"
+        else:
+            action, reason = existing_action(args.if_exists, path, part, f, name in mismatched)
+            tag = f"if-exists {args.if_exists}"
+        logging.info(f"[{tag}] {name}: {reason}", extra={"file": name})
+        if action == "skip":
+            stats.record(identifier, name, "skipped")
+            continue
+        if action == "fresh" and os.path.exists(part):
+            os.remove(part)
+        elif action == "continue" and (not os.path.exists(part) or os.path.getsize(part) < os.path.getsize(path)):
+            # the longer of the two copies becomes the partial that fetch_file extends
+            os.replace(path, part)
+        prefix = f"[{position}] [{idx}/{len(files)}] {name}" if position else f"[{idx}/{len(files)}] {name}"
+        otf = is_otf(f)
+        # the normal /download/<id>/<name> URL is what asks IA to generate an on-the-fly file;
+        # it has no size or checksum to hold the result to
+        extra = {"otf": True} if otf else {}
+        trace = {}
+        size = None if otf else parse_size(f.get("size"))
+        url = download_url(identifier, name)
+        started = time.time()
+        budget = Budget(started + args.max_elapsed_per_file if args.max_elapsed_per_file else None, run_deadline)
+        try:
+            transfer = downloader.fetch(url, part, size, prefix, OTF_TIMEOUT if otf else REQUEST_TIMEOUT, trace, budget,
+                                        list(metadata_digests(f)))
+        except Interrupted:
+            kept = os.path.exists(part)
+            logging.warning(f"Interrupted: {name}" + (f", {format_size(os.path.getsize(part))} kept in {os.path.basename(part)}" if kept else ""), extra={"file": name})
+            stats.record(identifier, name, "failed", seconds=time.time() - started, error="interrupted", **extra, **trace)
+            continue
+        except (requests.RequestException, OSError) as e:
+            logging.error(f"Download failed: {name} - {e}", extra={"file": name})
+            if isinstance(e, ArchiveError):
+                extra["error_kind"] = e.kind
+            stats.record(identifier, name, "failed", seconds=time.time() - started, error=str(e), **extra, **trace)
+            continue
+        received = transfer.received
+        elapsed = time.time() - started
+        if transfer.digests is not None:
+            # --checksum, or a segmented download, which is always checked as a whole
+            method = transfer.method
+            mismatch = digest_mismatch(metadata_digests(f), transfer.digests)
+            verify = {"algo": "+".join(transfer.digests), "method": method, "ok": mismatch is None}
+            extra["verify"] = verify
+            if mismatch:
+                logging.error(f"Checksum mismatch after download ({method}): {name}: {mismatch}", extra={"file": name})
+                os.remove(part)
+                stats.record(identifier, name, "failed", received, elapsed, error=f"{verify['algo']} mismatch", **extra, **trace)
+                continue
+            logging.info(f"Verified {verify['algo']} ({method}): {name}", extra={"file": name})
+        os.replace(part, path)
+        if args.ia_compat:
+            set_ia_mtime(path, f)
+        if db is not None and transfer.digests:
+            db.record(path, transfer.digests, identifier)
+        logging.info(f"Downloaded {name}{' (on-the-fly)' if otf else ''} ({format_size(received)} in {elapsed:.1f}s)", extra={"file": name})
+        stats.record(identifier, name, "downloaded", received, elapsed, **extra, **trace)
+
+    if args.newer_only:
+        done = {e["name"] for e in stats.items.get(identifier, []) if e["status"] != "failed"}
+        mtimes = [parse_size(f.get("mtime")) for f in files if f["name"] in done]
+        mtimes = [m for m in mtimes if m is not None]
+        if mtimes and max(mtimes) > (high_water or 0):
+            save_high_water(item_dir, max(mtimes))
+    return left_behind
 
 
 def main():
-    p = argparse.ArgumentParser(description="Download an entire Internet Archive item/collection (v2)")
-    p.add_argument("identifier", help="Archive.org item identifier")
-    p.add_argument("--destdir", "-o", default=DEFAULT_DEST, help="Destination directory")
-    p.add_argument("--ignore-existing", action="store_true", default=True, help="Skip files that already exist (default: true)")
-    p.add_argument("--no-ignore-existing", action="store_false", dest="ignore_existing", help="Do not skip existing files")
-    p.add_argument("--checksum", action="store_true", help="Verify checksums after download")
+    p = argparse.ArgumentParser(description="Download an entire Internet Archive item/collection (v2)",
+                                epilog=f"{GLOB_HELP}\n\n{EXIT_CODES_HELP}", formatter_class=argparse.RawDescriptionHelpFormatter)
+    p.add_argument("identifier", nargs="?", help="Archive.org item identifier")
+    p.add_argument("--from-json", help="Download the files listed in IA-Advanced-Search-v2 output, grouped by identifier")
+    p.add_argument("--destdir", "-o", help=f"Destination directory (default: {DEFAULT_DEST}, or the current directory with --ia-compat)")
+    existing = p.add_mutually_exclusive_group()
+    existing.add_argument("--if-exists", choices=IF_EXISTS_POLICIES, default="skip",
+                          help="What to do with files already on disk: skip them, overwrite them, checksum them and repair mismatches, "
+                               "or resume them when shorter than their metadata size (default: skip; leftover .part files are resumed except with overwrite)")
+    existing.add_argument("--ignore-existing", action="store_const", const="skip", dest="if_exists", help="Alias for --if-exists skip")
+    existing.add_argument("--no-ignore-existing", action="store_const", const="overwrite", dest="if_exists", help="Alias for --if-exists overwrite")
+    p.add_argument("--checksum", action="store_true", help="Verify the md5 of each download before moving it into place")
+    existing.add_argument("--checksum-existing", action="store_const", const="checksum", dest="if_exists", help="Alias for --if-exists checksum")
+    p.add_argument("--newer-only", action="store_true", help="Only download missing files and files whose metadata mtime is newer than the local copy (and the last run's high-water mark)")
+    p.add_argument("--mtime-tolerance", type=parse_duration, default=300, help="Clock-skew allowance for --newer-only, e.g. 5m (default: 5m)")
+    p.add_argument("--ia-compat", action="store_true", help="Lay out and skip files like the ia CLI: ./<identifier>/<name>, skip on matching size+mtime (md5 with --checksum), overwrite anything else, stamp downloads with the metadata mtime")
     p.add_argument("--retries", type=int, default=5, help="Number of retries")
-    p.add_argument("--glob", help="Only download files matching this glob pattern (e.g. *.iso)")
+    add_file_filter_args(p, "download")
+    p.add_argument("--save-item-metadata", action="store_true", default=True, help="Always refresh <id>_files.xml, <id>_meta.xml and <id>_metadata.json in the item directory, regardless of filters (default: true)")
+    p.add_argument("--no-save-item-metadata", action="store_false", dest="save_item_metadata", help="Only download the item's metadata files when the filters select them")
+    p.add_argument("--show-default-excludes", action="store_true", help="Print the built-in exclude patterns and exit")
+    p.add_argument("--save-metadata", action="store_true", help="Write the full /metadata response to <identifier>/<identifier>.metadata.json on every run")
+    p.add_argument("--save-reviews", action="store_true", help="Write the item's reviews to <identifier>/<identifier>.reviews.json on every run")
+    p.add_argument("--refresh-metadata", action="store_true", help=f"Fetch item metadata again instead of revalidating the copy cached in <identifier>/{METADATA_CACHE}")
+    p.add_argument("--segments", type=int, default=1, help="Download large files as N concurrent range requests when the node supports ranges (default: 1)")
+    p.add_argument("--max-files", type=int, help="Download at most N of the matching files")
+    prefer = p.add_mutually_exclusive_group()
+    prefer.add_argument("--prefer-largest", action="store_const", const="largest", dest="prefer", help="With --max-files, keep the largest matching files")
+    prefer.add_argument("--prefer-smallest", action="store_const", const="smallest", dest="prefer", help="With --max-files, keep the smallest matching files")
+    p.add_argument("--max-elapsed-per-file", type=parse_duration, help="Give up on a file (counted as failed, its .part kept) after this much wall time, e.g. 30m")
+    p.add_argument("--drain", type=float, default=DRAIN_SECONDS, help="After Ctrl-C, seconds the transfers in flight get to finish before they are cut off, keeping their .part (default: 10; 0 to stop them at once)")
+    add_lock_args(p)
+    add_checksum_db_args(p)
+    p.add_argument("--max-elapsed", type=parse_duration, help="Stop starting new files after this much wall time for the whole run, e.g. 6h; exits with code 6")
+    p.add_argument("--limit-rate", type=parse_human_size, default=os.environ.get("IA_LIMIT_RATE"), help="Cap the combined download rate of all transfers, in bytes per second with units like 500K or 10M (default: $IA_LIMIT_RATE)")
+    add_request_rate_args(p)
+    add_breaker_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="User-Agent for metadata and file requests (default: $IA_USER_AGENT, else tool name, version and $IA_CONTACT)")
+    p.add_argument("--report", help="Write per-file outcomes and run totals to this JSON file")
+    add_stats_args(p)
+    add_notify_args(p)
     p.add_argument("--log-file", help="Optional path to a log file")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
     p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
     p.add_argument("--dry-run", action="store_true", help="List files without downloading")
-    args = p.parse_args()
+    p.add_argument("--output", choices=["table", "tsv"], default="table", help="Dry-run listing format: aligned table or TSV (sizes in bytes) for scripts")
+    p.add_argument("--sort-by", choices=sorted(SORT_KEYS), help="Sort the dry-run listing by this column (default: metadata order)")
+    p.add_argument("--print-urls", action="store_true", help="Print the download URL of each selected file instead of downloading")
+    p.add_argument("--print-curl", action="store_true", help="Print a resumable curl command per selected file (same layout and User-Agent) instead of downloading")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.show_default_excludes:
+        for pat in default_excludes(args.identifier or "<identifier>"):
+            print(pat)
+        return
+    if not args.identifier and not args.from_json:
+        p.error("an identifier or --from-json is required")
+    if args.identifier and args.from_json:
+        p.error("give either an identifier or --from-json, not both")
+    if args.segments < 1:
+        p.error("--segments must be at least 1")
+    if args.limit_rate is not None and args.limit_rate < 1:
+        p.error("--limit-rate must be at least 1 byte per second")
+    if args.max_files is not None and args.max_files < 1:
+        p.error("--max-files must be at least 1")
+    check_file_filter_args(p, args)
+    check_breaker_args(p, args)
+    check_stats_args(p, args)
+    check_notify_args(p, args)
 
-    setup_logging(args.v, args.log_file)
+    if args.destdir is None:
+        args.destdir = "." if args.ia_compat else DEFAULT_DEST
+    if args.ia_compat and args.if_exists == "resume":
+        p.error("--if-exists resume does not apply with --ia-compat, which overwrites files it doesn't skip")
 
-    os.makedirs(args.destdir, exist_ok=True)
+    setup_logging(args.v, args.log_file, log_format=args.log_format)
 
-    logging.info(f"Starting download for '{args.identifier}' -> {args.destdir}")
+    # Both sessions carry the credentials (none with --anonymous) and the same User-Agent. Metadata requests are retried
+    # by the session; downloads only by the Downloader, which resumes a body cut short. Each session has
+    # its own --max-rps bucket, so a run of small files doesn't hold up metadata calls or the other way round, but the
+    # circuit breaker is one: archive.org failing pauses both
+    own = default_user_agent(TOOL_NAME, TOOL_VERSION, f"internetarchive/{internetarchive.__version__}")
+    user_agent = args.user_agent or own
+    breaker = circuit_breaker(args)
+    session = session_from_args(args, own, internetarchive.get_session(), breaker=breaker, timeout=REQUEST_TIMEOUT)
+    transfers = session_from_args(args, own, internetarchive.get_session(), breaker=breaker, timeout=REQUEST_TIMEOUT, retries=0)
+    logging.debug(f"User-Agent: {user_agent}")
 
-    if args.dry_run:
-        # internetarchive library supports listing files via get_item
-        item = internetarchive.get_item(args.identifier)
-        for f in item.files:
-            name = f.get("name")
-            if args.glob and not item.session.matches(name, args.glob):
-                continue
-            print(name)
-        return
+    if args.from_json:
+        groups = load_json_entries(args.from_json)
+        logging.info(f"{sum(len(v) for v in groups.values())} file(s) from {len(groups)} item(s) in {args.from_json}")
+    else:
+        groups = {args.identifier: None}
+
+    shutdown = Shutdown(args.drain).install()
+    stats = RunStats(user_agent)
+    run_deadline = stats.started + args.max_elapsed if args.max_elapsed else None
+    downloader = Downloader(transfers, args.retries, args.segments, RateLimiter(args.limit_rate) if args.limit_rate else None,
+                            args.checksum)
+    left_behind = 0
+    listing = args.dry_run or args.print_urls or args.print_curl
+    db = None
+    if not listing:
+        # listing modes write nothing, so they don't wait for (or hold up) a run that does
+        shutdown.on_exit(lock_destination(args.destdir, TOOL_NAME, args.lock_wait).release)
+        db = open_checksum_db(p, args)
+        if db is not None:
+            shutdown.on_exit(db.close)
+
+    def write_final_report():
+        report = stats.report()
+        report["interrupted"] = STOP.is_set()
+        write_report(args.report, report)
+        logging.info(f"Wrote report to {args.report}")
+
+    if args.report and not listing:
+        # also when a second Ctrl-C cuts the run short
+        shutdown.on_exit(write_final_report)
+    stats_file = StatsFile(None if listing else args.stats_file, args.stats_interval, TOOL_NAME).start()
+    stats_file.begin(len(groups))
+    shutdown.on_exit(lambda: stats_file.finish(EXIT_INTERRUPTED))
+
+    def run_summary() -> dict:
+        report = stats.report()
+        return {"destdir": args.destdir, "items": len(groups), "elapsed_seconds": report["elapsed_seconds"], **report["totals"]}
 
-    # Perform download
-    internetarchive.download(
-        args.identifier,
-        destdir=args.destdir,
-        verbose=args.v >= 1,
-        ignore_existing=args.ignore_existing,
-        checksum=args.checksum,
-        retries=args.retries,
-        glob_pattern=args.glob,
-    )
+    # the failures in a row are counted in the destination, next to what they are about
+    notifier = Notifier(args, TOOL_NAME, user_agent, args.destdir)
+    if not listing:
+        notifier.install(run_summary)
+    planned = ""
+    if len(groups) > 1 and not listing:
+        planned_files, planned_bytes, uncached = plan_totals(groups, args)
+        cached = len(groups) - uncached
+        print(f"Planned from cached metadata: {planned_files} file(s), {format_size(planned_bytes)} in {cached} of {len(groups)} item(s)"
+              + (f"; {uncached} item(s) have no cached metadata yet" if uncached else ""))
+        if cached:
+            planned = f" of {'at least ' if uncached else ''}{planned_files}"
+    for n, (identifier, wanted) in enumerate(groups.items(), start=1):
+        if STOP.is_set() or run_deadline is not None and time.time() >= run_deadline:
+            if not STOP.is_set():
+                logging.warning(f"--max-elapsed used up, not starting item {identifier}")
+            stats.note(identifier, not_started=len(wanted) if wanted is not None else "all")
+            stats_file.item_done()
+            continue
+        if len(groups) > 1 and args.dry_run and args.output == "table":
+            print(f"== {identifier}")
+        position = f"item {n}/{len(groups)}" if len(groups) > 1 else ""
+        with log_context(identifier=identifier):
+            left_behind += mirror_item(session, downloader, identifier, args, stats, wanted, run_deadline, position, db)
+        t = stats.totals([e for entries in stats.items.values() for e in entries])
+        stats_file.item_done()
+        stats_file.update(files_downloaded=t["downloaded"], files_skipped=t["skipped"], files_failed=t["failed"])
+        if position and not listing:
+            done = t["downloaded"] + t["skipped"] + t["failed"]
+            print(f"Overall after {position}: {done}{planned} file(s) done, {t['failed']} failed, {format_size(t['bytes'])} downloaded")
+    metadata_errors = sum(1 for n in stats.notes.values() if "metadata_error" in n)
+    kinds = ({n.get("error_kind") for n in stats.notes.values()}
+             | {e.get("error_kind") for files in stats.items.values() for e in files})
+    rate_limited = RateLimited.kind in kinds
+    if listing:
+        sys.exit(exit_code(0, 0, 0, metadata_errors, rate_limited=rate_limited))
 
+    if left_behind:
+        print(f"Left behind {left_behind} matching file(s) because of --max-files")
+    missing = sum(len(n.get("missing", [])) for n in stats.notes.values())
+    if missing:
+        print(f"{missing} file(s) from {args.from_json} are no longer in their items (see the log or --report)")
     logging.info("Download finished")
+    stats.print_summary()
+    partial = any("not_started" in n for n in stats.notes.values())
+    if STOP.is_set():
+        print("Interrupted: completed files are in place and partial ones kept, run the same command again to continue")
+    elif partial:
+        print("Stopped early: --max-elapsed ran out before every file was started")
+    entries = [e for files in stats.items.values() for e in files if e.get("error") != "interrupted"]
+    verify_failed = sum(1 for e in entries if e.get("error") == "md5 mismatch")
+    failed = sum(1 for e in entries if e["status"] == "failed") - verify_failed
+    if rate_limited:
+        print("archive.org is rate limiting these requests; wait a while (or lower --max-rps) before running again")
+    code = exit_code(len(entries), failed, verify_failed, metadata_errors, partial, STOP.is_set(), rate_limited)
+    # before the on_exit() hooks, whose stats-file one is for a second Ctrl-C
+    stats_file.finish(code)
+    shutdown.finish()
+    notifier.done(code, run_summary())
+    sys.exit(code)
 
 
 if __name__ == "__main__":
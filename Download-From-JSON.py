@@ -1,32 +1,25 @@
+import argparse
 import os
-import json
-import requests
 import sys
 import time
 
-# Load the ISO metadata (explicit UTF-8 to avoid Windows cp1252 decode issues)
-with open("misc.json", "r", encoding="utf-8") as f:
-    iso_list = json.load(f)
-
-# Make sure the output directory exists
-output_dir = "G:/Linux-ISOs/"
-os.makedirs(output_dir, exist_ok=True)
+from ia_catalog import iter_entries
+from ia_common import (add_auth_args, add_breaker_args, add_request_rate_args, add_transport_args, check_breaker_args, circuit_breaker,
+                       default_user_agent, format_size, parse_args, parse_human_size, parse_size, session_from_args)
+from ia_download import (PART_SUFFIX, Downloader, Progress, RateLimiter, StatsFile, add_lock_args, add_stats_args, check_stats_args,
+                         lock_destination, status_line, status_tag, supports_glyphs)
 
+INPUT_FILE = "misc.json"
+OUTPUT_DIR = "G:/Linux-ISOs/"
 BAR_WIDTH = 40
-CHUNK_SIZE = 1024 * 256  # 256 KiB chunks for smoother progress
 REQUEST_TIMEOUT = 60
-
-
-def _format_size(num_bytes: int | None) -> str:
-    if num_bytes is None:
-        return "?"
-    units = ["B", "KB", "MB", "GB", "TB"]
-    size = float(num_bytes)
-    for unit in units:
-        if size < 1024 or unit == units[-1]:
-            return f"{size:.1f}{unit}"
-        size /= 1024
-    return f"{num_bytes}B"
+# Connection errors, 429/5xx answers and bodies cut short are retried with backoff, resuming what arrived
+RETRIES = 3
+# the list could not be read, or stops partway with something that isn't an entry
+EXIT_BAD_INPUT = 2
+TOOL_NAME = "Download-From-JSON"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
 
 
 def _print_bar(prefix: str, downloaded: int, total: int | None):
@@ -35,71 +28,139 @@ def _print_bar(prefix: str, downloaded: int, total: int | None):
         filled = int(BAR_WIDTH * frac)
         bar = "#" * filled + "-" * (BAR_WIDTH - filled)
         percent = int(frac * 100)
-        total_s = _format_size(total)
-        cur_s = _format_size(downloaded)
+        total_s = format_size(total)
+        cur_s = format_size(downloaded)
         line = f"{prefix} [{bar}] {percent:3d}% ({cur_s}/{total_s})"
     else:
         # Unknown total size
-        cur_s = _format_size(downloaded)
+        cur_s = format_size(downloaded)
         bar = "#" * (downloaded // (10 * 1024 * 1024))  # one # per ~10MB as a rough indicator
         bar = bar[-BAR_WIDTH:]
         line = f"{prefix} [{bar:<{BAR_WIDTH}}] {cur_s}"
     print("\r" + line, end="", flush=True)
 
 
-def download_file(url: str, dest_path: str, display_name: str | None = None):
-    """Download a URL to dest_path with a simple progress bar."""
-    display_name = display_name or os.path.basename(dest_path)
-    try:
-        with requests.get(url, stream=True, timeout=REQUEST_TIMEOUT) as r:
-            r.raise_for_status()
-            total_str = r.headers.get("Content-Length") or r.headers.get("content-length")
-            total = int(total_str) if total_str and total_str.isdigit() else None
-
-            downloaded = 0
-            last_update = 0.0
-            prefix = f"[↓] {display_name}"
-            _print_bar(prefix, downloaded, total)
-            with open(dest_path, "wb") as f:
-                for chunk in r.iter_content(chunk_size=CHUNK_SIZE):
-                    if not chunk:
-                        continue
-                    f.write(chunk)
-                    downloaded += len(chunk)
-                    # Throttle refresh rate to reduce flicker/CPU
-                    now = time.time()
-                    if now - last_update >= 0.05:
-                        _print_bar(prefix, downloaded, total)
-                        last_update = now
-            # Finalize bar at 100%
-            _print_bar(prefix, downloaded, total)
-            print()  # newline after bar
-    except Exception:
-        # Ensure the progress line doesn't stick on errors
+class BarProgress(Progress):
+    """Draws the progress bar for one file, at most every 50ms to reduce flicker/CPU."""
+
+    def __init__(self, prefix: str):
+        self.prefix = prefix
+        self.done = 0
+        self.total = None
+        self.last_update = 0.0
+        _print_bar(prefix, 0, None)
+
+    def update(self, done: int, total: int | None, rate: float | None):
+        self.done, self.total = done, total
+        now = time.time()
+        if now - self.last_update >= 0.05:
+            _print_bar(self.prefix, done, total)
+            self.last_update = now
+
+    def end(self):
+        # Finalize the bar and move off its line, also when the download failed
+        _print_bar(self.prefix, self.done, self.total)
         print()
-        raise
+
+
+def download_file(downloader: Downloader, url: str, dest_path: str, size: int | None = None,
+                  display_name: str | None = None, ascii_only: bool = False):
+    """Download a URL to dest_path with a simple progress bar.
+
+    A failed download keeps what arrived in <dest_path>.part, and the next run resumes it.
+    """
+    display_name = display_name or os.path.basename(dest_path)
+    part_path = dest_path + PART_SUFFIX
+    downloader.fetch(url, part_path, size, f"{status_tag('download', ascii_only)} {display_name}")
+    os.replace(part_path, dest_path)
 
 
 def main():
-    total_items = len(iso_list)
-    for idx, iso in enumerate(iso_list, start=1):
-        file_name = iso.get("file_name")
-        url = iso.get("download_url")
-        if not file_name or not url:
-            continue
-
-        dest_path = os.path.join(output_dir, file_name)
-        prefix = f"[{idx}/{total_items} {(idx/total_items*100):.1f}%]"
-
-        if os.path.exists(dest_path):
-            print(f"{prefix} [✓] Already exists: {file_name}")
-            continue
-
-        try:
-            download_file(url, dest_path, display_name=file_name)
-            print(f"{prefix} [✔] Done: {file_name}")
-        except Exception as e:
-            print(f"{prefix} [✗] Failed: {file_name} - {e}")
+    parser = argparse.ArgumentParser(description=f"Download the files listed in {INPUT_FILE} into {OUTPUT_DIR}")
+    parser.add_argument("--input", "-i", default=INPUT_FILE,
+                        help=f"The list to download: JSON, NDJSON or any format IA-Convert.py reads; '-' reads NDJSON from stdin as it "
+                             f"arrives, e.g. from `IA-Advanced-Search-v2.py --output-format ndjson --out -` (default: {INPUT_FILE})")
+    parser.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT") or DEFAULT_USER_AGENT,
+                        help="User-Agent for file requests (default: $IA_USER_AGENT, else tool name, version and $IA_CONTACT)")
+    parser.add_argument("--limit-rate", type=parse_human_size, default=os.environ.get("IA_LIMIT_RATE"),
+                        help="Cap the download rate, in bytes per second with units like 500K or 10M (default: $IA_LIMIT_RATE)")
+    add_request_rate_args(parser)
+    add_breaker_args(parser)
+    add_transport_args(parser)
+    add_auth_args(parser)
+    add_lock_args(parser)
+    add_stats_args(parser)
+    parser.add_argument("--ascii", action="store_true",
+                        help="Mark the status lines [OK]/[FAIL] instead of with glyphs (automatic when the console can't print them)")
+    args = parse_args(parser, __file__, version=TOOL_VERSION)
+    if args.limit_rate is not None and args.limit_rate < 1:
+        parser.error("--limit-rate must be at least 1 byte per second")
+    check_breaker_args(parser, args)
+    check_stats_args(parser, args)
+    ascii_only = args.ascii or not supports_glyphs(sys.stdout)
+    if ascii_only and hasattr(sys.stdout, "reconfigure"):
+        # a file name the console's code page can't print comes out with ? instead of stopping the run
+        sys.stdout.reconfigure(errors="replace")
+
+    # The list is decoded as it is read, once to count the entries and again to download them, so a catalog
+    # of millions of entries takes the memory of one (it is read as UTF-8, whatever the Windows code page).
+    # stdin is read once, an entry at a time: its total is unknown, and a writer that gets ahead of the
+    # downloads waits on the full pipe rather than piling entries up here
+    try:
+        total_items = None if args.input == "-" else sum(1 for _ in iter_entries(args.input))
+    except (OSError, ValueError) as e:
+        print(f"Could not read {args.input}: {e}", file=sys.stderr)
+        sys.exit(EXIT_BAD_INPUT)
+
+    # Creates the output directory, and keeps another run from downloading into it at the same time
+    lock = lock_destination(OUTPUT_DIR, TOOL_NAME, args.lock_wait)
+    # Retries are the Downloader's, which resumes the .part; the session itself doesn't retry
+    session = session_from_args(args, DEFAULT_USER_AGENT, breaker=circuit_breaker(args), timeout=REQUEST_TIMEOUT, retries=0)
+    downloader = Downloader(session, RETRIES, limiter=RateLimiter(args.limit_rate) if args.limit_rate else None,
+                            progress=BarProgress)
+
+    stats_file = StatsFile(args.stats_file, args.stats_interval, TOOL_NAME).start()
+    stats_file.begin(total_items)
+    done = failed = 0
+    code = 0
+    with lock:
+        entries = enumerate(iter_entries(args.input), start=1)
+        while True:
+            try:
+                idx, iso = next(entries)
+            except StopIteration:
+                break
+            except (OSError, ValueError) as e:
+                # e.g. the search writing stdin was stopped partway through an entry; the files before it are done
+                print(f"Stopped reading {args.input}: {e}", file=sys.stderr)
+                code = EXIT_BAD_INPUT
+                break
+            file_name = iso.get("file_name")
+            url = iso.get("download_url")
+            if not file_name or not url:
+                stats_file.item_done()
+                continue
+
+            dest_path = os.path.join(OUTPUT_DIR, file_name)
+            prefix = f"[{idx}/{total_items} {(idx/total_items*100):.1f}%]" if total_items else f"[{idx}]"
+
+            if os.path.exists(dest_path):
+                print(status_line(prefix, "exists", f"Already exists: {file_name}", ascii_only))
+                stats_file.item_done()
+                continue
+
+            try:
+                download_file(downloader, url, dest_path, parse_size(iso.get("size")), display_name=file_name, ascii_only=ascii_only)
+                print(status_line(prefix, "done", f"Done: {file_name}", ascii_only))
+                done += 1
+            except Exception as e:
+                print(status_line(prefix, "failed", f"Failed: {file_name} - {e}", ascii_only))
+                stats_file.record(f"{file_name}: {e}")
+                failed += 1
+            stats_file.item_done()
+            stats_file.update(files_downloaded=done, files_failed=failed)
+    stats_file.finish(code)
+    sys.exit(code)
 
 
 if __name__ == "__main__":
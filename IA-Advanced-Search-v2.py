@@ -1,185 +1,567 @@
 import argparse
+import csv
+import hashlib
 import json
 import logging
+import os
+import signal
 import sys
+import threading
 import time
-from typing import List, Optional
+from concurrent.futures import ThreadPoolExecutor
+from datetime import datetime
+from typing import Callable, Dict, Iterator, List, Optional, Set, TextIO, Tuple
 
 import requests
-from requests.adapters import HTTPAdapter
-from urllib3.util.retry import Retry
 
-SEARCH_URL = "https://archive.org/advancedsearch.php"
-METADATA_BASE_URL = "https://archive.org/metadata/"
-DOWNLOAD_BASE_URL = "https://archive.org/download"
+from ia_catalog import iter_entries
+from ia_common import (LOG_FORMATS, SEARCH_DEPTH_LIMIT, CursorExpired, Dark, NotFound, RateLimited, RequestLimiter, ScrapeResults,
+                       SearchDoc, SearchError, SearchResults, add_auth_args, add_request_rate_args, add_size_filter_args, add_transport_args,
+                       check_size_filter_args, default_user_agent, download_url, format_size, parse_args, parse_size, session_from_args,
+                       setup_logging, size_in_range)
+from ia_common import fetch_metadata as ia_fetch_metadata
 
+TOOL_NAME = "IA-Advanced-Search"
+TOOL_VERSION = "2.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+
+# the search when neither --query nor --collection or --mediatype says what to look for
+DEFAULT_QUERY = '(format:ISO OR format:IMG) AND mediatype:software AND description:"linux, distribution"'
 DEFAULT_FIELDS = ["identifier", "title", "date", "creator"]
+# the files of each item that become entries, by the end of their name; --extensions
+DEFAULT_EXTENSIONS = ".iso,.img,.zip"
+OUTPUT_FORMATS = ("json", "ndjson", "csv")
+# the fields --since and --until can range over
+DATE_FIELDS = ("publicdate", "addeddate", "date")
+# what an entry has of its file's metadata besides the size, when the metadata gives it
+FILE_FIELDS = ("format", "md5", "sha1", "crc32")
+# the columns of --format csv, in order
+CSV_COLUMNS = ("identifier", "title", "file_name", "download_url", "size", *FILE_FIELDS)
+# a search page could not be had, even after the retries; the entries found so far are still written
+EXIT_SEARCH_FAILED = 4
+# Ctrl-C or SIGTERM: the entries found so far are still written
+EXIT_INTERRUPTED = 130
+# how far a search got, next to its --out, for --resume
+STATE_SUFFIX = ".state"
 
 
-def setup_logging(verbosity: int, log_file: Optional[str] = None):
-    level = logging.WARNING
-    if verbosity == 1:
-        level = logging.INFO
-    elif verbosity >= 2:
-        level = logging.DEBUG
-
-    handlers = [logging.StreamHandler(sys.stdout)]
-    if log_file:
-        handlers.append(logging.FileHandler(log_file, encoding="utf-8"))
-
-    logging.basicConfig(
-        level=level,
-        format="%(asctime)s | %(levelname)-8s | %(message)s",
-        datefmt="%H:%M:%S",
-        handlers=handlers,
-    )
-
-    # Tame noisy urllib3 retry warnings unless user asked for very verbose logs
-    u3_level = logging.DEBUG if verbosity >= 2 else logging.ERROR
-    for name in ("urllib3", "urllib3.connectionpool", "requests.packages.urllib3"):
-        logging.getLogger(name).setLevel(u3_level)
-
-
-def build_session(timeout: int, retries: int, backoff: float, user_agent: Optional[str]) -> requests.Session:
-    session = requests.Session()
-    session.headers.update({
-        "User-Agent": user_agent or "Internet-Archive-API/2.0 (+https://example.local) Python-requests"
-    })
-    retry = Retry(
-        total=retries,
-        connect=retries,
-        read=retries,
-        backoff_factor=backoff,
-        status_forcelist=(429, 500, 502, 503, 504),
-        allowed_methods=("HEAD", "GET", "OPTIONS"),
-        raise_on_status=False,
-    )
-    adapter = HTTPAdapter(max_retries=retry)
-    session.mount("https://", adapter)
-    session.mount("http://", adapter)
-    # attach default timeout wrapper
-    session.request = _timeout_wrapper(session.request, timeout)
-    return session
-
-
-def _timeout_wrapper(request_func, default_timeout: int):
-    def wrapped(method, url, **kwargs):
-        if "timeout" not in kwargs:
-            kwargs["timeout"] = default_timeout
-        return request_func(method, url, **kwargs)
-    return wrapped
-
-
-def search_page(session: requests.Session, query: str, fields: List[str], rows: int, page: int) -> dict:
-    params = {
-        "q": query,
-        "fl[]": fields,
-        "rows": rows,
-        "page": page,
-        "output": "json",
-    }
-    resp = session.get(SEARCH_URL, params=params)
-    if resp.status_code != 200:
-        raise RuntimeError(f"Advanced search failed with status {resp.status_code}: {resp.text[:300]}")
+def fetch_metadata(session: requests.Session, identifier: str) -> Optional[dict]:
+    """The item's metadata, or None (logged) when it can't be had."""
     try:
-        return resp.json()
-    except json.JSONDecodeError as e:
-        raise RuntimeError(f"Failed to parse JSON from advanced search: {e}\nBody: {resp.text[:300]}") from e
+        return ia_fetch_metadata(session, identifier)
+    except (NotFound, Dark) as e:
+        logging.debug(str(e))
+    except RateLimited as e:
+        logging.warning(f"Skipping {identifier}, still rate limited after the retries ({e}); try a lower --max-rps or a longer --sleep")
+    except (requests.RequestException, ValueError) as e:
+        logging.warning(f"Could not fetch metadata for {identifier}: {e}")
+    return None
 
 
-def fetch_metadata(session: requests.Session, identifier: str) -> Optional[dict]:
-    url = f"{METADATA_BASE_URL}{identifier}"
+def extension_list(value: str) -> Tuple[str, ...]:
+    """argparse type for --extensions: "iso,img,tar.xz" as (".iso", ".img", ".tar.xz"); "" or "*" as (), every file."""
+    if value.strip() in ("", "*"):
+        return ()
+    extensions = tuple("." + e.strip().lower().lstrip(".") for e in value.split(",") if e.strip().lstrip("."))
+    if not extensions:
+        raise argparse.ArgumentTypeError(f"expected extensions such as iso,img,tar.xz, got {value!r}")
+    return extensions
+
+
+def describe_extensions(extensions: Tuple[str, ...]) -> str:
+    return ", ".join(extensions) if extensions else "all files"
+
+
+def size_filtered(args: argparse.Namespace) -> bool:
+    # --no-keep-unknown-size is about the files a bound can't be checked against, so alone it leaves out none
+    return args.min_size is not None or args.max_size is not None
+
+
+def describe_sizes(args: argparse.Namespace) -> str:
+    """The size filter for the log and the summary, e.g. "300.0MB to 5.0GB"."""
+    if args.min_size is not None and args.max_size is not None:
+        bounds = f"{format_size(args.min_size)} to {format_size(args.max_size)}"
+    elif args.min_size is not None:
+        bounds = f"at least {format_size(args.min_size)}"
+    else:
+        bounds = f"at most {format_size(args.max_size)}"
+    return bounds + ("" if args.keep_unknown_size else ", with a known size")
+
+
+def sort_list(value: str) -> List[str]:
+    """argparse type for --sort: "downloads desc, publicdate asc" as ["downloads desc", "publicdate asc"]."""
+    return [s.strip() for s in value.split(",") if s.strip()]
+
+
+def file_entry(identifier: str, title: str, f: dict) -> dict:
+    """The entry of one file of an item's metadata: its size as a number (None when unknown), and its format and
+    checksums, for the downloaders to check the file against, only when the metadata has them."""
+    name = f["name"]
+    entry = {"identifier": identifier, "title": title, "file_name": name, "download_url": download_url(identifier, name),
+             "size": parse_size(f.get("size"))}
+    entry.update((key, str(f[key])) for key in FILE_FIELDS if f.get(key))
+    return entry
+
+
+def day(value: str) -> str:
+    """argparse type for --since and --until: a YYYY-MM-DD date, as the search index takes it."""
+    try:
+        # strptime takes 2024-6-30 too; the index doesn't
+        valid = datetime.strptime(value, "%Y-%m-%d").strftime("%Y-%m-%d") == value
+    except ValueError:
+        valid = False
+    if not valid:
+        raise argparse.ArgumentTypeError(f"invalid date {value!r}, expected YYYY-MM-DD, e.g. 2024-06-30")
+    return value
+
+
+def search_query(args: argparse.Namespace) -> str:
+    """The query sent: any of the --collections, the --mediatype, --query and the range of --since and --until
+    (open at the end not given), ANDed; DEFAULT_QUERY in place of --query when none of the first three is given."""
+    parts = []
+    if args.collection:
+        collections = " OR ".join(f"collection:{c}" for c in args.collection)
+        parts.append(f"({collections})" if len(args.collection) > 1 else collections)
+    if args.mediatype:
+        parts.append(f"mediatype:{args.mediatype}")
+    dates = []
+    if args.since or args.until:
+        # "null" leaves that end of the range open, as archive.org's own search does
+        dates.append(f"{args.date_field}:[{args.since or 'null'} TO {args.until or 'null'}]")
+    query = args.query or (None if parts else DEFAULT_QUERY)
+    if query:
+        parts.append(f"({query})" if parts or dates else query)
+    return " AND ".join(parts + dates)
+
+
+def query_hash(query: str, sort: List[str]) -> str:
+    # another order puts other items on each page, so a search can't carry on from one of the same query sorted otherwise
+    return hashlib.sha256("\n".join([query, *sort]).encode("utf-8")).hexdigest()
+
+
+def load_state(path: str) -> Optional[dict]:
     try:
-        resp = session.get(url)
-        if resp.status_code != 200:
-            return None
-        return resp.json()
-    except Exception:
+        with open(path, encoding="utf-8") as f:
+            state = json.load(f)
+    except FileNotFoundError:
         return None
+    if not isinstance(state, dict):
+        raise ValueError("not a state file the search tool writes")
+    return state
+
+
+def save_state(path: str, state: dict):
+    tmp = path + ".tmp"
+    with open(tmp, "w", encoding="utf-8") as f:
+        json.dump(dict(state, saved=time.time()), f, ensure_ascii=False)
+    os.replace(tmp, path)
+
+
+class EntryWriter:
+    """Where the entries go ("-" for stdout): a JSON array written once the search is over, or NDJSON or CSV,
+    one line (row) per entry flushed as it is found.
+
+    With NDJSON to stdout, a downloader reading the pipe starts on the first file while the search is still paging.
+    NDJSON and CSV entries are not kept once written, so a large search's memory doesn't grow with them, and a
+    crash loses none of those written. The CSV header is written up front, so a search that finds nothing
+    still leaves one. With append the entries already in the file are kept (the JSON array's are read back in,
+    to be written again with the new ones), their items are in identifiers, and count is of the new ones only.
+    """
+
+    def __init__(self, path: str, fmt: str, append: bool = False):
+        self.path = path
+        self.fmt = fmt
+        self.entries: List[dict] = []
+        self.identifiers: Set[str] = set()
+        self.count = 0
+        append = append and os.path.exists(path) and os.path.getsize(path) > 0
+        if append:
+            if fmt == "json":
+                with open(path, encoding="utf-8") as f:
+                    self.entries = json.load(f)
+                if not isinstance(self.entries, list):
+                    raise ValueError("expected the JSON array of an earlier search")
+            self.identifiers = {str(e["identifier"]) for e in (self.entries if fmt == "json" else iter_entries(path)) if e.get("identifier")}
+        self.f: Optional[TextIO] = self.open("a" if append else "w") if fmt != "json" else None
+        if fmt == "csv":
+            self.csv = csv.DictWriter(self.f, fieldnames=CSV_COLUMNS, lineterminator="\n")
+            if not append:
+                self.csv.writeheader()
+                self.f.flush()
+
+    def open(self, mode: str = "w") -> TextIO:
+        # the csv module quotes the newlines in a title itself
+        return sys.stdout if self.path == "-" else open(self.path, mode, encoding="utf-8", newline="" if self.fmt == "csv" else None)
+
+    def add(self, entry: dict):
+        if self.fmt == "ndjson":
+            self.f.write(json.dumps(entry, ensure_ascii=False) + "\n")
+            self.f.flush()
+        elif self.fmt == "csv":
+            # empty when unknown
+            self.csv.writerow({k: "" if v is None else v for k, v in entry.items()})
+            self.f.flush()
+        else:
+            self.entries.append(entry)
+        self.count += 1
+
+    def finish(self):
+        """Write the JSON array; NDJSON and CSV are out already."""
+        if self.fmt == "json":
+            self.f = self.open()
+            json.dump(self.entries, self.f, indent=2, ensure_ascii=False)
+            if self.path == "-":
+                self.f.write("\n")
+
+    def close(self):
+        if self.f is sys.stdout:
+            self.f.flush()
+        elif self.f is not None:
+            self.f.close()
+
+
+class Crawl:
+    """How far the search has got: for the summary, to say where an interrupted one stopped, and for --resume.
+
+    pages is the last page done, counted from the first page of the search, not of this run; cursor is the
+    scrape API's for the page after it. done are the items whose entries are written (those of the pages done,
+    and of the page under way so far), retry those whose metadata could not be fetched, with their title.
+    """
+
+    def __init__(self, mode: str = "search"):
+        # "search" pages advanced search by number, "scrape" follows the scrape API's cursor
+        self.mode = mode
+        self.pages = 0
+        self.cursor: Optional[str] = None
+        self.items = 0
+        self.done: Set[str] = set()
+        self.retry: Dict[str, str] = {}
+        # known once the first page has arrived
+        self.pages_total: Optional[int] = None
+        self.items_total: Optional[int] = None
+        # the items whose metadata could not be fetched: not found, dark, or the request failed
+        self.no_metadata: List[str] = []
+        # the files with a name --extensions takes that --min-size or --max-size left out
+        self.size_excluded = 0
+        # metadata requests being sent by the workers right now
+        self.in_flight = 0
+        self.lock = threading.Lock()
+
+    def where(self) -> str:
+        def of(total: Optional[int]) -> str:
+            return str(total) if total is not None else "?"
+
+        return f"{self.pages}/{of(self.pages_total)} pages, {self.items}/{of(self.items_total)} items"
+
+    def state(self, args: argparse.Namespace) -> dict:
+        with self.lock:
+            return {"query_hash": query_hash(args.query, args.sort), "rows": args.rows, "mode": self.mode, "page": self.pages,
+                    "cursor": self.cursor, "items": self.items, "done": sorted(self.done), "retry": dict(self.retry)}
+
+    def resume(self, state: dict, paging: bool):
+        """Carry on from the state of an earlier run: its items done and to retry, and with paging its place in the results."""
+        self.done = set(state.get("done") or [])
+        self.retry = dict(state.get("retry") or {})
+        if paging:
+            self.mode = state.get("mode") or self.mode
+            self.pages = int(state.get("page") or 0)
+            self.cursor = state.get("cursor")
+            self.items = int(state.get("items") or 0)
 
 
 def main():
     parser = argparse.ArgumentParser(description="Internet Archive Advanced Search (v2)")
-    parser.add_argument("--query", "-q", default='(format:ISO OR format:IMG) AND mediatype:software AND description:"linux, distribution"', help="Advanced search query string")
-    parser.add_argument("--rows", type=int, default=500, help="Rows per page (<=1000)")
+    parser.add_argument("--query", "-q", help="Advanced search query string (default: Linux disc images, unless --collection or --mediatype is given)")
+    parser.add_argument("--collection", "-c", action="append", default=[],
+                        help="Only items in this collection (repeatable, any of them), ANDed with the query")
+    parser.add_argument("--mediatype", help="Only items of this mediatype, e.g. software, audio, texts or movies, ANDed with the query")
+    parser.add_argument("--rows", type=int, default=500, help="Rows per page (<=1000; 100 to 10000 with the scrape API)")
+    parser.add_argument("--since", type=day, help="Only the items whose --date-field is on or after this day (YYYY-MM-DD)")
+    parser.add_argument("--until", type=day, help="Only the items whose --date-field is on or before this day (YYYY-MM-DD)")
+    parser.add_argument("--date-field", choices=DATE_FIELDS, default="publicdate",
+                        help="The date --since and --until are about: publicdate, when the item was made public (default), "
+                             "addeddate, when it was added, or date, the one its uploader gave")
     parser.add_argument("--max-pages", type=int, help="Limit number of pages to fetch")
-    parser.add_argument("--sleep", type=float, default=1.0, help="Sleep seconds between requests")
+    parser.add_argument("--sort", type=sort_list, action="extend", default=[],
+                        help="Order the results, as a field and asc or desc, e.g. 'downloads desc' (the most downloaded first), "
+                             "'publicdate desc', 'addeddate asc' or 'titleSorter asc'; repeat it or give a comma-separated list "
+                             "for ties")
+    parser.add_argument("--use-scrape", action="store_true",
+                        help=f"Page with the scrape API's cursor instead of page numbers (automatic past {SEARCH_DEPTH_LIMIT} results, "
+                             "which advanced search can't page through)")
+    parser.add_argument("--sleep", type=float, default=1.0, help="Sleep seconds between requests (between the metadata fetches of all workers together)")
+    parser.add_argument("--workers", type=int, default=1, help="Item metadata requests at a time (default: 1)")
     parser.add_argument("--fields", nargs="*", default=DEFAULT_FIELDS, help="Fields to fetch in search results")
-    parser.add_argument("--out", "-o", default="pear.json", help="Output JSON file for results")
+    parser.add_argument("--extensions", type=extension_list, default=extension_list(DEFAULT_EXTENSIONS),
+                        help="The files of each item to list, by the end of their name, any case: a comma-separated list such as "
+                             "iso,img,qcow2,tar.xz (default: iso,img,zip); '' or '*' for every file")
+    add_size_filter_args(parser, "list")
+    parser.add_argument("--out", "-o", default="pear.json", help="Output file for results ('-' for stdout, with the log and summary on stderr)")
+    parser.add_argument("--output-format", "--format", choices=OUTPUT_FORMATS, default="json",
+                        help="json: one array, written at the end (default); ndjson: one entry per line, written as each is found, "
+                             f"e.g. for `--out - | Download-From-JSON.py -i -`; csv: a header row ({','.join(CSV_COLUMNS)}), "
+                             "then a row per entry as each is found")
+    parser.add_argument("--resume", action="store_true",
+                        help=f"Carry on from where the last run with this --out stopped, as <out>{STATE_SUFFIX} records it: "
+                             "the items done are skipped, those whose metadata could not be fetched are tried again, "
+                             "and the new entries are added to --out")
+    parser.add_argument("--force", action="store_true",
+                        help="With --resume, carry on even though the query or --sort has changed: its items done are still skipped, "
+                             "and the paging starts over")
     parser.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
     parser.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
     parser.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
-    parser.add_argument("--user-agent", help="Custom User-Agent header")
+    parser.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(parser)
+    add_transport_args(parser)
+    add_auth_args(parser)
     parser.add_argument("--log-file", help="Optional log file path")
+    parser.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
     parser.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
     parser.add_argument("--dry-run", action="store_true", help="Do not fetch per-item metadata, only list identifiers")
-    args = parser.parse_args()
-
-    setup_logging(args.v, args.log_file)
-    session = build_session(args.timeout, args.retries, args.backoff, args.user_agent)
+    args = parse_args(parser, __file__, version=TOOL_VERSION)
+    if args.workers < 1:
+        parser.error("--workers must be at least 1")
+    check_size_filter_args(parser, args)
+    if args.since and args.until and args.since > args.until:
+        parser.error(f"--since {args.since} is after --until {args.until}")
+    # what is sent, logged and hashed for --resume
+    args.query = search_query(args)
+    if args.force and not args.resume:
+        parser.error("--force is for --resume")
+    if args.resume and args.out == "-":
+        parser.error("--resume needs an --out file to add to")
+
+    to_stdout = args.out == "-"
+    # with the entries on stdout, everything else goes to stderr
+    report = sys.stderr if to_stdout else sys.stdout
+    setup_logging(args.v, args.log_file, report, log_format=args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
 
     logging.info(f"Query: {args.query}")
+    if args.sort:
+        logging.info(f"Sort: {', '.join(args.sort)}")
+    logging.info(f"Files listed: {describe_extensions(args.extensions)}")
+    if size_filtered(args):
+        logging.info(f"File sizes listed: {describe_sizes(args)}")
+
+    if to_stdout and hasattr(sys.stdout, "reconfigure"):
+        # the reader decodes UTF-8, whatever the console's code page
+        sys.stdout.reconfigure(encoding="utf-8")
+    # a dry run writes no entries, so it has nothing to carry on from
+    state_path = args.out + STATE_SUFFIX if not to_stdout and not args.dry_run else None
+    crawl = Crawl("scrape" if args.use_scrape else "search")
+    state = None
+    if args.resume and state_path:
+        try:
+            state = load_state(state_path)
+        except (OSError, ValueError) as e:
+            parser.error(f"could not read {state_path}: {e}")
+        if state is None:
+            logging.warning(f"No {state_path} to carry on from; searching from the first page")
+        elif state.get("query_hash") != query_hash(args.query, args.sort) and not args.force:
+            parser.error(f"{state_path} is from a search with another query or --sort; give --force to carry on anyway, "
+                         "or leave out --resume to start over")
+    if state is not None:
+        paging = state.get("query_hash") == query_hash(args.query, args.sort)
+        if not paging:
+            logging.warning(f"The query or --sort has changed since {state_path} was saved; skipping its {len(state.get('done') or [])} items done, "
+                            "paging from the first page")
+        elif state.get("rows") != args.rows or args.use_scrape and state.get("mode") == "search":
+            logging.warning("The paging has changed (--rows or --use-scrape) since the last run; skipping its items done, "
+                            "paging from the first page")
+            paging = False
+        crawl.resume(state, paging)
+        logging.info(f"Carrying on from {state_path}: {crawl.pages} page(s) and {len(crawl.done)} item(s) done, "
+                     f"{len(crawl.retry)} to try again")
+    try:
+        writer = EntryWriter(args.out, args.output_format, append=args.resume)
+    except (OSError, ValueError) as e:
+        parser.error(f"could not read {args.out} to add to it: {e}")
+    crawl.done |= writer.identifiers
 
-    iso_entries = []
-
-    # Fetch first page to get numFound
-    first = search_page(session, args.query, args.fields, args.rows, 1)
-    response_obj = first.get("response")
-    if not isinstance(response_obj, dict) or "docs" not in response_obj:
-        err = first.get("error") or first
-        raise RuntimeError(f"Unexpected search response structure, missing 'response.docs'. Details: {json.dumps(err)[:500]}")
-
-    num_found = int(response_obj.get("numFound", 0))
-    total_pages = max(1, (num_found + args.rows - 1) // args.rows)
-    if args.max_pages is not None:
-        total_pages = min(total_pages, args.max_pages)
-
-    logging.info(f"numFound={num_found}, pages={total_pages}")
-
-    for page in range(1, total_pages + 1):
-        if page > 1:
-            time.sleep(args.sleep)
-            data = search_page(session, args.query, args.fields, args.rows, page)
-            response_obj = data.get("response", {})
-        docs = response_obj.get("docs", [])
-        if not isinstance(docs, list):
-            continue
-
-        logging.debug(f"Processing page {page} with {len(docs)} docs")
-
-        for item in docs:
-            identifier = item.get("identifier")
-            if not identifier:
-                continue
-            title = item.get("title", "")
+    def checkpoint():
+        save_state(state_path, crawl.state(args))
 
-            if args.dry_run:
-                print(identifier, "-", title)
+    code = 0
+    # SIGTERM stops the search like Ctrl-C does, keeping what it found
+    signal.signal(signal.SIGTERM, signal.default_int_handler)
+    try:
+        try:
+            # the JSON array is written only at the end, so it is checkpointed with it; NDJSON and CSV after every page
+            search(session, args, writer, crawl, checkpoint if state_path and args.output_format != "json" else None)
+        except KeyboardInterrupt:
+            logging.warning(f"Interrupted after {crawl.where()}; the {writer.count} entries found so far are written")
+            code = EXIT_INTERRUPTED
+        except (SearchError, requests.RequestException) as e:
+            logging.error(f"Search failed after {crawl.where()}: {e}")
+            code = EXIT_SEARCH_FAILED
+        writer.finish()
+        if state_path and code:
+            checkpoint()
+        elif state_path and os.path.exists(state_path):
+            # the search is complete, so the next run starts over
+            os.remove(state_path)
+    except BrokenPipeError:
+        # whoever read stdout is gone, e.g. a downloader that was stopped: stop without a traceback,
+        # and without another one when Python flushes stdout on the way out
+        os.dup2(os.open(os.devnull, os.O_WRONLY), sys.stdout.fileno())
+        logging.warning(f"The reader of stdout went away after {writer.count} entries; stopping the search")
+        sys.exit(0)
+    finally:
+        writer.close()
+
+    saved = {"ndjson": f"Saved {writer.count} lines to {args.out}", "csv": f"Saved {writer.count} rows to {args.out}"}.get(
+        args.output_format, f"Saved to {args.out}")
+    print(f"Found {writer.count} matching files ({describe_extensions(args.extensions)}). {saved}.", file=report)
+    if not args.dry_run:
+        print(f"Metadata could not be fetched for {len(crawl.no_metadata)} item(s).", file=report)
+        if size_filtered(args):
+            print(f"Excluded {crawl.size_excluded} file(s) by the size filter ({describe_sizes(args)}).", file=report)
+    if code:
+        print(f"Stopped after {crawl.where()}." + (" Run again with --resume to carry on." if state_path else ""), file=report)
+        if crawl.in_flight:
+            # a worker's request would hold the exit up until it is answered or times out; the output is all written
+            report.flush()
+            logging.shutdown()
+            os._exit(code)
+    sys.exit(code)
+
+
+def search_pages(session: requests.Session, args: argparse.Namespace, crawl: Crawl) -> Iterator[Tuple[int, List[dict], Optional[str]]]:
+    """The pages of docs the query finds after crawl.pages, each with the scrape cursor of the page after it: from
+    advanced search, or by following the scrape API's cursor with --use-scrape or when there are more results
+    than advanced search gives. A resumed search pages the way the run it carries on from did."""
+    if crawl.mode == "search":
+        results = SearchResults(session, args.query, args.fields, args.rows, args.sleep, args.max_pages, args.sort or None,
+                                first_page=crawl.pages + 1)
+        for page, docs in results.pages():
+            if page > 1 or results.num_found <= SEARCH_DEPTH_LIMIT:
+                if page == results.first_page:
+                    logging.info(f"numFound={results.num_found}, pages={results.total_pages}")
+                    crawl.pages_total, crawl.items_total = results.total_pages, results.num_found
+                yield page, docs, None
                 continue
-
+            # the first page's docs come again from the scrape API, so none of them is handled twice
+            logging.info(f"numFound={results.num_found}, past advanced search's depth limit of {SEARCH_DEPTH_LIMIT}; using the scrape API")
+            crawl.mode = "scrape"
             time.sleep(args.sleep)
-            meta_json = fetch_metadata(session, identifier)
+            break
+        else:
+            return
+    elif crawl.pages and not crawl.cursor:
+        # the scrape's last page was done
+        return
+
+    first = crawl.pages
+    try:
+        yield from scrape_pages(session, args, crawl)
+    except CursorExpired as e:
+        if not first or crawl.pages != first:
+            raise
+        # the earlier run's cursor has gone stale; its items done are skipped on the way back
+        logging.warning(f"{e}; scraping from the first page again")
+        crawl.pages, crawl.cursor = 0, None
+        yield from scrape_pages(session, args, crawl)
+
+
+def scrape_pages(session: requests.Session, args: argparse.Namespace, crawl: Crawl) -> Iterator[Tuple[int, List[dict], Optional[str]]]:
+    results = ScrapeResults(session, args.query, list(dict.fromkeys(["identifier", *args.fields])), args.rows, args.sleep,
+                            args.max_pages, cursor=crawl.cursor, sort=args.sort or None)
+    if results.count != args.rows:
+        logging.warning(f"--rows {args.rows} is outside what the scrape API takes; asking for {results.count} per page")
+    first = crawl.pages
+    for page, docs in results.pages():
+        if page == 1:
+            logging.info(f"total={results.total if results.total is not None else 'unknown'}, {results.count} per page")
+            if results.total is not None:
+                crawl.items_total = results.total
+                crawl.pages_total = max(1, -(-results.total // results.count))
+                if args.max_pages is not None:
+                    crawl.pages_total = min(crawl.pages_total, first + args.max_pages)
+        yield first + page, docs, results.cursor
+
+
+def search(session: requests.Session, args: argparse.Namespace, writer: EntryWriter, crawl: Crawl,
+           checkpoint: Optional[Callable[[], None]] = None):
+    """Write the entries of the items the query finds that aren't done, first those of the items to retry;
+    checkpoint() is called after every page, once its entries are written."""
+    # --sleep spaces the metadata fetches of every worker together, so more workers don't mean more requests per second
+    limiter = RequestLimiter(1 / args.sleep, burst=1) if args.sleep > 0 else None
+
+    def item_metadata(identifier: str) -> Optional[dict]:
+        if limiter:
+            limiter.acquire()
+        with crawl.lock:
+            crawl.in_flight += 1
+        try:
+            return fetch_metadata(session, identifier)
+        finally:
+            with crawl.lock:
+                crawl.in_flight -= 1
+
+    def add(items: List[SearchDoc], found: bool = True):
+        # map() gives the metadata in the order of the docs, so the entries come in the same order with any --workers
+        for item, meta_json in zip(items, pool.map(item_metadata, [item.identifier for item in items])):
+            identifier = item.identifier
+            if found:
+                crawl.items += 1
             if not meta_json:
                 logging.debug(f"No metadata for {identifier}")
+                crawl.no_metadata.append(identifier)
+                # the next --resume tries it again
+                with crawl.lock:
+                    crawl.retry[identifier] = item.title
                 continue
 
             files = meta_json.get("files", []) or []
             for f in files:
                 name = (f.get("name", "") or "")
-                lname = name.lower()
-                if lname.endswith((".iso", ".img", ".zip")):
-                    iso_entries.append({
-                        "identifier": identifier,
-                        "title": title,
-                        "file_name": name,
-                        "download_url": f"{DOWNLOAD_BASE_URL}/{identifier}/{name}",
-                        "size": f.get("size", "unknown"),
-                    })
-
-    with open(args.out, "w", encoding="utf-8") as f:
-        json.dump(iso_entries, f, indent=2, ensure_ascii=False)
-
-    print(f"Found {len(iso_entries)} ISO-like files. Saved to {args.out}.")
+                if name and (not args.extensions or name.lower().endswith(args.extensions)):
+                    entry = file_entry(identifier, item.title, f)
+                    if size_filtered(args) and not size_in_range(entry["size"], args.min_size, args.max_size, args.keep_unknown_size):
+                        logging.debug(f"Size filter excludes {identifier}/{name}")
+                        crawl.size_excluded += 1
+                        continue
+                    writer.add(entry)
+            # only once its entries are written, so an item whose metadata failed is not skipped by --resume
+            with crawl.lock:
+                crawl.done.add(identifier)
+                crawl.retry.pop(identifier, None)
+
+    pool = ThreadPoolExecutor(max_workers=args.workers)
+    try:
+        if crawl.retry and not args.dry_run:
+            logging.info(f"Trying the metadata of {len(crawl.retry)} item(s) again")
+            # counted by the run that found them
+            add([SearchDoc.from_doc({"identifier": identifier, "title": title}) for identifier, title in list(crawl.retry.items())], found=False)
+        # those still failing are not asked for again when their page comes
+        tried = set(crawl.retry)
+        for page, docs, cursor in search_pages(session, args, crawl):
+            logging.debug(f"Processing page {page} with {len(docs)} docs")
+            # a title set twice comes as a list; the entries always have one string
+            items = [item for item in map(SearchDoc.from_doc, docs) if item.identifier]
+
+            if args.dry_run:
+                for item in items:
+                    print(item.identifier, "-", item.title)
+                crawl.items += len(items)
+                crawl.pages = page
+                continue
+
+            todo = [item for item in dict((item.identifier, item) for item in items).values()
+                    if item.identifier not in crawl.done and item.identifier not in tried]
+            crawl.items += len(items) - len(todo)
+            add(todo)
+            with crawl.lock:
+                crawl.pages, crawl.cursor = page, cursor
+            if checkpoint:
+                checkpoint()
+    except BaseException:
+        # on Ctrl-C or SIGTERM the page's fetches not started yet are dropped, and those in flight not waited for
+        pool.shutdown(wait=False, cancel_futures=True)
+        raise
+    pool.shutdown()
 
 
 if __name__ == "__main__":
@@ -1,12 +1,9 @@
+import os
 import requests
-from requests.adapters import HTTPAdapter
-from urllib3.util.retry import Retry
 import time
 import json
 
-SEARCH_URL = "https://archive.org/advancedsearch.php"
-METADATA_BASE_URL = "https://archive.org/metadata/"
-DOWNLOAD_BASE_URL = "https://archive.org/download"
+from ia_common import SEARCH_URL, SearchDoc, build_session, default_user_agent, download_url, metadata_url, request_limiter, s3_auth
 
 # Build a valid query:
 # - Only software media type
@@ -19,23 +16,11 @@ ROWS_PER_PAGE = 500  # IA allows up to 1000; use 500 to be gentle
 REQUEST_TIMEOUT = 30
 SLEEP_SECONDS = 1.0  # rate limiting between requests
 
-# Configure a resilient HTTP session with retries and backoff
-_SESSION = requests.Session()
-_SESSION.headers.update({
-    "User-Agent": "Internet-Archive-API/1.0 (+https://example.local) Python-requests"
-})
-_retry = Retry(
-    total=5,
-    connect=5,
-    read=5,
-    backoff_factor=1.0,
-    status_forcelist=(429, 500, 502, 503, 504),
-    allowed_methods=("HEAD", "GET", "OPTIONS"),
-    raise_on_status=False,
-)
-_adapter = HTTPAdapter(max_retries=_retry)
-_SESSION.mount("https://", _adapter)
-_SESSION.mount("http://", _adapter)
+# Configure a resilient HTTP session with retries and backoff, paced by $IA_MAX_RPS / $IA_RPS_BURST when set
+# and signed with the IAS3 keys from the environment or ia.ini when there are any
+_SESSION = build_session(REQUEST_TIMEOUT, 5, 1.0, default_user_agent("IA-Advanced-Search", "1.0"),
+                         limiter=request_limiter(float(os.environ.get("IA_MAX_RPS") or 0), int(os.environ.get("IA_RPS_BURST") or 0)),
+                         auth=s3_auth())
 
 def search_page(page: int) -> dict:
     params = {
@@ -58,7 +43,7 @@ def search_page(page: int) -> dict:
     return data
 
 def fetch_metadata(identifier: str) -> dict | None:
-    url = f"{METADATA_BASE_URL}{identifier}"
+    url = metadata_url(identifier)
     try:
         resp = _SESSION.get(url, timeout=REQUEST_TIMEOUT)
     except requests.RequestException:
@@ -93,8 +78,8 @@ def main():
         if not isinstance(docs, list):
             continue
 
-        for item in docs:
-            identifier = item.get("identifier")
+        for item in map(SearchDoc.from_doc, docs):
+            identifier = item.identifier
             if not identifier:
                 continue
 
@@ -110,9 +95,9 @@ def main():
                 if lname.endswith((".iso", ".img", ".zip")):
                     iso_entries.append({
                         "identifier": identifier,
-                        "title": item.get("title", ""),
+                        "title": item.title,
                         "file_name": name,
-                        "download_url": f"{DOWNLOAD_BASE_URL}/{identifier}/{name}",
+                        "download_url": download_url(identifier, name),
                         "size": f.get("size", "unknown")
                     })
 
@@ -0,0 +1,70 @@
+import argparse
+import json
+import logging
+import sqlite3
+import sys
+
+from ia_common import LOG_FORMATS, parse_args, setup_logging
+from ia_download import add_checksum_db_args, open_checksum_db
+
+TOOL_NAME = "IA-ChecksumDB"
+TOOL_VERSION = "1.0"
+EXIT_OK = 0
+# the file to import could not be read, or is not what export writes
+EXIT_BAD_INPUT = 2
+
+
+def main():
+    common = argparse.ArgumentParser(add_help=False)
+    add_checksum_db_args(common)
+    common.add_argument("--log-file", help="Optional log file path")
+    common.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    common.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+
+    p = argparse.ArgumentParser(description="Export, import or prune the --checksum-db the downloaders and IA-Verify.py share")
+    commands = p.add_subparsers(dest="command", required=True)
+    e = commands.add_parser("export", parents=[common], help="Write every record as a JSON array")
+    e.add_argument("--output", "-o", default="-", help="Where to write it (default: stdout)")
+    i = commands.add_parser("import", parents=[common], help="Add the records of a JSON array written by export, e.g. on another machine "
+                                                           "with the same paths")
+    i.add_argument("input", help="The JSON file ('-' for stdin)")
+    commands.add_parser("prune", parents=[common], help="Forget the files that are gone or have changed since they were hashed")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if not args.checksum_db:
+        p.error("give --checksum-db or set $IA_CHECKSUM_DB")
+
+    # stdout is for the export and the summaries
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    db = open_checksum_db(p, args)
+    try:
+        if args.command == "export":
+            records = db.export()
+            if args.output == "-":
+                print(json.dumps(records, indent=2, ensure_ascii=False))
+            else:
+                with open(args.output, "w", encoding="utf-8") as f:
+                    json.dump(records, f, indent=2, ensure_ascii=False)
+            logging.info(f"{len(records)} record(s) exported")
+        elif args.command == "import":
+            try:
+                if args.input == "-":
+                    records = json.load(sys.stdin)
+                else:
+                    with open(args.input, encoding="utf-8") as f:
+                        records = json.load(f)
+                if not isinstance(records, list):
+                    raise ValueError("expected a JSON array")
+                count = db.load(records)
+            except (OSError, ValueError, sqlite3.Error) as e:
+                logging.error(f"Could not import {args.input}: {e}")
+                sys.exit(EXIT_BAD_INPUT)
+            print(f"{count} record(s) imported into {args.checksum_db}")
+        else:
+            print(f"{db.prune()} record(s) of files gone or changed removed from {args.checksum_db}")
+    finally:
+        db.close()
+    sys.exit(EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
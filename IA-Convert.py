@@ -0,0 +1,130 @@
+import argparse
+import csv
+import json
+import logging
+import os
+import sqlite3
+import sys
+from typing import List, Optional, Tuple
+
+from ia_catalog import FORMATS, Catalog, columns, load_catalog
+from ia_common import LOG_FORMATS, parse_args, setup_logging
+
+TOOL_NAME = "IA-Convert"
+TOOL_VERSION = "1.0"
+EXTENSIONS = {".json": "json", ".ndjson": "ndjson", ".jsonl": "ndjson", ".csv": "csv", ".aria2": "aria2",
+              ".sqlite": "sqlite", ".sqlite3": "sqlite", ".db": "sqlite"}
+
+
+def lost_fields(catalog: Catalog, fmt: str) -> Tuple[List[str], List[str]]:
+    """The fields the target format can't keep, and those it keeps only as text (nested lists and objects)."""
+    fields = columns(catalog.entries)
+    if fmt == "aria2":
+        dropped = [f for f in fields if f not in ("identifier", "file_name", "download_url", "md5")]
+        return dropped, []
+    nested = sorted({k for e in catalog.entries for k, v in e.items() if isinstance(v, (dict, list))})
+    return [], nested if fmt in ("csv", "sqlite") else []
+
+
+def write_catalog(catalog: Catalog, fmt: str, out_path: str):
+    if catalog.provenance and fmt not in ("json", "sqlite"):
+        logging.warning(f"{fmt} has no place for the catalog's provenance ({', '.join(catalog.provenance)}); it is left out")
+    dropped, as_text = lost_fields(catalog, fmt)
+    if dropped:
+        logging.warning(f"{fmt} can't hold these fields, so they are left out: {', '.join(dropped)}")
+    if as_text:
+        logging.warning(f"{fmt} keeps these fields' lists and objects as JSON text: {', '.join(as_text)}")
+    if fmt == "sqlite":
+        return write_sqlite(catalog, out_path)
+    out = sys.stdout if out_path == "-" else open(out_path, "w", encoding="utf-8", newline="")
+    try:
+        if fmt == "json":
+            value = dict(catalog.provenance, **{catalog.entry_key: catalog.entries}) if catalog.provenance else catalog.entries
+            json.dump(value, out, indent=2, ensure_ascii=False)
+            out.write("\n")
+        elif fmt == "ndjson":
+            out.writelines(json.dumps(e, ensure_ascii=False) + "\n" for e in catalog.entries)
+        elif fmt == "csv":
+            writer = csv.DictWriter(out, fieldnames=columns(catalog.entries), lineterminator="\n")
+            writer.writeheader()
+            for entry in catalog.entries:
+                writer.writerow({k: as_scalar(v) for k, v in entry.items()})
+        else:
+            for entry in catalog.entries:
+                if not entry.get("download_url"):
+                    logging.warning(f"No download_url for {entry.get('identifier')}/{entry.get('file_name')}; left out")
+                    continue
+                out.write(f"{entry['download_url']}\n")
+                if entry.get("identifier"):
+                    out.write(f"  dir={entry['identifier']}\n")
+                if entry.get("file_name"):
+                    out.write(f"  out={entry['file_name']}\n")
+                if entry.get("md5"):
+                    out.write(f"  checksum=md5={entry['md5']}\n")
+    finally:
+        if out is not sys.stdout:
+            out.close()
+
+
+def write_sqlite(catalog: Catalog, path: str):
+    if path == "-":
+        raise ValueError("a SQLite catalog can't go to stdout; give a file name")
+    if os.path.exists(path):
+        os.remove(path)
+    fields = columns(catalog.entries) or ["identifier"]
+    db = sqlite3.connect(path)
+    try:
+        with db:
+            # no column types: SQLite keeps each value's own, so a numeric size stays a number and a string a string
+            db.execute(f"CREATE TABLE entries ({', '.join(map(quote_name, fields))})")
+            db.executemany(f"INSERT INTO entries ({', '.join(map(quote_name, fields))}) VALUES ({', '.join('?' for _ in fields)})",
+                           [[as_scalar(e.get(f)) for f in fields] for e in catalog.entries])
+            if catalog.provenance:
+                db.execute("CREATE TABLE provenance (key TEXT, value TEXT)")
+                items = dict(catalog.provenance, _entry_key=catalog.entry_key)
+                db.executemany("INSERT INTO provenance VALUES (?, ?)", [(k, json.dumps(v)) for k, v in items.items()])
+    finally:
+        db.close()
+
+
+def quote_name(name: str) -> str:
+    return '"' + name.replace('"', '""') + '"'
+
+
+def as_scalar(value):
+    return json.dumps(value, ensure_ascii=False) if isinstance(value, (dict, list)) else value
+
+
+def format_of(path: str, given: Optional[str]) -> Optional[str]:
+    return given or EXTENSIONS.get(os.path.splitext(path)[1].lower())
+
+
+def main():
+    p = argparse.ArgumentParser(description="Convert file catalogs (the search tool's JSON, NDJSON, CSV, aria2 input files, SQLite) into each other")
+    p.add_argument("-i", "--input", required=True, help='Catalog to read ("-" for stdin); its format is told from the content')
+    p.add_argument("-o", "--output", required=True, help='Where to write ("-" for stdout); the format comes from the extension, or --to')
+    p.add_argument("--from", dest="from_", choices=FORMATS, help="Read the input as this format instead of detecting it")
+    p.add_argument("--to", choices=FORMATS, help="Write this format, whatever the output's extension")
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    fmt = format_of(args.output, args.to)
+    if fmt is None:
+        p.error(f"can't tell the format from {args.output!r}; give --to")
+
+    # stdout may be for the catalog
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    try:
+        catalog, source = load_catalog(args.input, args.from_)
+    except (OSError, ValueError) as e:
+        p.error(f"could not read {args.input}: {e}")
+    try:
+        write_catalog(catalog, fmt, args.output)
+    except (OSError, ValueError, sqlite3.Error) as e:
+        p.error(f"could not write {args.output}: {e}")
+    logging.info(f"{len(catalog.entries)} entries, {source} to {fmt}")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,195 @@
+import argparse
+import logging
+import os
+import sys
+from typing import Dict, List, Tuple
+from urllib.parse import quote
+
+import requests
+
+from ia_common import (ARCHIVE_URL, GLOB_HELP, LOG_FORMATS, ArchiveError, TasksError, add_file_filter_args, add_ia_config_arg,
+                       add_transport_args, check_file_filter_args, default_user_agent, fetch_metadata, format_size, matches_glob,
+                       parse_args, parse_duration, parse_size, raise_for_status, retry_call, s3_credentials, s3_url, select_files,
+                       session_from_args, setup_logging, wait_for_tasks)
+
+TOOL_NAME = "IA-Copy"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+# IAS3 answers a copy once it has queued it; the copy itself is done by a catalog task
+REQUEST_TIMEOUT = 120
+EXIT_OK = 0
+# the source item's metadata could not be read, or no file of it matches
+EXIT_SOURCE_ERROR = 2
+EXIT_SOME_FAILED = 3
+EXIT_ALL_FAILED = 4
+# a copy was accepted, but the destination's metadata doesn't list it with the source's md5
+EXIT_VERIFY_FAILED = 5
+# the tasks were still pending at --wait-timeout, so the copies are not verified
+EXIT_WAIT_TIMEOUT = 6
+
+
+def split_path(value: str) -> Tuple[str, str]:
+    """identifier[/file] into (identifier, file), file "" when there is none."""
+    # a trailing "/" is kept: in the destination it says to copy under that directory
+    identifier, _, name = value.lstrip("/").partition("/")
+    if not identifier:
+        raise argparse.ArgumentTypeError(f"expected identifier[/file], got {value!r}")
+    return identifier, name
+
+
+def source_files(metadata: dict, identifier: str, pattern: str, args) -> List[dict]:
+    """The files of the source item to copy: the one named pattern, or those matching it as a glob, after the file filters."""
+    files = metadata.get("files", [])
+    exact = [f for f in files if f.get("name") == pattern]
+    if exact:
+        return exact
+    # the files archive.org makes for every item (_files.xml, _meta.xml...) are the destination's own already
+    files = [f for f in files if f.get("source") != "metadata"]
+    if pattern:
+        files = [f for f in files if matches_glob(f.get("name", ""), pattern)]
+    return select_files(files, args, identifier)[0]
+
+
+def destination_names(names: List[str], dst_name: str) -> Dict[str, str]:
+    """Where each source file goes in the destination item.
+
+    Each keeps its name, under dst_name when that ends with "/"; a single file can be given another name instead.
+    """
+    if dst_name and not dst_name.endswith("/"):
+        if len(names) != 1:
+            raise ValueError(f"{len(names)} files can't all be named {dst_name}; end it with / to copy them under it")
+        return {names[0]: dst_name}
+    return {name: dst_name + name for name in names}
+
+
+def copy_headers(src_id: str, name: str, args) -> Dict[str, str]:
+    headers = {"x-amz-copy-source": f"/{quote(src_id, safe='')}/{quote(name)}", "x-amz-metadata-directive": "COPY",
+               "x-archive-auto-make-bucket": "1", "Content-Length": "0"}
+    if not args.derive:
+        headers["x-archive-queue-derive"] = "0"
+    return headers
+
+
+def copy_file(session: requests.Session, url: str, headers: Dict[str, str], retries: int) -> requests.Response:
+    """The signed PUT that asks IAS3 to copy, retrying 503 SlowDown and dropped connections."""
+    def once(attempt: int) -> requests.Response:
+        r = session.put(url, headers=headers, data=b"", timeout=REQUEST_TIMEOUT)
+        raise_for_status(r)
+        return r
+
+    return retry_call(once, retries, method="PUT", url=url)
+
+
+def print_dry_run(plan: List[Tuple[dict, str]], src_id: str, dst_id: str, args):
+    keys = s3_credentials()
+    auth = f"LOW {keys[0]}:<secret>" if keys else "<no IAS3 keys found; a real run stops here>"
+    for f, name in plan:
+        print(f"PUT {s3_url(dst_id, name)}")
+        for k, v in {"Authorization": auth, **copy_headers(src_id, f['name'], args)}.items():
+            print(f"  {k}: {v}")
+
+
+def verify(session: requests.Session, dst_id: str, plan: List[Tuple[dict, str]]) -> List[str]:
+    """The copies the destination's metadata doesn't list with the md5 of their source, each with why."""
+    files = {f.get("name"): f for f in fetch_metadata(session, dst_id).get("files", [])}
+    problems = []
+    for f, name in plan:
+        copy = files.get(name)
+        if copy is None:
+            problems.append(f"{name}: not in {dst_id}'s metadata")
+        elif f.get("md5") and copy.get("md5") != f["md5"]:
+            problems.append(f"{name}: md5 {copy.get('md5')}, the source's is {f['md5']}")
+    return problems
+
+
+def main():
+    p = argparse.ArgumentParser(description="Copy files from one Internet Archive item to another on archive.org's side, "
+                                            "through the IAS3 API, without downloading them",
+                                epilog=f"{GLOB_HELP}\n\nexit codes: 0 all copied and verified, 2 the source could not be read or "
+                                       "nothing matches, 3 some copies failed, 4 all failed, 5 a copy is missing or its md5 differs, "
+                                       "6 --wait-timeout ran out", formatter_class=argparse.RawDescriptionHelpFormatter)
+    p.add_argument("source", type=split_path, help="identifier/file, or identifier/glob for several files (e.g. 'distro-1.0/*.iso'), "
+                                                   "or an identifier with --glob")
+    p.add_argument("dest", type=split_path, help="Destination identifier, created when it doesn't exist; identifier/name to rename "
+                                                 "a single file, identifier/dir/ to copy under a directory")
+    add_file_filter_args(p, "copy")
+    p.add_argument("--no-derive", action="store_false", dest="derive", help="Don't queue a derive task after the copies")
+    p.add_argument("--no-wait", action="store_false", dest="wait", help="Don't wait for the copy tasks, nor verify the copies")
+    p.add_argument("--wait-timeout", type=parse_duration, default=3600, help="Give up waiting for the tasks after this long, e.g. 30m (default: 1h)")
+    p.add_argument("--interval", type=parse_duration, default=30, help="Time between task polls (default: 30s)")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="Retries per request on 503 SlowDown, 5xx and dropped connections")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    p.add_argument("--dry-run", action="store_true", help="Print the copy requests that would be sent (secret redacted) and send none")
+    add_transport_args(p)
+    add_ia_config_arg(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    check_file_filter_args(p, args)
+    (src_id, pattern), (dst_id, dst_name) = args.source, args.dest
+    if not args.dry_run and not s3_credentials():
+        p.error("copying needs IAS3 keys: set $IA_ACCESS_KEY and $IA_SECRET_KEY, or run `ia configure`")
+
+    # stdout is for the copies and the summary
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    # copies retry in copy_file(); the session's retries are for GETs only anyway
+    writes = session_from_args(args, DEFAULT_USER_AGENT, retries=0)
+    try:
+        files = source_files(fetch_metadata(session, src_id), src_id, pattern, args)
+    except (requests.RequestException, ValueError) as e:
+        logging.error(str(e) if isinstance(e, ArchiveError) else f"Could not fetch metadata for {src_id}: {e}")
+        sys.exit(EXIT_SOURCE_ERROR)
+    if not files:
+        logging.error(f"No file of {src_id} matches {pattern or '--glob'}")
+        sys.exit(EXIT_SOURCE_ERROR)
+    try:
+        names = destination_names([f["name"] for f in files], dst_name)
+    except ValueError as e:
+        p.error(str(e))
+    plan = [(f, names[f["name"]]) for f in files]
+    if src_id == dst_id and any(f["name"] == name for f, name in plan):
+        p.error("a file can't be copied onto itself; give the destination another name")
+    if args.dry_run:
+        print_dry_run(plan, src_id, dst_id, args)
+        return
+
+    copied: List[Tuple[dict, str]] = []
+    for n, (f, name) in enumerate(plan, start=1):
+        url = s3_url(dst_id, name)
+        try:
+            copy_file(writes, url, copy_headers(src_id, f["name"], args), args.retries)
+        except requests.RequestException as e:
+            logging.error(f"Copy failed: {src_id}/{f['name']} - {e}")
+            continue
+        size = parse_size(f.get("size"))
+        print(f"[{n}/{len(plan)}] {src_id}/{f['name']} -> {dst_id}/{name} ({format_size(size)})")
+        copied.append((f, name))
+    failed = len(plan) - len(copied)
+    print(f"{len(copied)} of {len(plan)} file(s) copied to {ARCHIVE_URL}/details/{dst_id}")
+    if not copied:
+        sys.exit(EXIT_ALL_FAILED)
+    if not args.wait:
+        sys.exit(EXIT_SOME_FAILED if failed else EXIT_OK)
+
+    # the copies land once the destination's tasks have run; until then its metadata doesn't list them
+    try:
+        tasks, timed_out = wait_for_tasks(session, {"identifier": dst_id}, wait_timeout=args.wait_timeout, interval=args.interval)
+        for t in tasks:
+            if t["status"] == "error":
+                logging.error(f"Task {t.get('task_id')} ({t.get('cmd')}) of {dst_id} is in the error state")
+        problems = [] if timed_out else verify(session, dst_id, copied)
+    except (requests.RequestException, TasksError, ValueError) as e:
+        logging.error(f"Could not check the copies in {dst_id}: {e}")
+        sys.exit(EXIT_SOME_FAILED if failed else EXIT_VERIFY_FAILED)
+    for problem in problems:
+        logging.error(f"Not verified: {problem}")
+    if not timed_out:
+        print(f"{len(copied) - len(problems)} of {len(copied)} copies verified against {dst_id}'s metadata")
+    sys.exit(EXIT_SOME_FAILED if failed else EXIT_WAIT_TIMEOUT if timed_out else EXIT_VERIFY_FAILED if problems else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
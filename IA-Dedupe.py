@@ -0,0 +1,344 @@
+import argparse
+import json
+import logging
+import os
+import stat
+import sys
+from collections import defaultdict
+from typing import Dict, List, Optional, Tuple
+
+from ia_catalog import load_catalog
+from ia_common import LOG_FORMATS, format_size, parse_args, parse_human_size, setup_logging
+from ia_download import PART_SUFFIX, TerminalProgress, add_lock_args, hash_file, lock_destination
+
+TOOL_NAME = "IA-Dedupe"
+TOOL_VERSION = "1.0"
+# no duplicates, or every group was linked or deleted down to one copy
+EXIT_OK = 0
+# duplicates were found and left as they are (no --link or --delete, --dry-run, or skipped when asked)
+EXIT_DUPLICATES = 1
+# some copy could not be linked or deleted
+EXIT_FAILED = 3
+# Kept in the root directory; what was hashed, by path, size and mtime, so a re-run only hashes what changed
+INDEX_FILE = ".ia-dedupe.json"
+INDEX_VERSION = 1
+KEEP_POLICIES = ("first", "shortest", "oldest", "newest")
+# next to the copy being replaced while the link is made, so a failure leaves the copy as it was
+LINK_SUFFIX = ".ia-dedupe-link"
+
+
+class HashIndex:
+    """md5s of the files under a root by relative path, valid while their size and mtime stay the same.
+
+    Only the entries looked up or added in this run are saved, so files that went away drop out of it.
+    """
+
+    def __init__(self, path: Optional[str]):
+        self.path = path
+        self.old: Dict[str, list] = {}
+        self.new: Dict[str, list] = {}
+        self.hits = 0
+        if path:
+            try:
+                with open(path, encoding="utf-8") as f:
+                    data = json.load(f)
+                if isinstance(data, dict) and data.get("version") == INDEX_VERSION:
+                    self.old = data.get("files", {})
+            except FileNotFoundError:
+                pass
+            except (OSError, ValueError) as e:
+                logging.warning(f"Could not read {path} ({e}); hashing everything again")
+
+    def get(self, rel: str, st: os.stat_result) -> Optional[str]:
+        entry = self.old.get(rel)
+        if entry and entry[:2] == [st.st_size, st.st_mtime_ns]:
+            self.new[rel] = entry
+            self.hits += 1
+            return entry[2]
+        return None
+
+    def put(self, rel: str, st: os.stat_result, md5: str):
+        self.new[rel] = [st.st_size, st.st_mtime_ns, md5]
+
+    def save(self):
+        if not self.path:
+            return
+        tmp = self.path + ".tmp"
+        try:
+            with open(tmp, "w", encoding="utf-8") as f:
+                json.dump({"version": INDEX_VERSION, "files": self.new}, f)
+            os.replace(tmp, self.path)
+        except OSError as e:
+            logging.warning(f"Could not save {self.path}: {e}")
+
+
+def scan(root: str, min_size: int) -> Dict[str, os.stat_result]:
+    """Every regular file under root of at least min_size bytes, by "/"-separated relative path.
+
+    Dot files (this tool's index, the downloaders' state and lock) and .part downloads are left out, as are symlinks.
+    """
+    found = {}
+    for top, dirs, names in os.walk(root):
+        dirs[:] = sorted(d for d in dirs if not d.startswith("."))
+        for name in sorted(names):
+            if name.startswith(".") or name.endswith(PART_SUFFIX) or name.endswith(LINK_SUFFIX):
+                continue
+            path = os.path.join(top, name)
+            try:
+                st = os.lstat(path)
+            except OSError as e:
+                logging.warning(f"Could not stat {path}: {e}")
+                continue
+            if stat.S_ISREG(st.st_mode) and st.st_size >= min_size:
+                found[os.path.relpath(path, root).replace(os.sep, "/")] = st
+    return found
+
+
+class Group:
+    """Files with the same content: copies holds one list of paths per inode, as hard links to one another are one copy."""
+
+    def __init__(self, md5: str, size: int, copies: List[List[str]]):
+        self.md5 = md5
+        self.size = size
+        self.copies = copies
+        self.catalog: List[str] = []
+        self.keep: Optional[str] = None
+        self.action: Optional[str] = None
+
+    @property
+    def paths(self) -> List[str]:
+        return [rel for copy in self.copies for rel in copy]
+
+    @property
+    def wasted(self) -> int:
+        return self.size * (len(self.copies) - 1)
+
+    def to_dict(self) -> dict:
+        return {"md5": self.md5, "size": self.size, "copies": len(self.copies), "wasted": self.wasted, "paths": self.paths,
+                "catalog": self.catalog, "keep": self.keep, "action": self.action}
+
+
+def find_duplicates(root: str, files: Dict[str, os.stat_result], index: HashIndex) -> List[Group]:
+    """The groups of two or more copies with the same content, largest waste first.
+
+    Only files that share their size with another copy are hashed, and each inode only once.
+    """
+    by_size: Dict[int, Dict[Tuple[int, int], List[str]]] = defaultdict(lambda: defaultdict(list))
+    for rel, st in files.items():
+        by_size[st.st_size][(st.st_dev, st.st_ino)].append(rel)
+    candidates = {size: inodes for size, inodes in by_size.items() if len(inodes) > 1}
+    count = sum(len(inodes) for inodes in candidates.values())
+    logging.info(f"{len(files)} file(s), {count} of them sharing a size with another to hash")
+
+    groups = []
+    done = 0
+    for size, inodes in sorted(candidates.items()):
+        by_md5: Dict[str, List[List[str]]] = defaultdict(list)
+        for paths in inodes.values():
+            done += 1
+            rel = paths[0]
+            md5 = index.get(rel, files[rel])
+            if md5 is None:
+                try:
+                    md5 = hash_file(os.path.join(root, rel), ["md5"], TerminalProgress(f"[hash {done}/{count}] {rel}"))["md5"]
+                except OSError as e:
+                    logging.warning(f"Could not hash {rel}: {e}")
+                    continue
+                index.put(rel, files[rel], md5)
+            for other in paths[1:]:
+                index.put(other, files[other], md5)
+            by_md5[md5].append(sorted(paths))
+        groups += [Group(md5, size, sorted(copies)) for md5, copies in by_md5.items() if len(copies) > 1]
+    logging.info(f"{index.hits} hash(es) taken from the index")
+    return sorted(groups, key=lambda g: (-g.wasted, g.paths[0]))
+
+
+def catalog_paths(path: str) -> Dict[str, List[str]]:
+    """The "<identifier>/<file name>" entries of a catalog by lowercased md5."""
+    catalog, fmt = load_catalog(path)
+    by_md5: Dict[str, List[str]] = defaultdict(list)
+    for entry in catalog.entries:
+        md5, identifier, name = entry.get("md5"), entry.get("identifier"), entry.get("file_name")
+        if md5 and identifier and name:
+            by_md5[str(md5).lower()].append(f"{identifier}/{name}")
+    logging.info(f"{path}: {len(catalog.entries)} entries ({fmt}), {len(by_md5)} distinct md5(s)")
+    return by_md5
+
+
+def at_catalog_path(rel: str, catalog: List[str]) -> bool:
+    # the root may hold the items themselves or a level above them, such as one directory per collection
+    return any(rel == c or rel.endswith("/" + c) for c in catalog)
+
+
+def choose_keep(group: Group, policy: str, files: Dict[str, os.stat_result]) -> str:
+    """The path of the copy to keep: one where the catalog puts the file, if any, then the one policy picks."""
+    candidates = [rel for rel in group.paths if at_catalog_path(rel, group.catalog)] or group.paths
+    if policy == "shortest":
+        return min(candidates, key=lambda rel: (len(rel), rel))
+    if policy == "oldest":
+        return min(candidates, key=lambda rel: (files[rel].st_mtime_ns, rel))
+    if policy == "newest":
+        return max(candidates, key=lambda rel: files[rel].st_mtime_ns)
+    return candidates[0]
+
+
+def ask_keep(group: Group, default: str) -> Optional[str]:
+    """Ask on the terminal which copy to keep; None to leave the group alone. EOFError or "q" stops asking."""
+    numbered = group.paths
+    print(f"\n{len(group.copies)} copies of {format_size(group.size)} (md5 {group.md5}):")
+    for n, rel in enumerate(numbered, start=1):
+        print(f"  {n}) {rel}{'  (default)' if rel == default else ''}")
+    while True:
+        answer = input(f"Keep which? [1-{len(numbered)}, Enter for the default, s to skip, q to stop] ").strip().lower()
+        if not answer:
+            return default
+        if answer == "s":
+            return None
+        if answer == "q":
+            raise EOFError
+        if answer.isdigit() and 1 <= int(answer) <= len(numbered):
+            return numbered[int(answer) - 1]
+
+
+def unchanged(path: str, st: os.stat_result) -> bool:
+    try:
+        now = os.lstat(path)
+    except OSError:
+        return False
+    return (now.st_size, now.st_mtime_ns, now.st_ino) == (st.st_size, st.st_mtime_ns, st.st_ino)
+
+
+def resolve(root: str, group: Group, files: Dict[str, os.stat_result], index: HashIndex, link: bool, dry_run: bool) -> bool:
+    """Replace each copy but the kept one with a hard link to it (link) or delete it; False when some copy could not be."""
+    keep_path = os.path.join(root, group.keep)
+    kept = next(copy for copy in group.copies if group.keep in copy)
+    verb = "link" if link else "delete"
+    ok = True
+    for copy in group.copies:
+        if copy is kept:
+            # hard links to the kept copy take no space
+            continue
+        for rel in copy:
+            path = os.path.join(root, rel)
+            if dry_run:
+                logging.info(f"Would {verb} {rel}" + (f" to {group.keep}" if link else ""))
+                continue
+            # the hashes are from the index or from a while ago; a copy written to since is not the same any more
+            if not unchanged(path, files[rel]) or not unchanged(keep_path, files[group.keep]):
+                logging.warning(f"{rel} or {group.keep} changed since it was hashed; left alone")
+                ok = False
+                continue
+            try:
+                if link:
+                    tmp = path + LINK_SUFFIX
+                    os.link(keep_path, tmp)
+                    os.replace(tmp, path)
+                    index.put(rel, files[group.keep], group.md5)
+                else:
+                    os.remove(path)
+                    index.new.pop(rel, None)
+            except OSError as e:
+                logging.error(f"Could not {verb} {rel}: {e}")
+                if link and os.path.lexists(path + LINK_SUFFIX):
+                    os.remove(path + LINK_SUFFIX)
+                ok = False
+                continue
+            logging.info(f"{'Linked' if link else 'Deleted'} {rel}" + (f" to {group.keep}" if link else ""))
+    return ok
+
+
+def text_report(groups: List[Group]) -> str:
+    if not groups:
+        return "No duplicates\n"
+    files = sum(len(g.copies) for g in groups)
+    lines = [f"{len(groups)} group(s) of duplicates, {files} copies, {format_size(sum(g.wasted for g in groups))} wasted"]
+    for g in groups:
+        catalog = f" [{', '.join(g.catalog)}]" if g.catalog else ""
+        lines += ["", f"{g.md5} {format_size(g.size)} x {len(g.copies)}, {format_size(g.wasted)} wasted{catalog}"]
+        for rel in g.paths:
+            mark = "*" if rel == g.keep else " "
+            lines.append(f" {mark} {rel}")
+    return "\n".join(lines) + "\n"
+
+
+def main():
+    p = argparse.ArgumentParser(description="Find files with the same content in a local mirror, and optionally hard link or delete the extra copies")
+    p.add_argument("root", help="The directory to search, with everything under it")
+    p.add_argument("--min-size", type=parse_human_size, default=1, help="Skip files smaller than this, e.g. 1M (default: 1, skipping empty files)")
+    p.add_argument("--index", help=f"Where to keep the hashes between runs (default: {INDEX_FILE} in the root)")
+    p.add_argument("--no-index", action="store_true", help="Hash every candidate again, and keep no index")
+    p.add_argument("--catalog", help="A catalog (as IA-Convert.py reads them) whose md5s name the files; the copy at "
+                                     "<identifier>/<file name> is the one kept")
+    action = p.add_mutually_exclusive_group()
+    action.add_argument("--link", action="store_true", help="Replace the extra copies with hard links to the kept one")
+    action.add_argument("--delete", action="store_true", help="Delete the extra copies")
+    p.add_argument("--keep", choices=KEEP_POLICIES, default="first",
+                   help="Which copy to keep where the catalog doesn't say: the first by path (default), the shortest path, "
+                        "the oldest or the newest")
+    p.add_argument("--interactive", action="store_true", help="Ask which copy to keep for each group, with --keep's as the default")
+    p.add_argument("--dry-run", action="store_true", help="Say what --link or --delete would do without doing it")
+    add_lock_args(p)
+    p.add_argument("--report", help="Also write the groups to this JSON file")
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if not os.path.isdir(args.root):
+        p.error(f"{args.root} is not a directory")
+    if args.interactive and not (args.link or args.delete):
+        p.error("--interactive asks which copy --link or --delete keeps; give one of them")
+
+    # stdout is for the report and the questions
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    changing = (args.link or args.delete) and not args.dry_run
+    # a downloader writing to the mirror meanwhile could have a copy replaced under it
+    lock = lock_destination(args.root, TOOL_NAME, args.lock_wait) if changing else None
+    try:
+        by_md5 = catalog_paths(args.catalog) if args.catalog else {}
+    except (OSError, ValueError) as e:
+        p.error(f"could not read {args.catalog}: {e}")
+    index = HashIndex(None if args.no_index else args.index or os.path.join(args.root, INDEX_FILE))
+    files = scan(args.root, args.min_size)
+    try:
+        groups = find_duplicates(args.root, files, index)
+        for g in groups:
+            g.catalog = sorted(set(by_md5.get(g.md5, [])))
+            g.keep = choose_keep(g, args.keep, files)
+
+        failed = left = stopped = False
+        for g in groups:
+            if not (args.link or args.delete) or stopped:
+                left = True
+                continue
+            if args.interactive:
+                try:
+                    choice = ask_keep(g, g.keep)
+                except EOFError:
+                    # no more questions, and nothing more done
+                    stopped, choice = True, None
+                if choice is None:
+                    left = True
+                    continue
+                g.keep = choice
+            if resolve(args.root, g, files, index, args.link, args.dry_run):
+                g.action = ("would " if args.dry_run else "") + ("link" if args.link else "delete")
+                left = left or args.dry_run
+            else:
+                failed = True
+    finally:
+        index.save()
+        if lock:
+            lock.release()
+
+    sys.stdout.write(text_report(groups))
+    if args.report:
+        with open(args.report, "w", encoding="utf-8") as f:
+            json.dump({"root": args.root, "wasted": sum(g.wasted for g in groups), "groups": [g.to_dict() for g in groups]},
+                      f, indent=2, ensure_ascii=False)
+    if failed:
+        sys.exit(EXIT_FAILED)
+    sys.exit(EXIT_DUPLICATES if left and groups else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
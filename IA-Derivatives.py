@@ -0,0 +1,152 @@
+import argparse
+import json
+import logging
+import os
+import sys
+from typing import List
+
+import requests
+
+from ia_common import (LOG_FORMATS, ArchiveError, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, fetch_metadata, format_size, parse_args, parse_size, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Derivatives"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the item's metadata could not be fetched, or the identifier does not exist or is dark
+EXIT_METADATA_ERROR = 2
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+INDENT = "  "
+
+
+def originals(f: dict) -> List[str]:
+    # "original" names the file a derivative was made from; a few derivers give a list of them
+    value = f.get("original")
+    if isinstance(value, list):
+        return [str(v) for v in value if v]
+    return [str(value)] if value else []
+
+
+def build_tree(files: List[dict]) -> List[dict]:
+    """The item's files as a forest: each node is {"file": entry, "children": [nodes]}, names in order at every level.
+
+    A file is a root when it names no original, or only originals that aren't in the item (marked "orphan");
+    a derivative of several originals is listed under the first one that is.
+    """
+    nodes = {f["name"]: {"file": f, "children": []} for f in files if f.get("name")}
+    roots = []
+    for name in sorted(nodes):
+        node = nodes[name]
+        parent = next((nodes[o] for o in originals(node["file"]) if o in nodes and o != name), None)
+        if parent is None:
+            if originals(node["file"]):
+                node["orphan"] = True
+            roots.append(node)
+        else:
+            parent["children"].append(node)
+    # a loop of originals has no root; its files are listed as roots rather than not at all
+    reached = set()
+
+    def walk(node):
+        reached.add(id(node))
+        for child in node["children"]:
+            walk(child)
+
+    for root in roots:
+        walk(root)
+    for name in sorted(nodes):
+        node = nodes[name]
+        if id(node) not in reached:
+            logging.warning(f"{name} is in a loop of originals; listed as a root")
+            for other in nodes.values():
+                if node in other["children"]:
+                    other["children"].remove(node)
+            roots.append(node)
+            walk(node)
+    return roots
+
+
+def flatten(roots: List[dict]) -> List[dict]:
+    """Every node, each before its derivatives."""
+    out = []
+    for node in roots:
+        out.append(node)
+        out += flatten(node["children"])
+    return out
+
+
+def describe(f: dict) -> str:
+    size = parse_size(f.get("size"))
+    details = [f.get("format") or "no format", format_size(size) if size is not None else "size unknown"]
+    return f"{f['name']}  ({', '.join(details)})"
+
+
+def text_tree(roots: List[dict], depth: int = 0) -> List[str]:
+    lines = []
+    for node in roots:
+        orphan = f"  [original {', '.join(originals(node['file']))} is not in the item]" if node.get("orphan") else ""
+        lines.append(INDENT * depth + describe(node["file"]) + orphan)
+        lines += text_tree(node["children"], depth + 1)
+    return lines
+
+
+def json_tree(roots: List[dict]) -> List[dict]:
+    return [dict(node["file"], derivatives=json_tree(node["children"])) for node in roots]
+
+
+def main():
+    p = argparse.ArgumentParser(description="Show which files of an Internet Archive item were derived from which, as a tree of originals and their derivatives")
+    p.add_argument("identifier", help="Item identifier")
+    only = p.add_mutually_exclusive_group()
+    only.add_argument("--only-roots", action="store_true", help="List only the files that weren't made from another one: "
+                                                                 "the originals the derivatives come from")
+    only.add_argument("--only-leaves", action="store_true", help="List only the files nothing was derived from")
+    p.add_argument("--json", action="store_true", help="Print the tree as JSON: each file's metadata with a \"derivatives\" array "
+                                                       "(a flat array with --only-roots or --only-leaves)")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+
+    # stdout is for the tree
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    try:
+        metadata = fetch_metadata(session, args.identifier)
+    except RateLimited as e:
+        logging.error(f"{args.identifier}: still rate limited after the retries ({e})")
+        sys.exit(EXIT_RATE_LIMITED)
+    except ArchiveError as e:
+        logging.error(str(e) if e.kind in ("not_found", "dark") else f"{args.identifier}: {e}")
+        sys.exit(EXIT_METADATA_ERROR)
+    except (requests.RequestException, ValueError) as e:
+        logging.error(f"Could not fetch metadata for {args.identifier}: {e}")
+        sys.exit(EXIT_METADATA_ERROR)
+
+    roots = build_tree(metadata.get("files", []))
+    if args.only_roots or args.only_leaves:
+        nodes = roots if args.only_roots else [n for n in flatten(roots) if not n["children"]]
+        if args.json:
+            print(json.dumps([n["file"] for n in nodes], indent=2, ensure_ascii=False))
+        else:
+            for node in nodes:
+                print(describe(node["file"]))
+    elif args.json:
+        print(json.dumps(json_tree(roots), indent=2, ensure_ascii=False))
+    else:
+        for line in text_tree(roots):
+            print(line)
+    sys.exit(EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
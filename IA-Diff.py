@@ -0,0 +1,152 @@
+import argparse
+import json
+import logging
+import sys
+from typing import Dict, List, Optional, Tuple
+
+from ia_catalog import Catalog, load_catalog
+from ia_common import LOG_FORMATS, format_size, parse_args, parse_size, setup_logging
+
+TOOL_NAME = "IA-Diff"
+TOOL_VERSION = "1.0"
+# as diff(1): no differences, differences, trouble (the last from argparse)
+EXIT_SAME = 0
+EXIT_CHANGED = 1
+# what makes an entry changed; the other fields (title, download_url...) may differ without it
+COMPARED = ("size", "md5")
+
+Key = Tuple[str, str]
+
+
+def keyed(catalog: Catalog, path: str) -> Dict[Key, dict]:
+    """The entries by (identifier, file_name); those without both are left out, and of repeats the last one counts."""
+    entries: Dict[Key, dict] = {}
+    for n, entry in enumerate(catalog.entries, start=1):
+        identifier, name = entry.get("identifier"), entry.get("file_name")
+        if not identifier or not name:
+            logging.warning(f"{path}: entry {n} has no identifier or file_name; left out")
+            continue
+        key = (str(identifier), str(name))
+        if key in entries:
+            logging.warning(f"{path}: {key[0]}/{key[1]} is listed more than once; the last one counts")
+        entries[key] = entry
+    return entries
+
+
+def comparable(field: str, value) -> Optional[object]:
+    # the search tool writes sizes as strings and CSV gives them back as numbers; md5s may come in either case
+    if field == "size":
+        return parse_size(value)
+    return str(value).lower() if value not in (None, "") else None
+
+
+def diff(old: Dict[Key, dict], new: Dict[Key, dict]) -> dict:
+    """Added, removed and changed entries, each list in key order; a change maps each differing field to [old, new]."""
+    changed = []
+    for key in sorted(old.keys() & new.keys()):
+        changes = {f: [old[key].get(f), new[key].get(f)] for f in COMPARED
+                   if comparable(f, old[key].get(f)) != comparable(f, new[key].get(f))}
+        if changes:
+            changed.append({"identifier": key[0], "file_name": key[1], "changes": changes})
+    return {
+        "added": [new[k] for k in sorted(new.keys() - old.keys())],
+        "removed": [old[k] for k in sorted(old.keys() - new.keys())],
+        "changed": changed,
+    }
+
+
+def summary(result: dict, old_count: int, new_count: int) -> dict:
+    return {"old": old_count, "new": new_count, "added": len(result["added"]), "removed": len(result["removed"]),
+            "changed": len(result["changed"])}
+
+
+def describe(field: str, values: List[object]) -> str:
+    def one(value):
+        if value in (None, ""):
+            return "(none)"
+        size = parse_size(value) if field == "size" else None
+        return format_size(size) if size is not None else str(value)
+
+    return f"{field} {one(values[0])} -> {one(values[1])}"
+
+
+def sized(entry: dict) -> str:
+    size = parse_size(entry.get("size"))
+    return f" ({format_size(size)})" if size is not None else ""
+
+
+def text_report(result: dict, counts: dict) -> str:
+    lines = [f"{counts['added']} added, {counts['removed']} removed, {counts['changed']} changed "
+             f"({counts['old']} entries before, {counts['new']} after)"]
+    lines += [f"+ {e['identifier']}/{e['file_name']}{sized(e)}" for e in result["added"]]
+    lines += [f"- {e['identifier']}/{e['file_name']}{sized(e)}" for e in result["removed"]]
+    lines += [f"~ {c['identifier']}/{c['file_name']}: " + ", ".join(describe(f, v) for f, v in c["changes"].items())
+              for c in result["changed"]]
+    return "\n".join(lines) + "\n"
+
+
+def cell(text: str) -> str:
+    return text.replace("|", "\\|")
+
+
+def markdown_report(result: dict, counts: dict, old_path: str, new_path: str) -> str:
+    lines = [f"## {cell(old_path)} → {cell(new_path)}", "",
+             f"**{counts['added']}** added, **{counts['removed']}** removed, **{counts['changed']}** changed "
+             f"({counts['old']} entries before, {counts['new']} after)"]
+    for title, entries in (("Added", result["added"]), ("Removed", result["removed"])):
+        if entries:
+            lines += ["", f"### {title}", "", "| identifier | file | size |", "|---|---|---|"]
+            lines += [f"| {cell(e['identifier'])} | {cell(e['file_name'])} | {sized(e).strip(' ()')} |" for e in entries]
+    if result["changed"]:
+        lines += ["", "### Changed", "", "| identifier | file | change |", "|---|---|---|"]
+        lines += [f"| {cell(c['identifier'])} | {cell(c['file_name'])} | "
+                  f"{cell(', '.join(describe(f, v) for f, v in c['changes'].items()))} |" for c in result["changed"]]
+    return "\n".join(lines) + "\n"
+
+
+def read(p: argparse.ArgumentParser, path: str) -> Tuple[Dict[Key, dict], int]:
+    try:
+        catalog, fmt = load_catalog(path)
+    except (OSError, ValueError) as e:
+        p.error(f"could not read {path}: {e}")
+    logging.info(f"{path}: {len(catalog.entries)} entries ({fmt})")
+    return keyed(catalog, path), len(catalog.entries)
+
+
+def main():
+    p = argparse.ArgumentParser(description="Compare two file catalogs (JSON, NDJSON, CSV, aria2 or SQLite, as IA-Convert.py reads them): "
+                                            "entries added, removed, or with a different size or md5, by identifier and file name")
+    p.add_argument("old", help='The earlier catalog ("-" for stdin)')
+    p.add_argument("new", help='The later catalog ("-" for stdin)')
+    p.add_argument("--format", choices=["text", "json", "markdown"], default="text",
+                   help="A summary line and one line per difference (default), JSON, or Markdown tables for a report or issue")
+    p.add_argument("--out", "-o", help="Write here instead of stdout")
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.old == "-" and args.new == "-":
+        p.error("only one of the catalogs can come from stdin")
+
+    # stdout may be for the report
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    old, old_count = read(p, args.old)
+    new, new_count = read(p, args.new)
+    result = diff(old, new)
+    counts = summary(result, old_count, new_count)
+    if args.format == "json":
+        report = json.dumps(dict(result, summary=counts), indent=2, ensure_ascii=False) + "\n"
+    elif args.format == "markdown":
+        report = markdown_report(result, counts, args.old, args.new)
+    else:
+        report = text_report(result, counts)
+    if args.out:
+        with open(args.out, "w", encoding="utf-8") as f:
+            f.write(report)
+    else:
+        sys.stdout.write(report)
+    sys.exit(EXIT_CHANGED if result["added"] or result["removed"] or result["changed"] else EXIT_SAME)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,186 @@
+import argparse
+import json
+import logging
+import os
+import re
+import sys
+from typing import Iterator, List, Optional
+
+import requests
+
+from ia_common import (ARCHIVE_URL, FTS_URL, LOG_FORMATS, ArchiveError, RateLimited, add_auth_args, add_request_rate_args,
+                       add_transport_args, default_user_agent, fetch_metadata, parse_args, raise_for_status, retry_call,
+                       session_from_args, setup_logging)
+
+TOOL_NAME = "IA-FTS"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# nothing matched
+EXIT_NO_HITS = 1
+# the search failed
+EXIT_SEARCH_FAILED = 2
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+# how the FTS API and search inside mark a match: {{{word}}}, or <em>word</em> from a plain Elasticsearch highlighter
+MATCH_MARK = re.compile(r"\{\{\{(.*?)\}\}\}|<em>(.*?)</em>", re.DOTALL)
+
+
+def highlight(text: str, mark: str) -> str:
+    """The snippet with each match wrapped in mark ("**" by default), or left bare when mark is empty."""
+    return MATCH_MARK.sub(lambda m: f"{mark}{m.group(1) if m.group(1) is not None else m.group(2)}{mark}", text)
+
+
+def scoped_query(query: str, collections: List[str]) -> str:
+    if not collections:
+        return query
+    return f"({query}) AND ({' OR '.join(f'collection:{c}' for c in collections)})"
+
+
+def first(value):
+    """Elasticsearch returns "fields" as lists; _source as plain values."""
+    return value[0] if isinstance(value, list) and value else value
+
+
+class FullTextSearch:
+    """The hits of one query, fetched rows at a time through the FTS API's scroll, up to limit."""
+
+    def __init__(self, session: requests.Session, query: str, rows: int = 100, limit: Optional[int] = None,
+                 retries: int = 5, backoff: float = 1.0):
+        self.session = session
+        self.query = query
+        self.rows = rows
+        self.limit = limit
+        self.retries = retries
+        self.backoff = backoff
+        self.total: Optional[int] = None
+
+    def post(self, body: dict) -> dict:
+        """One FTS request. It's a POST, which the session does not retry, so the retries are here."""
+        def once(attempt: int) -> dict:
+            r = self.session.post(FTS_URL, json=body)
+            raise_for_status(r)
+            return r.json()
+
+        return retry_call(once, self.retries, self.backoff, "POST", FTS_URL)
+
+    def __iter__(self) -> Iterator[dict]:
+        body = {"q": self.query, "size": self.rows, "scroll": True}
+        seen = 0
+        while self.limit is None or seen < self.limit:
+            answer = self.post(body)
+            hits = (answer.get("hits") or {}).get("hits") or []
+            total = (answer.get("hits") or {}).get("total")
+            self.total = total.get("value") if isinstance(total, dict) else total
+            if not hits:
+                return
+            for hit in hits[:None if self.limit is None else self.limit - seen]:
+                seen += 1
+                yield hit
+            if not answer.get("_scroll_id"):
+                return
+            body = {"scroll_id": answer["_scroll_id"], "scroll": True}
+
+
+def describe(hit: dict, mark: str) -> dict:
+    fields = dict(hit.get("fields") or {}, **(hit.get("_source") or {}))
+    snippets = [text for texts in (hit.get("highlight") or {}).values() for text in texts]
+    return {
+        "identifier": first(fields.get("identifier")) or hit.get("_id"),
+        "title": first(fields.get("title")),
+        "score": hit.get("_score"),
+        "snippets": [highlight(text, mark) for text in snippets],
+    }
+
+
+def text_doc(identifier: str, files: List[dict]) -> str:
+    """The book inside the item that search inside looks in: the stem of its _djvu.xml or hOCR file."""
+    for f in files:
+        name = f.get("name") or ""
+        for suffix in ("_djvu.xml", "_chocr.html.gz", "_hocr.html"):
+            if name.endswith(suffix):
+                return name[:-len(suffix)]
+    return identifier
+
+
+def search_inside(session: requests.Session, identifier: str, query: str, mark: str) -> List[dict]:
+    """The pages of one item the phrase is on, from the BookReader search inside service on the item's data node."""
+    metadata = fetch_metadata(session, identifier)
+    server = metadata.get("server")
+    base = f"https://{server}" if server else ARCHIVE_URL
+    r = session.get(f"{base}/fulltext/inside.php", params={
+        "item_id": identifier,
+        "doc": text_doc(identifier, metadata.get("files", [])),
+        "path": metadata.get("dir", ""),
+        "q": query,
+    })
+    raise_for_status(r)
+    pages = []
+    for match in (r.json() or {}).get("matches", []):
+        numbers = sorted({p.get("page") for p in match.get("par", []) if p.get("page") is not None})
+        pages.append({"pages": numbers, "text": highlight(match.get("text", ""), mark)})
+    return pages
+
+
+def main():
+    p = argparse.ArgumentParser(description="Find Internet Archive items whose full text (OCR, scanned books) contains a phrase",
+                                epilog="exit codes: 0 hits found, 1 no hits, 2 the search failed, 7 rate limited")
+    p.add_argument("query", help='Full-text query, e.g. "kernel panic" (quoted for the phrase)')
+    p.add_argument("--collection", "-c", action="append", default=[], help="Only items in this collection (repeatable)")
+    p.add_argument("--limit", type=int, help="Stop after this many hits")
+    p.add_argument("--rows", type=int, default=100, help="Hits per request (default: 100)")
+    p.add_argument("--pages", action="store_true", help="Also look up the page numbers and text of each match (two requests per hit)")
+    p.add_argument("--highlight", default="**", metavar="MARK", help='Put this around each match in the snippets (default: "**"; "" for none)')
+    p.add_argument("--format", choices=["json", "ndjson"], default="json", help="A JSON array, or one compact line per hit as it arrives")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.limit is not None and args.limit < 1:
+        p.error("--limit must be at least 1")
+
+    # stdout is for the hits
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    search = FullTextSearch(session, scoped_query(args.query, args.collection), args.rows, args.limit, args.retries, args.backoff)
+
+    results = []
+    found = 0
+    try:
+        for hit in search:
+            found += 1
+            out = describe(hit, args.highlight)
+            if args.pages and out["identifier"]:
+                try:
+                    out["matches"] = search_inside(session, out["identifier"], args.query, args.highlight)
+                except RateLimited:
+                    raise
+                except (requests.RequestException, ValueError) as e:
+                    logging.warning(f"{out['identifier']}: no page numbers ({e})")
+                    out["matches"] = None
+            if args.format == "ndjson":
+                print(json.dumps(out, ensure_ascii=False), flush=True)
+            else:
+                results.append(out)
+    except RateLimited as e:
+        logging.error(f"Still rate limited after the retries ({e})")
+        sys.exit(EXIT_RATE_LIMITED)
+    except (requests.RequestException, ValueError) as e:
+        logging.error(str(e) if isinstance(e, ArchiveError) else f"Full-text search failed: {e}")
+        sys.exit(EXIT_SEARCH_FAILED)
+
+    if args.format == "json":
+        print(json.dumps(results, indent=2, ensure_ascii=False))
+    logging.info(f"{found} hit(s) shown, {search.total if search.total is not None else '?'} in all")
+    sys.exit(EXIT_OK if found else EXIT_NO_HITS)
+
+
+if __name__ == "__main__":
+    main()
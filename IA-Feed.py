@@ -0,0 +1,176 @@
+import argparse
+import logging
+import os
+import sys
+import xml.etree.ElementTree as ET
+from datetime import datetime, timezone
+from typing import List, Optional
+from urllib.parse import quote
+
+import requests
+
+from ia_common import (ARCHIVE_URL, LOG_FORMATS, SearchError, SearchResults, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, details_url, parse_args, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Feed"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the search failed (or was still rate limited after the retries); no feed was written
+EXIT_SEARCH_FAILED = 4
+ATOM_NS = "http://www.w3.org/2005/Atom"
+FIELDS = ["identifier", "title", "publicdate", "description", "creator", "mediatype"]
+# entry ids don't change when the feed moves or archive.org's address does
+ENTRY_ID = "tag:archive.org,2005:{identifier}"
+
+ET.register_namespace("", ATOM_NS)
+
+
+def feed_query(query: Optional[str], collections: List[str], since: Optional[str]) -> str:
+    parts = [f"({query})"] if query else []
+    parts += [f"collection:{c}" for c in collections]
+    if since:
+        parts.append(f"publicdate:[{since} TO null]")
+    return " AND ".join(parts)
+
+
+def since_date(value: str) -> str:
+    """argparse type for --since: a day or a UTC time, as the search index takes it."""
+    try:
+        when = datetime.fromisoformat(value.replace("Z", "+00:00"))
+    except ValueError:
+        raise argparse.ArgumentTypeError(f"invalid date {value!r}, expected e.g. 2024-05-01 or 2024-05-01T12:00:00Z")
+    return rfc3339(when)
+
+
+def rfc3339(when: datetime) -> str:
+    if when.tzinfo is None:
+        when = when.replace(tzinfo=timezone.utc)
+    return when.astimezone(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+
+
+def doc_time(value) -> Optional[str]:
+    """A search doc's date as Atom wants it, or None when it has none that parses."""
+    if isinstance(value, list):
+        value = value[0] if value else None
+    if not value:
+        return None
+    try:
+        return rfc3339(datetime.fromisoformat(str(value).replace("Z", "+00:00")))
+    except ValueError:
+        return None
+
+
+def text_of(value) -> str:
+    # repeatable metadata fields come as lists
+    if isinstance(value, list):
+        return "\n".join(str(v) for v in value)
+    return str(value) if value is not None else ""
+
+
+def sub(parent: ET.Element, tag: str, text: Optional[str] = None, **attrib) -> ET.Element:
+    element = ET.SubElement(parent, f"{{{ATOM_NS}}}{tag}", attrib)
+    if text is not None:
+        element.text = text
+    return element
+
+
+def build_feed(docs: List[dict], title: str, feed_id: str, self_url: Optional[str], alternate: str,
+               now: Optional[datetime] = None) -> ET.Element:
+    """An Atom feed with one entry per doc that has an identifier, in the order given."""
+    feed = ET.Element(f"{{{ATOM_NS}}}feed")
+    sub(feed, "title", title)
+    sub(feed, "id", feed_id)
+    entries = []
+    for doc in docs:
+        identifier = doc.get("identifier")
+        if not identifier:
+            continue
+        published = doc_time(doc.get("publicdate"))
+        entries.append((identifier, published, doc))
+    # the newest entry's time, so readers see the feed change only when an entry does
+    times = [published for _, published, _ in entries if published]
+    sub(feed, "updated", max(times) if times else rfc3339(now or datetime.now(timezone.utc)))
+    if self_url:
+        sub(feed, "link", rel="self", type="application/atom+xml", href=self_url)
+    sub(feed, "link", rel="alternate", type="text/html", href=alternate)
+    # Atom needs an author for every entry; those without a creator get the feed's
+    author = sub(feed, "author")
+    sub(author, "name", "Internet Archive")
+    sub(feed, "generator", TOOL_NAME, version=TOOL_VERSION)
+    for identifier, published, doc in entries:
+        entry = sub(feed, "entry")
+        sub(entry, "title", text_of(doc.get("title")) or identifier)
+        sub(entry, "id", ENTRY_ID.format(identifier=identifier))
+        sub(entry, "link", rel="alternate", type="text/html", href=details_url(identifier))
+        when = published or feed.findtext(f"{{{ATOM_NS}}}updated")
+        sub(entry, "updated", when)
+        if published:
+            sub(entry, "published", published)
+        for creator in doc.get("creator") if isinstance(doc.get("creator"), list) else [doc.get("creator")]:
+            if creator:
+                sub(sub(entry, "author"), "name", str(creator))
+        if doc.get("mediatype"):
+            sub(entry, "category", term=text_of(doc["mediatype"]))
+        if doc.get("description"):
+            # archive.org descriptions are often HTML; the reader shows it as such
+            sub(entry, "summary", text_of(doc["description"]), type="html")
+    return feed
+
+
+def main():
+    p = argparse.ArgumentParser(description="Turn an Internet Archive search, such as a collection's newest items, into an Atom feed")
+    p.add_argument("query", nargs="?", help="Advanced search query (default: everything in the --collections given)")
+    p.add_argument("--collection", "-c", action="append", default=[], help="Only items in this collection (repeatable)")
+    p.add_argument("--since", type=since_date, help="Only items published on or after this date, e.g. 2024-05-01")
+    p.add_argument("--limit", "-n", type=int, default=50, help="The newest N items (default: 50)")
+    p.add_argument("--title", help="Feed title (default: the query)")
+    p.add_argument("--self-url", help="The URL the feed will be served at, for its rel=self link and id")
+    p.add_argument("--out", "-o", help="Write the feed here instead of stdout")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if not args.query and not args.collection:
+        p.error("give a query, --collection, or both")
+    if not 1 <= args.limit <= 10000:
+        p.error("--limit must be between 1 and 10000")
+
+    # stdout may be for the feed
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    query = feed_query(args.query, args.collection, args.since)
+    logging.info(f"Query: {query}")
+    results = SearchResults(session, query, FIELDS, rows=args.limit, max_pages=1, sort=["publicdate desc"])
+    try:
+        docs = list(results)
+    except (SearchError, requests.RequestException) as e:
+        logging.error(f"Search failed: {e}")
+        sys.exit(EXIT_SEARCH_FAILED)
+    logging.info(f"{len(docs)} of {results.num_found} item(s) in the feed")
+
+    alternate = f"{ARCHIVE_URL}/search?query={quote(query)}&sort=-publicdate"
+    feed_id = args.self_url or f"tag:archive.org,2005:search:{quote(query, safe='')}"
+    feed = build_feed(docs, args.title or query, feed_id, args.self_url, alternate)
+    ET.indent(feed)
+    text = '<?xml version="1.0" encoding="utf-8"?>\n' + ET.tostring(feed, encoding="unicode") + "\n"
+    if args.out:
+        tmp = args.out + ".tmp"
+        with open(tmp, "w", encoding="utf-8") as f:
+            f.write(text)
+        # a feed reader polling the file never sees half of one
+        os.replace(tmp, args.out)
+    else:
+        sys.stdout.write(text)
+    sys.exit(EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
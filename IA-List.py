@@ -0,0 +1,119 @@
+import argparse
+import json
+import logging
+import os
+import sys
+from typing import List
+
+import requests
+
+from ia_common import (GLOB_HELP, LOG_FORMATS, SORT_KEYS, ArchiveError, RateLimited, add_auth_args, add_file_filter_args,
+                       add_request_rate_args, add_transport_args, check_file_filter_args, default_user_agent, fetch_metadata,
+                       format_size, parse_args, parse_size, select_files, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-List"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the item's metadata could not be fetched, or the identifier does not exist or is dark
+EXIT_METADATA_ERROR = 2
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+COLUMNS = ("name", "size", "format", "source", "md5", "sha1")
+
+
+def file_rows(files: List[dict], tsv: bool) -> List[List[str]]:
+    rows = []
+    for f in files:
+        size = parse_size(f.get("size"))
+        rows.append([
+            f.get("name") or "",
+            ("" if size is None else str(size)) if tsv else format_size(size),
+            f.get("format") or "",
+            f.get("source") or "",
+            f.get("md5") or "",
+            f.get("sha1") or "",
+        ])
+    return rows
+
+
+def totals_line(files: List[dict], suppressed: List[dict]) -> str:
+    unknown = sum(1 for f in files if parse_size(f.get("size")) is None)
+    line = f"{len(files)} files, {format_size(sum(parse_size(f.get('size')) or 0 for f in files))} total"
+    if unknown:
+        line += f" ({unknown} without size)"
+    if suppressed:
+        line += f"; {len(suppressed)} housekeeping file(s) not listed (--include-housekeeping to list them)"
+    return line
+
+
+def print_table(files: List[dict]):
+    rows = file_rows(files, tsv=False)
+    widths = [max(len(r[i]) for r in [list(COLUMNS)] + rows) for i in range(len(COLUMNS))]
+    for row in [list(COLUMNS)] + rows:
+        # size is right-aligned, everything else left-aligned
+        print("  ".join(c.rjust(w) if i == 1 else c.ljust(w) for i, (c, w) in enumerate(zip(row, widths))).rstrip())
+
+
+def main():
+    p = argparse.ArgumentParser(description="List the files of an Internet Archive item, with the filters Download-Collections-v2.py uses",
+                                epilog=GLOB_HELP, formatter_class=argparse.RawDescriptionHelpFormatter)
+    p.add_argument("identifier", help="Item identifier")
+    add_file_filter_args(p, "list")
+    p.add_argument("--sort-by", choices=sorted(SORT_KEYS), help="Sort by this column (default: metadata order)")
+    output = p.add_mutually_exclusive_group()
+    output.add_argument("--json", action="store_true", help="Print the selected files' metadata as a JSON array")
+    output.add_argument("--tsv", action="store_true", help="Print tab-separated columns with sizes in bytes")
+    p.add_argument("--total", action="store_true", help="Finish with the number of files and their total size")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    check_file_filter_args(p, args)
+
+    # stdout is for the listing
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+
+    try:
+        metadata = fetch_metadata(session, args.identifier)
+    except RateLimited as e:
+        logging.error(f"{args.identifier}: still rate limited after the retries ({e})")
+        sys.exit(EXIT_RATE_LIMITED)
+    except ArchiveError as e:
+        logging.error(str(e) if e.kind in ("not_found", "dark") else f"{args.identifier}: {e}")
+        sys.exit(EXIT_METADATA_ERROR)
+    except (requests.RequestException, ValueError) as e:
+        logging.error(f"Could not fetch metadata for {args.identifier}: {e}")
+        sys.exit(EXIT_METADATA_ERROR)
+
+    files, suppressed = select_files(metadata.get("files", []), args, args.identifier)
+    if args.sort_by:
+        files = sorted(files, key=SORT_KEYS[args.sort_by])
+
+    if args.json:
+        out = files
+        if args.total:
+            out = {"files": files, "count": len(files), "size": sum(parse_size(f.get("size")) or 0 for f in files)}
+        print(json.dumps(out, indent=2, ensure_ascii=False))
+    elif args.tsv:
+        for row in [list(COLUMNS)] + file_rows(files, tsv=True):
+            print("\t".join(row))
+        if args.total:
+            # keep stdout machine-readable
+            print(totals_line(files, suppressed), file=sys.stderr)
+    else:
+        print_table(files)
+        if args.total:
+            print(totals_line(files, suppressed))
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,135 @@
+import argparse
+import json
+import logging
+import os
+import re
+import sys
+from typing import List
+
+import requests
+
+from ia_common import (LOG_FORMATS, ArchiveError, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, fetch_metadata, parse_args, read_list, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Metadata"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# at least one identifier had no metadata to show (not found, dark, or the request failed)
+EXIT_METADATA_ERROR = 2
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+# one path segment: a key, optionally followed by [] (every element) or [N] (one element)
+PATH_SEGMENT = re.compile(r"([^\[\]]*)(?:\[(\d*)\])?")
+
+
+def select(value, path: str):
+    """The part of value at a path like metadata.title, files[].name or files[0].md5.
+
+    [] maps the rest of the path over a list; a key or index that isn't there gives None.
+    """
+    return _select(value, path.split("."))
+
+
+def _select(value, segments: List[str]):
+    if not segments:
+        return value
+    match = PATH_SEGMENT.fullmatch(segments[0])
+    if match is None:
+        raise ValueError(f"bad path segment {segments[0]!r}")
+    key, index = match.groups()
+    if key:
+        value = value.get(key) if isinstance(value, dict) else None
+    if index is None:
+        return _select(value, segments[1:])
+    if not isinstance(value, list):
+        return None
+    if index == "":
+        return [_select(v, segments[1:]) for v in value]
+    return _select(value[int(index)], segments[1:]) if int(index) < len(value) else None
+
+
+def field_paths(value: str) -> List[str]:
+    """--fields: comma-separated paths, checked up front so a typo doesn't fail halfway through a run."""
+    paths = [p for p in value.split(",") if p]
+    for path in paths:
+        if not all(PATH_SEGMENT.fullmatch(segment) for segment in path.split(".")):
+            raise argparse.ArgumentTypeError(f"bad path {path!r}; use keys, key[] and key[N] joined by dots")
+    return paths
+
+
+def shape(identifier: str, metadata: dict, args) -> object:
+    if args.fields:
+        return {"identifier": identifier, **{path: select(metadata, path) for path in args.fields}}
+    if args.files_only:
+        return metadata.get("files", [])
+    if args.item_only:
+        return metadata.get("metadata", {})
+    return metadata
+
+
+def main():
+    parser = argparse.ArgumentParser(description="Fetch and print the /metadata of Internet Archive items")
+    parser.add_argument("identifiers", nargs="*", help="Item identifiers (default: read from --identifiers-file or stdin)")
+    parser.add_argument("--identifiers-file", "-f", help="File with one identifier per line ('-' for stdin)")
+    parser.add_argument("--format", choices=["json", "ndjson"], default="json",
+                        help="Pretty JSON (one object for one identifier, an array for several) or one compact line per item")
+    shortcut = parser.add_mutually_exclusive_group()
+    shortcut.add_argument("--fields", type=field_paths,
+                          help="Only these comma-separated paths, e.g. metadata.title,files[].name,files[0].md5")
+    shortcut.add_argument("--files-only", action="store_true", help="Only the files list")
+    shortcut.add_argument("--item-only", action="store_true", help="Only the item-level metadata object")
+    parser.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    parser.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    parser.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    parser.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(parser)
+    add_transport_args(parser)
+    add_auth_args(parser)
+    parser.add_argument("--log-file", help="Optional log file path")
+    parser.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    parser.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(parser, __file__, version=TOOL_VERSION)
+
+    identifiers = list(read_list(args.identifiers, args.identifiers_file))
+    if not identifiers:
+        parser.error("give identifiers as arguments, with --identifiers-file, or on stdin")
+
+    # stdout is for the JSON
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+
+    results = []
+    failed = 0
+    rate_limited = False
+    for identifier in identifiers:
+        try:
+            metadata = fetch_metadata(session, identifier)
+        except RateLimited as e:
+            logging.error(f"{identifier}: still rate limited after the retries ({e})")
+            failed += 1
+            rate_limited = True
+            continue
+        except ArchiveError as e:
+            logging.error(str(e) if e.kind in ("not_found", "dark") else f"{identifier}: {e}")
+            failed += 1
+            continue
+        except (requests.RequestException, ValueError) as e:
+            logging.error(f"Could not fetch metadata for {identifier}: {e}")
+            failed += 1
+            continue
+        out = shape(identifier, metadata, args)
+        if args.format == "ndjson":
+            print(json.dumps(out, ensure_ascii=False), flush=True)
+        else:
+            results.append(out)
+
+    if args.format == "json" and results:
+        print(json.dumps(results[0] if len(identifiers) == 1 else results, indent=2, ensure_ascii=False))
+    if rate_limited:
+        sys.exit(EXIT_RATE_LIMITED)
+    sys.exit(EXIT_METADATA_ERROR if failed else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,485 @@
+import argparse
+import logging
+import os
+import shutil
+import sqlite3
+import sys
+import time
+from datetime import datetime, timezone
+from typing import Dict, List, Optional, Set
+
+import requests
+
+from ia_common import (GLOB_HELP, LOG_FORMATS, ArchiveError, RateLimited, SearchError, SearchResults, add_auth_args, add_breaker_args,
+                       add_file_filter_args, add_request_rate_args, add_transport_args, check_breaker_args, check_file_filter_args,
+                       circuit_breaker, collection_members, default_user_agent, digest_mismatch, download_url, fetch_metadata,
+                       format_size, is_otf, log_context, metadata_digests, parse_args, parse_duration, parse_size, select_files,
+                       session_from_args, setup_logging)
+from ia_download import (DRAIN_SECONDS, PART_SUFFIX, REQUEST_TIMEOUT, STOP, ChecksumDB, Downloader, Interrupted, Shutdown, StatsFile,
+                         add_checksum_db_args, add_lock_args, add_stats_args, check_stats_args, local_names, lock_destination, long_path,
+                         open_checksum_db)
+from ia_notify import Notifier, add_notify_args, check_notify_args
+
+TOOL_NAME = "IA-Mirror"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the collection could not be searched
+EXIT_SEARCH_FAILED = 2
+# some items could not be read or some files failed; they are retried on the next run
+EXIT_SOME_FAILED = 3
+# archive.org still answered 429 after the retries; the run stopped and the next one picks up from here
+EXIT_RATE_LIMITED = 7
+# SIGINT/SIGTERM, the shell's usual 128 + SIGINT; with --watch, a signal ends the run with EXIT_OK instead
+EXIT_INTERRUPTED = 130
+# The mirror's state, kept in the destination directory
+STATE_FILE = ".ia-mirror.sqlite"
+# The search index lags behind item updates, so each incremental query reaches this far before the last one
+SINCE_OVERLAP = 24 * 3600
+SCHEMA = """
+CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value TEXT);
+CREATE TABLE IF NOT EXISTS items (
+    identifier TEXT PRIMARY KEY,
+    state TEXT NOT NULL,          -- pending, synced or withdrawn
+    updated INTEGER,              -- item_last_updated of the metadata last mirrored
+    synced REAL                   -- when every selected file was last in place
+);
+CREATE TABLE IF NOT EXISTS files (
+    identifier TEXT NOT NULL,
+    name TEXT NOT NULL,
+    path TEXT NOT NULL,           -- relative to the destination directory
+    size INTEGER,
+    md5 TEXT,
+    PRIMARY KEY (identifier, name)
+);
+"""
+
+
+class MirrorState:
+    """The SQLite database of known items and file digests; every change is committed at once so a stopped run loses nothing."""
+
+    def __init__(self, path: str, dry_run: bool = False):
+        self.db = sqlite3.connect(path)
+        self.db.row_factory = sqlite3.Row
+        self.db.executescript(SCHEMA)
+        self.dry_run = dry_run
+
+    def write(self, sql: str, *params):
+        if self.dry_run:
+            return
+        with self.db:
+            self.db.execute(sql, params)
+
+    def get(self, key: str) -> Optional[str]:
+        row = self.db.execute("SELECT value FROM meta WHERE key = ?", (key,)).fetchone()
+        return row["value"] if row else None
+
+    def set(self, key: str, value: str):
+        self.write("INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)", key, value)
+
+    def item(self, identifier: str) -> Optional[sqlite3.Row]:
+        return self.db.execute("SELECT * FROM items WHERE identifier = ?", (identifier,)).fetchone()
+
+    def identifiers(self, *states: str) -> List[str]:
+        marks = ",".join("?" * len(states))
+        return [r["identifier"] for r in self.db.execute(f"SELECT identifier FROM items WHERE state IN ({marks}) ORDER BY identifier", states)]
+
+    def set_item(self, identifier: str, state: str, updated: Optional[int] = None, synced: Optional[float] = None):
+        self.write("INSERT INTO items (identifier, state, updated, synced) VALUES (?, ?, ?, ?) "
+                   "ON CONFLICT (identifier) DO UPDATE SET state = excluded.state, "
+                   "updated = COALESCE(excluded.updated, updated), synced = COALESCE(excluded.synced, synced)",
+                   identifier, state, updated, synced)
+
+    def files(self, identifier: str) -> Dict[str, sqlite3.Row]:
+        return {r["name"]: r for r in self.db.execute("SELECT * FROM files WHERE identifier = ?", (identifier,))}
+
+    def set_file(self, identifier: str, name: str, path: str, size: Optional[int], md5: Optional[str]):
+        self.write("INSERT OR REPLACE INTO files (identifier, name, path, size, md5) VALUES (?, ?, ?, ?, ?)",
+                   identifier, name, path, size, md5)
+
+    def drop_files(self, identifier: str, names: Optional[List[str]] = None):
+        if names is None:
+            self.write("DELETE FROM files WHERE identifier = ?", identifier)
+        for name in names or []:
+            self.write("DELETE FROM files WHERE identifier = ? AND name = ?", identifier, name)
+
+    def totals(self) -> Dict[str, int]:
+        counts = {r["state"]: r["n"] for r in self.db.execute("SELECT state, COUNT(*) AS n FROM items GROUP BY state")}
+        files = self.db.execute("SELECT COUNT(*) AS n, COALESCE(SUM(size), 0) AS bytes FROM files").fetchone()
+        return {"synced": counts.get("synced", 0), "pending": counts.get("pending", 0),
+                "withdrawn": counts.get("withdrawn", 0), "files": files["n"], "bytes": files["bytes"]}
+
+
+def iso_time(ts: float) -> str:
+    return datetime.fromtimestamp(ts, timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+
+
+def updated_since(since: float) -> str:
+    return f"oai_updatedate:[{iso_time(since - SINCE_OVERLAP)} TO null]"
+
+
+def collection_query(collection: str, since: Optional[float] = None) -> str:
+    query = f"collection:{collection}"
+    if since is not None:
+        query += f" AND {updated_since(since)}"
+    return query
+
+
+def search_identifiers(session: requests.Session, collection: str, since: Optional[float], sleep: float) -> List[str]:
+    where = updated_since(since) if since is not None else None
+    return [doc["identifier"] for doc in collection_members(session, collection, where=where, sleep=sleep)]
+
+
+def open_state(p: argparse.ArgumentParser, args, dry_run: bool = False) -> MirrorState:
+    path = os.path.join(args.dest, STATE_FILE)
+    if not os.path.exists(path) and args.command == "status":
+        p.error(f"{args.dest} is not a mirror yet (no {STATE_FILE}); run sync first")
+    os.makedirs(args.dest, exist_ok=True)
+    state = MirrorState(path, dry_run)
+    known = state.get("collection")
+    if known is None:
+        state.set("collection", args.collection)
+    elif known != args.collection:
+        state.db.close()
+        p.error(f"{args.dest} mirrors {known}, not {args.collection}")
+    return state
+
+
+class Mirror:
+    """One sync run: brings each item given to sync_item() up to date and records what it did in the state."""
+
+    def __init__(self, session: requests.Session, downloader: Downloader, state: MirrorState, args, db: Optional[ChecksumDB] = None):
+        self.session = session
+        self.downloader = downloader
+        self.state = state
+        self.args = args
+        self.db = db
+        self.downloaded = 0
+        self.failed = 0
+
+    def sync_item(self, identifier: str) -> bool:
+        """Download what is new or changed in one item; False when something is left for the next run."""
+        known = self.state.item(identifier)
+        metadata = fetch_metadata(self.session, identifier)
+        updated = metadata.get("item_last_updated")
+        if known is not None and known["state"] == "synced" and updated is not None and known["updated"] == updated:
+            logging.debug(f"{identifier}: unchanged since the last sync")
+            return True
+        if known is None or known["state"] != "pending":
+            self.state.set_item(identifier, "pending")
+
+        files, _ = select_files(metadata.get("files", []), self.args, identifier)
+        local = local_names(files)
+        recorded = self.state.files(identifier)
+        ok = True
+        for f in files:
+            name = f["name"]
+            rel = f"{identifier}/{local[name]}"
+            path = long_path(os.path.join(self.args.dest, *rel.split("/")))
+            size, md5 = parse_size(f.get("size")), f.get("md5")
+            row = recorded.get(name)
+            if (row is not None and row["md5"] == md5 and row["size"] == size and row["path"] == rel
+                    and os.path.isfile(path) and (size is None or os.path.getsize(path) == size)):
+                continue
+            if self.already_there(path, f):
+                # the copy on disk is one --checksum-db has seen match these digests, e.g. with a new state or --dest
+                logging.info(f"{rel}: already on disk, matching --checksum-db")
+                self.state.set_file(identifier, name, rel, size, md5)
+                continue
+            if self.args.dry_run:
+                print(f"would download {rel} ({format_size(size)})")
+                continue
+            with log_context(file=name):
+                fetched = self.fetch(identifier, f, path)
+            if not fetched:
+                ok = False
+                continue
+            self.state.set_file(identifier, name, rel, size, md5)
+
+        gone = [name for name in recorded if name not in local]
+        if gone:
+            self.remove_files(identifier, [recorded[name] for name in gone])
+        if ok and not self.args.dry_run:
+            self.state.set_item(identifier, "synced", updated, time.time())
+        return ok
+
+    def already_there(self, path: str, f: dict) -> bool:
+        expected = metadata_digests(f)
+        if self.db is None or not expected or is_otf(f):
+            return False
+        known = self.db.digests(path, list(expected))
+        return known is not None and digest_mismatch(expected, known) is None
+
+    def fetch(self, identifier: str, f: dict, path: str) -> bool:
+        name = f["name"]
+        part = path + PART_SUFFIX
+        otf = is_otf(f)
+        try:
+            transfer = self.downloader.fetch(download_url(identifier, name), part, None if otf else parse_size(f.get("size")),
+                                             f"{identifier}/{name}", REQUEST_TIMEOUT,
+                                             algos=list(metadata_digests(f)))
+        except Interrupted:
+            raise
+        except (requests.RequestException, OSError) as e:
+            logging.error(f"Download failed: {identifier}/{name} - {e}")
+            self.failed += 1
+            return False
+        mismatch = digest_mismatch(metadata_digests(f), transfer.digests) if transfer.digests is not None else None
+        if mismatch:
+            logging.error(f"Checksum mismatch after download: {identifier}/{name}: {mismatch}")
+            os.remove(part)
+            self.failed += 1
+            return False
+        os.replace(part, path)
+        if self.db is not None and transfer.digests:
+            self.db.record(path, transfer.digests, identifier)
+        logging.info(f"Downloaded {identifier}/{name} ({format_size(transfer.received)})")
+        self.downloaded += 1
+        return True
+
+    def remove_files(self, identifier: str, rows: List[sqlite3.Row]):
+        """Files the item no longer has (or the filters no longer select) are deleted with --prune and forgotten either way."""
+        for row in rows:
+            path = os.path.join(self.args.dest, *row["path"].split("/"))
+            if self.args.prune and os.path.isfile(path):
+                if self.args.dry_run:
+                    print(f"would remove {row['path']}")
+                    continue
+                os.remove(path)
+                logging.info(f"Removed {row['path']}, no longer in the item")
+        self.state.drop_files(identifier, [row["name"] for row in rows])
+
+    def prune_item(self, identifier: str):
+        item_dir = os.path.join(self.args.dest, identifier)
+        if self.args.dry_run:
+            print(f"would prune {identifier}/")
+            return
+        if os.path.isdir(item_dir):
+            shutil.rmtree(item_dir)
+        self.state.drop_files(identifier)
+        self.state.set_item(identifier, "withdrawn")
+        logging.warning(f"Pruned {identifier}: it is no longer in the collection")
+
+
+def sync(state: MirrorState, args, stats_file: StatsFile, db: Optional[ChecksumDB] = None) -> int:
+    # downloads retry in the Downloader, which resumes a body cut short; the sessions are closed after each run, so
+    # a --watch process doesn't keep one connection pool per cycle. Both sessions share the circuit breaker
+    breaker = circuit_breaker(args)
+    with session_from_args(args, DEFAULT_USER_AGENT, breaker=breaker) as session, \
+            session_from_args(args, DEFAULT_USER_AGENT, breaker=breaker, retries=0) as transfers:
+        return sync_with(state, args, session, Downloader(transfers, args.retries, checksum=True), stats_file, db)
+
+
+def sync_with(state: MirrorState, args, session: requests.Session, downloader: Downloader, stats_file: StatsFile,
+              db: Optional[ChecksumDB] = None) -> int:
+    mirror = Mirror(session, downloader, state, args, db)
+
+    saved = state.get("since")
+    since = args.since.timestamp() if args.since else None if args.full or saved is None else float(saved)
+    started = time.time()
+    try:
+        discovered = search_identifiers(session, args.collection, since, args.sleep)
+        live: Optional[Set[str]] = set(search_identifiers(session, args.collection, None, args.sleep)) if args.prune else None
+    except (SearchError, requests.RequestException) as e:
+        logging.error(f"Could not search {args.collection}: {e}")
+        return EXIT_SEARCH_FAILED
+    # items a stopped or failed run left half done are picked up whether or not the search lists them again
+    pending = state.identifiers("pending")
+    todo = sorted(set(discovered) | set(pending))
+    logging.info(f"{len(discovered)} item(s) new or changed {'since ' + iso_time(since) if since else 'in total'}, "
+                 f"{len(pending)} left from earlier runs")
+
+    incomplete = 0
+    stats_file.begin(len(todo))
+    try:
+        for n, identifier in enumerate(todo, start=1):
+            if STOP.is_set():
+                raise Interrupted()
+            if live is not None and identifier not in live:
+                stats_file.item_done()
+                continue
+            logging.info(f"[item {n}/{len(todo)}] {identifier}")
+            try:
+                with log_context(identifier=identifier):
+                    synced = mirror.sync_item(identifier)
+                if not synced:
+                    incomplete += 1
+            except RateLimited as e:
+                logging.error(f"{identifier}: still rate limited after the retries ({e}); stopping, the next run resumes here")
+                return EXIT_RATE_LIMITED
+            except ArchiveError as e:
+                if e.kind in ("not_found", "dark") and args.prune:
+                    mirror.prune_item(identifier)
+                    continue
+                logging.error(str(e))
+                incomplete += 1
+            except (requests.RequestException, ValueError) as e:
+                logging.error(f"Could not fetch metadata for {identifier}: {e}")
+                incomplete += 1
+            finally:
+                stats_file.item_done()
+                stats_file.update(files_downloaded=mirror.downloaded, files_failed=mirror.failed)
+        if live is not None:
+            for identifier in state.identifiers("synced", "pending"):
+                if identifier not in live:
+                    mirror.prune_item(identifier)
+    except Interrupted:
+        logging.warning(f"Interrupted after {mirror.downloaded} download(s); the next run picks up from here")
+        return EXIT_INTERRUPTED
+
+    # the whole listing was worked through, so the next run only needs what changed from here on
+    state.set("since", str(started))
+    state.set("last_sync", str(time.time()))
+    print(f"{len(todo)} item(s) checked, {mirror.downloaded} file(s) downloaded, {mirror.failed} failed")
+    return EXIT_SOME_FAILED if incomplete else EXIT_OK
+
+
+def cycle_summary(state: MirrorState, args, cycle: Optional[int] = None) -> dict:
+    summary = {"collection": args.collection, "dest": args.dest, **state.totals()}
+    if cycle is not None:
+        summary["cycle"] = cycle
+    return summary
+
+
+def watch(state: MirrorState, args, stats_file: StatsFile, notifier: Notifier, db: Optional[ChecksumDB] = None) -> int:
+    """sync every --interval until a signal: each cycle looks for what changed since the one before.
+
+    A cycle that fails (the search is down, still rate limited, some files failed) is logged and the
+    next one tries again, so an outage costs a cycle and not the process. All that is kept from one
+    cycle to the next is in the state database.
+    """
+    cycle = 0
+    while True:
+        cycle += 1
+        started = time.time()
+        logging.info(f"Cycle {cycle} of {args.collection} starting")
+        stats_file.update(cycle=cycle)
+        code = sync(state, args, stats_file, db)
+        # --since and --full are for the first cycle; the later ones carry on from the state
+        args.since, args.full = None, False
+        if code == EXIT_INTERRUPTED or STOP.is_set():
+            logging.info(f"Stopped during cycle {cycle}; the next run picks up from here")
+            return EXIT_OK
+        totals = state.totals()
+        outcome = {EXIT_OK: "in sync", EXIT_SEARCH_FAILED: "search failed", EXIT_SOME_FAILED: "some items or files failed",
+                   EXIT_RATE_LIMITED: "rate limited"}.get(code, f"exit code {code}")
+        logging.info(f"Cycle {cycle} done in {time.time() - started:.0f}s: {outcome}; {totals['synced']} item(s) mirrored, "
+                     f"{totals['pending']} pending, {format_size(totals['bytes'])}; next cycle at {iso_time(time.time() + args.interval)}")
+        notifier.done(code, dict(cycle_summary(state, args, cycle), outcome=outcome))
+        # a signal sets STOP, which ends the wait at once
+        if STOP.wait(args.interval):
+            return EXIT_OK
+
+
+def status(state: MirrorState, args) -> int:
+    totals = state.totals()
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    results = SearchResults(session, collection_query(args.collection), ["identifier"], rows=1, max_pages=1)
+    try:
+        next(iter(results), None)
+    except (SearchError, requests.RequestException) as e:
+        logging.error(f"Could not search {args.collection}: {e}")
+        return EXIT_SEARCH_FAILED
+    live = results.num_found or 0
+    complete = f" ({totals['synced'] * 100 / live:.1f}%)" if live else ""
+    print(f"{args.collection}: {live} item(s) live, {totals['synced']} mirrored{complete}, "
+          f"{totals['pending']} pending, {totals['withdrawn']} withdrawn")
+    print(f"files: {totals['files']} ({format_size(totals['bytes'])})")
+    last = state.get("last_sync")
+    print(f"last sync: {iso_time(float(last)) if last else 'never finished'}")
+    return EXIT_OK if totals["pending"] == 0 and totals["synced"] >= live else EXIT_SOME_FAILED
+
+
+def since_time(value: str) -> datetime:
+    try:
+        return datetime.fromisoformat(value.replace("Z", "+00:00")).replace(tzinfo=timezone.utc)
+    except ValueError:
+        raise argparse.ArgumentTypeError(f"invalid date {value!r}, expected e.g. 2024-05-01 or 2024-05-01T12:00:00")
+
+
+def main():
+    common = argparse.ArgumentParser(add_help=False)
+    common.add_argument("--collection", "-c", required=True, help="Collection identifier to mirror")
+    common.add_argument("--dest", "-d", required=True, help=f"Mirror directory; one <identifier>/ per item and the state in {STATE_FILE}")
+    common.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    common.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    common.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    common.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(common)
+    add_transport_args(common)
+    add_auth_args(common)
+    common.add_argument("--log-file", help="Optional log file path")
+    common.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    common.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+
+    p = argparse.ArgumentParser(description="Keep a local mirror of an Internet Archive collection up to date")
+    commands = p.add_subparsers(dest="command", required=True)
+    s = commands.add_parser("sync", parents=[common], help="Download what is new or changed since the last run",
+                            epilog=GLOB_HELP, formatter_class=argparse.RawDescriptionHelpFormatter)
+    add_file_filter_args(s, "mirror")
+    s.add_argument("--since", type=since_time, help="Look for items changed since this date instead of since the last run")
+    s.add_argument("--full", action="store_true", help="Check every item of the collection, not only those changed since the last run")
+    s.add_argument("--drain", type=float, default=DRAIN_SECONDS, help="After Ctrl-C, seconds the transfers in flight get to finish before they are cut off, keeping their .part (default: 10; 0 to stop them at once)")
+    s.add_argument("--prune", action="store_true", help="Delete items that left the collection (or went dark) and files items no longer have")
+    s.add_argument("--sleep", type=float, default=1.0, help="Seconds between search pages")
+    s.add_argument("--dry-run", action="store_true", help="Print what would be downloaded or pruned; change nothing")
+    add_lock_args(s)
+    add_checksum_db_args(s)
+    s.add_argument("--watch", action="store_true", help="Keep running: sync again every --interval until SIGTERM or Ctrl-C")
+    s.add_argument("--interval", type=parse_duration, default=6 * 3600, help="With --watch, the wait after one cycle before the next, e.g. 30m or 6h (default: 6h)")
+    add_breaker_args(s)
+    add_stats_args(s)
+    add_notify_args(s)
+    commands.add_parser("status", parents=[common], help="Compare the mirror with the live collection")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.command == "sync":
+        check_file_filter_args(p, args)
+        if args.watch and args.dry_run:
+            p.error("--watch does not go with --dry-run")
+        if args.interval <= 0:
+            p.error("--interval must be more than 0")
+        check_breaker_args(p, args)
+        check_stats_args(p, args)
+        check_notify_args(p, args)
+    db = open_checksum_db(p, args) if args.command == "sync" else None
+
+    setup_logging(args.v, args.log_file, log_format=args.log_format)
+    lock = None
+    stats_file = StatsFile(None, 0, TOOL_NAME)
+    notifier = None
+    if args.command == "sync":
+        # the state is committed as it changes, so at a second Ctrl-C there are only the lock and --stats-file left
+        shutdown = Shutdown(args.drain).install()
+        if not args.dry_run:
+            # before the state is opened, so two syncs never share it; status and --dry-run only read
+            lock = lock_destination(args.dest, TOOL_NAME, args.lock_wait)
+            shutdown.on_exit(lock.release)
+            stats_file = StatsFile(args.stats_file, args.stats_interval, TOOL_NAME).start()
+            shutdown.on_exit(lambda: stats_file.finish(EXIT_INTERRUPTED))
+            # with --watch, each cycle is a run to notify about; the failures in a row are counted in --dest
+            notifier = Notifier(args, TOOL_NAME, args.user_agent or DEFAULT_USER_AGENT, args.dest).install(
+                lambda: {"collection": args.collection, "dest": args.dest})
+    try:
+        state = open_state(p, args, getattr(args, "dry_run", False))
+        try:
+            if args.command == "sync" and args.watch:
+                code = watch(state, args, stats_file, notifier, db)
+            elif args.command == "sync":
+                code = sync(state, args, stats_file, db)
+                if notifier:
+                    notifier.done(code, cycle_summary(state, args))
+            else:
+                code = status(state, args)
+        finally:
+            state.db.close()
+            if db is not None:
+                db.close()
+    finally:
+        if lock:
+            lock.release()
+    stats_file.finish(code)
+    sys.exit(code)
+
+
+if __name__ == "__main__":
+    main()
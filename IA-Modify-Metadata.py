@@ -0,0 +1,165 @@
+import argparse
+import json
+import logging
+import os
+import sys
+from typing import List, Optional, Tuple
+
+import requests
+
+from ia_common import (LOG_FORMATS, ArchiveError, add_ia_config_arg, add_transport_args, default_user_agent, fetch_metadata,
+                       metadata_pair, metadata_url, parse_args, raise_for_status, s3_credentials, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Modify-Metadata"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the item (or the file named by --target) could not be read
+EXIT_METADATA_ERROR = 2
+# archive.org refused the patch or the request failed
+EXIT_WRITE_FAILED = 3
+
+
+class Op(argparse.Action):
+    """Collects --set, --append and --remove in command-line order as (op, key, value)."""
+
+    def __call__(self, parser, namespace, values, option_string=None):
+        if self.dest == "remove":
+            key, value = values.lower(), None
+        else:
+            key, value = values
+        namespace.ops = (getattr(namespace, "ops", None) or []) + [(self.dest, key, value)]
+
+
+def pointer(key: str) -> str:
+    """The JSON Pointer (RFC 6901) for a top-level key."""
+    return "/" + key.replace("~", "~0").replace("/", "~1")
+
+
+def build_patch(current: dict, ops: List[Tuple[str, str, Optional[str]]]) -> List[dict]:
+    """A JSON Patch that turns current into what the --set/--append/--remove ops ask for.
+
+    set adds or replaces a key (and is left out when the value is already there), append adds a
+    value to a key's list, turning a single value into a list, and remove drops a key that exists.
+    """
+    state = dict(current)
+    patch = []
+    for op, key, value in ops:
+        path = pointer(key)
+        if op == "set":
+            if state.get(key) == value:
+                continue
+            patch.append({"op": "replace" if key in state else "add", "path": path, "value": value})
+            state[key] = value
+        elif op == "append":
+            old = state.get(key)
+            if isinstance(old, list):
+                patch.append({"op": "add", "path": f"{path}/-", "value": value})
+                state[key] = old + [value]
+            elif old is None:
+                patch.append({"op": "add", "path": path, "value": [value]})
+                state[key] = [value]
+            else:
+                patch.append({"op": "replace", "path": path, "value": [old, value]})
+                state[key] = [old, value]
+        elif key in state:
+            patch.append({"op": "remove", "path": path})
+            del state[key]
+        else:
+            logging.warning(f"--remove {key}: the key isn't there, nothing to remove")
+    return patch
+
+
+def target_metadata(item: dict, target: str) -> dict:
+    """The part of the /metadata response that --target names: "metadata" or "files/<name>"."""
+    if target == "metadata":
+        return item.get("metadata", {})
+    name = target[len("files/"):]
+    for f in item.get("files", []):
+        if f.get("name") == name:
+            return f
+    raise LookupError(f"the item has no file named {name!r}")
+
+
+def write_patch(session: requests.Session, identifier: str, target: str, patch: List[dict]) -> dict:
+    """POST the patch to the metadata write API and return its answer; raises when it is refused."""
+    keys = s3_credentials()
+    r = session.post(metadata_url(identifier), data={
+        "-target": target,
+        "-patch": json.dumps(patch),
+        "access": keys[0],
+        "secret": keys[1],
+    })
+    answer = None
+    try:
+        answer = r.json()
+    except ValueError:
+        pass
+    if not isinstance(answer, dict) or not answer.get("success"):
+        error = answer.get("error") if isinstance(answer, dict) else None
+        if error is None:
+            raise_for_status(r)
+        raise requests.HTTPError(f"archive.org refused the patch: {error or r.text[:300]}", response=r)
+    return answer
+
+
+def main():
+    p = argparse.ArgumentParser(description="Change an Internet Archive item's metadata through the metadata write API")
+    p.add_argument("identifier", help="Item identifier")
+    p.add_argument("--set", "-s", dest="set", action=Op, type=metadata_pair, metavar="KEY=VALUE", help="Set a key, replacing its value")
+    p.add_argument("--append", "-a", dest="append", action=Op, type=metadata_pair, metavar="KEY=VALUE",
+                   help="Add a value to a key's list (a single existing value becomes a list)")
+    p.add_argument("--remove", "-r", dest="remove", action=Op, metavar="KEY", help="Remove a key")
+    p.add_argument("--patch-file", help="Send this raw JSON Patch (a JSON array of operations) instead of --set/--append/--remove")
+    p.add_argument("--target", default="metadata", help="What to change: metadata (the default) or files/<name>")
+    p.add_argument("--dry-run", action="store_true", help="Print the patch and send nothing")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors (reads only; the write is sent once)")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_transport_args(p)
+    add_ia_config_arg(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    p.set_defaults(ops=[])
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if bool(args.ops) == bool(args.patch_file):
+        p.error("give --set/--append/--remove operations or --patch-file, not both or neither")
+    if args.target != "metadata" and not args.target.startswith("files/"):
+        p.error("--target must be metadata or files/<name>")
+    if not args.dry_run and not s3_credentials():
+        p.error("changing metadata needs IAS3 keys: set $IA_ACCESS_KEY and $IA_SECRET_KEY, or run `ia configure`")
+
+    setup_logging(args.v, args.log_file, log_format=args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+
+    if args.patch_file:
+        with open(args.patch_file, encoding="utf-8") as f:
+            patch = json.load(f)
+        if not isinstance(patch, list):
+            p.error(f"{args.patch_file} must hold a JSON array of patch operations")
+    else:
+        try:
+            current = target_metadata(fetch_metadata(session, args.identifier), args.target)
+        except (requests.RequestException, ValueError, LookupError) as e:
+            logging.error(str(e) if isinstance(e, (ArchiveError, LookupError)) else f"Could not fetch metadata for {args.identifier}: {e}")
+            sys.exit(EXIT_METADATA_ERROR)
+        patch = build_patch(current, args.ops)
+    if not patch:
+        print(f"{args.identifier}: nothing to change")
+        return
+    if args.dry_run:
+        print(f"-target: {args.target}")
+        print(json.dumps(patch, indent=2, ensure_ascii=False))
+        return
+
+    try:
+        answer = write_patch(session, args.identifier, args.target, patch)
+    except requests.RequestException as e:
+        logging.error(f"{args.identifier}: {e}")
+        sys.exit(EXIT_WRITE_FAILED)
+    print(f"{args.identifier}: {len(patch)} change(s) accepted" + (f", task {answer['task_id']} queued" if answer.get("task_id") else ""))
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,209 @@
+import argparse
+import json
+import logging
+import os
+import re
+import sys
+import time
+import xml.etree.ElementTree as ET
+from typing import Dict, Iterator, Optional, Tuple
+
+import requests
+
+from ia_common import (LOG_FORMATS, OAI_URL, RateLimited, add_auth_args, add_request_rate_args, add_transport_args, default_user_agent,
+                       parse_args, raise_for_status, session_from_args, setup_logging)
+from ia_download import safe_relpath
+
+TOOL_NAME = "IA-OAI-Harvest"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the endpoint failed or answered an OAI-PMH error other than noRecordsMatch
+EXIT_HARVEST_FAILED = 2
+# archive.org still answered 429 after the retries; --state lets the next run carry on
+EXIT_RATE_LIMITED = 7
+# Ctrl-C; --state lets the next run carry on
+EXIT_INTERRUPTED = 130
+NS = {"oai": "http://www.openarchives.org/OAI/2.0/", "oai_dc": "http://www.openarchives.org/OAI/2.0/oai_dc/",
+      "dc": "http://purl.org/dc/elements/1.1/"}
+# OAI-PMH dates: a day, or a UTC second
+OAI_DATE = re.compile(r"\d{4}-\d{2}-\d{2}(T\d{2}:\d{2}:\d{2}Z)?")
+
+
+class OAIError(RuntimeError):
+    """An <error> in the OAI-PMH answer; code is e.g. badArgument or badResumptionToken."""
+
+    def __init__(self, code: str, message: str):
+        super().__init__(f"{code}: {message}" if message else code)
+        self.code = code
+
+
+def oai_date(value: str) -> str:
+    """argparse type for --from/--until: YYYY-MM-DD or YYYY-MM-DDThh:mm:ssZ, as OAI-PMH takes them."""
+    if not OAI_DATE.fullmatch(value):
+        raise argparse.ArgumentTypeError(f"invalid date {value!r}, expected YYYY-MM-DD or YYYY-MM-DDThh:mm:ssZ")
+    return value
+
+
+def harvest_params(args) -> Dict[str, str]:
+    """The query of the first request; the later ones send only the resumption token."""
+    params = {"verb": args.verb, "metadataPrefix": args.metadata_prefix}
+    for key, value in (("set", args.set), ("from", args.from_), ("until", args.until)):
+        if value:
+            params[key] = value
+    return params
+
+
+def parse_header(header: ET.Element) -> dict:
+    return {
+        "identifier": header.findtext("oai:identifier", "", NS),
+        "datestamp": header.findtext("oai:datestamp", "", NS),
+        "sets": [s.text for s in header.findall("oai:setSpec", NS)],
+        "deleted": header.get("status") == "deleted",
+    }
+
+
+def parse_record(record: ET.Element) -> dict:
+    """A record's header fields and, for oai_dc, its Dublin Core elements as lists of values."""
+    header = record.find("oai:header", NS)
+    out = parse_header(header if header is not None else record)
+    dc = record.find("oai:metadata/oai_dc:dc", NS)
+    if dc is not None:
+        fields: Dict[str, list] = {}
+        for element in dc:
+            name = element.tag.rsplit("}", 1)[-1]
+            fields.setdefault(name, []).append((element.text or "").strip())
+        out["dc"] = fields
+    return out
+
+
+def pages(session: requests.Session, params: Dict[str, str], token: Optional[str] = None,
+          sleep: float = 0.0) -> Iterator[Tuple[ET.Element, Optional[str]]]:
+    """Each ListRecords/ListIdentifiers page with the resumption token of the page after it (None on the last).
+
+    With token, the harvest carries on from there instead of starting with params.
+    """
+    while True:
+        query = {"verb": params["verb"], "resumptionToken": token} if token else params
+        r = session.get(OAI_URL, params=query)
+        raise_for_status(r)
+        try:
+            root = ET.fromstring(r.content)
+        except ET.ParseError as e:
+            raise OAIError("badResponse", f"not OAI-PMH XML ({e}): {r.text[:200]}") from e
+        error = root.find("oai:error", NS)
+        if error is not None:
+            if error.get("code") == "noRecordsMatch":
+                return
+            raise OAIError(error.get("code", "unknown"), (error.text or "").strip())
+        page = root.find(f"oai:{params['verb']}", NS)
+        if page is None:
+            raise OAIError("badResponse", f"no {params['verb']} element in the answer")
+        token = (page.findtext("oai:resumptionToken", "", NS) or "").strip() or None
+        yield page, token
+        if not token:
+            return
+        if sleep:
+            time.sleep(sleep)
+
+
+def load_state(path: str, params: Dict[str, str]) -> Optional[str]:
+    """The stored resumption token, when the state file is for the same harvest."""
+    try:
+        with open(path, encoding="utf-8") as f:
+            state = json.load(f)
+    except FileNotFoundError:
+        return None
+    if state.get("params") != params:
+        raise ValueError(f"{path} is the state of another harvest ({state.get('params')}); remove it or use another --state")
+    return state.get("token")
+
+
+def save_state(path: str, params: Dict[str, str], token: Optional[str]):
+    if token is None:
+        # the harvest is complete, so the next run starts over
+        if os.path.exists(path):
+            os.remove(path)
+        return
+    tmp = path + ".tmp"
+    with open(tmp, "w", encoding="utf-8") as f:
+        json.dump({"params": params, "token": token, "saved": time.time()}, f)
+    os.replace(tmp, path)
+
+
+def record_file(out_dir: str, identifier: str) -> str:
+    """<out_dir>/<identifier>.xml, named by the part after oai:archive.org: when there is one."""
+    name = identifier.split("oai:archive.org:", 1)[-1]
+    return os.path.join(out_dir, safe_relpath(name.replace("/", "_")) + ".xml")
+
+
+def main():
+    p = argparse.ArgumentParser(description="Harvest archive.org's OAI-PMH endpoint, with resumption tokens")
+    p.add_argument("--verb", choices=["ListRecords", "ListIdentifiers"], default="ListRecords",
+                   help="Whole records (default) or just their headers")
+    p.add_argument("--set", help="Only this set, e.g. collection:prelinger or mediatype:texts")
+    p.add_argument("--from", dest="from_", type=oai_date, help="Records changed on or after this date (YYYY-MM-DD)")
+    p.add_argument("--until", type=oai_date, help="Records changed on or before this date")
+    p.add_argument("--metadata-prefix", default="oai_dc", help="Record format (default: oai_dc, which is parsed into fields)")
+    p.add_argument("--out-dir", help="Write each record's XML to <dir>/<identifier>.xml instead of NDJSON to stdout")
+    p.add_argument("--state", help="Keep the resumption token in this file, so an interrupted harvest carries on where it stopped")
+    p.add_argument("--resumption-token", help="Start from this resumption token")
+    p.add_argument("--sleep", type=float, default=1.0, help="Seconds between pages (default: 1)")
+    p.add_argument("--timeout", type=int, default=60, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+
+    # stdout may be for the records
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    params = harvest_params(args)
+    token = args.resumption_token
+    if args.state and not token:
+        try:
+            token = load_state(args.state, params)
+        except (OSError, ValueError) as e:
+            p.error(str(e))
+        if token:
+            logging.info(f"Carrying on from the resumption token in {args.state}")
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    if args.out_dir:
+        os.makedirs(args.out_dir, exist_ok=True)
+
+    count = 0
+    tag = "oai:record" if args.verb == "ListRecords" else "oai:header"
+    try:
+        for page, next_token in pages(session, params, token, args.sleep):
+            for element in page.findall(tag, NS):
+                record = parse_record(element) if args.verb == "ListRecords" else parse_header(element)
+                if args.out_dir:
+                    with open(record_file(args.out_dir, record["identifier"]), "wb") as f:
+                        f.write(ET.tostring(element, encoding="utf-8"))
+                else:
+                    print(json.dumps(record, ensure_ascii=False))
+                count += 1
+            sys.stdout.flush()
+            # after the page is written, so a run that stops never skips records
+            if args.state:
+                save_state(args.state, params, next_token)
+            logging.info(f"{count} record(s) so far" + (f"; resumption token {next_token}" if next_token else ""))
+    except KeyboardInterrupt:
+        logging.warning(f"Interrupted after {count} record(s)" + ("; run again with the same --state to carry on" if args.state else ""))
+        sys.exit(EXIT_INTERRUPTED)
+    except RateLimited as e:
+        logging.error(f"Still rate limited after the retries ({e})")
+        sys.exit(EXIT_RATE_LIMITED)
+    except (requests.RequestException, OAIError) as e:
+        logging.error(f"Harvest failed after {count} record(s): {e}")
+        sys.exit(EXIT_HARVEST_FAILED)
+    logging.info(f"{count} record(s) harvested")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,119 @@
+import argparse
+import csv
+import json
+import logging
+import os
+import sys
+from typing import List, Optional
+
+import requests
+
+from ia_common import (LOG_FORMATS, ArchiveError, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, fetch_metadata, parse_args, read_list, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Reviews"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# at least one identifier's reviews could not be read (not found, dark, or the request failed)
+EXIT_METADATA_ERROR = 2
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+COLUMNS = ("identifier", "reviewer", "date", "stars", "title", "body")
+STATS_COLUMNS = ("identifier", "count", "average_stars")
+
+
+def stars_of(review: dict) -> Optional[int]:
+    """The 0-5 rating; /metadata gives it as a string, and old reviews may have none."""
+    try:
+        return int(review.get("stars"))
+    except (TypeError, ValueError):
+        return None
+
+
+def review_rows(identifier: str, reviews: List[dict], min_stars: Optional[int] = None) -> List[dict]:
+    """The reviews of one item as rows with COLUMNS, oldest first; min_stars drops the lower rated and the unrated."""
+    rows = []
+    for review in reviews:
+        stars = stars_of(review)
+        if min_stars is not None and (stars is None or stars < min_stars):
+            continue
+        rows.append({
+            "identifier": identifier,
+            "reviewer": review.get("reviewer") or "",
+            "date": review.get("reviewdate") or review.get("createdate") or "",
+            "stars": stars,
+            "title": review.get("reviewtitle") or "",
+            "body": review.get("reviewbody") or "",
+        })
+    return sorted(rows, key=lambda r: r["date"])
+
+
+def item_stats(identifier: str, rows: List[dict]) -> dict:
+    rated = [r["stars"] for r in rows if r["stars"] is not None]
+    return {"identifier": identifier, "count": len(rows),
+            "average_stars": round(sum(rated) / len(rated), 2) if rated else None}
+
+
+def main():
+    parser = argparse.ArgumentParser(description="Print the reviews of Internet Archive items as JSON or CSV")
+    parser.add_argument("identifiers", nargs="*", help="Item identifiers (default: read from --identifiers-file or stdin)")
+    parser.add_argument("--identifiers-file", "-f", help="File with one identifier per line ('-' for stdin)")
+    parser.add_argument("--format", choices=["json", "csv"], default="json", help="A JSON array (default), or CSV with a header row")
+    parser.add_argument("--min-stars", type=int, choices=range(0, 6), metavar="0-5", help="Only reviews with at least this many stars")
+    parser.add_argument("--stats", action="store_true", help="Instead of the reviews, print each item's review count and average stars")
+    parser.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    parser.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    parser.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    parser.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(parser)
+    add_transport_args(parser)
+    add_auth_args(parser)
+    parser.add_argument("--log-file", help="Optional log file path")
+    parser.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    parser.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(parser, __file__, version=TOOL_VERSION)
+
+    identifiers = list(read_list(args.identifiers, args.identifiers_file))
+    if not identifiers:
+        parser.error("give identifiers as arguments, with --identifiers-file, or on stdin")
+
+    # stdout is for the reviews
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+
+    results = []
+    failed = 0
+    rate_limited = False
+    for identifier in identifiers:
+        try:
+            metadata = fetch_metadata(session, identifier)
+        except RateLimited as e:
+            logging.error(f"{identifier}: still rate limited after the retries ({e})")
+            failed += 1
+            rate_limited = True
+            continue
+        except ArchiveError as e:
+            logging.error(str(e) if e.kind in ("not_found", "dark") else f"{identifier}: {e}")
+            failed += 1
+            continue
+        except (requests.RequestException, ValueError) as e:
+            logging.error(f"Could not fetch metadata for {identifier}: {e}")
+            failed += 1
+            continue
+        rows = review_rows(identifier, metadata.get("reviews") or [], args.min_stars)
+        results.extend([item_stats(identifier, rows)] if args.stats else rows)
+
+    if args.format == "csv":
+        writer = csv.DictWriter(sys.stdout, fieldnames=STATS_COLUMNS if args.stats else COLUMNS, lineterminator="\n")
+        writer.writeheader()
+        writer.writerows(results)
+    else:
+        print(json.dumps(results, indent=2, ensure_ascii=False))
+    if rate_limited:
+        sys.exit(EXIT_RATE_LIMITED)
+    sys.exit(EXIT_METADATA_ERROR if failed else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
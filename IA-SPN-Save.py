@@ -0,0 +1,217 @@
+import argparse
+import json
+import logging
+import os
+import sys
+import threading
+import time
+from concurrent.futures import ThreadPoolExecutor
+from typing import Dict, Optional
+
+import requests
+
+from ia_common import (LOG_FORMATS, WAYBACK_URL, RateLimited, add_ia_config_arg, add_request_rate_args, add_transport_args,
+                       default_user_agent, parse_args, parse_duration, raise_for_status, read_list, retry_call, s3_credentials,
+                       session_from_args, setup_logging)
+
+TOOL_NAME = "IA-SPN-Save"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# some URLs were not saved; each one's line says why
+EXIT_SOME_FAILED = 3
+# every URL failed
+EXIT_ALL_FAILED = 4
+# the daily capture quota is used up, or archive.org still answered 429 after the retries
+EXIT_RATE_LIMITED = 7
+# SPN answers that mean "not now" rather than "not this URL": wait and submit again
+BUSY = ("error:user-session-limit", "error:concurrency-limit", "error:too-many-requests")
+# after this one nothing more is accepted today
+DAILY_LIMIT = "error:too-many-daily-captures"
+
+
+class SPNError(Exception):
+    """SPN turned a URL down; status_ext is its machine-readable reason, e.g. error:blocked-url."""
+
+    def __init__(self, status_ext: str, message: str = ""):
+        super().__init__(f"{status_ext}: {message}" if message else status_ext)
+        self.status_ext = status_ext
+        self.message = message
+
+
+def capture_options(args) -> Dict[str, str]:
+    """The SPN2 form fields for the capture flags given."""
+    options = {}
+    if args.capture_outlinks:
+        options["capture_outlinks"] = "1"
+    if args.capture_screenshot:
+        options["capture_screenshot"] = "1"
+    if args.capture_all:
+        options["capture_all"] = "1"
+    if args.if_not_archived_within:
+        options["if_not_archived_within"] = f"{int(args.if_not_archived_within)}s"
+    return options
+
+
+def snapshot_url(timestamp: str, original: str) -> str:
+    return f"{WAYBACK_URL}/web/{timestamp}/{original}"
+
+
+class SavePageNow:
+    """The SPN2 API: submit a capture job, then poll its status until it is done.
+
+    The session signs the requests with the IAS3 keys, which SPN2 requires.
+    """
+
+    def __init__(self, session: requests.Session, retries: int = 5, backoff: float = 1.0, poll: float = 5.0,
+                 wait: float = 600.0):
+        self.session = session
+        self.retries = retries
+        self.backoff = backoff
+        self.poll = poll
+        self.wait = wait
+        # set once the daily quota is used up, so the URLs still queued aren't submitted in vain
+        self.exhausted = threading.Event()
+
+    def request(self, method: str, url: str, **kwargs) -> dict:
+        """One SPN request and its JSON. The submission is a POST, which the session does not retry, so the retries are here."""
+        def once(attempt: int) -> dict:
+            r = self.session.request(method, url, headers={"Accept": "application/json"}, **kwargs)
+            raise_for_status(r)
+            return r.json()
+
+        # the session already retried a GET
+        return retry_call(once, 0 if method == "GET" else self.retries, self.backoff, method, url)
+
+    def available(self) -> Optional[int]:
+        """How many more captures the account may have in progress right now, when SPN says."""
+        try:
+            return self.request("GET", f"{WAYBACK_URL}/save/status/user").get("available")
+        except (requests.RequestException, ValueError) as e:
+            logging.debug(f"Could not read the SPN quota: {e}")
+            return None
+
+    def submit(self, url: str, options: Dict[str, str]) -> str:
+        """Start a capture and return its job id, waiting while the account has as many captures running as SPN allows."""
+        deadline = time.time() + self.wait
+        while True:
+            if self.exhausted.is_set():
+                raise SPNError(DAILY_LIMIT, "the daily capture quota is used up")
+            answer = self.request("POST", f"{WAYBACK_URL}/save", data=dict(options, url=url))
+            if answer.get("job_id"):
+                return answer["job_id"]
+            status_ext = answer.get("status_ext") or "error:unknown"
+            if status_ext == DAILY_LIMIT:
+                self.exhausted.set()
+            if status_ext not in BUSY or time.time() + self.poll > deadline:
+                raise SPNError(status_ext, answer.get("message", ""))
+            logging.info(f"{url}: {status_ext}; submitting again in {self.poll:g}s")
+            time.sleep(self.poll)
+
+    def save(self, url: str, options: Dict[str, str]) -> dict:
+        """Capture url and return its result line: status success or error, with the snapshot URL or the reason."""
+        result = {"url": url}
+        try:
+            job_id = self.submit(url, options)
+            result["job_id"] = job_id
+            deadline = time.time() + self.wait
+            while True:
+                job = self.request("GET", f"{WAYBACK_URL}/save/status/{job_id}")
+                if job.get("status") != "pending":
+                    break
+                if time.time() + self.poll > deadline:
+                    raise SPNError("error:timeout", f"still pending after {self.wait:g}s")
+                time.sleep(self.poll)
+        except SPNError as e:
+            return dict(result, status="error", status_ext=e.status_ext, message=e.message)
+        except requests.RequestException as e:
+            if isinstance(e, RateLimited):
+                self.exhausted.set()
+            return dict(result, status="error", status_ext="error:request-failed", message=str(e))
+        except ValueError as e:
+            return dict(result, status="error", status_ext="error:bad-answer", message=str(e))
+        if job.get("status") != "success":
+            return dict(result, status="error", status_ext=job.get("status_ext") or "error:unknown", message=job.get("message", ""))
+        original = job.get("original_url") or url
+        result.update(status="success", timestamp=job.get("timestamp"), snapshot=snapshot_url(job.get("timestamp"), original))
+        for key in ("outlinks", "screenshot"):
+            if job.get(key):
+                result[key] = job[key]
+        return result
+
+
+def main():
+    p = argparse.ArgumentParser(description="Capture web pages in the Wayback Machine with Save Page Now (SPN2)",
+                                epilog="exit codes: 0 all saved, 3 some failed, 4 all failed, 7 rate limited or daily quota used up")
+    p.add_argument("urls", nargs="*", help="URLs to save (default: --urls-file, else one per line on stdin)")
+    p.add_argument("--urls-file", help='File with one URL per line ("-" for stdin); # starts a comment')
+    p.add_argument("--capture-outlinks", action="store_true", help="Also capture the pages the page links to")
+    p.add_argument("--capture-screenshot", action="store_true", help="Also take a screenshot of the page")
+    p.add_argument("--capture-all", action="store_true", help="Keep the capture when the page answers with an error (4xx/5xx)")
+    p.add_argument("--if-not-archived-within", type=parse_duration, metavar="DURATION",
+                   help="Skip URLs captured more recently than this, e.g. 30m or 24h (the last capture is reported)")
+    p.add_argument("--concurrency", type=int, default=2, help="Captures in progress at a time (default: 2); lowered to what SPN says the account may have")
+    p.add_argument("--poll", type=float, default=5.0, help="Seconds between job status checks (default: 5)")
+    p.add_argument("--wait", type=parse_duration, default=600.0, help="Give up on a capture after this long (default: 10m)")
+    p.add_argument("--format", choices=["ndjson", "text"], default="ndjson",
+                   help="One JSON line per URL (default), or just the snapshot URLs, failures going to the log")
+    p.add_argument("--timeout", type=int, default=60, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_ia_config_arg(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.concurrency < 1:
+        p.error("--concurrency must be at least 1")
+    urls = list(read_list(args.urls, args.urls_file))
+    if not urls:
+        p.error("give URLs as arguments, with --urls-file, or on stdin")
+    if s3_credentials() is None:
+        p.error("Save Page Now needs your IAS3 keys: set $IA_ACCESS_KEY and $IA_SECRET_KEY, or run `ia configure`")
+
+    # stdout is for the results
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    spn = SavePageNow(session_from_args(args, DEFAULT_USER_AGENT), args.retries, args.backoff, args.poll, args.wait)
+    workers = args.concurrency
+    available = spn.available()
+    if available is not None and 0 < available < workers:
+        logging.info(f"SPN allows {available} capture(s) in progress for this account right now; running that many")
+        workers = available
+
+    lock = threading.Lock()
+    saved = failed = 0
+
+    def save(url: str):
+        nonlocal saved, failed
+        result = spn.save(url, capture_options(args))
+        with lock:
+            if result["status"] == "success":
+                saved += 1
+            else:
+                failed += 1
+                if args.format == "text":
+                    logging.error(f"{url}: not saved ({result['status_ext']}{': ' + result['message'] if result.get('message') else ''})")
+            if args.format == "ndjson":
+                print(json.dumps(result, ensure_ascii=False), flush=True)
+            elif result["status"] == "success":
+                print(result["snapshot"], flush=True)
+
+    with ThreadPoolExecutor(max_workers=workers) as pool:
+        for future in [pool.submit(save, url) for url in urls]:
+            future.result()
+
+    logging.info(f"{saved} saved, {failed} failed")
+    if spn.exhausted.is_set():
+        sys.exit(EXIT_RATE_LIMITED)
+    if failed:
+        sys.exit(EXIT_ALL_FAILED if not saved else EXIT_SOME_FAILED)
+    sys.exit(EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
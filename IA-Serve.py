@@ -0,0 +1,303 @@
+import argparse
+import html
+import logging
+import os
+import sys
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from typing import Dict, List, Optional, Tuple
+from urllib.parse import parse_qs, quote, unquote, urlencode, urlsplit
+
+import requests
+
+from ia_catalog import load_catalog
+from ia_common import (LOG_FORMATS, add_auth_args, add_request_rate_args, add_transport_args, default_user_agent, details_url,
+                       download_url, format_size, parse_args, parse_size, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Serve"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the address could not be listened on
+EXIT_LISTEN_FAILED = 2
+SORTS = ("name", "size", "date")
+# where a catalog keeps an entry's date, by the tool that wrote it
+DATE_FIELDS = ("date", "publicdate", "mtime", "addeddate")
+# what --relay passes on from archive.org's answer to a file request
+RELAYED_HEADERS = ("Content-Length", "Content-Range", "Accept-Ranges", "Content-Type", "Last-Modified", "ETag")
+RELAY_CHUNK = 256 * 1024
+
+PAGE = """<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{title}</title>
+<style>
+body {{ font-family: sans-serif; margin: 1.5em; }}
+form {{ margin-bottom: 1em; }}
+table {{ border-collapse: collapse; width: 100%; }}
+th, td {{ text-align: left; padding: 0.25em 0.6em; border-bottom: 1px solid #ddd; }}
+th a {{ color: inherit; }}
+td.size {{ text-align: right; white-space: nowrap; }}
+tr:hover {{ background: #f4f4f4; }}
+.nav {{ margin: 1em 0; }}
+</style>
+</head>
+<body>
+<h1>{title}</h1>
+<form method="get" action="/">
+<input type="search" name="q" value="{q}" placeholder="identifier, file or title" autofocus>
+<select name="ext"><option value="">any extension</option>{extensions}</select>
+{collections}
+<input type="hidden" name="sort" value="{sort}"><input type="hidden" name="order" value="{order}">
+<button type="submit">Filter</button>
+</form>
+<p>{summary}</p>
+<table>
+<thead><tr><th>{th_name}</th><th>File</th><th>{th_size}</th><th>{th_date}</th></tr></thead>
+<tbody>
+{rows}
+</tbody>
+</table>
+<p class="nav">{nav}</p>
+</body>
+</html>
+"""
+
+
+def listen_address(value: str) -> Tuple[str, int]:
+    """argparse type for --listen: host:port, or :port for every interface."""
+    host, sep, port = value.rpartition(":")
+    if not sep or not port.isdigit() or not 0 <= int(port) <= 65535:
+        raise argparse.ArgumentTypeError(f"invalid address {value!r}, expected host:port or :port, e.g. :8080")
+    return host.strip("[]"), int(port)
+
+
+def extension(name: str) -> str:
+    return os.path.splitext(name)[1].lower().lstrip(".")
+
+
+def entry_date(entry: dict) -> str:
+    for field in DATE_FIELDS:
+        value = entry.get(field)
+        if isinstance(value, list):
+            value = value[0] if value else None
+        if value not in (None, ""):
+            return str(value)
+    return ""
+
+
+def collections_of(entry: dict) -> List[str]:
+    value = entry.get("collection")
+    if isinstance(value, list):
+        return [str(v) for v in value]
+    return [str(value)] if value else []
+
+
+class Index:
+    """The catalog's entries, with what the page filters and sorts them by worked out once."""
+
+    def __init__(self, entries: List[dict]):
+        self.entries = [e for e in entries if e.get("identifier") and e.get("file_name")]
+        self.by_key: Dict[Tuple[str, str], dict] = {(str(e["identifier"]), str(e["file_name"])): e for e in self.entries}
+        self.extensions = sorted({extension(str(e["file_name"])) for e in self.entries} - {""})
+        self.collections = sorted({c for e in self.entries for c in collections_of(e)})
+
+    def select(self, q: str = "", ext: str = "", collection: str = "", sort: str = "name", descending: bool = False) -> List[dict]:
+        q = q.lower()
+        found = [e for e in self.entries
+                 if (not q or any(q in str(e.get(f) or "").lower() for f in ("identifier", "file_name", "title")))
+                 and (not ext or extension(str(e["file_name"])) == ext)
+                 and (not collection or collection in collections_of(e))]
+        if sort == "size":
+            # entries without a size go last either way
+            sized = sorted((e for e in found if parse_size(e.get("size")) is not None), key=lambda e: parse_size(e.get("size")),
+                           reverse=descending)
+            return sized + [e for e in found if parse_size(e.get("size")) is None]
+        if sort == "date":
+            dated = sorted((e for e in found if entry_date(e)), key=entry_date, reverse=descending)
+            return dated + [e for e in found if not entry_date(e)]
+        return sorted(found, key=lambda e: (str(e["identifier"]), str(e["file_name"])), reverse=descending)
+
+
+def file_link(entry: dict, relay: bool) -> str:
+    if relay:
+        return f"/files/{quote(str(entry['identifier']), safe='')}/{quote(str(entry['file_name']))}"
+    return str(entry.get("download_url") or download_url(str(entry["identifier"]), str(entry["file_name"])))
+
+
+def render_page(index: Index, params: Dict[str, str], title: str, relay: bool, page_size: int) -> str:
+    """The HTML table of the entries params (q, ext, collection, sort, order, page) select, as one page of page_size rows."""
+    q, ext, collection = params.get("q", ""), params.get("ext", ""), params.get("collection", "")
+    sort = params.get("sort") if params.get("sort") in SORTS else "name"
+    order = "desc" if params.get("order") == "desc" else "asc"
+    page = int(params["page"]) if params.get("page", "").isdigit() and int(params["page"]) > 0 else 1
+    found = index.select(q, ext, collection, sort, order == "desc")
+    shown = found[(page - 1) * page_size:page * page_size]
+
+    def link(**changes) -> str:
+        query = {k: v for k, v in dict({"q": q, "ext": ext, "collection": collection, "sort": sort, "order": order}, **changes).items() if v}
+        return "/?" + urlencode(query)
+
+    def heading(label: str, key: str) -> str:
+        # a second click on the column sorts the other way
+        flip = "desc" if sort == key and order == "asc" else "asc"
+        arrow = (" ▲" if order == "asc" else " ▼") if sort == key else ""
+        return f'<a href="{html.escape(link(sort=key, order=flip))}">{label}{arrow}</a>'
+
+    def option(value: str, selected: str) -> str:
+        mark = " selected" if value == selected else ""
+        return f'<option value="{html.escape(value)}"{mark}>{html.escape(value)}</option>'
+
+    rows = []
+    for e in shown:
+        identifier, name = str(e["identifier"]), str(e["file_name"])
+        item_title = f' title="{html.escape(str(e["title"]))}"' if e.get("title") else ""
+        rows.append(f'<tr><td><a href="{html.escape(details_url(identifier))}"{item_title}>{html.escape(identifier)}</a></td>'
+                    f'<td><a href="{html.escape(file_link(e, relay))}">{html.escape(name)}</a></td>'
+                    f'<td class="size">{format_size(parse_size(e.get("size"))) if parse_size(e.get("size")) is not None else ""}</td>'
+                    f"<td>{html.escape(entry_date(e))}</td></tr>")
+    collections = ""
+    if index.collections:
+        collections = ('<select name="collection"><option value="">any collection</option>'
+                       + "".join(option(c, collection) for c in index.collections) + "</select>")
+    total_bytes = sum(parse_size(e.get("size")) or 0 for e in found)
+    nav = []
+    if page > 1:
+        nav.append(f'<a href="{html.escape(link(page=str(page - 1)))}">← previous</a>')
+    if page * page_size < len(found):
+        nav.append(f'<a href="{html.escape(link(page=str(page + 1)))}">next →</a>')
+    first = (page - 1) * page_size + 1 if shown else 0
+    summary = (f"{len(found)} of {len(index.entries)} file(s), {format_size(total_bytes)}; "
+               f"showing {first}–{first + len(shown) - 1 if shown else 0}")
+    return PAGE.format(title=html.escape(title), q=html.escape(q), sort=sort, order=order,
+                       extensions="".join(option(x, ext) for x in index.extensions), collections=collections,
+                       summary=summary, th_name=heading("Identifier", "name"), th_size=heading("Size", "size"),
+                       th_date=heading("Date", "date"), rows="\n".join(rows) or '<tr><td colspan="4">Nothing matches.</td></tr>',
+                       nav=" · ".join(nav))
+
+
+class Handler(BaseHTTPRequestHandler):
+    """The page at /, and with --relay each catalog file at /files/<identifier>/<file_name>."""
+
+    server_version = f"{TOOL_NAME}/{TOOL_VERSION}"
+
+    def do_GET(self):
+        self.respond(head=False)
+
+    def do_HEAD(self):
+        self.respond(head=True)
+
+    def respond(self, head: bool):
+        url = urlsplit(self.path)
+        if url.path == "/":
+            params = {k: v[0] for k, v in parse_qs(url.query).items()}
+            body = render_page(self.server.index, params, self.server.title, self.server.relay, self.server.page_size).encode("utf-8")
+            self.send_response(200)
+            self.send_header("Content-Type", "text/html; charset=utf-8")
+            self.send_header("Content-Length", str(len(body)))
+            self.end_headers()
+            if not head:
+                self.wfile.write(body)
+            return
+        if self.server.relay and url.path.startswith("/files/"):
+            identifier, _, name = url.path[len("/files/"):].partition("/")
+            entry = self.server.index.by_key.get((unquote(identifier), unquote(name)))
+            if entry is not None:
+                self.relay(entry, head)
+                return
+        self.send_error(404, "Not in the catalog")
+
+    def relay(self, entry: dict, head: bool):
+        """Stream the file from archive.org, passing a Range request on, so downloads can resume through the server too."""
+        url = file_link(entry, relay=False)
+        # identity, so the bytes passed on are the file's and match its Content-Length
+        headers = {"Accept-Encoding": "identity"}
+        if self.headers.get("Range"):
+            headers["Range"] = self.headers["Range"]
+        try:
+            upstream = self.server.session.request("HEAD" if head else "GET", url, headers=headers, stream=True, allow_redirects=True)
+        except requests.RequestException as e:
+            logging.error(f"{entry['identifier']}/{entry['file_name']}: {e}")
+            self.send_error(502, "archive.org could not be reached")
+            return
+        with upstream:
+            self.send_response(upstream.status_code)
+            for name in RELAYED_HEADERS:
+                if upstream.headers.get(name):
+                    self.send_header(name, upstream.headers[name])
+            self.end_headers()
+            if head:
+                return
+            try:
+                for chunk in upstream.iter_content(chunk_size=RELAY_CHUNK):
+                    self.wfile.write(chunk)
+            except (BrokenPipeError, ConnectionResetError):
+                # the client went away; so does the request to archive.org
+                logging.debug(f"{entry['identifier']}/{entry['file_name']}: the client closed the connection")
+            except requests.RequestException as e:
+                logging.error(f"{entry['identifier']}/{entry['file_name']}: cut off from archive.org: {e}")
+                self.close_connection = True
+
+    def log_message(self, format, *args):
+        logging.info(f"{self.client_address[0]} {format % args}")
+
+
+def make_server(address: Tuple[str, int], index: Index, session: Optional[requests.Session], title: str, relay: bool,
+                page_size: int) -> ThreadingHTTPServer:
+    server = ThreadingHTTPServer(address, Handler)
+    server.daemon_threads = True
+    server.index, server.session, server.title, server.relay, server.page_size = index, session, title, relay, page_size
+    return server
+
+
+def main():
+    p = argparse.ArgumentParser(description="Browse a file catalog (the search tool's JSON, or any format IA-Convert.py reads) "
+                                            "as a web page: search, sort and filter, with links to archive.org or through this server")
+    p.add_argument("--input", "-i", required=True, help="The catalog to serve")
+    p.add_argument("--listen", "-l", type=listen_address, default="127.0.0.1:8080",
+                   help="Address to serve on, host:port or :port for every interface (default: 127.0.0.1:8080)")
+    p.add_argument("--relay", action="store_true", help="Link the files through this server, which fetches them from archive.org "
+                                                        "(with Range, so downloads resume), for machines that can't reach it")
+    p.add_argument("--title", help="Page title (default: the catalog's file name)")
+    p.add_argument("--page-size", type=int, default=200, help="Rows per page (default: 200)")
+    p.add_argument("--timeout", type=int, default=60, help="Request timeout seconds, for --relay")
+    p.add_argument("--retries", type=int, default=3, help="HTTP retries for transient errors, for --relay")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.page_size < 1:
+        p.error("--page-size must be at least 1")
+    try:
+        catalog, fmt = load_catalog(args.input)
+    except (OSError, ValueError) as e:
+        p.error(f"could not read {args.input}: {e}")
+
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    index = Index(catalog.entries)
+    logging.info(f"{len(index.entries)} file(s) from {args.input} ({fmt})")
+    session = session_from_args(args, DEFAULT_USER_AGENT) if args.relay else None
+    try:
+        server = make_server(args.listen, index, session, args.title or os.path.basename(args.input), args.relay, args.page_size)
+    except OSError as e:
+        logging.error(f"Could not listen on {args.listen[0] or '*'}:{args.listen[1]}: {e}")
+        sys.exit(EXIT_LISTEN_FAILED)
+    host, port = server.server_address[:2]
+    print(f"Serving {len(index.entries)} file(s) on http://{host if args.listen[0] else 'localhost'}:{port}/ (Ctrl-C to stop)",
+          file=sys.stderr)
+    try:
+        server.serve_forever()
+    except KeyboardInterrupt:
+        pass
+    finally:
+        server.server_close()
+    sys.exit(EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
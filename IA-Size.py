@@ -0,0 +1,170 @@
+import argparse
+import json
+import logging
+import os
+import sys
+import threading
+from concurrent.futures import ThreadPoolExecutor
+from typing import Dict, List
+
+import requests
+
+from ia_common import (GLOB_HELP, LOG_FORMATS, ArchiveError, RateLimited, SearchError, add_auth_args, add_file_filter_args,
+                       add_request_rate_args, add_transport_args, check_file_filter_args, collection_members, default_user_agent,
+                       fetch_metadata, format_size, parse_args, parse_size, read_list, select_files, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Size"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# some items could not be read (not found, dark, or the request failed), so the total leaves them out
+EXIT_METADATA_ERROR = 2
+# a collection could not be searched
+EXIT_SEARCH_FAILED = 4
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+
+
+class Tally:
+    """File counts and bytes, overall and by format and by source, of the files selected so far."""
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.items: Dict[str, dict] = {}
+        self.total = {"files": 0, "size": 0, "unknown_size": 0}
+        self.by_format: Dict[str, dict] = {}
+        self.by_source: Dict[str, dict] = {}
+
+    def add(self, identifier: str, files: List[dict]):
+        with self.lock:
+            item = self.items[identifier] = {"files": 0, "size": 0, "unknown_size": 0}
+            for f in files:
+                size = parse_size(f.get("size"))
+                groups = (item, self.total,
+                          self.by_format.setdefault(f.get("format") or "(none)", {"files": 0, "size": 0}),
+                          self.by_source.setdefault(f.get("source") or "(none)", {"files": 0, "size": 0}))
+                for group in groups:
+                    group["files"] += 1
+                    group["size"] += size or 0
+                if size is None:
+                    item["unknown_size"] += 1
+                    self.total["unknown_size"] += 1
+
+    def report(self, failed: List[str]) -> dict:
+        def ranked(groups: Dict[str, dict]) -> Dict[str, dict]:
+            return dict(sorted(groups.items(), key=lambda kv: -kv[1]["size"]))
+
+        return {"items": len(self.items), "total": self.total, "by_format": ranked(self.by_format),
+                "by_source": ranked(self.by_source), "per_item": dict(sorted(self.items.items())), "failed": failed}
+
+
+def print_breakdown(title: str, groups: Dict[str, dict]):
+    print(f"{title}:")
+    width = max(len(name) for name in groups)
+    for name, group in groups.items():
+        print(f"  {name.ljust(width)}  {format_size(group['size']).rjust(10)}  {group['files']} file(s)")
+
+
+def print_report(report: dict, per_item: bool):
+    total = report["total"]
+    line = f"{report['items']} item(s), {total['files']} file(s), {format_size(total['size'])}"
+    if total["unknown_size"]:
+        line += f" ({total['unknown_size']} file(s) without a size in metadata, not counted)"
+    print(line)
+    if report["by_format"]:
+        print_breakdown("by format", report["by_format"])
+        print_breakdown("by source", report["by_source"])
+    if per_item:
+        print_breakdown("by item", report["per_item"])
+    if report["failed"]:
+        print(f"{len(report['failed'])} item(s) could not be read and are not counted: {', '.join(report['failed'])}")
+
+
+def main():
+    p = argparse.ArgumentParser(description="Add up the file sizes of Internet Archive items or collections, with the filters Download-Collections-v2.py uses",
+                                epilog=GLOB_HELP, formatter_class=argparse.RawDescriptionHelpFormatter)
+    p.add_argument("identifiers", nargs="*", help="Item identifiers (default: --identifiers-file, or stdin unless --collection is given)")
+    p.add_argument("--identifiers-file", "-f", help="File with one identifier per line ('-' for stdin)")
+    p.add_argument("--collection", "-c", action="append", default=[], help="Also every item of this collection (repeatable)")
+    p.add_argument("--recursive", "-r", action="store_true", help="With --collection, also the items of its sub-collections, and theirs")
+    add_file_filter_args(p, "count")
+    p.add_argument("--per-item", action="store_true", help="Also print each item's size")
+    p.add_argument("--json", action="store_true", help="Print the totals and breakdowns as JSON")
+    p.add_argument("--workers", type=int, default=4, help="Item metadata requests at a time (default: 4)")
+    p.add_argument("--sleep", type=float, default=1.0, help="Seconds between search result pages")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    check_file_filter_args(p, args)
+    if args.workers < 1:
+        p.error("--workers must be at least 1")
+    # stdin only when nothing else says what to count
+    identifiers = list(read_list(args.identifiers, args.identifiers_file)) if args.identifiers or args.identifiers_file or not args.collection else []
+    if not identifiers and not args.collection:
+        p.error("give identifiers as arguments, with --identifiers-file or on stdin, or --collection")
+
+    # stdout is for the report
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    for collection in args.collection:
+        try:
+            found = [doc["identifier"] for doc in collection_members(session, collection, recursive=args.recursive, sleep=args.sleep)]
+        except (SearchError, requests.RequestException) as e:
+            logging.error(f"Could not search {collection}: {e}")
+            sys.exit(EXIT_SEARCH_FAILED)
+        logging.info(f"{collection}: {len(found)} item(s)")
+        identifiers += [i for i in found if i not in identifiers]
+
+    tally = Tally()
+    failed: List[str] = []
+    rate_limited = threading.Event()
+
+    def count(identifier: str):
+        # list.append is atomic, so the workers share failed without a lock
+        if rate_limited.is_set():
+            failed.append(identifier)
+            return
+        try:
+            metadata = fetch_metadata(session, identifier)
+        except RateLimited as e:
+            logging.error(f"{identifier}: still rate limited after the retries ({e}); the items left are not counted")
+            rate_limited.set()
+            failed.append(identifier)
+            return
+        except ArchiveError as e:
+            logging.error(str(e) if e.kind in ("not_found", "dark") else f"{identifier}: {e}")
+            failed.append(identifier)
+            return
+        except (requests.RequestException, ValueError) as e:
+            logging.error(f"Could not fetch metadata for {identifier}: {e}")
+            failed.append(identifier)
+            return
+        files, _ = select_files(metadata.get("files", []), args, identifier)
+        tally.add(identifier, files)
+
+    with ThreadPoolExecutor(max_workers=args.workers) as pool:
+        for future in [pool.submit(count, identifier) for identifier in identifiers]:
+            future.result()
+
+    report = tally.report(sorted(failed))
+    if args.json:
+        if not args.per_item:
+            del report["per_item"]
+        print(json.dumps(report, indent=2, ensure_ascii=False))
+    else:
+        print_report(report, args.per_item)
+    if rate_limited.is_set():
+        sys.exit(EXIT_RATE_LIMITED)
+    sys.exit(EXIT_METADATA_ERROR if failed else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,233 @@
+import argparse
+import json
+import logging
+import os
+import sys
+import threading
+from concurrent.futures import ThreadPoolExecutor
+from typing import Dict, Iterator, List, Optional, Set
+
+import requests
+
+from ia_catalog import iter_entries
+from ia_common import (LOG_FORMATS, ArchiveError, RateLimited, ScrapeResults, SearchError, add_auth_args, add_request_rate_args,
+                       add_transport_args, default_user_agent, fetch_metadata, format_size, int_value, parse_args, parse_size,
+                       session_from_args, setup_logging, text_values)
+
+TOOL_NAME = "IA-Stats"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# with --sizes metadata, some items could not be read (not found, dark, or the request failed) and are not counted
+EXIT_METADATA_ERROR = 2
+# the search failed
+EXIT_SEARCH_FAILED = 4
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+GROUPS = ("year", "mediatype", "collection", "format")
+SIZES = ("item_size", "metadata")
+# the search fields each grouping reads; year falls back to the year of date
+GROUP_FIELDS = {"year": ["year", "date"], "mediatype": ["mediatype"], "collection": ["collection"], "format": []}
+# the group of items (or files) without a value for the field grouped by
+UNKNOWN = "(none)"
+
+
+def group_keys(record: dict, group: str) -> List[str]:
+    """The groups a search doc, catalog entry or file belongs to; one per value of a repeated field such as collection."""
+    if group == "year":
+        year = int_value(record.get("year"))
+        if year is None:
+            year = int_value(record.get("date"))
+        return [str(year)] if year is not None else [UNKNOWN]
+    return list(dict.fromkeys(text_values(record.get(group)))) or [UNKNOWN]
+
+
+class Stats:
+    """Items and bytes, overall and per group, of the records added so far.
+
+    A record is an item with its size, or one of its files: an item counts once in each group any of
+    its records is in, and once in the totals, while every record's bytes are added to each of its groups.
+    """
+
+    def __init__(self, group: str):
+        self.group = group
+        self.lock = threading.Lock()
+        self.identifiers: Set[str] = set()
+        self.total = {"size": 0, "unknown_size": 0}
+        self.groups: Dict[str, dict] = {}
+
+    def add(self, identifier: str, keys: List[str], size: Optional[int]):
+        with self.lock:
+            self.identifiers.add(identifier)
+            self.total["size"] += size or 0
+            self.total["unknown_size"] += size is None
+            for key in keys:
+                counts = self.groups.setdefault(key, {"identifiers": set(), "size": 0, "unknown_size": 0})
+                counts["identifiers"].add(identifier)
+                counts["size"] += size or 0
+                counts["unknown_size"] += size is None
+
+    def rows(self) -> List[dict]:
+        """One row per group: years in order, with the totals to date; the others largest first."""
+        rows = [{"key": key, "items": len(g["identifiers"]), "size": g["size"], "unknown_size": g["unknown_size"]}
+                for key, g in self.groups.items()]
+        if self.group != "year":
+            return sorted(rows, key=lambda r: (r["key"] == UNKNOWN, -r["size"], -r["items"], r["key"]))
+        rows.sort(key=lambda r: (r["key"] == UNKNOWN, int(r["key"]) if r["key"] != UNKNOWN else 0))
+        items = size = 0
+        for row in rows:
+            if row["key"] != UNKNOWN:
+                items, size = items + row["items"], size + row["size"]
+                row.update(items_to_date=items, size_to_date=size)
+        return rows
+
+    def report(self, source: str, sizes: str, failed: List[str]) -> dict:
+        return {"source": source, "group_by": self.group, "sizes": sizes, "items": len(self.identifiers),
+                "size": self.total["size"], "unknown_size": self.total["unknown_size"], "groups": self.rows(), "failed": failed}
+
+
+def print_table(report: dict):
+    rows = report["groups"]
+    running = report["group_by"] == "year"
+    header = [report["group_by"], "items", "size"] + (["items to date", "size to date"] if running else [])
+    lines = [[r["key"], str(r["items"]), format_size(r["size"])]
+             + ([str(r["items_to_date"]), format_size(r["size_to_date"])] if running and "items_to_date" in r else
+                ["", ""] if running else []) for r in rows]
+    widths = [max(len(cell) for cell in column) for column in zip(header, *lines)]
+    for line in [header] + lines:
+        # the group name to the left, the numbers to the right
+        print("  ".join([line[0].ljust(widths[0])] + [cell.rjust(w) for cell, w in zip(line[1:], widths[1:])]).rstrip())
+    total = f"{report['items']} item(s), {format_size(report['size'])}"
+    if report["unknown_size"]:
+        total += f" ({report['unknown_size']} without a size, not counted)"
+    print(total)
+    if report["group_by"] in ("collection", "format"):
+        print(f"An item in several {report['group_by']}s counts in each of them, and once in the total")
+    if report["failed"]:
+        print(f"{len(report['failed'])} item(s) could not be read and are not counted: {', '.join(report['failed'])}")
+
+
+def search_docs(session: requests.Session, query: str, fields: List[str], sleep: float) -> Iterator[dict]:
+    """Every item the query finds, with only fields, from the scrape API.
+
+    Its pages of 10000 make a million-item query a hundred requests, and no item's metadata is fetched.
+    """
+    seen: Set[str] = set()
+    results = ScrapeResults(session, query, list(dict.fromkeys(["identifier", *fields])), sleep=sleep)
+    for page, docs in results.pages():
+        logging.info(f"Page {page}: {len(docs)} item(s){f' of {results.total}' if results.total is not None else ''}")
+        for doc in docs:
+            identifier = doc.get("identifier")
+            if identifier and identifier not in seen:
+                seen.add(identifier)
+                yield doc
+
+
+def main():
+    p = argparse.ArgumentParser(description="Count the items and bytes of an Internet Archive search or a catalog, "
+                                            "by year, mediatype, collection or file format")
+    p.add_argument("query", nargs="?", help="Search query, e.g. 'collection:linuxtracker AND mediatype:software'")
+    p.add_argument("--collection", "-c", help="Search the items of this collection (with the query, if given)")
+    p.add_argument("--input", "-i", help="Count a catalog instead of searching (any format IA-Convert.py reads, '-' for stdin): "
+                                         "each entry is a file, with its size")
+    p.add_argument("--group-by", "-g", choices=GROUPS, default="year",
+                   help="year (default, with the totals to date), mediatype, collection, or format, which counts files")
+    p.add_argument("--sizes", choices=SIZES,
+                   help="Where a searched item's bytes come from: item_size, the total the search index keeps "
+                        "(default), or metadata, the files of each item's /metadata, one request per item "
+                        "(always with --group-by format)")
+    p.add_argument("--json", action="store_true", help="Print the totals and groups as JSON")
+    p.add_argument("--workers", type=int, default=4, help="With --sizes metadata, item metadata requests at a time (default: 4)")
+    p.add_argument("--sleep", type=float, default=1.0, help="Seconds between search result pages")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    searching = bool(args.query or args.collection)
+    if searching == bool(args.input):
+        p.error("give a query or --collection to search, or --input, not both or neither")
+    if args.input and args.sizes:
+        p.error("--sizes is for searches; a catalog's entries carry their own sizes")
+    if args.group_by == "format" and args.sizes == "item_size":
+        p.error("--group-by format counts files, which only each item's metadata lists; drop --sizes item_size")
+    if args.workers < 1:
+        p.error("--workers must be at least 1")
+    sizes = "catalog" if args.input else "metadata" if args.group_by == "format" else args.sizes or "item_size"
+
+    # stdout is for the table
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    stats = Stats(args.group_by)
+    failed: List[str] = []
+    rate_limited = threading.Event()
+    if args.input:
+        source = args.input
+        try:
+            for entry in iter_entries(args.input):
+                if entry.get("identifier"):
+                    stats.add(str(entry["identifier"]), group_keys(entry, args.group_by), parse_size(entry.get("size")))
+        except (OSError, ValueError) as e:
+            p.error(f"could not read {args.input}: {e}")
+        code = EXIT_OK
+    else:
+        source = " AND ".join(q for q in (f"collection:{args.collection}" if args.collection else None,
+                                          f"({args.query})" if args.query and args.collection else args.query) if q)
+        session = session_from_args(args, DEFAULT_USER_AGENT)
+        fields = GROUP_FIELDS[args.group_by] + (["item_size"] if sizes == "item_size" else [])
+
+        def count(doc: dict):
+            # list.append is atomic, so the workers share failed without a lock
+            identifier = doc["identifier"]
+            if rate_limited.is_set():
+                failed.append(identifier)
+                return
+            try:
+                files = fetch_metadata(session, identifier).get("files", [])
+            except RateLimited as e:
+                logging.error(f"{identifier}: still rate limited after the retries ({e}); the items left are not counted")
+                rate_limited.set()
+                failed.append(identifier)
+                return
+            except ArchiveError as e:
+                logging.error(str(e) if e.kind in ("not_found", "dark") else f"{identifier}: {e}")
+                failed.append(identifier)
+                return
+            except (requests.RequestException, ValueError) as e:
+                logging.error(f"Could not fetch metadata for {identifier}: {e}")
+                failed.append(identifier)
+                return
+            if args.group_by == "format":
+                for f in files:
+                    stats.add(identifier, group_keys(f, "format"), parse_size(f.get("size")))
+            else:
+                stats.add(identifier, group_keys(doc, args.group_by), sum(parse_size(f.get("size")) or 0 for f in files))
+
+        try:
+            if sizes == "item_size":
+                for doc in search_docs(session, source, fields, args.sleep):
+                    stats.add(doc["identifier"], group_keys(doc, args.group_by), int_value(doc.get("item_size")))
+            else:
+                with ThreadPoolExecutor(max_workers=args.workers) as pool:
+                    for future in [pool.submit(count, doc) for doc in search_docs(session, source, fields, args.sleep)]:
+                        future.result()
+        except (SearchError, requests.RequestException) as e:
+            logging.error(f"Could not search {source}: {e}")
+            sys.exit(EXIT_SEARCH_FAILED)
+        code = EXIT_RATE_LIMITED if rate_limited.is_set() else EXIT_METADATA_ERROR if failed else EXIT_OK
+
+    report = stats.report(source, sizes, sorted(failed))
+    if args.json:
+        print(json.dumps(report, indent=2, ensure_ascii=False))
+    else:
+        print_table(report)
+    sys.exit(code)
+
+
+if __name__ == "__main__":
+    main()
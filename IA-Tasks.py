@@ -0,0 +1,85 @@
+import argparse
+import json
+import logging
+import os
+import sys
+from typing import List
+
+import requests
+
+from ia_common import (LOG_FORMATS, TasksError, add_ia_config_arg, add_transport_args, default_user_agent, fetch_tasks, parse_args,
+                       parse_duration, s3_credentials, session_from_args, setup_logging, wait_for_tasks)
+
+TOOL_NAME = "IA-Tasks"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the tasks could not be listed
+EXIT_REQUEST_FAILED = 2
+# a listed task is in the error state (red in the catalog)
+EXIT_TASK_ERROR = 3
+# --wait gave up before the queue emptied
+EXIT_WAIT_TIMEOUT = 6
+COLUMNS = ("task_id", "status", "cmd", "identifier", "submitter", "submittime", "finished")
+
+
+def print_table(tasks: List[dict]):
+    rows = [[str(t.get(c) if t.get(c) is not None else "") for c in COLUMNS] for t in tasks]
+    widths = [max([len(c)] + [len(r[i]) for r in rows]) for i, c in enumerate(COLUMNS)]
+    print("  ".join(c.ljust(w) for c, w in zip(COLUMNS, widths)).rstrip())
+    for r in rows:
+        print("  ".join(v.ljust(w) for v, w in zip(r, widths)).rstrip())
+
+
+def main():
+    p = argparse.ArgumentParser(description="Show the Internet Archive catalog tasks of an item or a submitter",
+                                epilog="exit codes: 0 ok, 2 the tasks could not be listed, 3 a listed task is in the error state, 6 --wait timed out")
+    p.add_argument("identifier", nargs="?", help="Item identifier")
+    p.add_argument("--submitter", help="Tasks submitted by this account (its email address) instead of one item's")
+    p.add_argument("--history", action="store_true", help="Also list finished tasks")
+    p.add_argument("--limit", type=int, help="At most this many tasks of each kind (catalog, history)")
+    p.add_argument("--json", action="store_true", help="Print the tasks as a JSON array instead of a table")
+    p.add_argument("--wait", action="store_true", help="Poll until no task is queued or running, then list what's left")
+    p.add_argument("--wait-timeout", type=parse_duration, default=3600, help="Give up waiting after this long, e.g. 30m (default: 1h)")
+    p.add_argument("--interval", type=parse_duration, default=30, help="Time between polls with --wait (default: 30s)")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_transport_args(p)
+    add_ia_config_arg(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if bool(args.identifier) == bool(args.submitter):
+        p.error("give an identifier or --submitter")
+    if not s3_credentials():
+        p.error("the tasks API needs IAS3 keys: set $IA_ACCESS_KEY and $IA_SECRET_KEY, or run `ia configure`")
+
+    setup_logging(args.v, args.log_file, sys.stderr if args.json else None, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    query = {"identifier": args.identifier} if args.identifier else {"submitter": args.submitter}
+
+    timed_out = False
+    try:
+        if args.wait:
+            tasks, timed_out = wait_for_tasks(session, query, args.history, args.limit, args.wait_timeout, args.interval)
+        else:
+            tasks = fetch_tasks(session, query, args.history, args.limit)
+    except (requests.RequestException, TasksError) as e:
+        logging.error(f"Could not list tasks: {e}")
+        sys.exit(EXIT_REQUEST_FAILED)
+
+    if args.json:
+        print(json.dumps(tasks, indent=2, ensure_ascii=False))
+    elif tasks:
+        print_table(tasks)
+    else:
+        print("No tasks")
+    if timed_out:
+        sys.exit(EXIT_WAIT_TIMEOUT)
+    sys.exit(EXIT_TASK_ERROR if any(t["status"] == "error" for t in tasks) else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
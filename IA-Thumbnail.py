@@ -0,0 +1,194 @@
+import argparse
+import logging
+import os
+import sys
+import threading
+from concurrent.futures import ThreadPoolExecutor
+from typing import List, Optional, Tuple
+from urllib.parse import quote, urlsplit
+
+import requests
+
+from ia_catalog import load_catalog
+from ia_common import (ARCHIVE_URL, LOG_FORMATS, ArchiveError, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, download_url, fetch_metadata, format_size, parse_args, parse_size, raise_for_status,
+                       read_list, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Thumbnail"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# some item's image could not be fetched: the request failed, or (with --size large) its metadata could not be read
+EXIT_FAILED = 2
+# some items have no image of their own
+EXIT_MISSING = 3
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+SIZES = ("thumb", "large")
+THUMB_FILE = "__ia_thumb.jpg"
+# what /services/img/ redirects to for an item with no image of its own: the generic icon of its mediatype
+PLACEHOLDER_PATH = "/images/"
+# the file name extension of each image type, and the ones looked for before fetching an item's again
+EXTENSIONS = {"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/webp": ".webp"}
+# the original files --size large takes, by format, or by name for an entry without one
+IMAGE_FORMATS = ("JPEG", "PNG", "GIF")
+IMAGE_SUFFIXES = (".jpg", ".jpeg", ".png", ".gif")
+
+
+def existing(out_dir: str, identifier: str) -> Optional[str]:
+    for ext in EXTENSIONS.values():
+        path = os.path.join(out_dir, identifier + ext)
+        if os.path.exists(path):
+            return path
+    return None
+
+
+def largest_image(metadata: dict) -> Optional[dict]:
+    """The item's largest original image file, such as a scanned cover, or None when it has none."""
+    def image(f: dict) -> bool:
+        if f.get("format"):
+            return f["format"] in IMAGE_FORMATS
+        return str(f.get("name", "")).lower().endswith(IMAGE_SUFFIXES)
+
+    images = [f for f in metadata.get("files", []) if f.get("source") == "original" and f.get("name") != THUMB_FILE and image(f)]
+    return max(images, key=lambda f: parse_size(f.get("size")) or 0, default=None)
+
+
+def image_urls(session: requests.Session, identifier: str, size: str) -> List[str]:
+    """Where to look for the item's image, in order: for --size large its largest original image first, then the thumbnail."""
+    urls = []
+    if size == "large":
+        image = largest_image(fetch_metadata(session, identifier))
+        if image:
+            urls.append(download_url(identifier, image["name"]))
+    return urls + [download_url(identifier, THUMB_FILE), f"{ARCHIVE_URL}/services/img/{quote(identifier, safe='')}"]
+
+
+def fetch_image(session: requests.Session, identifier: str, size: str) -> Optional[Tuple[bytes, str, str]]:
+    """The item's image, its content type and the URL it came from; None when the item has none."""
+    for url in image_urls(session, identifier, size):
+        r = session.get(url)
+        if r.status_code in (404, 410) or r.ok and urlsplit(r.url).path.startswith(PLACEHOLDER_PATH):
+            logging.debug(f"{identifier}: no image at {url}")
+            continue
+        raise_for_status(r)
+        content_type = r.headers.get("Content-Type", "").split(";")[0].strip().lower()
+        if content_type not in EXTENSIONS:
+            raise ArchiveError(f"{url} answered with {content_type or 'no content type'}, not an image", response=r)
+        return r.content, content_type, url
+    return None
+
+
+def save(out_dir: str, identifier: str, data: bytes, content_type: str) -> str:
+    path = os.path.join(out_dir, identifier + EXTENSIONS[content_type])
+    tmp = path + ".part"
+    with open(tmp, "wb") as f:
+        f.write(data)
+    os.replace(tmp, path)
+    return path
+
+
+def catalog_identifiers(path: str) -> List[str]:
+    catalog, _ = load_catalog(path)
+    return list(dict.fromkeys(str(e["identifier"]) for e in catalog.entries if e.get("identifier")))
+
+
+def main():
+    p = argparse.ArgumentParser(description="Download the thumbnail of Internet Archive items, named by identifier, e.g. for a gallery of a mirror")
+    p.add_argument("identifiers", nargs="*", help="Item identifiers (default: --identifiers-file, or stdin unless --input is given)")
+    p.add_argument("--identifiers-file", "-f", help="File with one identifier per line ('-' for stdin)")
+    p.add_argument("--input", "-i", help="Also every item of this catalog (any format IA-Convert.py reads)")
+    p.add_argument("--out-dir", "-o", default="thumbnails", help="Where to save the images, as <identifier>.jpg (default: thumbnails)")
+    p.add_argument("--size", choices=SIZES, default="thumb",
+                   help="thumb: the item's thumbnail (default); large: its largest original image, such as a cover scan, "
+                        "and the thumbnail for items without one")
+    p.add_argument("--overwrite", action="store_true", help="Fetch the image of items that already have one in --out-dir again")
+    p.add_argument("--workers", type=int, default=4, help="Images fetched at a time (default: 4)")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.workers < 1:
+        p.error("--workers must be at least 1")
+    # stdin only when nothing else says which items
+    identifiers = list(read_list(args.identifiers, args.identifiers_file)) if args.identifiers or args.identifiers_file or not args.input else []
+    if args.input:
+        try:
+            identifiers += [i for i in catalog_identifiers(args.input) if i not in identifiers]
+        except (OSError, ValueError) as e:
+            p.error(f"could not read {args.input}: {e}")
+    if not identifiers:
+        p.error("give identifiers as arguments, with --identifiers-file or on stdin, or --input")
+
+    # stdout is for the summary
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    os.makedirs(args.out_dir, exist_ok=True)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    # list.append is atomic, so the workers share these without a lock
+    saved: List[str] = []
+    skipped: List[str] = []
+    missing: List[str] = []
+    failed: List[str] = []
+    rate_limited = threading.Event()
+
+    def thumbnail(identifier: str):
+        if not args.overwrite and existing(args.out_dir, identifier):
+            skipped.append(identifier)
+            return
+        if rate_limited.is_set():
+            failed.append(identifier)
+            return
+        try:
+            found = fetch_image(session, identifier, args.size)
+        except RateLimited as e:
+            logging.error(f"{identifier}: still rate limited after the retries ({e}); the items left are not fetched")
+            rate_limited.set()
+            failed.append(identifier)
+            return
+        except ArchiveError as e:
+            logging.error(str(e) if e.kind in ("not_found", "dark") else f"{identifier}: {e}")
+            failed.append(identifier)
+            return
+        except (requests.RequestException, ValueError) as e:
+            logging.error(f"Could not fetch the image of {identifier}: {e}")
+            failed.append(identifier)
+            return
+        if found is None:
+            logging.warning(f"{identifier}: no thumbnail")
+            missing.append(identifier)
+            return
+        data, content_type, url = found
+        try:
+            path = save(args.out_dir, identifier, data, content_type)
+        except OSError as e:
+            logging.error(f"Could not save the image of {identifier}: {e}")
+            failed.append(identifier)
+            return
+        logging.info(f"{identifier}: {path} ({format_size(len(data))}, from {url})")
+        saved.append(identifier)
+
+    with ThreadPoolExecutor(max_workers=args.workers) as pool:
+        for future in [pool.submit(thumbnail, identifier) for identifier in identifiers]:
+            future.result()
+
+    print(f"{len(saved)} saved, {len(skipped)} already there, {len(missing)} without a thumbnail, {len(failed)} failed")
+    if missing:
+        print(f"No thumbnail: {', '.join(sorted(missing))}")
+    if failed:
+        print(f"Failed: {', '.join(sorted(failed))}")
+    if rate_limited.is_set():
+        sys.exit(EXIT_RATE_LIMITED)
+    if failed:
+        sys.exit(EXIT_FAILED)
+    sys.exit(EXIT_MISSING if missing else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,197 @@
+import argparse
+import hashlib
+import json
+import logging
+import os
+import sys
+from typing import List, Tuple
+from urllib.parse import quote
+
+import requests
+
+from ia_common import (LOG_FORMATS, ArchiveError, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, download_url, parse_args, raise_for_status, read_list, session_from_args, setup_logging)
+
+TOOL_NAME = "IA-Torrents"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# some items have no torrent (or a broken one); they are listed for fetching over HTTP
+EXIT_SOME_MISSING = 3
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+
+
+def bdecode(data: bytes, pos: int = 0) -> Tuple[object, int]:
+    """The bencoded value at data[pos:] and the position after it; ValueError when it isn't well formed."""
+    kind = data[pos:pos + 1]
+    if kind == b"i":
+        end = data.index(b"e", pos)
+        return int(data[pos + 1:end]), end + 1
+    if kind in (b"l", b"d"):
+        pos += 1
+        items = []
+        while data[pos:pos + 1] != b"e":
+            if pos >= len(data):
+                raise ValueError("unterminated list or dictionary")
+            value, pos = bdecode(data, pos)
+            items.append(value)
+        if kind == b"l":
+            return items, pos + 1
+        if len(items) % 2 or not all(isinstance(k, bytes) for k in items[::2]):
+            raise ValueError("dictionary keys must be strings")
+        return dict(zip(items[::2], items[1::2])), pos + 1
+    if kind.isdigit():
+        colon = data.index(b":", pos)
+        start = colon + 1
+        end = start + int(data[pos:colon])
+        if end > len(data):
+            raise ValueError("string runs past the end")
+        return data[start:end], end
+    raise ValueError(f"unexpected {kind!r} at byte {pos}")
+
+
+def parse_torrent(data: bytes) -> dict:
+    """Check that data is a torrent file and return its name, info hash, trackers, web seeds and size."""
+    if data[:1] != b"d":
+        raise ValueError("not a bencoded dictionary")
+    pos, top, info_raw = 1, {}, None
+    while data[pos:pos + 1] != b"e":
+        key, pos = bdecode(data, pos)
+        start = pos
+        top[key], pos = bdecode(data, pos)
+        # the info hash is over the info dictionary's bytes exactly as they are in the file
+        if key == b"info":
+            info_raw = data[start:pos]
+    if pos + 1 != len(data):
+        raise ValueError("data after the end of the torrent")
+    info = top.get(b"info")
+    if not isinstance(info, dict) or info_raw is None or b"name" not in info or b"piece length" not in info:
+        raise ValueError("no valid info dictionary")
+    trackers = [top[b"announce"]] if isinstance(top.get(b"announce"), bytes) else []
+    for tier in top.get(b"announce-list") or []:
+        trackers += [t for t in tier if isinstance(t, bytes) and t not in trackers]
+    seeds = top.get(b"url-list") or []
+    files = info.get(b"files") or [info]
+    return {
+        "name": info[b"name"].decode("utf-8", "replace"),
+        "info_hash": hashlib.sha1(info_raw).hexdigest(),
+        "trackers": [t.decode("utf-8", "replace") for t in trackers],
+        "webseeds": [s.decode("utf-8", "replace") for s in ([seeds] if isinstance(seeds, bytes) else seeds)],
+        "size": sum(f.get(b"length", 0) for f in files),
+    }
+
+
+def magnet_link(torrent: dict) -> str:
+    parts = [f"xt=urn:btih:{torrent['info_hash']}", f"dn={quote(torrent['name'], safe='')}"]
+    parts += [f"tr={quote(t, safe='')}" for t in torrent["trackers"]]
+    parts += [f"ws={quote(s, safe='')}" for s in torrent["webseeds"]]
+    return "magnet:?" + "&".join(parts)
+
+
+def search_identifiers(path: str) -> List[str]:
+    """The identifiers of IA-Advanced-Search-v2.py's JSON output (a list of file entries), each once, in order."""
+    with open(path, encoding="utf-8") as f:
+        entries = json.load(f)
+    if not isinstance(entries, list):
+        raise ValueError(f"{path}: expected a JSON list of search results")
+    seen = {}
+    for entry in entries:
+        if isinstance(entry, dict) and entry.get("identifier"):
+            seen.setdefault(entry["identifier"], None)
+    return list(seen)
+
+
+def main():
+    p = argparse.ArgumentParser(description="Collect the .torrent files of Internet Archive items, with magnet links")
+    p.add_argument("identifiers", nargs="*", help="Item identifiers (default: --from-json, --identifiers-file or stdin)")
+    p.add_argument("--identifiers-file", "-f", help="File with one identifier per line ('-' for stdin)")
+    p.add_argument("--from-json", help="Take the identifiers from IA-Advanced-Search-v2.py's JSON output")
+    p.add_argument("--dest", "-d", default="torrents", help="Directory for the <identifier>_archive.torrent files (default: torrents)")
+    p.add_argument("--magnets", help="Also write one magnet link per torrent to this file")
+    p.add_argument("--missing", help="Write the identifiers without a usable torrent to this file, to fetch over HTTP")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+
+    try:
+        identifiers = list(read_list(args.identifiers, args.identifiers_file))
+        if args.from_json:
+            identifiers += [i for i in search_identifiers(args.from_json) if i not in identifiers]
+    except (OSError, ValueError) as e:
+        p.error(str(e))
+    if not identifiers:
+        p.error("give identifiers as arguments, with --from-json or --identifiers-file, or on stdin")
+
+    setup_logging(args.v, args.log_file, log_format=args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    os.makedirs(args.dest, exist_ok=True)
+
+    magnets, missing = [], []
+    rate_limited = False
+    for n, identifier in enumerate(identifiers, start=1):
+        name = f"{identifier}_archive.torrent"
+        path = os.path.join(args.dest, name)
+        prefix = f"[{n}/{len(identifiers)}] {identifier}"
+        try:
+            if os.path.exists(path):
+                with open(path, "rb") as f:
+                    data = f.read()
+                logging.info(f"{prefix}: already have {name}")
+            else:
+                r = session.get(download_url(identifier, name))
+                raise_for_status(r)
+                data = r.content
+            torrent = parse_torrent(data)
+        except RateLimited as e:
+            logging.error(f"{prefix}: still rate limited after the retries ({e}); stopping")
+            missing += identifiers[n - 1:]
+            rate_limited = True
+            break
+        except ArchiveError as e:
+            logging.warning(f"{prefix}: no torrent ({e})")
+            missing.append(identifier)
+            continue
+        except requests.RequestException as e:
+            logging.error(f"{prefix}: could not download {name}: {e}")
+            missing.append(identifier)
+            continue
+        except ValueError as e:
+            logging.warning(f"{prefix}: {name} is not a valid torrent ({e})")
+            if os.path.exists(path):
+                # so the next run downloads it again
+                os.remove(path)
+            missing.append(identifier)
+            continue
+        if not os.path.exists(path):
+            tmp = path + ".part"
+            with open(tmp, "wb") as f:
+                f.write(data)
+            os.replace(tmp, path)
+        magnets.append(magnet_link(torrent))
+        logging.info(f"{prefix}: {torrent['name']}, {len(torrent['webseeds'])} web seed(s)")
+
+    if args.magnets:
+        with open(args.magnets, "w", encoding="utf-8") as f:
+            f.writelines(m + "\n" for m in magnets)
+    if args.missing:
+        with open(args.missing, "w", encoding="utf-8") as f:
+            f.writelines(i + "\n" for i in missing)
+    print(f"{len(magnets)} torrent(s) in {args.dest}, {len(missing)} item(s) without one")
+    for identifier in missing if not args.missing else []:
+        print(f"  no torrent: {identifier}")
+    if rate_limited:
+        sys.exit(EXIT_RATE_LIMITED)
+    sys.exit(EXIT_SOME_MISSING if missing else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
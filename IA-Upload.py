@@ -0,0 +1,275 @@
+import argparse
+import glob
+import hashlib
+import logging
+import os
+import sys
+import time
+import xml.etree.ElementTree as ET
+from typing import Dict, List, Optional, Tuple
+from urllib.parse import quote
+
+import requests
+
+from ia_common import (ARCHIVE_URL, LOG_FORMATS, add_ia_config_arg, add_transport_args, default_user_agent, format_size, metadata_pair,
+                       parse_args, parse_human_size, raise_for_status, retry_call, s3_credentials, s3_url, session_from_args,
+                       setup_logging)
+from ia_download import TerminalProgress
+
+TOOL_NAME = "IA-Upload"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+# a whole file is PUT in one request up to this size, in parts above it (S3 caps a single PUT at 5 GiB)
+DEFAULT_MULTIPART_SIZE = "2G"
+DEFAULT_PART_SIZE = "256M"
+# generous: IAS3 may only answer once it has written the whole body
+REQUEST_TIMEOUT = 600
+EXIT_OK = 0
+EXIT_SOME_FAILED = 3
+EXIT_ALL_FAILED = 4
+# a file arrived, but the ETag IAS3 returned is not the md5 of what was sent
+EXIT_VERIFY_FAILED = 5
+S3_NS = {"s3": "http://s3.amazonaws.com/doc/2006-03-01/"}
+
+
+def meta_headers(pairs: List[Tuple[str, str]]) -> Dict[str, str]:
+    """The x-archive-meta-* headers that set item metadata on the upload that creates the item.
+
+    A key given more than once becomes meta01-key, meta02-key, ... (a list); "_" is spelled "--"
+    in header names, and values that aren't plain ASCII go as uri(<percent-encoded>).
+    """
+    values: Dict[str, List[str]] = {}
+    for key, val in pairs:
+        values.setdefault(key, []).append(val)
+    headers = {}
+    for key, vals in values.items():
+        name = key.replace("_", "--")
+        for n, val in enumerate(vals, start=1):
+            if not val.isascii() or any(c in val for c in "\r\n"):
+                val = f"uri({quote(val)})"
+            headers[f"x-archive-meta{n:02d}-{name}" if len(vals) > 1 else f"x-archive-meta-{name}"] = val
+    return headers
+
+
+def expand_files(patterns: List[str]) -> List[str]:
+    """Paths and globs (expanded here too, since Windows shells don't) to the files to upload, in order, once each."""
+    files = []
+    for pattern in patterns:
+        matches = sorted(glob.glob(pattern)) if glob.has_magic(pattern) else [pattern]
+        if not matches:
+            raise FileNotFoundError(f"no file matches {pattern}")
+        for path in matches:
+            if not os.path.isfile(path):
+                raise FileNotFoundError(f"not a file: {path}")
+            if path not in files:
+                files.append(path)
+    return files
+
+
+class Body:
+    """length bytes of path from offset, read by requests as the request body with progress and md5 along the way."""
+
+    def __init__(self, path: str, offset: int, length: int, progress, done: int = 0, total: Optional[int] = None):
+        self.fh = open(path, "rb")
+        self.fh.seek(offset)
+        self.left = length
+        self.length = length
+        self.md5 = hashlib.md5()
+        self.progress = progress
+        self.done = done
+        self.total = total
+        self.began = time.time()
+        self.shown = 0.0
+
+    def __len__(self):
+        return self.length
+
+    def read(self, size: int = -1) -> bytes:
+        if self.left <= 0:
+            return b""
+        chunk = self.fh.read(self.left if size is None or size < 0 else min(size, self.left))
+        self.left -= len(chunk)
+        self.md5.update(chunk)
+        self.done += len(chunk)
+        now = time.time()
+        # requests reads in small blocks; redraw a few times a second and at the end
+        if now - self.shown >= 0.2 or not self.left:
+            self.progress.update(self.done, self.total, self.done / max(now - self.began, 1e-6))
+            self.shown = now
+        return chunk
+
+    def close(self):
+        self.fh.close()
+
+
+class Uploader:
+    """Sends files to IAS3, one PUT each or in parts, retrying 503 SlowDown and dropped connections itself.
+
+    The session must not retry (retries=0): a body requests has already read can't be sent again by
+    urllib3, so each attempt here opens the file afresh.
+    """
+
+    def __init__(self, session: requests.Session, retries: int = 5, multipart_size: int = parse_human_size(DEFAULT_MULTIPART_SIZE),
+                 part_size: int = parse_human_size(DEFAULT_PART_SIZE), progress=TerminalProgress):
+        self.session = session
+        self.retries = retries
+        self.multipart_size = multipart_size
+        self.part_size = part_size
+        self.progress = progress
+
+    def request(self, method: str, url: str, headers: Dict[str, str], prefix: str, path: Optional[str] = None,
+                offset: int = 0, length: int = 0, done: int = 0, total: Optional[int] = None,
+                data: bytes = b"") -> Tuple[requests.Response, Optional[str]]:
+        """One IAS3 request with retries; returns the response and the md5 of the file bytes sent, if any."""
+        def once(attempt: int) -> Tuple[requests.Response, Optional[str]]:
+            progress = self.progress(prefix)
+            body = Body(path, offset, length, progress, done, total) if path else None
+            try:
+                r = self.session.request(method, url, data=body if body else data, headers=headers, timeout=REQUEST_TIMEOUT)
+                progress.end()
+                raise_for_status(r)
+                return r, body.md5.hexdigest() if body else None
+            except requests.RequestException:
+                progress.end()
+                raise
+            finally:
+                if body:
+                    body.close()
+
+        # no max_elapsed: sending a large part can take longer than RETRY_MAX_ELAPSED on its own
+        return retry_call(once, self.retries, method=method, url=url, max_elapsed=None)
+
+    def upload(self, identifier: str, path: str, name: str, headers: Dict[str, str], prefix: str) -> Tuple[bool, str]:
+        """Upload path as identifier/name; returns (verified, how) where how says what the ETag was checked against."""
+        size = os.path.getsize(path)
+        url = s3_url(identifier, name)
+        if size <= self.multipart_size:
+            r, md5 = self.request("PUT", url, headers, prefix, path, 0, size, total=size)
+            etag = r.headers.get("ETag", "").strip('"')
+            if not etag:
+                return True, "no ETag returned, not verified"
+            return etag == md5, f"md5 {md5}" + ("" if etag == md5 else f" but ETag {etag}")
+        return self.upload_parts(url, path, size, headers, prefix)
+
+    def upload_parts(self, url: str, path: str, size: int, headers: Dict[str, str], prefix: str) -> Tuple[bool, str]:
+        r, _ = self.request("POST", f"{url}?uploads", headers, f"{prefix} (starting multipart upload)")
+        try:
+            root = ET.fromstring(r.content)
+            upload_id = root.findtext("s3:UploadId", namespaces=S3_NS) or root.findtext("UploadId")
+        except ET.ParseError:
+            upload_id = None
+        if not upload_id:
+            raise requests.HTTPError(f"no UploadId in the answer to {url}?uploads", response=r)
+        parts = []
+        try:
+            for number, offset in enumerate(range(0, size, self.part_size), start=1):
+                length = min(self.part_size, size - offset)
+                r, md5 = self.request("PUT", f"{url}?partNumber={number}&uploadId={quote(upload_id)}", {},
+                                      f"{prefix} (part {number})", path, offset, length, offset, size)
+                etag = r.headers.get("ETag", "").strip('"')
+                if etag and etag != md5:
+                    raise IOError(f"part {number}: ETag {etag} is not the md5 {md5} of what was sent")
+                parts.append((number, etag or md5))
+            complete = "".join(f"<Part><PartNumber>{n}</PartNumber><ETag>\"{etag}\"</ETag></Part>" for n, etag in parts)
+            self.request("POST", f"{url}?uploadId={quote(upload_id)}", {"Content-Type": "application/xml"},
+                         f"{prefix} (completing)", data=f"<CompleteMultipartUpload>{complete}</CompleteMultipartUpload>".encode())
+        except (requests.RequestException, OSError):
+            try:
+                self.session.delete(f"{url}?uploadId={quote(upload_id)}", timeout=60)
+            except requests.RequestException as e:
+                logging.warning(f"Could not abort the multipart upload of {url}: {e}")
+            raise
+        return True, f"{len(parts)} parts, each md5 matched its ETag"
+
+
+def upload_headers(args, files: List[str], n: int) -> Dict[str, str]:
+    """Headers for the upload of files[n]: the first one, which creates the item, also carries its metadata."""
+    headers = {"x-archive-auto-make-bucket": "1"}
+    if not args.derive:
+        headers["x-archive-queue-derive"] = "0"
+    if n == 0:
+        headers.update(meta_headers(args.metadata))
+    # on the first upload the whole item's size, so IAS3 puts it on a node with room for the rest
+    headers["x-archive-size-hint"] = str(sum(map(os.path.getsize, files)) if n == 0 else os.path.getsize(files[n]))
+    return headers
+
+
+def print_dry_run(args, files: List[str], uploader: Uploader):
+    keys = s3_credentials()
+    auth = f"LOW {keys[0]}:<secret>" if keys else "<no IAS3 keys found; a real run stops here>"
+    for n, path in enumerate(files):
+        size = os.path.getsize(path)
+        url = s3_url(args.identifier, os.path.basename(path))
+        multipart = size > uploader.multipart_size
+        print(f"POST {url}?uploads" if multipart else f"PUT {url}")
+        for k, v in {"Authorization": auth, **upload_headers(args, files, n)}.items():
+            print(f"  {k}: {v}")
+        if not multipart:
+            print(f"  Content-Length: {size}  <{path}>")
+            continue
+        parts = -(-size // uploader.part_size)
+        print(f"PUT {url}?partNumber=1..{parts}&uploadId=<id>  <{path} in {parts} parts of up to {format_size(uploader.part_size)}>")
+        print(f"POST {url}?uploadId=<id>  <CompleteMultipartUpload with the {parts} part ETags>")
+
+
+def main():
+    p = argparse.ArgumentParser(description="Upload files to an Internet Archive item through the IAS3 API",
+                                epilog="exit codes: 0 all uploaded, 3 some failed, 4 all failed, 5 an ETag did not match the md5 sent")
+    p.add_argument("identifier", help="Item identifier; the item is created by the first upload when it doesn't exist")
+    p.add_argument("files", nargs="+", help="Files or glob patterns; each is uploaded under its base name")
+    p.add_argument("--metadata", "-m", type=metadata_pair, action="append", default=[],
+                   help="Item metadata as key=value, set on the first upload; give a key twice for a list (e.g. -m subject=linux -m subject=iso)")
+    p.add_argument("--no-derive", action="store_false", dest="derive", help="Don't queue a derive task after the upload")
+    p.add_argument("--multipart-size", type=parse_human_size, default=DEFAULT_MULTIPART_SIZE,
+                   help=f"Upload files larger than this in parts (default: {DEFAULT_MULTIPART_SIZE})")
+    p.add_argument("--part-size", type=parse_human_size, default=DEFAULT_PART_SIZE, help=f"Size of each part (default: {DEFAULT_PART_SIZE})")
+    p.add_argument("--retries", type=int, default=5, help="Retries per request on 503 SlowDown, 5xx and dropped connections")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    p.add_argument("--dry-run", action="store_true", help="Print the requests that would be sent (secret redacted) and send nothing")
+    add_transport_args(p)
+    add_ia_config_arg(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.part_size < 5 * 1024 ** 2:
+        p.error("--part-size must be at least 5M, the smallest part S3 accepts")
+    try:
+        files = expand_files(args.files)
+    except FileNotFoundError as e:
+        p.error(str(e))
+
+    setup_logging(args.v, args.log_file, log_format=args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT, retries=0, timeout=REQUEST_TIMEOUT)
+    uploader = Uploader(session, args.retries, args.multipart_size, args.part_size)
+    if args.dry_run:
+        print_dry_run(args, files, uploader)
+        return
+    if not s3_credentials():
+        p.error("uploading needs IAS3 keys: set $IA_ACCESS_KEY and $IA_SECRET_KEY, or run `ia configure`")
+
+    failed = mismatched = 0
+    for n, path in enumerate(files):
+        name = os.path.basename(path)
+        prefix = f"[{n + 1}/{len(files)}] {name}"
+        try:
+            ok, how = uploader.upload(args.identifier, path, name, upload_headers(args, files, n), prefix)
+        except (requests.RequestException, OSError) as e:
+            logging.error(f"Upload failed: {name} - {e}")
+            failed += 1
+            continue
+        if not ok:
+            logging.error(f"Checksum mismatch after upload: {name} ({how})")
+            mismatched += 1
+            continue
+        print(f"{prefix} uploaded ({format_size(os.path.getsize(path))}; {how})")
+    print(f"{len(files) - failed - mismatched} of {len(files)} file(s) uploaded to {ARCHIVE_URL}/details/{args.identifier}")
+    if failed + mismatched == len(files):
+        sys.exit(EXIT_ALL_FAILED)
+    if failed:
+        sys.exit(EXIT_SOME_FAILED)
+    sys.exit(EXIT_VERIFY_FAILED if mismatched else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,251 @@
+import argparse
+import json
+import logging
+import os
+import sys
+from typing import Dict, List, Optional, Tuple
+
+import requests
+
+from ia_common import (GLOB_HELP, LOG_FORMATS, ArchiveError, RateLimited, add_auth_args, add_file_filter_args, add_request_rate_args,
+                       add_transport_args, check_file_filter_args, default_user_agent, digest_mismatch, download_url, fetch_metadata,
+                       format_size, is_otf, log_context, metadata_digests, parse_args, parse_size, select_files, session_from_args,
+                       setup_logging)
+from ia_download import (PART_SUFFIX, REQUEST_TIMEOUT, ChecksumDB, Downloader, TerminalProgress, add_checksum_db_args, hash_file, local_names,
+                         long_path, open_checksum_db, safe_relpath)
+
+TOOL_NAME = "IA-Verify"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# some item's metadata could not be fetched, or the identifier does not exist or is dark
+EXIT_METADATA_ERROR = 2
+# files are missing, corrupt or extra (with --fix: what it couldn't repair, and extra files, which it leaves alone)
+EXIT_PROBLEMS = 3
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+# What Download-Collections-v2.py keeps next to the files it mirrors; {id} is the item identifier
+SIDECARS = ("{id}_files.xml", "{id}_meta.xml", "{id}_metadata.json", "{id}.metadata.json", "{id}.reviews.json",
+            ".checksums.json", ".newer-only.json", ".metadata-cache.json")
+
+
+def load_map(path: str) -> List[Tuple[str, str]]:
+    """(identifier, directory) pairs from a file of "<identifier> <directory>" lines; # starts a comment."""
+    pairs = []
+    with open(path, encoding="utf-8") as f:
+        for n, line in enumerate(f, start=1):
+            line = line.split("#", 1)[0].strip()
+            if not line:
+                continue
+            parts = line.split(None, 1)
+            if len(parts) != 2:
+                raise ValueError(f"{path}:{n}: expected an identifier and a directory")
+            pairs.append((parts[0], parts[1]))
+    return pairs
+
+
+def mirror_items(root: str) -> List[Tuple[str, str]]:
+    """Every subdirectory of root is an item named after its identifier, as Download-Collections-v2.py lays them out."""
+    return [(name, os.path.join(root, name)) for name in sorted(os.listdir(root))
+            if not name.startswith(".") and os.path.isdir(os.path.join(root, name))]
+
+
+def local_files(item_dir: str) -> List[str]:
+    """The "/"-separated relative paths of every file under item_dir."""
+    found = []
+    for top, dirs, names in os.walk(item_dir):
+        dirs.sort()
+        for name in sorted(names):
+            found.append(os.path.relpath(os.path.join(top, name), item_dir).replace(os.sep, "/"))
+    return found
+
+
+def check_file(path: str, f: dict, size_only: bool, progress_prefix: str, db: Optional[ChecksumDB] = None,
+               from_db: bool = False, identifier: Optional[str] = None) -> Optional[str]:
+    """Why the local copy at path differs from its metadata entry, or None when it matches.
+
+    With a db the digests computed are kept in it; from_db takes them from it instead of reading a file
+    that hasn't changed since they were.
+    """
+    if not os.path.isfile(path):
+        return "missing"
+    if is_otf(f):
+        # generated on request, so neither size nor digest is stable
+        return None
+    size = parse_size(f.get("size"))
+    actual = os.path.getsize(path)
+    if size is not None and actual != size:
+        return f"size {actual}, metadata says {size}"
+    expected = metadata_digests(f)
+    if size_only or not expected:
+        return None
+    actual = db.digests(path, list(expected)) if db is not None and from_db else None
+    if actual is None:
+        actual = hash_file(path, list(expected), TerminalProgress(progress_prefix))
+        if db is not None:
+            db.record(path, actual, identifier)
+    return digest_mismatch(expected, actual)
+
+
+def verify_item(session: requests.Session, identifier: str, item_dir: str, args,
+                db: Optional[ChecksumDB] = None) -> Tuple[dict, List[dict], Dict[str, str]]:
+    """Check item_dir against the item's metadata.
+
+    Returns the item's report entry, the files checked and where each of them is expected on disk.
+    """
+    metadata = fetch_metadata(session, identifier)
+    everything = metadata.get("files", [])
+    files, _ = select_files(everything, args, identifier)
+    layout = (lambda fs: {f["name"]: safe_relpath(f["name"]) for f in fs}) if args.ia_compat else local_names
+    local = layout(files)
+
+    report = {"dir": item_dir, "checked": len(files), "ok": 0, "missing": [], "corrupt": [], "extra": []}
+    for idx, f in enumerate(files, start=1):
+        name = f["name"]
+        reason = check_file(long_path(os.path.join(item_dir, local[name])), f, args.size_only,
+                            f"[verify {idx}/{len(files)}] {name}", db, args.from_db, identifier)
+        if reason is None:
+            report["ok"] += 1
+        elif reason == "missing":
+            logging.warning(f"{identifier}: missing {name}")
+            report["missing"].append(name)
+        else:
+            logging.warning(f"{identifier}: corrupt {name} ({reason})")
+            report["corrupt"].append({"name": name, "reason": reason})
+
+    if os.path.isdir(item_dir):
+        known = set(local.values()) | set(layout(everything).values()) | {s.format(id=identifier) for s in SIDECARS}
+        for rel in local_files(item_dir):
+            if rel not in known and not rel.endswith(PART_SUFFIX):
+                logging.warning(f"{identifier}: extra {rel} (not in the item's metadata)")
+                report["extra"].append(rel)
+    return report, files, local
+
+
+def fix_item(downloader: Downloader, identifier: str, report: dict, files: List[dict], local: Dict[str, str],
+             db: Optional[ChecksumDB] = None) -> int:
+    """Download the missing and corrupt files again and return how many were repaired.
+
+    Each download is checked against its metadata md5 before it replaces the copy on disk.
+    """
+    fixed = 0
+    by_name = {f["name"]: f for f in files}
+    names = report["missing"] + [c["name"] for c in report["corrupt"]]
+    for idx, name in enumerate(names, start=1):
+        f = by_name[name]
+        path = long_path(os.path.join(report["dir"], local[name]))
+        part = path + PART_SUFFIX
+        try:
+            transfer = downloader.fetch(download_url(identifier, name), part, parse_size(f.get("size")),
+                                        f"[fix {idx}/{len(names)}] {name}", REQUEST_TIMEOUT,
+                                        algos=list(metadata_digests(f)))
+        except (requests.RequestException, OSError) as e:
+            logging.error(f"{identifier}: could not download {name} again: {e}")
+            continue
+        mismatch = digest_mismatch(metadata_digests(f), transfer.digests) if transfer.digests is not None else None
+        if mismatch:
+            logging.error(f"{identifier}: {name} still doesn't match its metadata after downloading it again: {mismatch}")
+            os.remove(part)
+            continue
+        os.replace(part, path)
+        if db is not None and transfer.digests:
+            db.record(path, transfer.digests, identifier)
+        logging.info(f"{identifier}: repaired {name} ({format_size(transfer.received)})")
+        fixed += 1
+        if name in report["missing"]:
+            report["missing"].remove(name)
+        else:
+            report["corrupt"] = [c for c in report["corrupt"] if c["name"] != name]
+        report.setdefault("fixed", []).append(name)
+    return fixed
+
+
+def print_summary(reports: Dict[str, dict], errors: Dict[str, str]):
+    for identifier, r in reports.items():
+        problems = len(r["missing"]) + len(r["corrupt"]) + len(r["extra"])
+        line = f"{identifier}: {r['ok']}/{r['checked']} ok"
+        if problems:
+            line += f", {len(r['missing'])} missing, {len(r['corrupt'])} corrupt, {len(r['extra'])} extra"
+        if r.get("fixed"):
+            line += f", {len(r['fixed'])} fixed"
+        print(line)
+    for identifier, error in errors.items():
+        print(f"{identifier}: not verified ({error})")
+
+
+def main():
+    p = argparse.ArgumentParser(description="Audit a local mirror of Internet Archive items against their metadata",
+                                epilog=GLOB_HELP, formatter_class=argparse.RawDescriptionHelpFormatter)
+    p.add_argument("root", nargs="?", help="Mirror directory holding one <identifier>/ directory per item")
+    p.add_argument("--map", help='File of "<identifier> <directory>" lines, for trees not laid out by identifier')
+    p.add_argument("--ia-compat", action="store_true", help="The tree was downloaded with Download-Collections-v2.py --ia-compat")
+    add_file_filter_args(p, "verify")
+    p.add_argument("--size-only", action="store_true", help="Compare sizes only, without hashing")
+    add_checksum_db_args(p)
+    p.add_argument("--from-db", action="store_true", help="Take the digests of files unchanged since they were last hashed from "
+                                                          "--checksum-db instead of reading them again")
+    p.add_argument("--fix", action="store_true", help="Download missing and corrupt files again (extra files are left alone)")
+    p.add_argument("--report", help="Write the missing, corrupt and extra files of every item to this JSON file")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if bool(args.root) == bool(args.map):
+        p.error("give a mirror directory or --map, not both or neither")
+    check_file_filter_args(p, args)
+    if args.from_db and not args.checksum_db:
+        p.error("--from-db needs --checksum-db")
+    db = open_checksum_db(p, args)
+
+    setup_logging(args.v, args.log_file, log_format=args.log_format)
+    try:
+        items = load_map(args.map) if args.map else mirror_items(args.root)
+    except (OSError, ValueError) as e:
+        p.error(str(e))
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    # --fix downloads retry in the Downloader, which resumes a body cut short
+    downloader = Downloader(session_from_args(args, DEFAULT_USER_AGENT, retries=0), args.retries, checksum=True)
+
+    reports, errors = {}, {}
+    rate_limited = False
+    for identifier, item_dir in items:
+        try:
+            with log_context(identifier=identifier):
+                report, files, local = verify_item(session, identifier, item_dir, args, db)
+        except RateLimited as e:
+            logging.error(f"{identifier}: still rate limited after the retries ({e})")
+            errors[identifier] = str(e)
+            rate_limited = True
+            continue
+        except (requests.RequestException, ValueError) as e:
+            logging.error(str(e) if isinstance(e, ArchiveError) else f"Could not fetch metadata for {identifier}: {e}")
+            errors[identifier] = str(e)
+            continue
+        if args.fix:
+            with log_context(identifier=identifier):
+                fix_item(downloader, identifier, report, files, local, db)
+        reports[identifier] = report
+    if db is not None:
+        db.close()
+
+    print_summary(reports, errors)
+    if args.report:
+        with open(args.report, "w", encoding="utf-8") as f:
+            json.dump({"items": reports, "errors": errors}, f, indent=2, ensure_ascii=False)
+    if rate_limited:
+        sys.exit(EXIT_RATE_LIMITED)
+    if errors:
+        sys.exit(EXIT_METADATA_ERROR)
+    problems = any(r["missing"] or r["corrupt"] or r["extra"] for r in reports.values())
+    sys.exit(EXIT_PROBLEMS if problems else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
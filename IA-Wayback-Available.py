@@ -0,0 +1,129 @@
+import argparse
+import csv
+import json
+import logging
+import os
+import sys
+import threading
+from concurrent.futures import ThreadPoolExecutor
+from typing import Optional
+
+import requests
+
+from ia_common import (AVAILABILITY_URL, LOG_FORMATS, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, parse_args, raise_for_status, read_list, session_from_args, setup_logging,
+                       wayback_timestamp)
+
+TOOL_NAME = "IA-Wayback-Available"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# some URLs could not be checked; their lines carry the error
+EXIT_SOME_FAILED = 3
+# archive.org still answered 429 after the retries; the URLs left were not checked
+EXIT_RATE_LIMITED = 7
+COLUMNS = ("url", "archived", "timestamp", "snapshot", "status", "error")
+
+
+def in_range(timestamp: str, before: Optional[str], after: Optional[str]) -> bool:
+    """Whether a 14-digit capture time is within --before/--after, which may be given to the year or day only."""
+    if before and timestamp[:len(before)] > before:
+        return False
+    return not after or timestamp[:len(after)] >= after
+
+
+def availability_params(url: str, before: Optional[str], after: Optional[str]) -> dict:
+    """The query for one URL: the capture closest to --before (or --after), on that side of it."""
+    params = {"url": url}
+    if before or after:
+        params.update(timestamp=before or after, closest="before" if before else "after")
+    return params
+
+
+def check(session: requests.Session, url: str, before: Optional[str] = None, after: Optional[str] = None) -> dict:
+    """The result line of one URL: archived and, when it is, the closest capture's time, Wayback URL and HTTP status."""
+    r = session.get(AVAILABILITY_URL, params=availability_params(url, before, after))
+    raise_for_status(r)
+    closest = (r.json().get("archived_snapshots") or {}).get("closest") or {}
+    if not closest.get("available") or not in_range(closest.get("timestamp") or "", before, after):
+        return {"url": url, "archived": False}
+    return {"url": url, "archived": True, "timestamp": closest["timestamp"], "snapshot": closest.get("url"),
+            "status": closest.get("status")}
+
+
+def main():
+    p = argparse.ArgumentParser(description="Check which URLs the Wayback Machine already has, with the closest capture of each")
+    p.add_argument("urls", nargs="*", help="URLs to check (default: --urls-file, else one per line on stdin)")
+    p.add_argument("--urls-file", help='File with one URL per line ("-" for stdin); # starts a comment')
+    p.add_argument("--before", type=wayback_timestamp, help="Only captures up to this time, the latest of them, e.g. 2024 or 2024-05-01")
+    p.add_argument("--after", type=wayback_timestamp, help="Only captures from this time on, the earliest of them unless --before is given too")
+    p.add_argument("--workers", type=int, default=4, help="URLs checked at a time (default: 4)")
+    p.add_argument("--format", choices=["ndjson", "csv"], default="ndjson", help="One JSON object per URL (default), or CSV with a header row")
+    p.add_argument("--out", "-o", help="Write here instead of stdout")
+    p.add_argument("--timeout", type=int, default=30, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.workers < 1:
+        p.error("--workers must be at least 1")
+    if args.before and args.after and args.before < args.after[:len(args.before)]:
+        p.error("--before is earlier than --after")
+    urls = list(read_list(args.urls, args.urls_file))
+    if not urls:
+        p.error("give URLs as arguments, with --urls-file, or on stdin")
+
+    # stdout may be for the results
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+    rate_limited = threading.Event()
+
+    def lookup(url: str) -> Optional[dict]:
+        if rate_limited.is_set():
+            return None
+        try:
+            return check(session, url, args.before, args.after)
+        except RateLimited as e:
+            logging.error(f"{url}: still rate limited after the retries ({e}); the URLs left are not checked")
+            rate_limited.set()
+            return None
+        except (requests.RequestException, ValueError) as e:
+            logging.error(f"{url}: {e}")
+            return {"url": url, "archived": None, "error": str(e)}
+
+    out = open(args.out, "w", encoding="utf-8", newline="") if args.out else sys.stdout
+    counts = {"archived": 0, "missing": 0, "failed": 0}
+    try:
+        writer = csv.DictWriter(out, fieldnames=COLUMNS, lineterminator="\n") if args.format == "csv" else None
+        if writer:
+            writer.writeheader()
+        with ThreadPoolExecutor(max_workers=args.workers) as pool:
+            # written in the order given, as each line's turn comes
+            for future in [pool.submit(lookup, url) for url in urls]:
+                result = future.result()
+                if result is None:
+                    continue
+                counts["failed" if "error" in result else "archived" if result["archived"] else "missing"] += 1
+                if writer:
+                    writer.writerow(result)
+                else:
+                    out.write(json.dumps(result, ensure_ascii=False) + "\n")
+                out.flush()
+    finally:
+        if out is not sys.stdout:
+            out.close()
+
+    logging.info(f"{counts['archived']} archived, {counts['missing']} not archived, {counts['failed']} failed")
+    if rate_limited.is_set():
+        sys.exit(EXIT_RATE_LIMITED)
+    sys.exit(EXIT_SOME_FAILED if counts["failed"] else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,145 @@
+import argparse
+import csv
+import json
+import logging
+import os
+import sys
+import time
+from typing import Dict, Iterator, Optional
+
+import requests
+
+from ia_common import (LOG_FORMATS, WAYBACK_URL, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, parse_args, raise_for_status, session_from_args, setup_logging, wayback_timestamp)
+
+TOOL_NAME = "IA-Wayback-CDX"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# the CDX server failed or answered something that isn't CDX JSON
+EXIT_QUERY_FAILED = 2
+# archive.org still answered 429 after the retries, as in Download-Collections-v2.py
+EXIT_RATE_LIMITED = 7
+FIELDS = ("urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length")
+MATCH_TYPES = ("exact", "prefix", "host", "domain")
+
+
+class CDXError(RuntimeError):
+    pass
+
+
+def cdx_params(args) -> Dict[str, object]:
+    params = {"url": args.url, "output": "json", "fl": ",".join(FIELDS), "matchType": args.match_type}
+    if args.from_:
+        params["from"] = args.from_
+    if args.to:
+        params["to"] = args.to
+    filters = list(args.filter)
+    if args.status:
+        filters.append(f"statuscode:{args.status}")
+    if args.mime:
+        filters.append(f"mimetype:{args.mime}")
+    if filters:
+        params["filter"] = filters
+    if args.collapse:
+        params["collapse"] = args.collapse
+    return params
+
+
+def captures(session: requests.Session, params: Dict[str, object], page_size: int, limit: Optional[int] = None,
+             resume_key: Optional[str] = None, sleep: float = 0.0) -> Iterator[Dict[str, str]]:
+    """Every capture the query matches, page_size at a time, following the resumption key the server hands out.
+
+    Each key is logged at info level as it arrives; pass the last one as resume_key to carry on after a failure.
+    """
+    seen = 0
+    while limit is None or seen < limit:
+        page = dict(params, limit=page_size if limit is None else min(page_size, limit - seen), showResumeKey="true")
+        if resume_key:
+            page["resumeKey"] = resume_key
+        r = session.get(f"{WAYBACK_URL}/cdx/search/cdx", params=page)
+        raise_for_status(r)
+        if not r.text.strip():
+            return
+        try:
+            rows = r.json()
+        except ValueError as e:
+            raise CDXError(f"the CDX server did not answer with JSON: {r.text[:300]}") from e
+        if not rows:
+            return
+        header, rows = rows[0], rows[1:]
+        resume_key = None
+        # the resumption key comes last, after an empty row
+        if len(rows) >= 2 and rows[-2] == [] and len(rows[-1]) == 1:
+            resume_key = rows[-1][0]
+            rows = rows[:-2]
+        for row in rows:
+            seen += 1
+            yield dict(zip(header, row))
+        if not resume_key:
+            return
+        logging.info(f"{seen} capture(s) so far; resume key {resume_key}")
+        if sleep:
+            time.sleep(sleep)
+
+
+def main():
+    p = argparse.ArgumentParser(description="List Wayback Machine captures of a URL or URL prefix through the CDX API")
+    p.add_argument("url", help="URL, or with --match-type prefix/host/domain, where to start (e.g. example.org/docs/)")
+    p.add_argument("--match-type", choices=MATCH_TYPES, default="exact", help="exact URL (default), everything under it, its host, or its domain and subdomains")
+    p.add_argument("--from", dest="from_", type=wayback_timestamp, help="Captures from this time on, e.g. 2020 or 2020-06-01")
+    p.add_argument("--to", type=wayback_timestamp, help="Captures up to this time")
+    p.add_argument("--status", help="Only this HTTP status, e.g. 200 (a regex, as the CDX filter takes it)")
+    p.add_argument("--mime", help="Only this mimetype, e.g. text/html (a regex)")
+    p.add_argument("--filter", action="append", default=[], help="Raw CDX filter, e.g. !statuscode:404 (repeatable)")
+    p.add_argument("--collapse", action="append", default=[], help="Collapse adjacent rows on a field, e.g. digest or timestamp:8 (repeatable)")
+    p.add_argument("--limit", type=int, help="Stop after this many captures")
+    p.add_argument("--page-size", type=int, default=10000, help="Captures per request (default: 10000)")
+    p.add_argument("--resume-key", help="Carry on from the resume key an interrupted run logged")
+    p.add_argument("--sleep", type=float, default=1.0, help="Seconds between pages")
+    p.add_argument("--format", choices=["ndjson", "csv"], default="ndjson", help="One JSON object per capture, or CSV with a header row")
+    p.add_argument("--out", "-o", help="Write here instead of stdout")
+    p.add_argument("--timeout", type=int, default=60, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="HTTP retries for transient errors")
+    p.add_argument("--backoff", type=float, default=1.0, help="Retry backoff factor")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.page_size < 1:
+        p.error("--page-size must be at least 1")
+
+    # stdout may be for the captures
+    setup_logging(args.v, args.log_file, sys.stderr, args.log_format)
+    session = session_from_args(args, DEFAULT_USER_AGENT)
+
+    out = open(args.out, "w", encoding="utf-8", newline="") if args.out else sys.stdout
+    count = 0
+    try:
+        writer = csv.writer(out) if args.format == "csv" else None
+        if writer:
+            writer.writerow(FIELDS)
+        for capture in captures(session, cdx_params(args), args.page_size, args.limit, args.resume_key, args.sleep):
+            if writer:
+                writer.writerow([capture.get(f, "") for f in FIELDS])
+            else:
+                out.write(json.dumps({f: capture.get(f) for f in FIELDS}, ensure_ascii=False) + "\n")
+            count += 1
+    except RateLimited as e:
+        logging.error(f"Still rate limited after the retries ({e}); carry on later with the last resume key logged (-v)")
+        sys.exit(EXIT_RATE_LIMITED)
+    except (requests.RequestException, CDXError) as e:
+        logging.error(f"CDX query failed after {count} capture(s): {e}")
+        sys.exit(EXIT_QUERY_FAILED)
+    finally:
+        if out is not sys.stdout:
+            out.close()
+    logging.info(f"{count} capture(s)")
+
+
+if __name__ == "__main__":
+    main()
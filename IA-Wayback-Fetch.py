@@ -0,0 +1,262 @@
+import argparse
+import base64
+import csv
+import gzip
+import hashlib
+import itertools
+import json
+import logging
+import os
+import sys
+import threading
+import time
+import uuid
+from concurrent.futures import ThreadPoolExecutor
+from typing import Dict, Iterable, Iterator, List, Optional, Tuple
+from urllib.parse import urlsplit
+
+import requests
+
+from ia_common import (LOG_FORMATS, WAYBACK_URL, RateLimited, add_auth_args, add_request_rate_args, add_transport_args,
+                       default_user_agent, full_version, parse_args, session_from_args, setup_logging)
+from ia_download import DRAIN_SECONDS, PART_SUFFIX, STOP, Downloader, Interrupted, Progress, Shutdown, long_path, safe_relpath
+
+TOOL_NAME = "IA-Wayback-Fetch"
+TOOL_VERSION = "1.0"
+DEFAULT_USER_AGENT = default_user_agent(TOOL_NAME, TOOL_VERSION)
+EXIT_OK = 0
+# some captures could not be downloaded; run again to retry them
+EXIT_SOME_FAILED = 3
+# the Wayback Machine still answered 429 after the retries; the run stopped, the next one picks up from here
+EXIT_RATE_LIMITED = 7
+# SIGINT/SIGTERM, the shell's usual 128 + SIGINT
+EXIT_INTERRUPTED = 130
+# the columns of the CDX server's default, space-separated output
+CDX_FIELDS = ("urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length")
+
+
+def read_captures(lines: Iterable[str]) -> Iterator[Dict[str, str]]:
+    """CDX rows as IA-Wayback-CDX.py writes them (NDJSON or CSV), or as the CDX server does (JSON or plain text).
+
+    The format is told from the first line that isn't blank.
+    """
+    lines = iter(lines)
+    first = next((line for line in lines if line.strip()), None)
+    if first is None:
+        return
+    rest = itertools.chain([first], lines)
+    if first.lstrip().startswith("{"):
+        for line in rest:
+            if line.strip():
+                yield json.loads(line)
+    elif first.lstrip().startswith("["):
+        rows = json.loads("".join(rest))
+        for row in rows[1:]:
+            # with showResumeKey the rows end in [] and [key]
+            if len(row) == len(rows[0]):
+                yield dict(zip(rows[0], row))
+    elif "," in first and "timestamp" in first:
+        yield from csv.DictReader(rest)
+    else:
+        for line in rest:
+            values = line.split()
+            if len(values) == len(CDX_FIELDS):
+                yield dict(zip(CDX_FIELDS, values))
+
+
+def capture_path(original: str, timestamp: str) -> str:
+    """Where a capture goes under the destination: <host>/<path segments>/<timestamp>.
+
+    The query string stays on the last segment, so /a?b=1 and /a?b=2 are kept apart.
+    """
+    url = urlsplit(original if "://" in original else f"http://{original}")
+    segments = [s for s in url.path.split("/") if s]
+    if url.query:
+        segments.append((segments.pop() if segments else "") + "?" + url.query)
+    return safe_relpath("/".join([url.netloc.lower() or "_", *segments, timestamp]))
+
+
+def unique_captures(rows: Iterable[Dict[str, str]]) -> Tuple[List[Dict[str, str]], int]:
+    """The rows to fetch, in order, without the ones whose digest an earlier row already has, and how many were dropped.
+
+    Revisits and unchanged recaptures share the digest of what was first captured, so only that one is kept.
+    """
+    seen, todo, dropped = set(), [], 0
+    for row in rows:
+        if not row.get("timestamp") or not row.get("original"):
+            continue
+        digest = row.get("digest")
+        if digest and digest != "-" and digest in seen:
+            dropped += 1
+            continue
+        seen.add(digest)
+        todo.append(row)
+    return todo, dropped
+
+
+def sha1_base32(path: str) -> str:
+    """A file's digest the way the CDX server and WARC headers write it: base32 of its sha1."""
+    h = hashlib.sha1()
+    with open(path, "rb") as f:
+        for chunk in iter(lambda: f.read(1024 * 1024), b""):
+            h.update(chunk)
+    return base64.b32encode(h.digest()).decode()
+
+
+def warc_date(timestamp: str) -> str:
+    t = timestamp.ljust(14, "0")
+    return f"{t[0:4]}-{t[4:6]}-{t[6:8]}T{t[8:10]}:{t[10:12]}:{t[12:14]}Z"
+
+
+class WarcWriter:
+    """Appends WARC/1.0 records to one file, a gzip member per record when its name ends in .gz.
+
+    A capture comes back from the Wayback Machine as the body only, so each is a resource record
+    with the original URL, capture time and mimetype; a new file starts with a warcinfo record.
+    """
+
+    def __init__(self, path: str):
+        self.path = path
+        self.lock = threading.Lock()
+        self.compress = path.endswith(".gz")
+        self.fh = open(path, "ab")
+        if self.fh.tell() == 0:
+            info = f"software: {TOOL_NAME}/{full_version(TOOL_VERSION)}\r\nformat: WARC File Format 1.0\r\n".encode()
+            self.write_record({"WARC-Type": "warcinfo", "WARC-Date": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+                               "WARC-Filename": os.path.basename(path), "Content-Type": "application/warc-fields"},
+                              [info], len(info))
+
+    def write_record(self, headers: Dict[str, str], body: Iterable[bytes], length: int):
+        head = "WARC/1.0\r\n" + f"WARC-Record-ID: <urn:uuid:{uuid.uuid4()}>\r\n"
+        head += "".join(f"{k}: {v}\r\n" for k, v in headers.items()) + f"Content-Length: {length}\r\n\r\n"
+        with self.lock:
+            out = gzip.GzipFile(fileobj=self.fh, mode="wb") if self.compress else self.fh
+            out.write(head.encode("utf-8"))
+            for chunk in body:
+                out.write(chunk)
+            out.write(b"\r\n\r\n")
+            if self.compress:
+                out.close()
+            self.fh.flush()
+
+    def add(self, path: str, row: Dict[str, str]):
+        digest = f"sha1:{sha1_base32(path)}"
+        headers = {"WARC-Type": "resource", "WARC-Target-URI": row["original"], "WARC-Date": warc_date(row["timestamp"]),
+                   "Content-Type": row.get("mimetype") or "application/octet-stream",
+                   "WARC-Block-Digest": digest, "WARC-Payload-Digest": digest}
+        with open(path, "rb") as f:
+            self.write_record(headers, iter(lambda: f.read(1024 * 1024), b""), os.path.getsize(path))
+
+    def close(self):
+        self.fh.close()
+
+
+class Fetcher:
+    """Downloads captures into dest, one thread each, and keeps the counts for the summary."""
+
+    def __init__(self, downloader: Downloader, dest: str, timeout: float, warc: Optional[WarcWriter] = None):
+        self.downloader = downloader
+        self.dest = dest
+        self.timeout = timeout
+        self.warc = warc
+        self.lock = threading.Lock()
+        self.counts = {"fetched": 0, "present": 0, "failed": 0}
+        self.rate_limited = False
+
+    def count(self, what: str):
+        with self.lock:
+            self.counts[what] += 1
+
+    def fetch(self, row: Dict[str, str], prefix: str):
+        if STOP.is_set() or self.rate_limited:
+            return
+        path = long_path(os.path.join(self.dest, capture_path(row["original"], row["timestamp"])))
+        if os.path.exists(path):
+            self.count("present")
+            return
+        part = path + PART_SUFFIX
+        # id_ asks for the capture as it was archived, without the Wayback Machine's banner and link rewriting
+        url = f"{WAYBACK_URL}/web/{row['timestamp']}id_/{row['original']}"
+        try:
+            # CDX "length" is that of the compressed WARC record, not of the body
+            self.downloader.fetch(url, part, None, prefix, self.timeout)
+            os.replace(part, path)
+            if self.warc:
+                self.warc.add(path, row)
+        except Interrupted:
+            return
+        except RateLimited as e:
+            logging.error(f"{prefix}: still rate limited after the retries ({e}); stopping, the next run resumes here")
+            self.rate_limited = True
+            self.count("failed")
+            return
+        except (requests.RequestException, OSError) as e:
+            logging.error(f"{prefix}: {row['original']} at {row['timestamp']}: {e}")
+            self.count("failed")
+            return
+        logging.info(f"{prefix}: {row['original']} at {row['timestamp']}")
+        self.count("fetched")
+
+
+def main():
+    p = argparse.ArgumentParser(description="Download Wayback Machine captures listed by IA-Wayback-CDX.py, or by the CDX server")
+    p.add_argument("input", help='CDX rows: NDJSON or CSV from IA-Wayback-CDX.py, or the CDX server\'s JSON or text output ("-" for stdin)')
+    p.add_argument("--dest", "-d", default=".", help="Directory for the <host>/<path>/<timestamp> tree (default: current directory)")
+    p.add_argument("--workers", type=int, default=4, help="Captures downloaded at a time (default: 4)")
+    p.add_argument("--no-dedupe", action="store_true", help="Fetch every row, also those whose digest an earlier row already has")
+    p.add_argument("--warc", help="Also add what is downloaded to this WARC file (gzipped per record when it ends in .gz)")
+    p.add_argument("--drain", type=float, default=DRAIN_SECONDS, help="After Ctrl-C, seconds the transfers in flight get to finish before they are cut off, keeping their .part (default: 10; 0 to stop them at once)")
+    p.add_argument("--timeout", type=int, default=60, help="Request timeout seconds")
+    p.add_argument("--retries", type=int, default=5, help="Retries per capture for transient errors, resuming what arrived")
+    p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"), help="Custom User-Agent header (default: $IA_USER_AGENT)")
+    add_request_rate_args(p)
+    add_transport_args(p)
+    add_auth_args(p)
+    p.add_argument("--log-file", help="Optional log file path")
+    p.add_argument("--log-format", choices=LOG_FORMATS, default="text", help="Log lines as text (default), or as one JSON object each for log collectors")
+    p.add_argument("-v", action="count", default=0, help="Increase verbosity (-v info, -vv debug)")
+    args = parse_args(p, __file__, version=TOOL_VERSION)
+    if args.workers < 1:
+        p.error("--workers must be at least 1")
+
+    setup_logging(args.v, args.log_file, log_format=args.log_format)
+    try:
+        if args.input == "-":
+            rows = list(read_captures(sys.stdin))
+        else:
+            with open(args.input, encoding="utf-8") as f:
+                rows = list(read_captures(f))
+    except (OSError, ValueError, csv.Error) as e:
+        p.error(f"could not read {args.input}: {e}")
+    todo, dropped = (rows, 0) if args.no_dedupe else unique_captures(rows)
+    if dropped:
+        logging.info(f"{dropped} capture(s) skipped: same digest as an earlier one")
+
+    # the Downloader retries, resuming the .part; the session itself doesn't. No progress lines: with
+    # several transfers at a time they would overwrite each other, so each capture is logged when done
+    downloader = Downloader(session_from_args(args, DEFAULT_USER_AGENT, retries=0), args.retries, progress=lambda prefix: Progress())
+    warc = WarcWriter(args.warc) if args.warc else None
+    fetcher = Fetcher(downloader, args.dest, args.timeout, warc)
+    shutdown = Shutdown(args.drain).install()
+    if warc:
+        shutdown.on_exit(warc.close)
+    try:
+        with ThreadPoolExecutor(max_workers=args.workers) as pool:
+            futures = [pool.submit(fetcher.fetch, row, f"[{n}/{len(todo)}]") for n, row in enumerate(todo, start=1)]
+            for future in futures:
+                future.result()
+    finally:
+        shutdown.finish()
+
+    c = fetcher.counts
+    print(f"{c['fetched']} capture(s) downloaded, {c['present']} already there, {dropped} duplicate(s) skipped, {c['failed']} failed")
+    if STOP.is_set():
+        print("Interrupted: run the same command again to continue")
+        sys.exit(EXIT_INTERRUPTED)
+    if fetcher.rate_limited:
+        sys.exit(EXIT_RATE_LIMITED)
+    sys.exit(EXIT_SOME_FAILED if c["failed"] else EXIT_OK)
+
+
+if __name__ == "__main__":
+    main()
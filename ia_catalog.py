@@ -0,0 +1,323 @@
+"""Reading file catalogs: the search tool's JSON (bare or wrapped with its provenance), NDJSON, CSV, aria2 input files and SQLite.
+
+load_catalog() reads one from a file or stdin, telling its format from the content, for IA-Convert.py
+and IA-Diff.py; the entries come back as dicts, with a numeric size where the format kept it as text.
+iter_entries() gives them one at a time instead, for a tool that only goes through them once. JSON
+and NDJSON are decoded as they are read, a buffer at a time, so neither holds the file's text: a
+catalog of a million entries costs load_catalog() the entries and iter_entries() one entry.
+"""
+import contextlib
+import csv
+import io
+import json
+import sqlite3
+import sys
+from typing import Dict, Iterator, List, Optional, TextIO, Tuple
+from urllib.parse import unquote, urlsplit
+
+FORMATS = ("json", "ndjson", "csv", "aria2", "sqlite")
+# the fields every format carries; the others may be lost, with a warning
+CORE_FIELDS = ("identifier", "file_name", "download_url", "md5", "size")
+# the keys a provenance-wrapped JSON catalog keeps its entries under
+ENTRY_KEYS = ("entries", "files", "results", "items")
+SQLITE_MAGIC = b"SQLite format 3\x00"
+# characters read from the file at a time when decoding JSON
+STREAM_CHUNK = 1 << 16
+JSON_WHITESPACE = " \t\n\r"
+
+Entries = List[Dict[str, object]]
+
+
+class Catalog:
+    """A list of file entries and, when the input had one, the wrapper object they came in (query, date, tool...)."""
+
+    def __init__(self, entries: Entries, provenance: Optional[dict] = None, entry_key: str = "entries"):
+        self.entries = entries
+        self.provenance = provenance or {}
+        self.entry_key = entry_key
+
+
+def columns(entries: Entries) -> List[str]:
+    """Every field any entry has, the core ones first and the rest in the order they turn up."""
+    seen = {f: None for f in CORE_FIELDS if any(f in e for e in entries)}
+    for entry in entries:
+        for key in entry:
+            seen.setdefault(key, None)
+    return list(seen)
+
+
+def numeric_size(entry: dict) -> dict:
+    """Text formats give size back as a string; make it the number again when it is one."""
+    size = entry.get("size")
+    if isinstance(size, str) and size.isdigit():
+        entry["size"] = int(size)
+    return entry
+
+
+def detect(data: bytes) -> str:
+    if data.startswith(SQLITE_MAGIC):
+        return "sqlite"
+    text = data.decode("utf-8-sig").lstrip()
+    if text.startswith("["):
+        return "json"
+    if text.startswith("{"):
+        try:
+            json.loads(text)
+            return "json"
+        except ValueError:
+            # more than one object: one per line
+            return "ndjson"
+    first = text.split("\n", 1)[0]
+    if first.startswith(("http://", "https://")):
+        return "aria2"
+    if "," in first or "identifier" in first:
+        return "csv"
+    raise ValueError("not a JSON, NDJSON, CSV, aria2 or SQLite catalog")
+
+
+def read_catalog(data: bytes, fmt: str, path: str) -> Catalog:
+    if fmt == "sqlite":
+        if path == "-":
+            raise ValueError("a SQLite catalog can't be read from stdin; give its file name")
+        return read_sqlite(path)
+    text = data.decode("utf-8-sig")
+    if fmt == "json":
+        value = json.loads(text)
+        if isinstance(value, list):
+            return Catalog(value)
+        if isinstance(value, dict):
+            key = next((k for k in ENTRY_KEYS if isinstance(value.get(k), list)), None)
+            if key is None:
+                # a single NDJSON line
+                return Catalog([value])
+            return Catalog(value[key], {k: v for k, v in value.items() if k != key}, key)
+        raise ValueError("a JSON catalog is a list of entries, or an object holding one")
+    if fmt == "ndjson":
+        return Catalog([json.loads(line) for line in text.splitlines() if line.strip()])
+    if fmt == "csv":
+        rows = []
+        for row in csv.DictReader(io.StringIO(text)):
+            rows.append(numeric_size({k: v for k, v in row.items() if v != ""}))
+        return Catalog(rows)
+    return Catalog(read_aria2(text))
+
+
+def read_aria2(text: str) -> Entries:
+    """The entries of an aria2 input file: a URL line, then indented option lines (dir, out, checksum)."""
+    entries = []
+    for line in text.splitlines():
+        if not line.strip() or line.lstrip().startswith("#"):
+            continue
+        if not line[0].isspace():
+            url = line.split("\t")[0].strip()
+            entry = {"download_url": url}
+            path = urlsplit(url).path
+            if path.startswith("/download/"):
+                identifier, _, name = path[len("/download/"):].partition("/")
+                entry.update(identifier=unquote(identifier), file_name=unquote(name))
+            entries.append(entry)
+            continue
+        if not entries:
+            raise ValueError(f"option before the first URL: {line.strip()}")
+        key, _, value = line.strip().partition("=")
+        if key == "out":
+            entries[-1]["file_name"] = value
+        elif key == "dir" and "identifier" not in entries[-1]:
+            entries[-1]["identifier"] = value
+        elif key == "checksum" and value.startswith("md5="):
+            entries[-1]["md5"] = value[len("md5="):]
+    return entries
+
+
+def read_sqlite(path: str) -> Catalog:
+    db = sqlite3.connect(f"file:{path}?mode=ro", uri=True)
+    try:
+        cur = db.execute("SELECT * FROM entries ORDER BY rowid")
+        names = [d[0] for d in cur.description]
+        entries = [{k: v for k, v in zip(names, row) if v is not None} for row in cur]
+        provenance = {}
+        if db.execute("SELECT 1 FROM sqlite_master WHERE name = 'provenance'").fetchone():
+            provenance = {k: json.loads(v) for k, v in db.execute("SELECT key, value FROM provenance ORDER BY rowid")}
+    except sqlite3.Error as e:
+        raise ValueError(f"not a catalog database: {e}") from e
+    finally:
+        db.close()
+    # the key the entries were under in the JSON they came from
+    entry_key = provenance.pop("_entry_key", "entries")
+    return Catalog(entries, provenance, entry_key)
+
+
+class JsonStream:
+    """JSON values read from a text stream one at a time, with raw_decode over a buffer of STREAM_CHUNK characters.
+
+    What has been decoded is dropped from the buffer as more is read, so it holds about one value. A pipe
+    is read a line (or STREAM_CHUNK characters) at a time instead, so each NDJSON entry is had as soon as
+    it is written, not once the writer has filled a whole chunk.
+    """
+
+    def __init__(self, f: TextIO):
+        self.f = f
+        self.buf = ""
+        self.pos = 0
+        self.decoder = json.JSONDecoder()
+        try:
+            seekable = f.seekable()
+        except (AttributeError, OSError, ValueError):
+            seekable = False
+        self.read = f.read if seekable else f.readline
+
+    def more(self) -> bool:
+        chunk = self.read(STREAM_CHUNK)
+        self.buf = self.buf[self.pos:] + chunk
+        self.pos = 0
+        return bool(chunk)
+
+    def peek(self) -> str:
+        """The next character that isn't whitespace, left in place; "" at the end."""
+        while True:
+            while self.pos < len(self.buf) and self.buf[self.pos] in JSON_WHITESPACE:
+                self.pos += 1
+            if self.pos < len(self.buf) or not self.more():
+                return self.buf[self.pos:self.pos + 1]
+
+    def value(self) -> object:
+        self.peek()
+        while True:
+            try:
+                value, end = self.decoder.raw_decode(self.buf, self.pos)
+            except json.JSONDecodeError as e:
+                # most likely a value the buffer ends inside of
+                if self.more():
+                    continue
+                raise ValueError(f"invalid JSON: {e}") from e
+            # a number the buffer ends with may go on in the next chunk
+            if end == len(self.buf) and self.more():
+                continue
+            self.pos = end
+            return value
+
+    def array(self) -> Iterator[object]:
+        """The elements of the array that comes next, each decoded when it is reached."""
+        self.peek()
+        self.pos += 1
+        if self.peek() == "]":
+            self.pos += 1
+            return
+        while True:
+            yield self.value()
+            sep = self.peek()
+            self.pos += 1
+            if sep == "]":
+                return
+            if sep != ",":
+                raise ValueError(f"invalid JSON: expected , or ] after an array element, found {sep or 'the end'}")
+
+    def rest(self) -> str:
+        return self.buf[self.pos:] + self.f.read()
+
+
+class JsonEntries:
+    """The entries of a JSON or NDJSON catalog, decoded from stream as they are iterated.
+
+    An array is a JSON catalog, and so is a single object holding the entries under one of ENTRY_KEYS
+    (whose other keys become the provenance); objects one after another are NDJSON. fmt says which,
+    once the iteration is over.
+    """
+
+    def __init__(self, stream: JsonStream):
+        self.stream = stream
+        self.fmt = "json"
+        self.provenance: dict = {}
+        self.entry_key = "entries"
+
+    def __iter__(self) -> Iterator[object]:
+        if self.stream.peek() == "[":
+            yield from self.stream.array()
+            return
+        first = self.stream.value()
+        key = next((k for k in ENTRY_KEYS if isinstance(first.get(k), list)), None) if isinstance(first, dict) else None
+        # only a value that could be the whole catalog waits for the next one, so an NDJSON
+        # entry read from a pipe is given out before its writer has sent another
+        if key is not None or not isinstance(first, dict):
+            more = self.stream.peek() != ""
+            if key is not None and not more:
+                self.provenance, self.entry_key = {k: v for k, v in first.items() if k != key}, key
+                yield from first[key]
+                return
+            if not isinstance(first, dict) and not more:
+                raise ValueError("a JSON catalog is a list of entries, or an object holding one")
+        yield first
+        while self.stream.peek() != "":
+            self.fmt = "ndjson"
+            yield self.stream.value()
+
+
+@contextlib.contextmanager
+def open_text(path: str) -> Iterator[TextIO]:
+    """The catalog in path, or stdin for "-", as UTF-8 text (a BOM is skipped)."""
+    if path != "-":
+        with open(path, encoding="utf-8-sig") as f:
+            yield f
+        return
+    f = io.TextIOWrapper(sys.stdin.buffer, encoding="utf-8-sig")
+    try:
+        yield f
+    finally:
+        # leave stdin open
+        f.detach()
+
+
+def is_sqlite(path: str) -> bool:
+    if path == "-":
+        return False
+    with open(path, "rb") as f:
+        return f.read(len(SQLITE_MAGIC)) == SQLITE_MAGIC
+
+
+def checked(entries) -> Iterator[dict]:
+    for entry in entries:
+        if not isinstance(entry, dict):
+            raise ValueError("every entry must be an object")
+        yield entry
+
+
+def load_catalog(path: str, fmt: Optional[str] = None) -> Tuple[Catalog, str]:
+    """The catalog in path ("-" for stdin) and its format, fmt or the one detected; ValueError (or OSError) when it can't be read."""
+    if fmt == "sqlite" or fmt is None and is_sqlite(path):
+        return read_catalog(b"", "sqlite", path), "sqlite"
+    with open_text(path) as f:
+        stream = JsonStream(f)
+        if fmt in (None, "json", "ndjson") and stream.peek() in ("[", "{"):
+            entries = JsonEntries(stream)
+            catalog = Catalog(list(checked(entries)), entries.provenance, entry_key=entries.entry_key)
+            return catalog, fmt or entries.fmt
+        data = stream.rest().encode("utf-8")
+    return read_whole(data, fmt, path)
+
+
+def read_whole(data: bytes, fmt: Optional[str], path: str) -> Tuple[Catalog, str]:
+    fmt = fmt or detect(data)
+    try:
+        catalog = read_catalog(data, fmt, path)
+    except csv.Error as e:
+        raise ValueError(str(e)) from e
+    if not all(isinstance(e, dict) for e in catalog.entries):
+        raise ValueError("every entry must be an object")
+    return catalog, fmt
+
+
+def iter_entries(path: str) -> Iterator[dict]:
+    """The entries of the catalog in path ("-" for stdin) one at a time, as load_catalog() would give them.
+
+    JSON and NDJSON are decoded as they are read; the other formats are read whole first.
+    """
+    if is_sqlite(path):
+        yield from load_catalog(path, "sqlite")[0].entries
+        return
+    with open_text(path) as f:
+        stream = JsonStream(f)
+        if stream.peek() in ("[", "{"):
+            yield from checked(JsonEntries(stream))
+            return
+        data = stream.rest().encode("utf-8")
+    yield from read_whole(data, None, path)[0].entries
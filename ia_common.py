@@ -0,0 +1,1984 @@
+"""Helpers shared by the scripts in this repository; keep it next to them so `import ia_common` works.
+
+It is also the small client library for other programs: build_session() gives a requests session with
+the retry policy, default timeout and User-Agent the tools use (session_from_args() configures one from
+a tool's flags, --record and --replay included), and the *_url helpers build archive.org URLs with the same escaping.
+"""
+import argparse
+import atexit
+import base64
+import configparser
+import contextlib
+import contextvars
+import functools
+import io
+import itertools
+import json
+import logging
+import os
+import platform
+import random
+import re
+import subprocess
+import sys
+import threading
+import time
+import warnings
+from collections import deque
+from datetime import datetime, timezone
+from typing import Callable, Dict, Iterator, List, NamedTuple, Optional, Sequence, Set, Tuple, TypeVar, Union
+from urllib.parse import quote, urlsplit
+
+import requests
+from requests.adapters import HTTPAdapter
+from requests.auth import AuthBase
+from requests.utils import should_bypass_proxies
+from urllib3.exceptions import InsecureRequestWarning, InvalidHeader, MaxRetryError, ResponseError
+from urllib3.response import HTTPResponse
+from urllib3.util.retry import Retry
+
+try:
+    import tomllib
+except ImportError:
+    # Python 3.10; only reading a config file needs it
+    tomllib = None
+
+# $IA_BASE_URL points every tool at another server, such as a mirror or the fake archive.org in tests/
+ARCHIVE_URL = (os.environ.get("IA_BASE_URL") or "https://archive.org").rstrip("/")
+SEARCH_URL = f"{ARCHIVE_URL}/advancedsearch.php"
+# the scrape API: cursor paging with no depth limit, for result sets advancedsearch.php can't page through
+SCRAPE_URL = f"{ARCHIVE_URL}/services/search/v1/scrape"
+METADATA_BASE_URL = f"{ARCHIVE_URL}/metadata/"
+DOWNLOAD_BASE_URL = f"{ARCHIVE_URL}/download"
+# the IAS3 upload endpoint, $IA_S3_URL to point it elsewhere
+S3_URL = (os.environ.get("IA_S3_URL") or "https://s3.us.archive.org").rstrip("/")
+TASKS_URL = f"{ARCHIVE_URL}/services/tasks.php"
+OAI_URL = f"{ARCHIVE_URL}/services/oai.php"
+# the Wayback Machine's availability API: the capture of a URL closest to a time
+AVAILABILITY_URL = f"{ARCHIVE_URL}/wayback/available"
+# the Wayback Machine (CDX, snapshots, Save Page Now), $IA_WAYBACK_URL to point it elsewhere
+WAYBACK_URL = (os.environ.get("IA_WAYBACK_URL") or "https://web.archive.org").rstrip("/")
+# the full-text search API (an Elasticsearch front end), $IA_FTS_URL to point it elsewhere
+FTS_URL = (os.environ.get("IA_FTS_URL") or "https://be-api.us.archive.org/ia-pub-fts-api").rstrip("/")
+# Transient statuses worth another attempt; everything else is returned to the caller
+RETRY_STATUSES = (429, 500, 502, 503, 504)
+# session_from_args() defaults for tools without --timeout, --retries or --backoff
+DEFAULT_TIMEOUT = 30
+DEFAULT_RETRIES = 5
+DEFAULT_BACKOFF = 1.0
+# Seconds to open a connection, TLS handshake included, for tools with --connect-timeout; --timeout is then the wait for each read
+DEFAULT_CONNECT_TIMEOUT = 10
+# Connections kept open per host; session_from_args() raises it to what a tool runs at once
+DEFAULT_POOL_SIZE = 10
+PROXY_SCHEMES = ("http", "https", "socks5", "socks5h")
+# added to a certificate verification failure, which is most often a proxy or firewall that inspects TLS
+TLS_HINT = "if this network inspects TLS traffic, give its CA certificate with --ca-cert"
+# Retries of one request stop once they would end past this many seconds, however long a Retry-After asks for
+RETRY_MAX_ELAPSED = 300
+# No backoff wait is longer than this; Retry-After may ask for more, up to RETRY_MAX_ELAPSED
+RETRY_BACKOFF_CAP = 30
+# advancedsearch.php gives no docs past this many results; larger result sets need the scrape API
+SEARCH_DEPTH_LIMIT = 10000
+# the docs one scrape request may ask for; count is kept within them
+SCRAPE_MIN_COUNT = 100
+SCRAPE_MAX_COUNT = 10000
+# archive.org asks clients that make many requests to say how to reach whoever runs them: $IA_CONTACT, an email address or URL,
+# goes into every default User-Agent. A run sending this many requests with no contact in it is reminded, once
+CONTACT_WARN_REQUESTS = 1000
+# add_breaker_args() defaults: pause the run once half of the last 20 attempts failed, for a minute at a time
+BREAKER_THRESHOLD = 0.5
+BREAKER_WINDOW = 20
+BREAKER_COOLDOWN = 60.0
+# --record keeps this much of each response body (--record-max-body); a longer one is cut, and marked so
+RECORD_MAX_BODY = 1024 ** 2
+CASSETTE_VERSION = 1
+# the headers and form fields whose values never go into a cassette
+REDACTED_HEADERS = ("authorization", "proxy-authorization", "cookie", "set-cookie")
+REDACTED_FIELDS = ("access", "secret")
+REDACTED = "<redacted>"
+
+# set by a packaging step that ships the scripts without their git checkout, e.g. "1a2b3c4d5e6f"; read from git otherwise
+BUILD_REVISION: Optional[str] = None
+
+SIZE_UNITS = {"": 1, "K": 1024, "M": 1024 ** 2, "G": 1024 ** 3, "T": 1024 ** 4}
+
+
+def parse_human_size(value: str) -> int:
+    """argparse type for sizes like 300MB, 5G, 1.5GiB or plain bytes (1024-based units)."""
+    m = re.fullmatch(r"\s*(\d+(?:\.\d+)?)\s*([KMGT]?)(?:I?B)?\s*", value, re.IGNORECASE)
+    if not m:
+        raise argparse.ArgumentTypeError(f"invalid size {value!r}, expected e.g. 300MB or 5G")
+    return int(float(m.group(1)) * SIZE_UNITS[m.group(2).upper()])
+
+
+def parse_size(value) -> Optional[int]:
+    """Metadata reports size as a string, int or float; return whole bytes or None."""
+    try:
+        return int(float(value))
+    except (TypeError, ValueError, OverflowError):
+        return None
+
+
+def size_in_range(size: Optional[int], min_size: Optional[int], max_size: Optional[int], keep_unknown: bool) -> bool:
+    if size is None:
+        return keep_unknown
+    if min_size is not None and size < min_size:
+        return False
+    if max_size is not None and size > max_size:
+        return False
+    return True
+
+
+def format_size(num_bytes: Optional[float]) -> str:
+    if num_bytes is None:
+        return "?"
+    size = float(num_bytes)
+    for unit in ("B", "KB", "MB", "GB", "TB"):
+        if size < 1024 or unit == "TB":
+            return f"{size:.1f}{unit}"
+        size /= 1024
+    return f"{num_bytes}B"
+
+
+def parse_duration(value: str) -> float:
+    """argparse type for durations like 90, 45s, 30m, 2h or 1h30m (plain numbers are seconds)."""
+    parts = re.fullmatch(r"\s*(?:(\d+)h)?\s*(?:(\d+)m)?\s*(?:(\d+(?:\.\d+)?)s?)?\s*", value, re.IGNORECASE)
+    if not value.strip() or not parts:
+        raise argparse.ArgumentTypeError(f"invalid duration {value!r}, expected e.g. 90s, 30m or 2h")
+    hours, minutes, seconds = (float(g) if g else 0.0 for g in parts.groups())
+    return hours * 3600 + minutes * 60 + seconds
+
+
+def wayback_timestamp(value: str) -> str:
+    """argparse type for Wayback times: 2024, 202405, 2024-05-01 or 20240501123000, as the digits the Wayback APIs take."""
+    digits = re.sub(r"[-:T ]", "", value)
+    if not re.fullmatch(r"\d{1,14}", digits):
+        raise argparse.ArgumentTypeError(f"invalid timestamp {value!r}, expected e.g. 2024, 2024-05-01 or 20240501123000")
+    return digits
+
+
+def read_list(values: List[str], path: Optional[str]) -> Iterator[str]:
+    """values from the command line, then the lines of path, then stdin when neither gave any ("-" is stdin too).
+
+    Blank lines and # comments are skipped; identifiers and URLs are read this way.
+    """
+    yield from values
+    lines = []
+    if path == "-" or not path and not values and not sys.stdin.isatty():
+        lines = sys.stdin.read().splitlines()
+    elif path:
+        with open(path, encoding="utf-8") as f:
+            lines = f.read().splitlines()
+    for line in lines:
+        line = line.split("#", 1)[0].strip()
+        if line:
+            yield line
+
+
+# Housekeeping files IA adds to every item; {id} is the item identifier. Applied after --glob and the
+# size filters unless --include-housekeeping is given.
+DEFAULT_EXCLUDES = [
+    "__ia_thumb.jpg",
+    "{id}_archive.torrent",
+    "{id}_meta.sqlite",
+    "{id}_reviews.xml",
+    "{id}_itemimage.*",
+    "**/*_thumbs/**",
+    "{id}.thumbs/**",
+]
+
+
+def is_otf(f: dict) -> bool:
+    """Metadata marks files generated on request with otf, as a bool or the string "true"."""
+    return str(f.get("otf", "")).lower() == "true"
+
+
+# The digests of a file's metadata entry that are checked, in this order; hashlib names them the same
+DIGEST_FIELDS = ("md5", "sha1")
+
+
+def metadata_digests(f: dict) -> Dict[str, str]:
+    """The digests f's metadata gives, {algo: lowercase hex}; none for an on-the-fly file, which has no stable one."""
+    if is_otf(f):
+        return {}
+    return {algo: str(f[algo]).lower() for algo in DIGEST_FIELDS if f.get(algo)}
+
+
+def digest_mismatch(expected: Dict[str, str], actual: Dict[str, str]) -> Optional[str]:
+    """How actual differs from expected, e.g. "md5 0a1b..., metadata says 9f8e...", or None when every digest matches."""
+    for algo, want in expected.items():
+        if actual.get(algo) != want:
+            return f"{algo} {actual.get(algo)}, metadata says {want}"
+    return None
+
+
+GLOB_HELP = """\
+--glob matching rules:
+  *.jpg             a pattern without "/" is matched against the base name (scans/page001.jpg matches)
+  scans/*.jpg       a pattern with "/" is matched against the full path; * and ? stop at "/"
+  scans/**/*.jpg    ** matches any number of directories, including none
+  *.iso|*.img       "|" separates alternatives
+  Matching ignores case, and "\\" counts as "/" in both patterns and names."""
+
+
+def glob_to_regex(pattern: str) -> re.Pattern:
+    """Translate a glob with ** support into a case-insensitive regex over "/"-separated names."""
+    out, i = [], 0
+    while i < len(pattern):
+        c = pattern[i]
+        if pattern.startswith("**/", i):
+            out.append("(?:.*/)?")
+            i += 3
+            continue
+        if pattern.startswith("**", i):
+            out.append(".*")
+            i += 2
+            continue
+        if c == "*":
+            out.append("[^/]*")
+        elif c == "?":
+            out.append("[^/]")
+        elif c == "[":
+            end = pattern.find("]", i + 2 if pattern.startswith("[!", i) else i + 1)
+            if end == -1:
+                out.append(re.escape(c))
+            else:
+                body = pattern[i + 1:end]
+                if body.startswith("!"):
+                    body = "^" + body[1:]
+                out.append("[" + body + "]")
+                i = end
+        else:
+            out.append(re.escape(c))
+        i += 1
+    return re.compile("".join(out) + r"\Z", re.IGNORECASE | re.DOTALL)
+
+
+def matches_glob(name: str, pattern: Optional[str]) -> bool:
+    # same "|"-separated alternatives the internetarchive library accepts for glob_pattern
+    if not pattern:
+        return True
+    name = name.replace("\\", "/")
+    for pat in pattern.replace("\\", "/").split("|"):
+        target = name if "/" in pat else name.rsplit("/", 1)[-1]
+        if glob_to_regex(pat).match(target):
+            return True
+    return False
+
+
+def default_excludes(identifier: str) -> List[str]:
+    return [pat.format(id=identifier) for pat in DEFAULT_EXCLUDES]
+
+
+def select_files(files: List[dict], args, identifier: str):
+    """Apply --glob and the size filters, then the housekeeping excludes, to the item's file list.
+
+    Returns (selected, suppressed) where suppressed holds the files only the default excludes dropped.
+    """
+    excludes = [] if args.include_housekeeping else default_excludes(identifier)
+    selected, suppressed = [], []
+    for f in files:
+        name = f.get("name") or ""
+        if not matches_glob(name, args.glob):
+            continue
+        if not size_in_range(parse_size(f.get("size")), args.min_size, args.max_size, args.keep_unknown_size):
+            logging.debug(f"Size filter excludes {name}")
+            continue
+        if any(matches_glob(name, pat) for pat in excludes):
+            logging.debug(f"Default excludes suppress {name}")
+            suppressed.append(f)
+            continue
+        selected.append(f)
+    return selected, suppressed
+
+
+def add_file_filter_args(parser: argparse.ArgumentParser, verb: str):
+    """The file filters select_files() applies: --glob, the size bounds and --include-housekeeping.
+
+    verb says what the tool does with the files selected ("download", "list").
+    """
+    parser.add_argument("--glob", help=f"Only {verb} files matching this glob pattern (e.g. *.iso); see the matching rules below")
+    parser.add_argument("--include-housekeeping", action="store_true", help="Keep IA housekeeping files (thumbnails, torrent, sqlite, ...) that are excluded by default")
+    add_size_filter_args(parser, verb)
+
+
+def add_size_filter_args(parser: argparse.ArgumentParser, verb: str):
+    """The size bounds alone, for tools with file filters of their own; size_in_range() applies them."""
+    parser.add_argument("--min-size", type=parse_human_size, help=f"Don't {verb} files smaller than this metadata size (e.g. 300MB)")
+    parser.add_argument("--max-size", type=parse_human_size, help=f"Don't {verb} files larger than this metadata size (e.g. 5G)")
+    parser.add_argument("--keep-unknown-size", action="store_true", default=True, help="Keep files with no size in metadata when a size filter is set (default: true)")
+    parser.add_argument("--no-keep-unknown-size", action="store_false", dest="keep_unknown_size", help="Drop files with no size in metadata when a size filter is set")
+
+
+def check_file_filter_args(parser: argparse.ArgumentParser, args: argparse.Namespace):
+    check_size_filter_args(parser, args)
+
+
+def check_size_filter_args(parser: argparse.ArgumentParser, args: argparse.Namespace):
+    if args.min_size is not None and args.max_size is not None and args.min_size > args.max_size:
+        parser.error("--min-size must not be larger than --max-size")
+
+
+# --sort-by columns for the file listings
+SORT_KEYS = {
+    "name": lambda f: (f.get("name") or "").lower(),
+    # unknown sizes sort after every known size
+    "size": lambda f: (parse_size(f.get("size")) is None, parse_size(f.get("size")) or 0),
+    "format": lambda f: (f.get("format") or "").lower(),
+    "source": lambda f: (f.get("source") or "").lower(),
+}
+
+
+# what a --log-format json line has besides time, level and message, from log_context() or a call's extra=
+LOG_FIELDS = ("identifier", "file", "url", "attempt", "status", "circuit_breaker")
+LOG_FORMATS = ("text", "json")
+_log_context: contextvars.ContextVar = contextvars.ContextVar("log_context", default={})
+
+
+@contextlib.contextmanager
+def log_context(**fields):
+    """Give the records logged inside, in this thread, these LOG_FIELDS (identifier=, file=...)."""
+    token = _log_context.set({**_log_context.get(), **fields})
+    try:
+        yield
+    finally:
+        _log_context.reset(token)
+
+
+class ContextFilter(logging.Filter):
+    """Copies the log_context() fields onto each record, unless the call's extra= set them."""
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        for name, value in _log_context.get().items():
+            if not hasattr(record, name):
+                setattr(record, name, value)
+        return True
+
+
+class JsonFormatter(logging.Formatter):
+    """One JSON object per record: time (UTC), level, message, the LOG_FIELDS it has and the traceback as error."""
+
+    def format(self, record: logging.LogRecord) -> str:
+        line = {"time": datetime.fromtimestamp(record.created, timezone.utc).isoformat(timespec="milliseconds"),
+                "level": record.levelname.lower(), "message": record.getMessage()}
+        for name in LOG_FIELDS:
+            if getattr(record, name, None) is not None:
+                line[name] = getattr(record, name)
+        if record.exc_info:
+            line["error"] = self.formatException(record.exc_info)
+        return json.dumps(line, ensure_ascii=False, default=str)
+
+
+def setup_logging(verbosity: int, log_file: Optional[str] = None, stream=None, log_format: str = "text"):
+    level = logging.WARNING
+    if verbosity == 1:
+        level = logging.INFO
+    elif verbosity >= 2:
+        level = logging.DEBUG
+
+    handlers = [logging.StreamHandler(stream or sys.stdout)]
+    if log_file:
+        handlers.append(logging.FileHandler(log_file, encoding="utf-8"))
+
+    for handler in handlers:
+        handler.addFilter(ContextFilter())
+        if log_format == "json":
+            handler.setFormatter(JsonFormatter())
+
+    logging.basicConfig(
+        level=level,
+        format="%(asctime)s | %(levelname)-8s | %(message)s",
+        datefmt="%H:%M:%S",
+        handlers=handlers,
+    )
+
+    # Tame noisy urllib3 retry warnings unless user asked for very verbose logs
+    u3_level = logging.DEBUG if verbosity >= 2 else logging.ERROR
+    for name in ("urllib3", "urllib3.connectionpool", "requests.packages.urllib3"):
+        logging.getLogger(name).setLevel(u3_level)
+
+
+# on_retry(method, url, attempt, retries, reason, delay) is called before retry attempt of retries sleeps delay seconds
+RetryHook = Callable[[str, str, int, int, str, float], None]
+
+
+def log_retry(method: str, url: str, attempt: int, retries: int, reason: str, delay: float):
+    status = int(reason[5:]) if re.fullmatch(r"HTTP \d+", reason) else None
+    logging.warning(f"{method} {url}: {reason}; retrying in {delay:.1f}s ({attempt}/{retries})",
+                    extra={"url": url, "attempt": attempt, "status": status})
+
+
+def retry_after(response) -> Optional[float]:
+    """Seconds the response's Retry-After header asks for (a number or an HTTP date), or None."""
+    value = response.headers.get("Retry-After") if response is not None else None
+    if not value:
+        return None
+    try:
+        return Retry().parse_retry_after(value)
+    except InvalidHeader:
+        return None
+
+
+def retry_delay(attempt: int, response=None, backoff: float = 1.0, cap: float = RETRY_BACKOFF_CAP, jitter: bool = True) -> float:
+    """How long to wait before retrying after attempt (0 for the first): Retry-After if the server sent one, else backoff.
+
+    The backoff doubles with each attempt up to cap, and with jitter is drawn anywhere between 0 and
+    that ("full jitter"), so clients that failed together don't all come back at the same moment.
+    """
+    after = retry_after(response)
+    if after is not None:
+        return after
+    ceiling = min(backoff * 2 ** attempt, cap)
+    return random.uniform(0, ceiling) if jitter else ceiling
+
+
+def transient(exc: Exception) -> bool:
+    """Whether a failed request is worth another attempt: no answer at all (connection errors, timeouts, bodies cut short), 429 or 5xx."""
+    response = getattr(exc, "response", None)
+    if response is None:
+        return True
+    return isinstance(classify(response), (RateLimited, Transient))
+
+
+def retry_reason(exc: Exception) -> str:
+    """How a retry warning names the failure: the status of an answer, else the error."""
+    response = getattr(exc, "response", None)
+    return f"HTTP {response.status_code}" if response is not None else str(exc)
+
+
+class RetryPolicy(Retry):
+    """The session-level retry policy: idempotent requests are retried on RETRY_STATUSES and network errors.
+
+    On top of urllib3's Retry (attempt counts, Retry-After), the waits are retry_delay()'s, the same
+    jittered backoff as retry_call(); each retry is reported to on_retry, and a request gives up once
+    its retries would end more than max_elapsed seconds after the first failure. A status answer is
+    then returned as is, an error raised.
+    """
+
+    def __init__(self, *args, on_retry: Optional[RetryHook] = None, max_elapsed: Optional[float] = None, **kwargs):
+        super().__init__(*args, **kwargs)
+        self.on_retry = on_retry
+        self.max_elapsed = max_elapsed
+        self.first_failure: Optional[float] = None
+        # chosen by increment(), then slept by urllib3 through get_backoff_time()
+        self.delay = 0.0
+
+    def new(self, **kw) -> "RetryPolicy":
+        new = super().new(**kw)
+        new.on_retry = self.on_retry
+        new.max_elapsed = self.max_elapsed
+        new.first_failure = self.first_failure
+        return new
+
+    def increment(self, method=None, url=None, response=None, error=None, _pool=None, _stacktrace=None) -> "RetryPolicy":
+        new = super().increment(method, url, response, error, _pool, _stacktrace)
+        if new.first_failure is None:
+            new.first_failure = time.monotonic()
+        after = retry_after(response) if self.respect_retry_after_header else None
+        delay = after if after is not None else retry_delay(len(new.history) - 1, backoff=self.backoff_factor, cap=self.backoff_max)
+        reason = str(error) if error else f"HTTP {response.status}" if response is not None else "failed"
+        if self.max_elapsed is not None and time.monotonic() + delay - new.first_failure > self.max_elapsed:
+            raise MaxRetryError(_pool, url, error or ResponseError(f"{reason}, and retrying would take more than {self.max_elapsed}s"))
+        if self.on_retry:
+            retries = new.total + len(new.history) if new.total is not None else len(new.history)
+            self.on_retry(method, url, len(new.history), retries, reason, delay)
+        new.delay = delay
+        return new
+
+    def get_backoff_time(self) -> float:
+        return self.delay
+
+
+def retry_policy(retries: int, backoff: float, on_retry: Optional[RetryHook] = None,
+                 max_elapsed: Optional[float] = RETRY_MAX_ELAPSED) -> RetryPolicy:
+    return RetryPolicy(
+        total=retries,
+        connect=retries,
+        read=retries,
+        backoff_factor=backoff,
+        backoff_max=RETRY_BACKOFF_CAP,
+        status_forcelist=RETRY_STATUSES,
+        allowed_methods=("HEAD", "GET", "OPTIONS"),
+        raise_on_status=False,
+        on_retry=on_retry,
+        max_elapsed=max_elapsed,
+    )
+
+
+T = TypeVar("T")
+
+
+def retry_call(call: Callable[[int], T], retries: int, backoff: float = DEFAULT_BACKOFF, method: str = "", url: str = "",
+               should_retry: Callable[[Exception], bool] = transient, errors: Tuple[type, ...] = (requests.RequestException,),
+               max_elapsed: Optional[float] = RETRY_MAX_ELAPSED, on_retry: Optional[Callable[[int, Exception, float], None]] = None,
+               sleep: Optional[Callable[[float], None]] = None) -> T:
+    """call(attempt) until it returns, for the requests the session's RetryPolicy can't retry (POSTs, PUTs, streamed bodies).
+
+    A failure in errors that should_retry() accepts is tried again, up to retries times, after
+    retry_delay(); the retries give up, raising the last failure, once they would end more than
+    max_elapsed seconds after the first one. on_retry(attempt, error, delay) is told of each retry
+    before sleep(delay) (time.sleep by default), and may raise to give up instead; by default it
+    logs method and url like the session's retries.
+    """
+    first_failure = None
+    for attempt in range(retries + 1):
+        try:
+            return call(attempt)
+        except errors as e:
+            if attempt == retries or not should_retry(e):
+                raise
+            delay = retry_delay(attempt, getattr(e, "response", None), backoff)
+            if first_failure is None:
+                first_failure = time.monotonic()
+            if max_elapsed is not None and time.monotonic() + delay - first_failure > max_elapsed:
+                raise
+            if on_retry:
+                on_retry(attempt + 1, e, delay)
+            else:
+                log_retry(method, url, attempt + 1, retries, retry_reason(e), delay)
+            (sleep or time.sleep)(delay)
+
+
+class RequestLimiter:
+    """Token bucket of requests: up to burst back to back, then rps per second, shared by every thread.
+
+    A request that finds the bucket empty takes a token anyway and sleeps off the debt, so waiting
+    requests go out in turn instead of racing for each new token.
+    """
+
+    def __init__(self, rps: float, burst: Optional[int] = None):
+        self.rps = rps
+        self.burst = burst or max(1, int(rps))
+        self.tokens = float(self.burst)
+        self.updated = time.monotonic()
+        self.lock = threading.Lock()
+
+    def acquire(self):
+        with self.lock:
+            now = time.monotonic()
+            self.tokens = min(self.burst, self.tokens + (now - self.updated) * self.rps) - 1
+            self.updated = now
+            wait = -self.tokens / self.rps if self.tokens < 0 else 0.0
+        if wait:
+            time.sleep(wait)
+
+
+class CircuitBreaker:
+    """The run's circuit breaker: when most recent requests fail, every thread waits it out instead of spending its retries.
+
+    Each attempt is record()ed, retries included; an answer with one of RETRY_STATUSES, or no answer
+    at all, is a failure. Once threshold of the last window attempts failed, the breaker opens:
+    acquire() holds every new request back for cooldown seconds, then lets one through as the probe
+    ("half-open"). An answer closes it again, and the run resumes; another failure opens it for
+    another cooldown. Retries of a request already sent are left to the session's policy. Each change
+    is logged as a warning whose circuit_breaker field is status(), which StatsFile copies into the
+    stats file.
+    """
+
+    CLOSED, OPEN, HALF_OPEN = "closed", "open", "half-open"
+
+    def __init__(self, threshold: float = BREAKER_THRESHOLD, window: int = BREAKER_WINDOW, cooldown: float = BREAKER_COOLDOWN,
+                 clock: Callable[[], float] = time.monotonic):
+        self.threshold = threshold
+        self.cooldown = cooldown
+        self.clock = clock
+        self.outcomes: deque = deque(maxlen=window)
+        self.state = self.CLOSED
+        self.reopens = 0.0
+        self.paused_since: Optional[float] = None
+        self.paused_seconds = 0.0
+        self.pauses = 0
+        self.probing = False
+        self.cond = threading.Condition()
+
+    def status(self) -> dict:
+        until = None
+        if self.state == self.OPEN:
+            until = datetime.fromtimestamp(time.time() + self.reopens - self.clock(), timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+        return {"state": self.state, "failed": self.outcomes.count(False), "window": self.outcomes.maxlen, "paused_until": until,
+                "pauses": self.pauses, "paused_seconds": round(self.paused_seconds)}
+
+    def allow(self) -> Optional[bool]:
+        """Whether a request may go now: True for the probe, False for any other; None when it has to wait."""
+        with self.cond:
+            if self.state == self.OPEN and self.clock() >= self.reopens:
+                self.state = self.HALF_OPEN
+                logging.info("Circuit breaker: the pause is over; one request checks whether archive.org answers again")
+            if self.state == self.CLOSED:
+                return False
+            if self.state == self.HALF_OPEN and not self.probing:
+                self.probing = True
+                return True
+            return None
+
+    def acquire(self) -> bool:
+        """Wait until a request may go; True when it is the probe, which must then be record()ed or release()d."""
+        with self.cond:
+            while True:
+                probe = self.allow()
+                if probe is not None:
+                    return probe
+                # the probe's outcome wakes the waiters; the timeout only covers a probe that never reports
+                self.cond.wait(max(self.reopens - self.clock(), 0.01) if self.state == self.OPEN else 1.0)
+
+    def record(self, ok: bool):
+        with self.cond:
+            if self.state == self.CLOSED:
+                self.outcomes.append(ok)
+                failed = self.outcomes.count(False)
+                if len(self.outcomes) == self.outcomes.maxlen and failed >= self.threshold * len(self.outcomes):
+                    self.paused_since = self.clock()
+                    self.pauses += 1
+                    self.open(f"{failed} of the last {len(self.outcomes)} requests to archive.org failed")
+            elif self.state == self.HALF_OPEN:
+                if ok:
+                    paused = self.clock() - self.paused_since
+                    self.paused_seconds += paused
+                    self.state = self.CLOSED
+                    self.outcomes.clear()
+                    self.probing = False
+                    logging.warning(f"Circuit breaker: archive.org answers again; resuming after {paused:.0f}s paused",
+                                    extra={"circuit_breaker": self.status()})
+                    self.cond.notify_all()
+                else:
+                    self.open("the request sent to check archive.org failed too")
+            # while open, the requests still in flight don't change anything
+
+    def release(self):
+        """The probe ended without an answer to judge archive.org by (an error of its own); another request probes."""
+        with self.cond:
+            if self.state == self.HALF_OPEN:
+                self.probing = False
+                self.cond.notify_all()
+
+    def open(self, reason: str):
+        self.state = self.OPEN
+        self.probing = False
+        self.reopens = self.clock() + self.cooldown
+        logging.warning(f"Circuit breaker: {reason}; pausing every request for {self.cooldown:g}s",
+                        extra={"circuit_breaker": self.status()})
+        self.cond.notify_all()
+
+
+def positive_number(value: str) -> float:
+    try:
+        number = float(value)
+    except ValueError:
+        number = 0
+    if not number > 0:
+        raise argparse.ArgumentTypeError(f"expected a number above 0, got {value!r}")
+    return number
+
+
+def metadata_pair(value: str) -> Tuple[str, str]:
+    """A key=value metadata argument, the key lowercased as archive.org stores it."""
+    key, sep, val = value.partition("=")
+    if not sep or not re.fullmatch(r"[A-Za-z][A-Za-z0-9_-]*", key):
+        raise argparse.ArgumentTypeError(f"expected key=value with a plain key, got {value!r}")
+    return key.lower(), val
+
+
+def add_request_rate_args(parser: argparse.ArgumentParser):
+    """--max-rps and --rps-burst, defaulting to $IA_MAX_RPS and $IA_RPS_BURST; see request_limiter()."""
+    parser.add_argument("--max-rps", type=positive_number, default=os.environ.get("IA_MAX_RPS"),
+                        help="Cap archive.org requests at this many per second across all threads (default: $IA_MAX_RPS, else no cap)")
+    parser.add_argument("--rps-burst", type=int, default=os.environ.get("IA_RPS_BURST"),
+                        help="Requests let through back to back before --max-rps paces them (default: $IA_RPS_BURST, else one second's worth)")
+
+
+def proxy_url(value: str) -> str:
+    """argparse type for --proxy: an http, https or socks5 URL, with user:password@ when the proxy wants them."""
+    parts = urlsplit(value)
+    if parts.scheme not in PROXY_SCHEMES or not parts.hostname:
+        raise argparse.ArgumentTypeError(f"expected an http://, https://, socks5:// or socks5h:// URL, got {value!r}")
+    if parts.scheme.startswith("socks"):
+        try:
+            import socks  # noqa: F401
+        except ImportError:
+            raise argparse.ArgumentTypeError("a SOCKS proxy needs PySocks: pip install 'requests[socks]'") from None
+    return value
+
+
+def ca_bundle(value: str) -> str:
+    """argparse type for --ca-cert: a PEM file that exists."""
+    if not os.path.isfile(value):
+        raise argparse.ArgumentTypeError(f"no such file: {value}")
+    return value
+
+
+def add_transport_args(parser: argparse.ArgumentParser):
+    """--proxy, --ca-cert, --connect-timeout, --insecure-skip-verify, --record and --replay; see build_session()."""
+    parser.add_argument("--proxy", type=proxy_url,
+                        help="Send every request through this proxy: http://, https://, socks5:// or socks5h:// (DNS through the proxy too); "
+                             "hosts in $NO_PROXY still go direct (default: $HTTPS_PROXY/$HTTP_PROXY)")
+    parser.add_argument("--ca-cert", type=ca_bundle,
+                        help="Trust the CA certificates in this PEM file instead of the bundled ones, e.g. a network's own CA that inspects TLS")
+    parser.add_argument("--connect-timeout", type=positive_number, default=DEFAULT_CONNECT_TIMEOUT,
+                        help=f"Seconds to connect, TLS handshake included (default: {DEFAULT_CONNECT_TIMEOUT}); --timeout is then the wait for each answer and read")
+    parser.add_argument("--insecure-skip-verify", action="store_true",
+                        help="DANGEROUS: don't check TLS certificates, so anyone on the way can read and change the traffic, credentials included")
+    cassette = parser.add_mutually_exclusive_group()
+    cassette.add_argument("--record", metavar="CASSETTE",
+                          help="Write every request and response of the run to this JSON file, credentials redacted, "
+                               "to replay it or attach to a bug report")
+    cassette.add_argument("--replay", metavar="CASSETTE",
+                          help="Answer every request from a file --record wrote instead of the network; a request it has no answer for stops the tool")
+    parser.add_argument("--record-max-body", type=parse_human_size, default=RECORD_MAX_BODY,
+                        help="With --record, keep at most this much of each response body, e.g. 10M (default: 1M)")
+
+
+def request_limiter(max_rps: Optional[float], burst: Optional[int] = None) -> Optional[RequestLimiter]:
+    return RequestLimiter(max_rps, burst) if max_rps else None
+
+
+def add_breaker_args(parser: argparse.ArgumentParser):
+    """--breaker-threshold, --breaker-window, --breaker-cooldown and --no-breaker; see circuit_breaker()."""
+    parser.add_argument("--breaker-threshold", type=float, default=BREAKER_THRESHOLD,
+                        help=f"Pause every request of the run once this share of the last --breaker-window attempts failed "
+                             f"(429, 5xx or no answer; default: {BREAKER_THRESHOLD:g})")
+    parser.add_argument("--breaker-window", type=int, default=BREAKER_WINDOW,
+                        help=f"Attempts, retries included, the failure share is taken over (default: {BREAKER_WINDOW})")
+    parser.add_argument("--breaker-cooldown", type=parse_duration, default=BREAKER_COOLDOWN,
+                        help=f"How long a pause lasts before one request checks whether archive.org answers again, e.g. 90s or 5m "
+                             f"(default: {BREAKER_COOLDOWN:g}s)")
+    parser.add_argument("--no-breaker", action="store_true", help="Never pause the run; each request only gets its own retries")
+
+
+def check_breaker_args(parser: argparse.ArgumentParser, args: argparse.Namespace):
+    if not 0 < args.breaker_threshold <= 1:
+        parser.error("--breaker-threshold must be more than 0 and at most 1")
+    if args.breaker_window < 1:
+        parser.error("--breaker-window must be at least 1")
+
+
+def circuit_breaker(args: argparse.Namespace) -> Optional[CircuitBreaker]:
+    """The breaker add_breaker_args() configures, for every session of the run to share; None with --no-breaker or without the flags."""
+    if not hasattr(args, "breaker_threshold") or args.no_breaker:
+        return None
+    return CircuitBreaker(args.breaker_threshold, args.breaker_window, args.breaker_cooldown)
+
+
+# where the ia tool looks for its config, in order; $IA_CONFIG_FILE comes first
+IA_CONFIG_FILES = ("~/.config/internetarchive/ia.ini", "~/.config/ia.ini", "~/.ia")
+
+
+class CredentialsError(ValueError):
+    """ia's config file is there but can't be used; better to stop than to carry on without the keys."""
+
+
+def ia_config() -> Optional[Tuple[str, configparser.ConfigParser]]:
+    """The ia tool's config file and what is in it: $IA_CONFIG_FILE (which --ia-config-file sets), else the first of IA_CONFIG_FILES."""
+    explicit = os.environ.get("IA_CONFIG_FILE")
+    if explicit and not os.path.isfile(explicit):
+        raise CredentialsError(f"the ia config file {explicit} does not exist")
+    for path in [explicit] if explicit else [os.path.expanduser(p) for p in IA_CONFIG_FILES]:
+        if not os.path.isfile(path):
+            continue
+        config = configparser.ConfigParser(interpolation=None)
+        try:
+            config.read(path, encoding="utf-8")
+        except (configparser.Error, UnicodeDecodeError) as e:
+            raise CredentialsError(f"{path} is not a valid ia config file: {e}") from e
+        return path, config
+    return None
+
+
+def s3_credentials() -> Optional[Tuple[str, str]]:
+    """IAS3 (access, secret) keys from $IA_ACCESS_KEY and $IA_SECRET_KEY, else the [s3] section of ia's ia.ini."""
+    if os.environ.get("IA_ACCESS_KEY") and os.environ.get("IA_SECRET_KEY"):
+        return os.environ["IA_ACCESS_KEY"], os.environ["IA_SECRET_KEY"]
+    found = ia_config()
+    if found is None:
+        return None
+    path, config = found
+    access, secret = (config.get("s3", key, fallback="").strip() for key in ("access", "secret"))
+    if bool(access) != bool(secret):
+        raise CredentialsError(f"{path}: [s3] has {'access' if access else 'secret'} but no {'secret' if access else 'access'}")
+    return (access, secret) if access else None
+
+
+def ia_cookies() -> Dict[str, str]:
+    """The login cookies (logged-in-user, logged-in-sig) in the [cookies] section of ia's ia.ini.
+
+    ia keeps each as it came in Set-Cookie; the value is the part before the first ";".
+    """
+    found = ia_config()
+    if found is None or not found[1].has_section("cookies"):
+        return {}
+    return {name: value.split(";", 1)[0].strip() for name, value in found[1].items("cookies") if value.strip()}
+
+
+def is_archive_host(url: str) -> bool:
+    host = urlsplit(url).hostname or ""
+    return (host == "archive.org" or host.endswith(".archive.org")
+            or host in (urlsplit(ARCHIVE_URL).hostname, urlsplit(S3_URL).hostname, urlsplit(WAYBACK_URL).hostname))
+
+
+class S3Auth(AuthBase):
+    """Signs archive.org requests with "Authorization: LOW access:secret"; other hosts never see the keys."""
+
+    def __init__(self, access_key: str, secret_key: str):
+        self.access_key = access_key
+        self.secret_key = secret_key
+
+    def __call__(self, request):
+        if is_archive_host(request.url):
+            request.headers["Authorization"] = f"LOW {self.access_key}:{self.secret_key}"
+        return request
+
+    def __repr__(self):
+        return f"S3Auth({self.access_key!r}, <secret>)"
+
+
+def s3_auth() -> Optional[S3Auth]:
+    keys = s3_credentials()
+    return S3Auth(*keys) if keys else None
+
+
+def add_ia_config_arg(parser: argparse.ArgumentParser):
+    parser.add_argument("--ia-config-file", default=os.environ.get("IA_CONFIG_FILE"),
+                        help=f"ia's config file, with your IAS3 keys and login cookies (default: $IA_CONFIG_FILE, else the first of {', '.join(IA_CONFIG_FILES)})")
+
+
+def add_auth_args(parser: argparse.ArgumentParser):
+    parser.add_argument("--anonymous", action="store_true",
+                        help="Send no credentials, even when $IA_ACCESS_KEY/$IA_SECRET_KEY or ia.ini has them")
+    add_ia_config_arg(parser)
+
+
+# the config file every tool reads its defaults from; --config or $IA_TOOLS_CONFIG to use another
+CONFIG_FILE = os.path.join(os.environ.get("XDG_CONFIG_HOME") or os.path.expanduser("~/.config"), "ia-tools", "config.toml")
+# flags whose default comes from the environment; a variable that is set wins over the config file
+ENV_DEFAULTS = {"user_agent": "IA_USER_AGENT", "limit_rate": "IA_LIMIT_RATE", "max_rps": "IA_MAX_RPS", "rps_burst": "IA_RPS_BURST",
+                "ia_config_file": "IA_CONFIG_FILE", "checksum_db": "IA_CHECKSUM_DB"}
+
+
+def load_config(path: str, tool: str) -> Tuple[Dict[str, object], Dict[str, object]]:
+    """The top-level settings of a config file, and those of its [tool] table.
+
+    Tables for other tools are skipped, so one file serves all of them.
+    """
+    if tomllib is None:
+        raise ValueError(f"reading {path} needs Python 3.11 or later (tomllib)")
+    with open(path, "rb") as f:
+        try:
+            config = tomllib.load(f)
+        except tomllib.TOMLDecodeError as e:
+            raise ValueError(f"{path}: {e}") from e
+    shared = {k: v for k, v in config.items() if not isinstance(v, dict)}
+    own = config.get(tool) if isinstance(config.get(tool), dict) else {}
+    return shared, own
+
+
+def _parsers(parser: argparse.ArgumentParser) -> Iterator[argparse.ArgumentParser]:
+    """parser and the parsers of its subcommands, which hold their own defaults."""
+    yield parser
+    for action in parser._actions:
+        if isinstance(action, argparse._SubParsersAction):
+            for sub in action.choices.values():
+                yield from _parsers(sub)
+
+
+@functools.lru_cache(maxsize=None)
+def build_info() -> Tuple[Optional[str], bool]:
+    """The git revision the scripts run from and whether they have uncommitted changes; (None, False) outside a checkout."""
+    if BUILD_REVISION:
+        return BUILD_REVISION, False
+    here = os.path.dirname(os.path.abspath(__file__))
+    try:
+        rev = subprocess.run(["git", "-C", here, "rev-parse", "--short=12", "HEAD"], capture_output=True, text=True, timeout=5)
+        if rev.returncode != 0:
+            return None, False
+        status = subprocess.run(["git", "-C", here, "status", "--porcelain", "--untracked-files=no"],
+                                capture_output=True, text=True, timeout=5)
+    except (OSError, subprocess.SubprocessError):
+        return None, False
+    return rev.stdout.strip(), bool(status.stdout.strip())
+
+
+def full_version(version: str) -> str:
+    """version with the revision it was built from, as a PEP 440 local version: 1.0+g1a2b3c4d5e6f, or 1.0+g1a2b3c4d5e6f.dirty."""
+    rev, dirty = build_info()
+    if not rev:
+        return version
+    return f"{version}+g{rev}" + (".dirty" if dirty else "")
+
+
+def default_user_agent(tool: str, version: str, client: str = "Python-requests") -> str:
+    """The User-Agent a tool sends without --user-agent: its name, full_version() and $IA_CONTACT, then the client library.
+
+    Every tool builds its own here, so they all say the same things, e.g.
+    "IA-Size/1.0+g1a2b3c4d5e6f (Internet-Archive-API; +ops@example.org) Python-requests".
+    """
+    contact = os.environ.get("IA_CONTACT", "").strip()
+    comment = f"Internet-Archive-API; +{contact}" if contact else "Internet-Archive-API"
+    return f"{tool}/{full_version(version)} ({comment}) {client}"
+
+
+def version_text(tool: str, version: str) -> str:
+    """What --version prints: the version, the revision and the Python and requests it runs on, for bug reports."""
+    rev, dirty = build_info()
+    lines = [f"{tool} {full_version(version)}",
+             f"revision {rev}" + (" (uncommitted changes)" if dirty else "") if rev else "revision unknown (not a git checkout)",
+             f"Python {platform.python_version()}, requests {requests.__version__}"]
+    return "\n".join(lines)
+
+
+class VersionAction(argparse.Action):
+    """argparse's version action, without rewrapping version_text() into one line."""
+
+    def __init__(self, option_strings, version: str, dest=argparse.SUPPRESS, default=argparse.SUPPRESS, help=None):
+        super().__init__(option_strings, dest, nargs=0, default=default, help=help)
+        self.version = version
+
+    def __call__(self, parser, namespace, values, option_string=None):
+        print(self.version)
+        parser.exit()
+
+
+def parse_args(parser: argparse.ArgumentParser, script: str, argv: Optional[List[str]] = None,
+               version: Optional[str] = None) -> argparse.Namespace:
+    """parser.parse_args() with --config and --print-config, taking defaults from the shared config file.
+
+    With version (the tool's TOOL_VERSION) there is --version too, printing version_text().
+    --generate-completion prints completion_script() for the parser as it is then, subcommands included.
+
+    A flag given wins over its environment variable (ENV_DEFAULTS), which wins over the config file, which
+    wins over the tool's default. In the file, keys are flag names (user-agent or user_agent); the top-level
+    ones apply to every tool that has the flag, and a table named after the script ([IA-Size] for
+    IA-Size.py) to that tool only, where a key it has no flag for is an error.
+
+    For tools with --ia-config-file, the file it names is the one s3_credentials() reads, and it is read
+    here once, so a broken one stops the tool before it sends anything without the keys. With --record or
+    --replay, args.cassette is the Cassette session_from_args() gives every session.
+    """
+    tool = os.path.splitext(os.path.basename(script))[0]
+    parser.add_argument("--config", help=f"Read default settings from this TOML file (default: $IA_TOOLS_CONFIG, else {CONFIG_FILE} when it exists)")
+    parser.add_argument("--print-config", action="store_true", help="Print the settings in effect, and where each comes from, and exit")
+    if version:
+        parser.add_argument("--version", action=VersionAction, version=version_text(tool, version), help="Print the version and revision, and exit")
+    parser.add_argument("--generate-completion", choices=SHELLS, help="Print a completion script of these flags for this shell, and exit")
+    pre = argparse.ArgumentParser(add_help=False)
+    pre.add_argument("--config")
+    pre.add_argument("--generate-completion", choices=SHELLS)
+    known, _ = pre.parse_known_args(argv)
+    if known.generate_completion:
+        # before anything else, so it works without the arguments the tool requires
+        print(completion_script(parser, os.path.basename(script), known.generate_completion), end="")
+        sys.exit(0)
+    path = known.config or os.environ.get("IA_TOOLS_CONFIG") or (CONFIG_FILE if os.path.isfile(CONFIG_FILE) else None)
+    applied: Dict[str, object] = {}
+    if path:
+        try:
+            shared, own = load_config(path, tool)
+        except (OSError, ValueError) as e:
+            parser.error(f"could not read the config file: {e}")
+        for settings, strict in ((shared, False), (own, True)):
+            for key, value in settings.items():
+                dest = key.replace("-", "_")
+                targets = [p for p in _parsers(parser) if any(a.dest == dest for a in p._actions)]
+                if not targets:
+                    if strict:
+                        parser.error(f"{path}: [{tool}] sets {key}, which {tool} has no flag for")
+                    continue
+                if os.environ.get(ENV_DEFAULTS.get(dest, "")):
+                    continue
+                for target in targets:
+                    target.set_defaults(**{dest: value})
+                applied[dest] = value
+    args = parser.parse_args(argv)
+    if getattr(args, "ia_config_file", None):
+        os.environ["IA_CONFIG_FILE"] = args.ia_config_file
+    if hasattr(args, "ia_config_file") and not getattr(args, "anonymous", False):
+        try:
+            s3_credentials()
+            ia_cookies()
+        except CredentialsError as e:
+            parser.error(str(e))
+    if getattr(args, "ca_cert", None) and getattr(args, "insecure_skip_verify", False):
+        parser.error("--ca-cert and --insecure-skip-verify contradict each other; give one")
+    if args.print_config:
+        print_config(parser, args, argv if argv is not None else sys.argv[1:], applied, path)
+        sys.exit(0)
+    if getattr(args, "record", None) or getattr(args, "replay", None):
+        # one cassette for all the sessions of the run
+        try:
+            args.cassette = Cassette(args.replay or args.record, replay=bool(args.replay), max_body=args.record_max_body, tool=tool)
+        except (OSError, ValueError) as e:
+            parser.error(f"could not read the cassette: {e}")
+    return args
+
+
+def print_config(parser: argparse.ArgumentParser, args: argparse.Namespace, argv: List[str], applied: Dict[str, object],
+                 path: Optional[str]):
+    print(f"# config file: {path or 'none'}")
+    seen = set()
+    for target in _parsers(parser):
+        for action in target._actions:
+            if not action.option_strings or action.dest in seen or action.dest in ("help", "config", "print_config"):
+                continue
+            seen.add(action.dest)
+            if not hasattr(args, action.dest):
+                continue
+            if any(arg == opt or arg.startswith(f"{opt}=") for arg in argv for opt in action.option_strings):
+                source = "command line"
+            elif action.dest in applied:
+                source = "config file"
+            elif os.environ.get(ENV_DEFAULTS.get(action.dest, "")):
+                source = f"${ENV_DEFAULTS[action.dest]}"
+            else:
+                source = "default"
+            print(f"{action.dest} = {json.dumps(getattr(args, action.dest), default=str)}  # {source}")
+
+
+# what --generate-completion completes with file or directory names; other values are free text unless they have choices
+COMPLETE_FILES = {"config", "files", "from_json", "input", "magnets", "map", "missing", "out", "output", "record", "replay", "report",
+                  "state", "warc"}
+COMPLETE_DIRS = {"dest", "destdir", "root"}
+SHELLS = ("bash", "zsh", "fish")
+
+
+def complete_hint(action: argparse.Action) -> Optional[Tuple[str, ...]]:
+    """What an option's value completes to: ("choices", ...), ("file",), ("dir",) or ("value",); None when it takes none."""
+    if action.nargs == 0:
+        return None
+    if action.choices:
+        return ("choices",) + tuple(str(c) for c in action.choices)
+    if action.dest in COMPLETE_DIRS or action.dest.endswith("_dir"):
+        return ("dir",)
+    if action.dest in COMPLETE_FILES or action.dest.endswith("_file"):
+        return ("file",)
+    return ("value",)
+
+
+def _commands(parser: argparse.ArgumentParser) -> List[Tuple[str, str, argparse.ArgumentParser]]:
+    """(name, help, parser) of each subcommand, or [] for a tool without any."""
+    for action in parser._actions:
+        if isinstance(action, argparse._SubParsersAction):
+            helps = {a.dest: a.help or "" for a in action._choices_actions}
+            return [(name, helps.get(name, ""), sub) for name, sub in action.choices.items()]
+    return []
+
+
+def _options(parser: argparse.ArgumentParser) -> List[argparse.Action]:
+    return [a for a in parser._actions if a.option_strings and a.help != argparse.SUPPRESS]
+
+
+def _positional_hint(parser: argparse.ArgumentParser) -> Optional[Tuple[str, ...]]:
+    for action in parser._actions:
+        if not action.option_strings and not isinstance(action, argparse._SubParsersAction):
+            hint = complete_hint(action)
+            if hint and hint[0] != "value":
+                return hint
+    return None
+
+
+def completion_script(parser: argparse.ArgumentParser, command: str, shell: str) -> str:
+    """A completion script for command (the script's file name) in shell, made from parser's own flags and subcommands."""
+    return {"bash": _bash_completion, "zsh": _zsh_completion, "fish": _fish_completion}[shell](parser, command)
+
+
+def _bash_completion(parser: argparse.ArgumentParser, command: str) -> str:
+    func = "_" + re.sub(r"\W", "_", command)
+    commands = _commands(parser)
+    scopes = [("", parser)] + [(name, sub) for name, _, sub in commands]
+    words = {"file": "compgen -f", "dir": "compgen -d"}
+    lines = [f"# bash completion for {command}; source it, or put it in ~/.local/share/bash-completion/completions/{command}",
+             f"{func}() {{", '    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" command="" i']
+    if commands:
+        names = " ".join(name for name, _, _ in commands)
+        lines += ["    for ((i = 1; i < COMP_CWORD; i++)); do",
+                  f'        case "${{COMP_WORDS[i]}}" in {"|".join(n for n, _, _ in commands)}) command="${{COMP_WORDS[i]}}"; break ;; esac',
+                  "    done"]
+    lines.append('    case "$command:$prev" in')
+    for scope, sub in scopes:
+        for action in _options(sub):
+            hint = complete_hint(action)
+            if hint is None:
+                continue
+            patterns = "|".join(f"{scope}:{opt}" for opt in action.option_strings)
+            if hint[0] == "choices":
+                reply = f'COMPREPLY=($(compgen -W "{" ".join(hint[1:])}" -- "$cur"))'
+            elif hint[0] in words:
+                reply = f'COMPREPLY=($({words[hint[0]]} -- "$cur"))'
+            else:
+                reply = "COMPREPLY=()"
+            lines.append(f"        {patterns}) {reply}; return ;;")
+    lines.append("    esac")
+    lines.append('    case "$command" in')
+    for scope, sub in scopes:
+        flags = " ".join(opt for action in _options(sub) for opt in action.option_strings)
+        positional = _positional_hint(sub)
+        other = f'COMPREPLY=($({words[positional[0]]} -- "$cur"))' if positional and positional[0] in words else "COMPREPLY=()"
+        if scope == "" and commands:
+            other = f'COMPREPLY=($(compgen -W "{names}" -- "$cur"))'
+        lines.append(f'        "{scope}") if [[ $cur == -* ]]; then COMPREPLY=($(compgen -W "{flags}" -- "$cur")); else {other}; fi ;;')
+    lines += ["    esac", "}", f"complete -F {func} {command}", ""]
+    return "\n".join(lines)
+
+
+def _zsh_quote(text: str) -> str:
+    return text.replace("\\", "\\\\").replace("'", "'\\''").replace("[", "\\[").replace("]", "\\]").replace(":", "\\:")
+
+
+def _zsh_specs(parser: argparse.ArgumentParser, rest: bool = True) -> List[str]:
+    specs = []
+    for action in _options(parser):
+        hint = complete_hint(action)
+        value = "" if hint is None else {"choices": f":{action.dest}:({' '.join(hint[1:])})", "file": f":{action.dest}:_files",
+                                         "dir": f":{action.dest}:_files -/"}.get(hint[0], f":{action.dest}: ")
+        repeat = "*" if isinstance(action, (argparse._AppendAction, argparse._CountAction)) else ""
+        help_text = _zsh_quote((action.help or "").split("\n")[0])
+        for opt in action.option_strings:
+            specs.append(f"'{repeat}{opt}[{help_text}]{value}'")
+    positional = _positional_hint(parser)
+    if positional:
+        specs.append("'*:file:_files" + (" -/" if positional[0] == "dir" else "") + "'")
+    elif rest:
+        specs.append("'*: :'")
+    return specs
+
+
+def _zsh_completion(parser: argparse.ArgumentParser, command: str) -> str:
+    func = "_" + re.sub(r"\W", "_", command)
+    commands = _commands(parser)
+    lines = [f"#compdef {command}", f"# zsh completion for {command}; put it in a directory on $fpath as {func}", f"{func}() {{"]
+    if not commands:
+        specs = _zsh_specs(parser)
+        lines += ["    _arguments -s \\", *(f"        {spec} \\" for spec in specs[:-1]), f"        {specs[-1]}", "}"]
+    else:
+        names = " ".join(f"'{name}:{_zsh_quote(help_text)}'" for name, help_text, _ in commands)
+        lines += ["    local line state", "    _arguments -C \\", *(f"        {spec} \\" for spec in _zsh_specs(parser, rest=False)),
+                  "        '1: :->command' \\", "        '*:: :->args'", '    case "$state" in',
+                  f"        command) local -a commands; commands=({names}); _describe command commands ;;",
+                  '        args) case "$line[1]" in']
+        for name, _, sub in commands:
+            lines.append(f"            {name}) _arguments -s {' '.join(_zsh_specs(sub))} ;;")
+        lines += ["        esac ;;", "    esac", "}"]
+    lines += [f'{func} "$@"', ""]
+    return "\n".join(lines)
+
+
+def _fish_quote(text: str) -> str:
+    return "'" + text.replace("\\", "\\\\").replace("'", "\\'") + "'"
+
+
+def _fish_lines(parser: argparse.ArgumentParser, command: str, condition: Optional[str]) -> List[str]:
+    lines = []
+    for action in _options(parser):
+        parts = [f"complete -c {command}"]
+        if condition:
+            parts.append(f"-n {_fish_quote(condition)}")
+        for opt in action.option_strings:
+            parts.append(f"-l {opt[2:]}" if opt.startswith("--") else f"-o {opt[1:]}" if len(opt) > 2 else f"-s {opt[1:]}")
+        hint = complete_hint(action)
+        if hint is not None:
+            parts.append({"choices": f"-x -a {_fish_quote(' '.join(hint[1:]))}", "file": "-r -F",
+                          "dir": "-x -a '(__fish_complete_directories)'"}.get(hint[0], "-x"))
+        if action.help:
+            parts.append(f"-d {_fish_quote(action.help.split(chr(10))[0])}")
+        lines.append(" ".join(parts))
+    return lines
+
+
+def _fish_completion(parser: argparse.ArgumentParser, command: str) -> str:
+    commands = _commands(parser)
+    lines = [f"# fish completion for {command}; put it in ~/.config/fish/completions/{command}.fish"]
+    if not _positional_hint(parser) and not commands:
+        # the positional arguments are identifiers, URLs or queries, not files
+        lines.append(f"complete -c {command} -f")
+    lines += _fish_lines(parser, command, "__fish_use_subcommand" if commands else None)
+    for name, help_text, sub in commands:
+        lines.append(f"complete -c {command} -f -n '__fish_use_subcommand' -a {name} -d {_fish_quote(help_text)}")
+        lines += _fish_lines(sub, command, f"__fish_seen_subcommand_from {name}")
+    return "\n".join(lines) + "\n"
+
+class CassetteMiss(RuntimeError):
+    """--replay was asked for a request its cassette has no answer left for.
+
+    Not a requests.RequestException, so no tool takes it for a network error and carries on.
+    """
+
+
+def redact_header(name: str, value: str) -> str:
+    if name.lower() not in REDACTED_HEADERS:
+        return value
+    # the scheme stays, so a bug report still shows which credentials were sent
+    scheme, _, rest = value.partition(" ")
+    return f"{scheme} {REDACTED}" if name.lower().endswith("authorization") and rest else REDACTED
+
+
+def redact_form(body: bytes) -> bytes:
+    """body with the values of the REDACTED_FIELDS form fields replaced, as the metadata write API is sent the keys."""
+    return re.sub(rb"(^|&)(" + "|".join(REDACTED_FIELDS).encode() + rb")=[^&]*", rb"\1\2=" + REDACTED.encode(), body)
+
+
+def _request_body(request: requests.PreparedRequest) -> Optional[bytes]:
+    """The request's body, redacted; None without one, or when it is streamed from a file, as uploads are."""
+    body = request.body.encode("utf-8") if isinstance(request.body, str) else request.body
+    return redact_form(body) if isinstance(body, bytes) else None
+
+
+def _body_fields(body: Optional[bytes]) -> dict:
+    if body is None:
+        return {"body": None}
+    try:
+        return {"body": body.decode("utf-8")}
+    except UnicodeDecodeError:
+        return {"body": base64.b64encode(body).decode("ascii"), "body_encoding": "base64"}
+
+
+def _body_bytes(record: dict) -> Optional[bytes]:
+    if record.get("body") is None:
+        return None
+    if record.get("body_encoding") == "base64":
+        return base64.b64decode(record["body"])
+    return record["body"].encode("utf-8")
+
+
+class _RecordedBody:
+    """A response's urllib3 body that keeps a copy of what is read of it, up to max_body bytes, for the cassette."""
+
+    def __init__(self, raw, record: dict, max_body: int):
+        self._raw = raw
+        self._record = record
+        self._max_body = max_body
+
+    def _keep(self, data: bytes):
+        room = self._max_body - len(self._record["data"])
+        if len(data) > room:
+            self._record["truncated"] = True
+        self._record["data"] += data[:max(room, 0)]
+
+    def stream(self, amt: int = 2 ** 16, decode_content: Optional[bool] = None):
+        for chunk in self._raw.stream(amt, decode_content=decode_content):
+            self._keep(chunk)
+            yield chunk
+
+    def read(self, *args, **kwargs):
+        data = self._raw.read(*args, **kwargs)
+        self._keep(data)
+        return data
+
+    def __getattr__(self, name):
+        return getattr(self._raw, name)
+
+
+class Cassette:
+    """The requests of a run and their answers: recorded into a JSON file with --record, or, with --replay,
+    answering every request from one instead of the network.
+
+    Credentials are redacted as they are recorded: the Authorization, Cookie and Set-Cookie headers and
+    the keys in a form body. Each response body is kept as it was read, decoded, up to max_body bytes; a
+    longer one is cut and marked "truncated". The file is written when the run ends, however it ends.
+
+    A replayed request is matched by method, URL and (redacted) body; the same request made again gets the
+    next of its recorded answers, so a poll goes as it went. Workers may ask in another order than they were
+    recorded in. A request with no answer left raises CassetteMiss.
+    """
+
+    def __init__(self, path: str, replay: bool = False, max_body: int = RECORD_MAX_BODY, tool: Optional[str] = None):
+        self.path = path
+        self.replay = replay
+        self.max_body = max_body
+        self.tool = tool
+        self.lock = threading.Lock()
+        self.interactions: List[dict] = []
+        self.answers: Dict[Tuple[str, str], List[dict]] = {}
+        if replay:
+            self.load()
+        else:
+            atexit.register(self.save)
+
+    def __str__(self):
+        return self.path
+
+    def load(self):
+        with open(self.path, encoding="utf-8") as f:
+            try:
+                data = json.load(f)
+            except json.JSONDecodeError as e:
+                raise ValueError(f"{self.path}: {e}") from e
+        if not isinstance(data, dict) or data.get("version") != CASSETTE_VERSION or not isinstance(data.get("interactions"), list):
+            raise ValueError(f"{self.path} is not a version {CASSETTE_VERSION} cassette written by --record")
+        for n, interaction in enumerate(data["interactions"]):
+            try:
+                key = (interaction["request"]["method"], interaction["request"]["url"])
+                if "response" not in interaction and "error" not in interaction:
+                    raise KeyError("response")
+            except (KeyError, TypeError) as e:
+                raise ValueError(f"{self.path}: interaction {n} has no {e}") from None
+            self.answers.setdefault(key, []).append(interaction)
+
+    def record(self, request: requests.PreparedRequest, response: Optional[requests.Response] = None,
+               error: Optional[Exception] = None):
+        """Add the exchange; the response's body is kept as it is read, through the raw body this returns."""
+        interaction = {"request": dict({"method": request.method, "url": request.url,
+                                        "headers": {k: redact_header(k, v) for k, v in request.headers.items()}},
+                                       **_body_fields(_request_body(request)))}
+        if response is None:
+            interaction["error"] = {"type": type(error).__name__, "message": str(error)}
+        else:
+            # the body is kept decoded, so it is not sent as gzip again on replay
+            headers = {k: redact_header(k, v) for k, v in response.headers.items()
+                       if k.lower() not in ("content-encoding", "transfer-encoding")}
+            interaction["response"] = {"status": response.status_code, "reason": response.reason, "headers": headers,
+                                       "data": bytearray()}
+        with self.lock:
+            self.interactions.append(interaction)
+        return _RecordedBody(response.raw, interaction["response"], self.max_body) if response is not None else None
+
+    def save(self):
+        with self.lock:
+            interactions = []
+            for interaction in self.interactions:
+                interaction = dict(interaction)
+                if "response" in interaction:
+                    response = dict(interaction["response"])
+                    response.update(_body_fields(bytes(response.pop("data"))))
+                    interaction["response"] = response
+                interactions.append(interaction)
+        recorded = datetime.now(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+        tmp = self.path + ".part"
+        try:
+            with open(tmp, "w", encoding="utf-8") as f:
+                json.dump({"version": CASSETTE_VERSION, "tool": self.tool, "recorded": recorded, "interactions": interactions},
+                          f, indent=2, ensure_ascii=False)
+            os.replace(tmp, self.path)
+        except OSError as e:
+            logging.error(f"Could not write the cassette {self.path}: {e}")
+            return
+        logging.info(f"{len(interactions)} request(s) recorded in {self.path}")
+
+    def answer(self, request: requests.PreparedRequest) -> dict:
+        body = _request_body(request)
+        with self.lock:
+            answers = self.answers.get((request.method, request.url))
+            for n, interaction in enumerate(answers or []):
+                recorded = _body_bytes(interaction["request"])
+                if recorded is None or body is None or recorded == body:
+                    return answers.pop(n)
+        message = f"{self.path} has no {'more answers' if answers is not None else 'recording'} for {request.method} {request.url}"
+        logging.error(message)
+        raise CassetteMiss(message)
+
+
+class CassetteAdapter(HTTPAdapter):
+    """An HTTPAdapter that records every exchange in cassette or, with a replaying one, answers from it without the network."""
+
+    def __init__(self, cassette: Cassette, **kwargs):
+        super().__init__(**kwargs)
+        self.cassette = cassette
+
+    def send(self, request, stream=False, timeout=None, verify=True, cert=None, proxies=None):
+        if self.cassette.replay:
+            return self.replayed(request, self.cassette.answer(request))
+        try:
+            response = super().send(request, stream=stream, timeout=timeout, verify=verify, cert=cert, proxies=proxies)
+        except requests.RequestException as e:
+            self.cassette.record(request, error=e)
+            raise
+        response.raw = self.cassette.record(request, response)
+        return response
+
+    def replayed(self, request: requests.PreparedRequest, interaction: dict) -> requests.Response:
+        if "error" in interaction:
+            error = getattr(requests.exceptions, interaction["error"].get("type", ""), None)
+            if not (isinstance(error, type) and issubclass(error, requests.RequestException)):
+                error = requests.ConnectionError
+            raise error(interaction["error"].get("message", ""), request=request)
+        recorded = interaction["response"]
+        if recorded.get("truncated"):
+            logging.warning(f"{request.method} {request.url}: the recorded body was cut at {self.cassette.max_body} bytes")
+        body = _body_bytes(recorded) or b""
+        headers = dict(recorded.get("headers") or {}, **{"Content-Length": str(len(body))})
+        raw = HTTPResponse(body=io.BytesIO(body), headers=headers, status=recorded["status"], reason=recorded.get("reason"),
+                           preload_content=False, decode_content=False)
+        return self.build_response(request, raw)
+
+
+def build_session(timeout: int, retries: int, backoff: float, user_agent: str,
+                  session: Optional[requests.Session] = None, on_retry: Optional[RetryHook] = log_retry,
+                  limiter: Optional[RequestLimiter] = None, auth: Optional[S3Auth] = None,
+                  connect_timeout: Optional[float] = None, pool_size: int = DEFAULT_POOL_SIZE, verify: Union[bool, str] = True,
+                  proxy: Optional[str] = None, breaker: Optional[CircuitBreaker] = None,
+                  cassette: Optional[Cassette] = None) -> requests.Session:
+    """Configure session (a new requests.Session by default) with retries, a default timeout and user_agent.
+
+    Every retry is reported to on_retry, a warning in the log by default. With limiter, each request
+    (not each retry, which the backoff already spaces out) waits for a token first. auth signs every
+    request to archive.org, including the storage node a download is redirected to.
+
+    With connect_timeout, connecting gets only that long, also for requests that give their own
+    timeout, which is then the read timeout. pool_size connections are kept open per host, so a tool
+    running more requests than that at once doesn't keep opening new ones. verify is as for requests:
+    False skips TLS certificate checks, a path is the CA bundle to check them with; unlike a plain
+    session's, it wins over $REQUESTS_CA_BUNDLE. proxy carries every request, redirects included,
+    except to hosts in $NO_PROXY. breaker, shared by the sessions of a run, is told of every attempt and
+    holds each request back while it is open. cassette records every exchange, redirects included, or
+    answers them all when it replays one; see Cassette.
+    """
+    session = session or requests.Session()
+    session.headers["User-Agent"] = user_agent
+    if auth:
+        session.auth = auth
+        # requests drops the Authorization header when a redirect changes host, as /download does
+        rebuild_auth = session.rebuild_auth
+
+        def resign(prepared, response):
+            rebuild_auth(prepared, response)
+            auth(prepared)
+        session.rebuild_auth = resign
+    if verify is False:
+        # session_from_args() warns once; urllib3 would on every request
+        warnings.simplefilter("ignore", InsecureRequestWarning)
+    if verify is not True or proxy:
+        session.verify = verify
+        merge_environment_settings = session.merge_environment_settings
+        rebuild_proxies = session.rebuild_proxies
+
+        def through(url: str) -> Dict[str, str]:
+            return {} if not proxy or should_bypass_proxies(url, no_proxy=None) else {"http": proxy, "https": proxy}
+
+        def settle(url, proxies, stream, verify_, cert):
+            settings = merge_environment_settings(url, proxies, stream, verify_, cert)
+            settings["proxies"] = dict(settings["proxies"], **through(url))
+            if verify is not True:
+                # requests would let $REQUESTS_CA_BUNDLE win over the session's own setting
+                settings["verify"] = verify
+            return settings
+
+        def reproxy(prepared, proxies):
+            # a redirect to a $NO_PROXY host goes direct
+            kept = {k: v for k, v in (proxies or {}).items() if v != proxy}
+            return rebuild_proxies(prepared, dict(kept, **through(prepared.url)))
+        session.merge_environment_settings = settle
+        session.rebuild_proxies = reproxy
+    if breaker:
+        report = on_retry
+
+        def on_retry(*event):
+            # each retry follows a failed attempt
+            breaker.record(False)
+            if report:
+                report(*event)
+    settings = {"max_retries": retry_policy(retries, backoff, on_retry), "pool_maxsize": pool_size}
+    adapter = CassetteAdapter(cassette, **settings) if cassette else HTTPAdapter(**settings)
+    session.mount("https://", adapter)
+    session.mount("http://", adapter)
+    # attach default timeout wrapper
+    session.request = _timeout_wrapper(session.request, timeout, limiter, connect_timeout, breaker)
+    return session
+
+
+def pool_size(args: argparse.Namespace) -> int:
+    """Connections per host for the requests a tool runs at once: --workers (or --concurrency) times --segments."""
+    at_once = (getattr(args, "workers", None) or getattr(args, "concurrency", None) or 1) * (getattr(args, "segments", None) or 1)
+    return max(DEFAULT_POOL_SIZE, at_once)
+
+
+def session_from_args(args: argparse.Namespace, user_agent: str, session: Optional[requests.Session] = None,
+                      breaker: Optional[CircuitBreaker] = None, **overrides) -> requests.Session:
+    """build_session() from the shared flags a tool defines, so a new flag is wired up here once.
+
+    --timeout, --retries, --backoff, --user-agent, --max-rps, --rps-burst, --proxy, --ca-cert,
+    --connect-timeout, --insecure-skip-verify, --record, --replay and --anonymous are read when the tool has them, the defaults below
+    otherwise; user_agent is the tool's own, used without --user-agent. The connection pool is sized
+    by pool_size(). overrides win over both, e.g. retries=0 for a session whose downloads the
+    Downloader retries. The session signs its requests with s3_credentials() and carries ia's login cookies unless
+    --anonymous is given. breaker is circuit_breaker(args), made once for all the sessions of a run.
+
+    When user_agent is sent with no $IA_CONTACT in it, the run is reminded to set one once it has made
+    CONTACT_WARN_REQUESTS requests, unless it is a --dry-run.
+    """
+    opts = {"timeout": DEFAULT_TIMEOUT, "retries": DEFAULT_RETRIES, "backoff": DEFAULT_BACKOFF, "connect_timeout": None,
+            "pool_size": pool_size(args)}
+    opts.update({name: getattr(args, name) for name in opts if getattr(args, name, None) is not None})
+    opts.update(overrides)
+    verify = False if getattr(args, "insecure_skip_verify", False) else getattr(args, "ca_cert", None) or True
+    if verify is False:
+        logging.warning("--insecure-skip-verify: TLS certificates are not checked, so the traffic (credentials included) "
+                        "can be read and changed by anyone on the way")
+    limiter = request_limiter(getattr(args, "max_rps", None), getattr(args, "rps_burst", None))
+    auth = None
+    if getattr(args, "anonymous", False):
+        if session is not None:
+            # an internetarchive session brings its own ia.ini credentials and login cookies
+            session.auth = None
+            session.cookies.clear()
+    else:
+        auth = s3_auth()
+    agent = getattr(args, "user_agent", None) or user_agent
+    session = build_session(opts["timeout"], opts["retries"], opts["backoff"], agent, session, limiter=limiter, auth=auth,
+                            connect_timeout=opts["connect_timeout"], pool_size=opts["pool_size"], verify=verify, proxy=getattr(args, "proxy", None), breaker=breaker,
+                            cassette=getattr(args, "cassette", None))
+    if agent == user_agent and not os.environ.get("IA_CONTACT", "").strip() and not getattr(args, "dry_run", False):
+        session.request = _contact_reminder(session.request)
+    if not getattr(args, "anonymous", False):
+        # like the keys, only for archive.org; a mirror at $IA_BASE_URL is trusted as it is for them
+        host = urlsplit(ARCHIVE_URL).hostname or ""
+        domains = [".archive.org"] + ([host] if host != "archive.org" and not host.endswith(".archive.org") else [])
+        for name, value in ia_cookies().items():
+            for domain in domains:
+                session.cookies.set(name, value, domain=domain)
+    return session
+
+
+# every request of the process's sessions with a default User-Agent that has no contact, for _contact_reminder()
+_UNIDENTIFIED_REQUESTS = itertools.count(1)
+
+
+def _contact_reminder(request_func):
+    def counted(method, url, **kwargs):
+        if next(_UNIDENTIFIED_REQUESTS) == CONTACT_WARN_REQUESTS:
+            logging.warning(f"{CONTACT_WARN_REQUESTS} requests so far with no contact in the User-Agent; set $IA_CONTACT to an "
+                            "email address or URL so archive.org can reach you about this traffic instead of blocking it")
+        return request_func(method, url, **kwargs)
+    return counted
+
+
+def _timeout_wrapper(request_func, default_timeout: int, limiter: Optional[RequestLimiter] = None,
+                     connect_timeout: Optional[float] = None, breaker: Optional[CircuitBreaker] = None):
+    def wrapped(method, url, **kwargs):
+        timeout = kwargs.get("timeout", default_timeout)
+        if connect_timeout and isinstance(timeout, (int, float)):
+            # a host that doesn't answer at all is given up on sooner than a slow read
+            timeout = (min(connect_timeout, timeout), timeout)
+        kwargs["timeout"] = timeout
+        probe = breaker.acquire() if breaker else False
+        if limiter:
+            limiter.acquire()
+        try:
+            response = request_func(method, url, **kwargs)
+        except requests.RequestException as e:
+            if breaker and transient(e):
+                breaker.record(False)
+            elif probe:
+                breaker.release()
+            if not isinstance(e, requests.exceptions.SSLError) or "CERTIFICATE_VERIFY_FAILED" not in str(e):
+                raise
+            raise requests.exceptions.SSLError(f"{e} ({TLS_HINT})", request=e.request, response=e.response) from e
+        except BaseException:
+            if probe:
+                breaker.release()
+            raise
+        if breaker:
+            breaker.record(response.status_code not in RETRY_STATUSES)
+        return response
+    return wrapped
+
+
+def metadata_url(identifier: str) -> str:
+    return f"{METADATA_BASE_URL}{quote(identifier, safe='')}"
+
+
+def details_url(identifier: str) -> str:
+    """The item's page on archive.org."""
+    return f"{ARCHIVE_URL}/details/{quote(identifier, safe='')}"
+
+
+def download_url(identifier: str, name: str) -> str:
+    # Escape each path segment so spaces, %, # and ? survive; keep "/" between segments.
+    segments = [quote(seg, safe="") for seg in name.split("/")]
+    return f"{DOWNLOAD_BASE_URL}/{quote(identifier, safe='')}/{'/'.join(segments)}"
+
+
+def s3_url(identifier: str, name: str) -> str:
+    segments = [quote(seg, safe="") for seg in name.split("/")]
+    return f"{S3_URL}/{quote(identifier, safe='')}/{'/'.join(segments)}"
+
+
+class ArchiveError(requests.HTTPError):
+    """A failed archive.org request, by kind; response is the answer when there was one.
+
+    The subclasses are what callers tell apart. They are requests.HTTPErrors, so code that only
+    cares that a request failed can keep catching requests.RequestException.
+    """
+
+    kind = "error"
+
+
+class NotFound(ArchiveError):
+    kind = "not_found"
+
+
+class Dark(ArchiveError):
+    """The item exists but has been taken down or hidden; its files can't be fetched."""
+
+    kind = "dark"
+
+
+class Forbidden(ArchiveError):
+    """Access denied, usually a restricted item or file that needs an account with access."""
+
+    kind = "forbidden"
+
+
+class RateLimited(ArchiveError):
+    """HTTP 429; retry_after is the wait the server asked for, when it said."""
+
+    kind = "rate_limited"
+
+    def __init__(self, *args, retry_after: Optional[float] = None, **kwargs):
+        super().__init__(*args, **kwargs)
+        self.retry_after = retry_after
+
+
+class Transient(ArchiveError):
+    """A server-side failure (RETRY_STATUSES other than 429) that may well succeed when tried again."""
+
+    kind = "transient"
+
+
+def classify(response: requests.Response) -> Optional[ArchiveError]:
+    """Return the error a response stands for, or None when it succeeded (below 400)."""
+    status = response.status_code
+    if status < 400:
+        return None
+    message = f"HTTP {status} for {response.url}"
+    if status in (404, 410):
+        return NotFound(f"{message}: not found", response=response)
+    if status in (401, 403):
+        return Forbidden(f"{message}: access denied", response=response)
+    if status == 429:
+        after = retry_after(response)
+        return RateLimited(f"{message}: rate limited" + (f", retry after {after:.0f}s" if after is not None else ""),
+                           response=response, retry_after=after)
+    if status in RETRY_STATUSES:
+        return Transient(f"{message}: server error", response=response)
+    return ArchiveError(message, response=response)
+
+
+def raise_for_status(response: requests.Response):
+    """Like response.raise_for_status(), with the error classified."""
+    error = classify(response)
+    if error is not None:
+        raise error
+
+
+def check_metadata(identifier: str, metadata: dict) -> dict:
+    """Return a /metadata response, or raise NotFound for the empty object sent for unknown items and Dark for dark ones."""
+    if not metadata:
+        raise NotFound(f"Item '{identifier}' does not exist")
+    if metadata.get("is_dark"):
+        raise Dark(f"Item '{identifier}' is dark (taken down or not public)")
+    return metadata
+
+
+def fetch_metadata(session: requests.Session, identifier: str) -> dict:
+    """GET an item's /metadata, raising the classified error when it can't be had."""
+    resp = session.get(metadata_url(identifier))
+    raise_for_status(resp)
+    return check_metadata(identifier, resp.json())
+
+
+# the catalog's wait_admin codes
+TASK_STATUSES = {0: "queued", 1: "running", 2: "error", 9: "paused"}
+
+
+class TasksError(RuntimeError):
+    pass
+
+
+def status_of(task: dict) -> str:
+    if task.get("finished"):
+        return "finished"
+    try:
+        return TASK_STATUSES.get(int(task.get("wait_admin")), "unknown")
+    except (TypeError, ValueError):
+        return "unknown"
+
+
+def fetch_tasks(session: requests.Session, query: Dict[str, str], history: bool, limit: Optional[int] = None) -> List[dict]:
+    """The catalog (queued, running, errored and paused) tasks matching query, and the finished ones with history.
+
+    Pages are followed through the cursor the API returns, up to limit rows of each kind.
+    """
+    tasks = []
+    for kind in ("catalog", "history") if history else ("catalog",):
+        params = dict(query, **{kind: "1", "summary": "0"})
+        got = 0
+        while True:
+            r = session.get(TASKS_URL, params=params)
+            raise_for_status(r)
+            try:
+                answer = r.json()
+            except ValueError as e:
+                raise TasksError(f"the tasks API did not answer with JSON: {r.text[:300]}") from e
+            if not answer.get("success"):
+                raise TasksError(f"the tasks API refused the query: {answer.get('error') or answer}")
+            rows = (answer.get("value") or {}).get(kind) or []
+            if limit is not None:
+                rows = rows[:limit - got]
+            tasks.extend(dict(row, status=status_of(row)) for row in rows)
+            got += len(rows)
+            if not answer.get("cursor") or (limit is not None and got >= limit):
+                break
+            params["cursor"] = answer["cursor"]
+    return tasks
+
+
+def wait_for_tasks(session: requests.Session, query: Dict[str, str], history: bool = False, limit: Optional[int] = None,
+                   wait_timeout: float = 3600, interval: float = 30) -> Tuple[List[dict], bool]:
+    """Poll the tasks matching query every interval until none is queued or running.
+
+    Returns the tasks of the last poll and whether it gave up at wait_timeout with some still pending.
+    Failures raise TasksError or the session's requests.RequestException.
+    """
+    deadline = time.time() + wait_timeout
+    tasks = fetch_tasks(session, query, history, limit)
+    while any(t["status"] in ("queued", "running") for t in tasks):
+        if time.time() + interval > deadline:
+            logging.warning(f"Tasks still pending after {wait_timeout:.0f}s, not waiting any longer")
+            return tasks, True
+        pending = sum(1 for t in tasks if t["status"] in ("queued", "running"))
+        logging.info(f"{pending} task(s) queued or running, checking again in {interval:.0f}s")
+        time.sleep(interval)
+        tasks = fetch_tasks(session, query, history, limit)
+    return tasks, False
+
+
+class SearchError(RuntimeError):
+    pass
+
+
+def search_page(session: requests.Session, query: str, fields: List[str], rows: int, page: int,
+                sort: Optional[List[str]] = None) -> dict:
+    params = {
+        "q": query,
+        "fl[]": fields,
+        "rows": rows,
+        "page": page,
+        "output": "json",
+    }
+    if sort:
+        # e.g. ["publicdate desc"]
+        params["sort[]"] = sort
+    resp = session.get(SEARCH_URL, params=params)
+    if resp.status_code != 200:
+        raise SearchError(f"Advanced search failed with status {resp.status_code}: {resp.text[:300]}")
+    try:
+        data = resp.json()
+    except json.JSONDecodeError as e:
+        raise SearchError(f"Failed to parse JSON from advanced search: {e}\nBody: {resp.text[:300]}") from e
+    error = data.get("error") if isinstance(data, dict) else None
+    if error and not data.get("response"):
+        # a sort or query the index can't take is answered 200 with Solr's error in place of the results
+        message = (error.get("msg") or json.dumps(error)) if isinstance(error, dict) else error
+        raise SearchError(f"Advanced search refused the request: {message}")
+    response_obj = data.get("response")
+    if not isinstance(response_obj, dict) or "docs" not in response_obj:
+        err = data.get("error") or data
+        raise SearchError(f"Unexpected search response structure, missing 'response.docs'. Details: {json.dumps(err)[:500]}")
+    return data
+
+
+def text_values(value) -> List[str]:
+    """A search doc field as a list of strings: repeatable metadata fields come as a string or a list of them."""
+    if value is None or value == "":
+        return []
+    if isinstance(value, list):
+        return [str(v) for v in value if v is not None and v != ""]
+    return [str(value)]
+
+
+def int_value(value) -> Optional[int]:
+    """A count or year that the index gives as a number or as a string (a list of them for a field set twice)."""
+    if isinstance(value, list):
+        value = value[0] if value else None
+    if isinstance(value, bool):
+        return None
+    if isinstance(value, (int, float)):
+        return int(value)
+    # the leading digits, so a year given as a date ("1999-05") is the year
+    match = re.match(r"\s*(-?\d+)", str(value)) if value is not None else None
+    return int(match.group(1)) if match else None
+
+
+class SearchDoc(NamedTuple):
+    """The common fields of a search result, each in one shape whatever the index gave.
+
+    title and date are text (the values of a repeated field joined with "; "), creator and collection
+    lists, downloads and year numbers or None; extra keeps the other fields requested, as they came.
+    """
+
+    identifier: str
+    title: str
+    date: str
+    creator: List[str]
+    collection: List[str]
+    downloads: Optional[int]
+    year: Optional[int]
+    extra: Dict[str, object]
+
+    @classmethod
+    def from_doc(cls, doc: dict) -> "SearchDoc":
+        known = cls._fields[:-1]
+        return cls(identifier="; ".join(text_values(doc.get("identifier"))), title="; ".join(text_values(doc.get("title"))),
+                   date="; ".join(text_values(doc.get("date"))), creator=text_values(doc.get("creator")),
+                   collection=text_values(doc.get("collection")), downloads=int_value(doc.get("downloads")),
+                   year=int_value(doc.get("year")), extra={k: v for k, v in doc.items() if k not in known})
+
+
+class SearchResults:
+    """Advanced search results, fetched page by page as they are iterated.
+
+    Iterating gives the docs; pages() gives (page, docs) for callers that report progress. Pages
+    after the first are requested sleep seconds apart, retries come from the session, and a failed
+    page raises SearchError out of the loop. num_found and total_pages are set once the first page
+    has arrived. sort orders the results, e.g. ["publicdate desc"]. first_page starts further in, for
+    a search carrying on where an earlier one stopped; max_pages then counts from it.
+    """
+
+    def __init__(self, session: requests.Session, query: str, fields: List[str], rows: int = 500,
+                 sleep: float = 1.0, max_pages: Optional[int] = None, sort: Optional[List[str]] = None, first_page: int = 1):
+        self.session = session
+        self.query = query
+        self.fields = fields
+        self.rows = rows
+        self.sort = sort
+        self.sleep = sleep
+        self.max_pages = max_pages
+        self.first_page = first_page
+        self.num_found: Optional[int] = None
+        self.total_pages: Optional[int] = None
+
+    def pages(self) -> Iterator[Tuple[int, List[dict]]]:
+        page = self.first_page
+        while self.total_pages is None or page <= self.total_pages:
+            if page > self.first_page:
+                time.sleep(self.sleep)
+            data = search_page(self.session, self.query, self.fields, self.rows, page, self.sort)
+            response_obj = data["response"]
+            if self.total_pages is None:
+                self.num_found = int(response_obj.get("numFound", 0))
+                self.total_pages = max(1, (self.num_found + self.rows - 1) // self.rows)
+                if self.max_pages is not None:
+                    self.total_pages = min(self.total_pages, self.first_page - 1 + self.max_pages)
+            docs = response_obj.get("docs", [])
+            if isinstance(docs, list):
+                yield page, docs
+            page += 1
+
+    def __iter__(self) -> Iterator[dict]:
+        for _, docs in self.pages():
+            yield from docs
+
+
+class CursorExpired(SearchError):
+    """The scrape API no longer knows the cursor asked for; the scrape has to start over."""
+
+    def __init__(self, cursor: str, message: str):
+        super().__init__(f"Scrape cursor {cursor} was refused, most likely expired ({message}); start the scrape over")
+        self.cursor = cursor
+
+
+def scrape_page(session: requests.Session, query: str, fields: List[str], count: int, cursor: Optional[str] = None,
+                sort: Optional[List[str]] = None) -> dict:
+    params = {"q": query, "fields": ",".join(fields), "count": count}
+    if sort:
+        params["sorts"] = ",".join(sort)
+    if cursor:
+        params["cursor"] = cursor
+    resp = session.get(SCRAPE_URL, params=params)
+    try:
+        data = resp.json()
+    except json.JSONDecodeError as e:
+        if resp.status_code == 200:
+            raise SearchError(f"Failed to parse JSON from the scrape API: {e}\nBody: {resp.text[:300]}") from e
+        data = None
+    error = data.get("error") if isinstance(data, dict) else None
+    # a cursor that worked for the page before it fails only when the server has let it go
+    if cursor and (error or 400 <= resp.status_code < 500):
+        raise CursorExpired(cursor, error or f"status {resp.status_code}")
+    if resp.status_code != 200 or error:
+        raise SearchError(f"Scrape API failed with status {resp.status_code}: {error or resp.text[:300]}")
+    if not isinstance(data, dict) or not isinstance(data.get("items"), list):
+        raise SearchError(f"Unexpected scrape response structure, missing 'items'. Details: {json.dumps(data)[:500]}")
+    return data
+
+
+class ScrapeResults:
+    """Scrape API results, fetched a page at a time by following the cursor each page ends with.
+
+    Used like SearchResults, for result sets past advancedsearch.php's depth limit. count is kept
+    within SCRAPE_MIN_COUNT and SCRAPE_MAX_COUNT. cursor starts the scrape where an earlier one left
+    off; while iterating it is the cursor of the page after the one just given (None after the last),
+    so a caller that saves it once it has handled a page can carry on from there. A failed page raises
+    SearchError, or CursorExpired when the server no longer has the cursor. total is set once the
+    first page has arrived. sort is as for SearchResults.
+    """
+
+    def __init__(self, session: requests.Session, query: str, fields: List[str], count: int = SCRAPE_MAX_COUNT,
+                 sleep: float = 1.0, max_pages: Optional[int] = None, cursor: Optional[str] = None, sort: Optional[List[str]] = None):
+        self.session = session
+        self.query = query
+        self.fields = fields
+        self.sort = sort
+        self.count = min(max(count, SCRAPE_MIN_COUNT), SCRAPE_MAX_COUNT)
+        self.sleep = sleep
+        self.max_pages = max_pages
+        self.cursor = cursor
+        self.total: Optional[int] = None
+
+    def pages(self) -> Iterator[Tuple[int, List[dict]]]:
+        page = 1
+        while self.max_pages is None or page <= self.max_pages:
+            if page > 1:
+                time.sleep(self.sleep)
+            data = scrape_page(self.session, self.query, self.fields, self.count, self.cursor, self.sort)
+            if self.total is None and data.get("total") is not None:
+                self.total = int(data["total"])
+            self.cursor = data.get("cursor") or None
+            yield page, data["items"]
+            if self.cursor is None:
+                return
+            page += 1
+
+    def __iter__(self) -> Iterator[dict]:
+        for _, docs in self.pages():
+            yield from docs
+
+
+def search_all(session: requests.Session, query: str, fields: List[str], sleep: float = 1.0, rows: int = 500) -> Iterator[dict]:
+    """Every doc query finds: from advanced search, or from the scrape API when there are more than it can page through.
+
+    After a cutover the docs of the first page come again; callers that mind dedupe by identifier.
+    """
+    results = SearchResults(session, query, fields, rows, sleep)
+    for _, docs in results.pages():
+        yield from docs
+        if results.num_found > SEARCH_DEPTH_LIMIT:
+            logging.info(f"{results.num_found} results for {query}, past advanced search's depth limit; using the scrape API")
+            # the scrape API sleeps between its own pages
+            time.sleep(sleep)
+            yield from ScrapeResults(session, query, fields, sleep=sleep)
+            return
+
+
+def collection_members(session: requests.Session, collection: str, fields: Sequence[str] = (), recursive: bool = False,
+                       where: Optional[str] = None, sleep: float = 1.0, rows: int = 500) -> Iterator[dict]:
+    """The items of a collection, each once, as search docs with their identifier and fields (e.g. mediatype, item_size).
+
+    where narrows the items with more of a search query, such as a date range. With recursive, the items
+    of its sub-collections (and theirs) come too, after the collection's own; sub-collections are found
+    whatever where says, and each is listed once even when collections contain each other. Failures raise
+    SearchError or the session's requests.RequestException.
+    """
+    fields = list(dict.fromkeys(["identifier", *fields]))
+    queue: List[str] = [collection]
+    listed: Set[str] = {collection}
+    seen: Set[str] = set()
+    while queue:
+        current = queue.pop(0)
+        query = f"collection:{current}" + (f" AND ({where})" if where else "")
+        for doc in search_all(session, query, fields, sleep, rows):
+            identifier = doc.get("identifier")
+            if identifier and identifier not in seen:
+                seen.add(identifier)
+                yield doc
+        if recursive:
+            for doc in search_all(session, f"collection:{current} AND mediatype:collection", ["identifier"], sleep, rows):
+                if doc.get("identifier") and doc["identifier"] not in listed:
+                    listed.add(doc["identifier"])
+                    queue.append(doc["identifier"])
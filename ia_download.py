@@ -0,0 +1,1063 @@
+"""File transfers shared by the download scripts: resume, segments, rate limit and checksums.
+
+Downloader.fetch() does one file into a .part the caller renames once it is happy with it. How
+progress is shown is up to the caller: the Downloader reports every chunk to a Progress made by its
+progress factory, TerminalProgress for the percent lines Download-Collections-v2.py prints.
+safe_relpath() and local_names() decide where a metadata file name lands on disk.
+"""
+import atexit
+import hashlib
+import json
+import logging
+import os
+import re
+import signal
+import socket
+import sqlite3
+import sys
+import threading
+import time
+from collections import deque
+from concurrent.futures import ThreadPoolExecutor
+from contextlib import contextmanager
+from datetime import datetime, timezone
+from typing import Callable, Dict, List, NamedTuple, Optional, Sequence
+from urllib.parse import urlsplit
+
+import requests
+
+from ia_common import DIGEST_FIELDS, format_size, parse_duration, raise_for_status, retry_call, transient
+
+CHUNK_SIZE = 1024 * 1024
+REQUEST_TIMEOUT = 60
+# Downloads land here first and are renamed into place only once complete (and verified)
+PART_SUFFIX = ".part"
+# Segmented downloads only split files large enough to give every segment at least this much
+SEGMENT_MIN_BYTES = 8 * CHUNK_SIZE
+# Response headers worth seeing at -vv when a download is slow or failing
+TRACE_HEADERS = ("Content-Length", "Content-Range", "Accept-Ranges", "X-Cache")
+# Names Windows refuses as a path segment, with or without an extension
+WINDOWS_RESERVED = {"CON", "PRN", "AUX", "NUL"} | {f"{dev}{n}" for dev in ("COM", "LPT") for n in range(1, 10)}
+WINDOWS_INVALID = re.compile(r'[<>:"|?*\x00-\x1f]')
+# Windows paths this long need the \\?\ prefix to be opened
+WINDOWS_MAX_PATH = 260
+# after Ctrl-C, the transfers in flight get this many seconds to finish before they are cut off
+DRAIN_SECONDS = 10.0
+# the exit status after a second Ctrl-C, the tools' EXIT_INTERRUPTED
+EXIT_INTERRUPTED = 130
+# the exit status when another run holds the destination's lock, the same in every tool that takes one
+EXIT_LOCKED = 8
+# Kept in a destination directory while a run writes to it
+LOCK_FILE = ".ia-lock"
+# A lock file this old that still can't be read was left half-written by a run that died creating it
+LOCK_UNREADABLE_STALE = 60
+# --checksum-db: what was last known of each file on disk
+CHECKSUM_DB_SCHEMA = """
+CREATE TABLE IF NOT EXISTS files (
+    path TEXT PRIMARY KEY,        -- absolute, as os.path.abspath() gives it
+    size INTEGER NOT NULL,
+    mtime_ns INTEGER NOT NULL,    -- the digests hold while size and mtime are still these
+    md5 TEXT,
+    sha1 TEXT,
+    identifier TEXT,              -- the item the file is a copy of, when known
+    verified TEXT NOT NULL        -- when the digests were computed
+);
+"""
+CHECKSUM_DB_FIELDS = ("path", "size", "mtime_ns", "md5", "sha1", "identifier", "verified")
+
+
+def sanitize_segment(segment: str, windows: bool) -> str:
+    if segment in ("", "."):
+        return ""
+    if segment == "..":
+        return "_"
+    if not windows:
+        return segment
+    segment = WINDOWS_INVALID.sub("_", segment).rstrip(". ") or "_"
+    if segment.split(".", 1)[0].upper() in WINDOWS_RESERVED:
+        segment = "_" + segment
+    return segment
+
+
+def safe_relpath(name: str, windows: bool = os.name == "nt") -> str:
+    """Turn a metadata file name into a relative path that stays inside the item directory.
+
+    Both "/" and "\\" separate directories; on Windows each segment also loses characters and
+    names (aux, trailing dots, ...) the filesystem rejects.
+    """
+    segments = [sanitize_segment(seg, windows) for seg in re.split(r"[/\\]", name)]
+    return "/".join(seg for seg in segments if seg) or "_"
+
+
+def local_names(files: List[dict], windows: bool = os.name == "nt") -> Dict[str, str]:
+    """Map each metadata name to its local relative path, disambiguating names sanitizing made equal.
+
+    Names that need no change keep them; the others get " (2)", " (3)", ... before the extension.
+    """
+    def key(rel):
+        # Windows filesystems compare names case-insensitively
+        return rel.lower() if windows else rel
+
+    wanted = {f["name"]: safe_relpath(f["name"], windows) for f in files}
+    taken = {key(rel) for name, rel in wanted.items() if rel == name}
+    local = {}
+    for name, rel in wanted.items():
+        if rel == name:
+            local[name] = rel
+            continue
+        candidate, n = rel, 1
+        while key(candidate) in taken:
+            n += 1
+            stem, ext = os.path.splitext(rel)
+            candidate = f"{stem} ({n}){ext}"
+        logging.debug(f"Saving {name} as {candidate}")
+        taken.add(key(candidate))
+        local[name] = candidate
+    return local
+
+
+def long_path(path: str) -> str:
+    r"""Prefix long Windows paths with \\?\ so they can still be created and opened."""
+    if os.name != "nt" or path.startswith("\\\\?\\"):
+        return path
+    # abspath also turns "/" into backslashes, which the prefixed form requires
+    full = os.path.abspath(path)
+    return "\\\\?\\" + full if len(full) >= WINDOWS_MAX_PATH else path
+
+
+class Progress:
+    """Receives one transfer's progress; this base shows nothing.
+
+    update() gets the bytes done so far, the total when known and the transfer rate in bytes per
+    second (None while hashing); end() comes once when the transfer stops, however it stops.
+    """
+
+    def update(self, done: int, total: Optional[int], rate: Optional[float]):
+        pass
+
+    def end(self):
+        pass
+
+
+class TerminalProgress(Progress):
+    """A "<prefix>  42% 1.5MB/s" line rewritten in place, only when stdout is a terminal."""
+
+    def __init__(self, prefix: str):
+        self.prefix = prefix
+        self.shown = False
+
+    def update(self, done: int, total: Optional[int], rate: Optional[float]):
+        if not sys.stdout.isatty():
+            return
+        total = total or done
+        percent = int(done * 100 / total) if total else 100
+        speed = f" {format_size(rate)}/s" if rate is not None else ""
+        print(f"\r{self.prefix} {percent:3d}%{speed}   ", end="", flush=True)
+        self.shown = True
+
+    def end(self):
+        if self.shown:
+            print()
+            self.shown = False
+
+
+# the markers of the downloaders' status lines, and what a console that can't print them gets instead:
+# the default Windows code pages (cp437, cp1252) and some CI logs
+STATUS_GLYPHS = {"download": "↓", "exists": "✓", "done": "✔", "failed": "✗"}
+STATUS_ASCII = {"download": "DL", "exists": "SKIP", "done": "OK", "failed": "FAIL"}
+
+
+def supports_glyphs(stream) -> bool:
+    """Whether stream can print STATUS_GLYPHS; a text buffer with no encoding, such as a StringIO, takes anything."""
+    encoding = getattr(stream, "encoding", None)
+    if not encoding:
+        return True
+    try:
+        "".join(STATUS_GLYPHS.values()).encode(encoding)
+    except (LookupError, UnicodeEncodeError):
+        return False
+    return True
+
+
+def status_tag(kind: str, ascii_only: bool = False) -> str:
+    """The marker of a status line: [✔] for a finished download, or [OK] with ascii_only."""
+    return f"[{(STATUS_ASCII if ascii_only else STATUS_GLYPHS)[kind]}]"
+
+
+def status_line(prefix: str, kind: str, message: str, ascii_only: bool = False) -> str:
+    return f"{prefix} {status_tag(kind, ascii_only)} {message}"
+
+
+class RateLimiter:
+    """Token bucket shared by every transfer of the run, refilled at rate bytes per second.
+
+    A transfer takes what it received and sleeps off any debt, so a chunk larger than the
+    bucket only delays that transfer instead of waiting for tokens that can never accumulate.
+    """
+
+    def __init__(self, rate: int):
+        self.rate = rate
+        # start empty, and only from the first transfer, so even a short run averages no more than the cap
+        self.tokens = 0.0
+        self.updated: Optional[float] = None
+        self.lock = threading.Lock()
+        # small enough chunks that the sleeps stay short and the rate smooth
+        self.chunk_size = max(16 * 1024, min(CHUNK_SIZE, rate // 4))
+
+    def consume(self, nbytes: int):
+        with self.lock:
+            now = time.monotonic()
+            refill = (now - self.updated) * self.rate if self.updated is not None else 0.0
+            self.tokens = min(self.rate, self.tokens + refill) - nbytes
+            self.updated = now
+            wait = -self.tokens / self.rate if self.tokens < 0 else 0.0
+        if wait:
+            time.sleep(wait)
+
+
+def hash_file(path: str, algos: Sequence[str], progress: Optional[Progress] = None) -> Dict[str, str]:
+    """The hex digests of a file on disk, one read for all of algos."""
+    hasher = StreamHash(algos, progress)
+    hasher.resume(path, os.path.getsize(path))
+    return hasher.hexdigests()
+
+
+class StreamHash:
+    """The digests (one per algo) of a download, fed with the stream as it is written to the .part file.
+
+    Every chunk goes to all of them in the one pass, and seen counts the bytes hashed. Resuming
+    bytes it never saw (a .part left by an earlier run) re-reads just that prefix, and method says
+    which happened so it can go in the log and the report.
+    """
+
+    def __init__(self, algos: Sequence[str], progress: Optional[Progress] = None):
+        self.algos = tuple(algos)
+        self.progress = progress or Progress()
+        self.method = "streamed"
+        self.reset()
+
+    def reset(self):
+        self.hashes = [hashlib.new(algo) for algo in self.algos]
+        self.seen = 0
+
+    def update(self, chunk: bytes):
+        for h in self.hashes:
+            h.update(chunk)
+        self.seen += len(chunk)
+
+    def resume(self, part: str, offset: int):
+        if self.seen == offset:
+            return
+        self.reset()
+        self.method = "re-read"
+        try:
+            with open(part, "rb") as fh:
+                while self.seen < offset:
+                    chunk = fh.read(min(CHUNK_SIZE, offset - self.seen))
+                    if not chunk:
+                        break
+                    self.update(chunk)
+                    self.progress.update(self.seen, offset, None)
+        finally:
+            self.progress.end()
+
+    def hexdigests(self) -> Dict[str, str]:
+        return {algo: h.hexdigest() for algo, h in zip(self.algos, self.hashes)}
+
+
+class ChecksumDB:
+    """--checksum-db: the digests of files on disk, shared by the downloaders and IA-Verify.py from one run to the next.
+
+    A file's digests are trusted while its size and mtime are the ones it had when they were
+    computed, so a file checked once isn't read again until it changes. Every write is committed at
+    once. The threads of a run share one connection, under a lock; other runs can use the same file at
+    the same time, as SQLite locks it for each write.
+    """
+
+    def __init__(self, path: str):
+        self.path = path
+        self.lock = threading.Lock()
+        self.db = sqlite3.connect(path, timeout=30, check_same_thread=False)
+        self.db.row_factory = sqlite3.Row
+        with self.lock:
+            self.db.executescript(CHECKSUM_DB_SCHEMA)
+
+    def known(self, path: str) -> Optional[dict]:
+        """The record of the file at path, if the file hasn't changed since; None otherwise."""
+        try:
+            st = os.stat(path)
+        except OSError:
+            return None
+        with self.lock:
+            row = self.db.execute("SELECT * FROM files WHERE path = ?", (os.path.abspath(path),)).fetchone()
+        if row is None or row["size"] != st.st_size or row["mtime_ns"] != st.st_mtime_ns:
+            return None
+        return dict(row)
+
+    def digests(self, path: str, algos: Sequence[str]) -> Optional[Dict[str, str]]:
+        """The file's digests of algos without reading it, or None unless it is unchanged and all of them are known."""
+        row = self.known(path)
+        if row is None or not all(row.get(algo) for algo in algos):
+            return None
+        return {algo: row[algo] for algo in algos}
+
+    def record(self, path: str, digests: Dict[str, str], identifier: Optional[str] = None):
+        """The digests just computed for the file at path; the ones it already had are kept for algos not among them."""
+        st = os.stat(path)
+        previous = self.known(path) or {}
+        values = {algo: digests.get(algo) or previous.get(algo) for algo in DIGEST_FIELDS}
+        with self.lock, self.db:
+            self.db.execute("INSERT OR REPLACE INTO files (path, size, mtime_ns, md5, sha1, identifier, verified) "
+                            "VALUES (?, ?, ?, ?, ?, ?, ?)",
+                            (os.path.abspath(path), st.st_size, st.st_mtime_ns, values["md5"], values["sha1"],
+                             identifier or previous.get("identifier"), iso_now()))
+
+    def export(self) -> List[dict]:
+        with self.lock:
+            return [dict(row) for row in self.db.execute("SELECT * FROM files ORDER BY path")]
+
+    def load(self, records: List[dict]) -> int:
+        """Add export()'s records (replacing those of the same paths) and return how many there were."""
+        rows = []
+        for n, r in enumerate(records, start=1):
+            if not isinstance(r, dict) or not r.get("path") or not isinstance(r.get("size"), int) or not isinstance(r.get("mtime_ns"), int):
+                raise ValueError(f"record {n}: expected an object with path, size and mtime_ns")
+            rows.append(tuple(r.get(field) for field in CHECKSUM_DB_FIELDS[:-1]) + (r.get("verified") or iso_now(),))
+        with self.lock, self.db:
+            self.db.executemany("INSERT OR REPLACE INTO files (path, size, mtime_ns, md5, sha1, identifier, verified) "
+                                "VALUES (?, ?, ?, ?, ?, ?, ?)", rows)
+        return len(rows)
+
+    def prune(self) -> int:
+        """Forget the files that are gone or have changed since, and return how many."""
+        stale = [r["path"] for r in self.export() if self.known(r["path"]) is None]
+        with self.lock, self.db:
+            self.db.executemany("DELETE FROM files WHERE path = ?", [(path,) for path in stale])
+        return len(stale)
+
+    def close(self):
+        with self.lock:
+            self.db.close()
+
+
+class BudgetExceeded(IOError):
+    pass
+
+
+class Interrupted(IOError):
+    pass
+
+
+# Set by the first SIGINT/SIGTERM: nothing new is started, no transfer is retried
+STOP = threading.Event()
+# Set when the drain time after a stop is up: the transfers in flight end at once and keep their .part
+ABORT = threading.Event()
+# Responses whose bodies are being read, so a stop can cut off a read that is waiting on a stalled node
+_ACTIVE = set()
+_ACTIVE_LOCK = threading.Lock()
+# Bytes every transfer of the run has received so far, for --stats-file
+_RECEIVED = [0]
+_RECEIVED_LOCK = threading.Lock()
+
+
+class LockHeld(RuntimeError):
+    """Another run holds a DirectoryLock; owner is what its lock file says (empty when it can't be read)."""
+
+    def __init__(self, path: str, owner: dict):
+        super().__init__(f"{path} is held by {describe_owner(owner)}; wait for that run to finish, or remove the file "
+                         "if the run is gone (on another host, its process can't be checked from here)")
+        self.path = path
+        self.owner = owner
+
+
+def describe_owner(owner: dict) -> str:
+    if not owner:
+        return "a run whose lock file can't be read"
+    return f"{owner.get('tool', 'a run')} (pid {owner.get('pid')} on {owner.get('host')}, since {owner.get('started')})"
+
+
+def pid_alive(pid: int) -> bool:
+    """Whether a process with this pid is running on this host; one we may not signal still counts."""
+    if pid <= 0:
+        return False
+    if os.name == "nt":
+        # os.kill(pid, 0) would terminate the process on Windows
+        import ctypes
+        kernel32 = ctypes.windll.kernel32
+        handle = kernel32.OpenProcess(0x1000, False, pid)  # PROCESS_QUERY_LIMITED_INFORMATION
+        if not handle:
+            # ERROR_ACCESS_DENIED: somebody else's process
+            return kernel32.GetLastError() == 5
+        try:
+            code = ctypes.c_ulong()
+            return bool(kernel32.GetExitCodeProcess(handle, ctypes.byref(code))) and code.value == 259  # STILL_ACTIVE
+        finally:
+            kernel32.CloseHandle(handle)
+    try:
+        os.kill(pid, 0)
+    except ProcessLookupError:
+        return False
+    except PermissionError:
+        return True
+    return True
+
+
+class DirectoryLock:
+    """Keeps two runs from writing to one destination directory at the same time.
+
+    acquire() creates LOCK_FILE there, with the owner's pid, host, start time and tool, or raises
+    LockHeld once wait seconds have gone by with another run holding it. A lock left by a process
+    that is no longer running on this host is stale and taken over; a lock from another host is
+    never, since its process can't be checked. release() is safe to call more than once, so the
+    tools both register it with Shutdown.on_exit() (a second Ctrl-C leaves with os._exit) and let
+    atexit run it on any other way out.
+    """
+
+    def __init__(self, directory: str, tool: str):
+        self.path = os.path.join(directory, LOCK_FILE)
+        self.owner = {"pid": os.getpid(), "host": socket.gethostname(), "tool": tool}
+        self.held = False
+
+    def acquire(self, wait: float = 0, poll: float = 1.0) -> "DirectoryLock":
+        deadline = time.monotonic() + wait
+        announced = False
+        while True:
+            try:
+                fd = os.open(self.path, os.O_CREAT | os.O_EXCL | os.O_WRONLY, 0o644)
+            except FileExistsError:
+                owner = self.read()
+                if owner is not None and self.stale(owner):
+                    logging.warning(f"Taking over {self.path}: {describe_owner(owner)} is no longer running")
+                    self.break_stale(owner)
+                    continue
+                left = deadline - time.monotonic()
+                if left <= 0:
+                    raise LockHeld(self.path, owner or {})
+                if not announced:
+                    logging.warning(f"{self.path} is held by {describe_owner(owner or {})}; waiting up to {wait:g}s for it")
+                    announced = True
+                if STOP.wait(min(poll, left)):
+                    raise Interrupted(f"stopped while waiting for {self.path}")
+                continue
+            self.owner["started"] = iso_now()
+            with os.fdopen(fd, "w", encoding="utf-8") as f:
+                json.dump(self.owner, f)
+            self.held = True
+            atexit.register(self.release)
+            logging.debug(f"Locked {self.path}")
+            return self
+
+    def read(self, path: Optional[str] = None) -> Optional[dict]:
+        """What a lock file says: None when it is gone, {} when it can't be read (yet)."""
+        try:
+            with open(path or self.path, encoding="utf-8") as f:
+                owner = json.load(f)
+        except FileNotFoundError:
+            return None
+        except (OSError, ValueError):
+            return {}
+        return owner if isinstance(owner, dict) else {}
+
+    def stale(self, owner: dict) -> bool:
+        if not owner:
+            # another run may be between creating the file and writing it
+            try:
+                return time.time() - os.path.getmtime(self.path) > LOCK_UNREADABLE_STALE
+            except OSError:
+                return False
+        if owner.get("host") != socket.gethostname() or not isinstance(owner.get("pid"), int):
+            return False
+        return not pid_alive(owner["pid"])
+
+    def break_stale(self, owner: dict):
+        # moved aside first, so of two runs taking over the same stale lock only one removes it
+        aside = f"{self.path}.{os.getpid()}.stale"
+        try:
+            os.replace(self.path, aside)
+        except FileNotFoundError:
+            return
+        if owner and self.read(aside) != owner:
+            # a new run took the lock since it was read; give it back unless yet another one has it now
+            try:
+                os.link(aside, self.path)
+            except OSError:
+                pass
+        os.remove(aside)
+
+    def release(self):
+        if not self.held:
+            return
+        self.held = False
+        # only our own lock: a run that took it over for stale (say, after a pid was reused) keeps its own
+        if self.read() == self.owner:
+            try:
+                os.remove(self.path)
+            except FileNotFoundError:
+                pass
+        logging.debug(f"Unlocked {self.path}")
+
+    def __enter__(self) -> "DirectoryLock":
+        return self
+
+    def __exit__(self, *exc):
+        self.release()
+
+
+def add_stats_args(p):
+    p.add_argument("--stats-file", help="Keep the run's totals in this JSON file (items done and left, bytes, rate, transfers in flight, "
+                                        "recent errors, ETA), for dashboards and health checks; the last write says how the run ended")
+    p.add_argument("--stats-interval", type=parse_duration, default=30, help="Rewrite --stats-file this often, e.g. 10s (default: 30s)")
+
+
+def check_stats_args(p, args):
+    if args.stats_interval <= 0:
+        p.error("--stats-interval must be more than 0")
+
+
+def add_checksum_db_args(p):
+    p.add_argument("--checksum-db", default=os.environ.get("IA_CHECKSUM_DB"),
+                   help="Keep the digests of the files on disk in this SQLite file, shared with the other tools and later runs, "
+                        "so a file that hasn't changed isn't hashed again (default: $IA_CHECKSUM_DB)")
+
+
+def open_checksum_db(p, args) -> Optional[ChecksumDB]:
+    if not args.checksum_db:
+        return None
+    try:
+        return ChecksumDB(args.checksum_db)
+    except sqlite3.Error as e:
+        p.error(f"could not open --checksum-db {args.checksum_db}: {e}")
+
+
+def add_lock_args(p):
+    p.add_argument("--lock-wait", type=parse_duration, default=0,
+                   help=f"When another run is writing to the destination (its {LOCK_FILE}), wait up to this long for it, e.g. 10m, "
+                        f"instead of exiting with code {EXIT_LOCKED} at once")
+
+
+def lock_destination(directory: str, tool: str, wait: float = 0) -> DirectoryLock:
+    """The lock of the destination directory, created if need be; exits with EXIT_LOCKED when another run keeps it."""
+    os.makedirs(directory, exist_ok=True)
+    try:
+        return DirectoryLock(directory, tool).acquire(wait)
+    except LockHeld as e:
+        logging.error(str(e))
+        sys.exit(EXIT_LOCKED)
+    except Interrupted:
+        sys.exit(EXIT_INTERRUPTED)
+
+
+class Shutdown:
+    """The SIGINT/SIGTERM handling of a run, shared by the tools that download.
+
+    The first signal sets STOP, so no new transfer starts, and gives the ones in flight drain seconds
+    to finish before ABORT cuts them off. The run's final writes (report, WARC file...) are registered
+    with on_exit() and happen once, in finish(): at the end of the run, or at a second signal, which
+    then exits at once with EXIT_INTERRUPTED.
+    """
+
+    def __init__(self, drain: float = DRAIN_SECONDS):
+        self.drain = drain
+        self.hooks: List[Callable[[], None]] = []
+        self.lock = threading.Lock()
+        self.finished = False
+        self.timer: Optional[threading.Timer] = None
+
+    def install(self) -> "Shutdown":
+        for sig in (signal.SIGINT, signal.SIGTERM):
+            signal.signal(sig, self.handle)
+        return self
+
+    def on_exit(self, hook: Callable[[], None]):
+        self.hooks.append(hook)
+
+    def handle(self, signum, frame):
+        name = signal.Signals(signum).name
+        if STOP.is_set():
+            logging.warning(f"{name} received again: quitting now, partial files are kept for the next run")
+            self.abort()
+            self.finish()
+            os._exit(EXIT_INTERRUPTED)
+        STOP.set()
+        if self.drain > 0:
+            logging.warning(f"{name} received: starting nothing new, the transfers in flight get {self.drain:g}s to finish; "
+                            "partial files are kept for the next run (again to quit at once)")
+            self.timer = threading.Timer(self.drain, self.abort)
+            self.timer.daemon = True
+            self.timer.start()
+        else:
+            logging.warning(f"{name} received: stopping the transfers in flight, "
+                            "partial files are kept for the next run (again to quit at once)")
+            self.abort()
+
+    def abort(self):
+        ABORT.set()
+        abort_transfers()
+
+    def finish(self):
+        """Run the on_exit() hooks, once; a failing hook is logged and the others still run."""
+        with self.lock:
+            if self.finished:
+                return
+            self.finished = True
+        if self.timer:
+            self.timer.cancel()
+        for hook in self.hooks:
+            try:
+                hook()
+            except Exception:
+                logging.exception("A final write failed")
+
+
+def abort_transfers():
+    """Shut down the connection of every body being read, so blocked reads fail now instead of at their timeout.
+
+    Only the body is covered: a request still waiting for its response headers ends at its timeout.
+    """
+    with _ACTIVE_LOCK:
+        active = list(_ACTIVE)
+    for r in active:
+        sock = _socket_of(r)
+        if sock is not None:
+            try:
+                sock.shutdown(socket.SHUT_RDWR)
+            except OSError:
+                pass
+
+
+def _socket_of(r) -> Optional[socket.socket]:
+    # urllib3 keeps the socket on the connection, unless the server is closing it after this response:
+    # then http.client has let go of it and only the response's file object still has it
+    raw = getattr(r, "raw", None)
+    sock = getattr(getattr(raw, "_connection", None), "sock", None)
+    if sock is None:
+        fp = getattr(getattr(raw, "_fp", None), "fp", None)
+        sock = getattr(getattr(fp, "raw", None), "_sock", None)
+    return sock
+
+
+def count_received(n: int):
+    with _RECEIVED_LOCK:
+        _RECEIVED[0] += n
+
+
+def received_so_far() -> int:
+    return _RECEIVED[0]
+
+
+def active_transfers() -> int:
+    """The bodies being read right now; a segmented download counts once per segment."""
+    return len(_ACTIVE)
+
+
+class StatsFile(logging.Handler):
+    """--stats-file: the run's totals as a small JSON file, rewritten every interval seconds.
+
+    A thread of its own does the writing, so a slow disk never holds up a transfer, and each write
+    replaces the file whole. The tool reports its items with begin() and item_done() and its own
+    counts with update(); bytes, rate and transfers in flight come from the Downloader, the recent
+    errors from the log (and record(), for what a tool only prints), as does the circuit breaker's
+    state once it has paused the run (circuit_breaker). finish() makes the last write,
+    with the exit status; atexit makes it with none when the run ends another way. Without a path,
+    nothing is written.
+    """
+
+    RECENT_ERRORS = 10
+
+    def __init__(self, path: Optional[str], interval: float, tool: str):
+        super().__init__(logging.WARNING)
+        self.path = path
+        self.interval = interval
+        self.fields = {"tool": tool, "pid": os.getpid(), "started": iso_now(), "finished": False, "exit_status": None}
+        self.began = self.started = time.time()
+        self.items_done = 0
+        self.items_total: Optional[int] = None
+        self.errors = deque(maxlen=self.RECENT_ERRORS)
+        self.last = (self.started, received_so_far())
+        self.bytes_at_start = received_so_far()
+        # fields_lock guards the counts, write_lock the file; a write never keeps the tool from counting
+        self.fields_lock = threading.RLock()
+        self.write_lock = threading.Lock()
+        self.done = threading.Event()
+        self.thread: Optional[threading.Thread] = None
+        self.failed = False
+
+    def start(self) -> "StatsFile":
+        if not self.path:
+            return self
+        logging.getLogger().addHandler(self)
+        atexit.register(self.finish, None)
+        self.write()
+        self.thread = threading.Thread(target=self.run, name="stats-file", daemon=True)
+        self.thread.start()
+        return self
+
+    def begin(self, total: int):
+        """A new list of total items to go through (each --watch cycle is one); the ETA is for it."""
+        with self.fields_lock:
+            self.items_done, self.items_total, self.began = 0, total, time.time()
+
+    def item_done(self):
+        with self.fields_lock:
+            self.items_done += 1
+
+    def update(self, **fields):
+        with self.fields_lock:
+            self.fields.update(fields)
+
+    def record(self, message: str, level: str = "ERROR"):
+        self.errors.append({"time": iso_now(), "level": level, "message": message})
+
+    def emit(self, record: logging.LogRecord):
+        breaker = getattr(record, "circuit_breaker", None)
+        if breaker is not None:
+            self.update(circuit_breaker=breaker)
+        self.record(record.getMessage(), record.levelname)
+
+    def snapshot(self) -> dict:
+        now, received = time.time(), received_so_far()
+        with self.fields_lock:
+            then, before = self.last
+            self.last = (now, received)
+            elapsed = now - self.started
+            done, total = self.items_done, self.items_total
+            eta = None
+            if total is not None and 0 < done < total:
+                eta = round((now - self.began) / done * (total - done))
+            elif total is not None and done >= total:
+                eta = 0
+            return dict(self.fields, updated=iso_now(), elapsed_seconds=round(elapsed, 1), items_done=done, items_total=total,
+                        items_remaining=total - done if total is not None else None, bytes=received - self.bytes_at_start,
+                        bytes_per_sec=round((received - before) / (now - then)) if now > then else None,
+                        avg_bytes_per_sec=round((received - self.bytes_at_start) / elapsed) if elapsed > 0 else None,
+                        active_transfers=active_transfers(), eta_seconds=eta, recent_errors=list(self.errors))
+
+    def write(self):
+        snapshot = self.snapshot()
+        with self.write_lock:
+            if self.fields["finished"] and not snapshot["finished"]:
+                # the thread's last write, come after the final one
+                return
+            tmp = self.path + ".tmp"
+            try:
+                with open(tmp, "w", encoding="utf-8") as f:
+                    json.dump(snapshot, f, indent=2)
+                os.replace(tmp, self.path)
+            except OSError as e:
+                if not self.failed:
+                    # once, not every interval; the run goes on without it
+                    logging.warning(f"--stats-file {self.path}: could not write it ({e}); trying again every {self.interval:g}s")
+                    self.failed = True
+
+    def run(self):
+        while not self.done.wait(self.interval):
+            self.write()
+
+    def finish(self, exit_status: Optional[int]):
+        """The last write, marked finished; only the first call counts."""
+        with self.fields_lock:
+            if not self.path or self.fields["finished"]:
+                return
+            self.fields.update(finished=True, exit_status=exit_status, ended=iso_now())
+            self.done.set()
+        logging.getLogger().removeHandler(self)
+        self.write()
+
+
+def iso_now() -> str:
+    return datetime.now(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+
+
+@contextmanager
+def abortable(r):
+    """Register r with abort_transfers() while its body is read."""
+    with _ACTIVE_LOCK:
+        _ACTIVE.add(r)
+    try:
+        # an abort that came before the registration would not have reached r
+        if ABORT.is_set():
+            raise Interrupted("interrupted")
+        yield r
+    finally:
+        with _ACTIVE_LOCK:
+            _ACTIVE.discard(r)
+
+
+class Budget:
+    """Wall-clock limits for one file: hard ends the transfer itself, soft only stops further attempts.
+
+    check() also gives up once the drain time after a stop is up, sleep() as soon as the run is asked to stop.
+    """
+
+    def __init__(self, hard: Optional[float] = None, soft: Optional[float] = None):
+        self.hard = hard
+        self.soft = soft
+
+    def check(self):
+        if ABORT.is_set():
+            raise Interrupted("interrupted")
+        if self.hard is not None and time.time() > self.hard:
+            raise BudgetExceeded("--max-elapsed-per-file used up")
+
+    def timeout(self, timeout: float) -> float:
+        # a stalled read must not outlast the hard limit either
+        if self.hard is None:
+            return timeout
+        return max(min(timeout, self.hard - time.time()), 1.0)
+
+    def backoff(self, delay: float) -> float:
+        """Return delay if another attempt fits in both limits after sleeping it, else give up."""
+        for limit, flag in ((self.hard, "--max-elapsed-per-file"), (self.soft, "--max-elapsed")):
+            if limit is not None and time.time() + delay >= limit:
+                raise BudgetExceeded(f"{flag} leaves no time to retry")
+        return delay
+
+    def sleep(self, delay: float):
+        if STOP.wait(delay):
+            raise Interrupted("interrupted")
+
+
+def retryable(exc: Exception) -> bool:
+    """Whether a failed transfer is worth another attempt, by the same rules as the session's retry policy."""
+    return not isinstance(exc, (BudgetExceeded, Interrupted)) and transient(exc)
+
+
+def retry_fields(url: str, attempt: int, exc: Exception) -> dict:
+    """The --log-format json fields of a retried transfer."""
+    response = getattr(exc, "response", None)
+    return {"url": url, "attempt": attempt, "status": response.status_code if response is not None else None}
+
+
+def trace_response(r, prefix: str, trace: Optional[dict]) -> None:
+    """Log the redirect hops and the serving node at -vv, and note the node in trace for the report."""
+    if logging.getLogger().isEnabledFor(logging.DEBUG):
+        for hop in r.history:
+            logging.debug(f"{prefix}: {hop.status_code} {hop.url} -> {hop.headers.get('Location')}")
+        headers = ", ".join(f"{h}={r.headers[h]}" for h in TRACE_HEADERS if h in r.headers)
+        logging.debug(f"{prefix}: {r.status_code} from {r.url}" + (f" ({headers})" if headers else ""))
+    if trace is not None:
+        trace["node"] = urlsplit(r.url).netloc
+
+
+class RangeNotHonored(Exception):
+    pass
+
+
+class Transfer(NamedTuple):
+    received: int
+    segmented: bool
+    # set when the file was hashed: {algo: hex digest} and "streamed" or "re-read"
+    digests: Optional[Dict[str, str]] = None
+    method: Optional[str] = None
+
+
+class Downloader:
+    """Downloads files into .part files with one policy for every transfer of a run.
+
+    retries is how many times a failed transfer is attempted again, resuming where it stopped
+    (resume=False starts every file over instead, a .part from an earlier run included). Files of a
+    known size are split into up to segments concurrent ranges, limiter caps the combined rate, and
+    with checksum the expected digest passed to fetch() is computed while the file streams in.
+    progress makes the Progress for each transfer from its log prefix.
+
+    Give it a session that doesn't retry itself (build_session with retries=0): the retry loops here
+    resume a body cut short, which a session-level retry can't, and classify failures and honor
+    Retry-After the same way the session policy does.
+    """
+
+    def __init__(self, session, retries: int = 3, segments: int = 1, limiter: Optional[RateLimiter] = None,
+                 checksum: bool = False, resume: bool = True,
+                 progress: Callable[[str], Progress] = TerminalProgress):
+        self.session = session
+        self.retries = retries
+        self.segments = segments
+        self.limiter = limiter
+        self.checksum = checksum
+        self.resume = resume
+        self.progress = progress
+        self.chunk_size = limiter.chunk_size if limiter else CHUNK_SIZE
+
+    def fetch(self, url: str, part: str, size: Optional[int], prefix: str, timeout: float = REQUEST_TIMEOUT,
+              trace: Optional[dict] = None, budget: Optional[Budget] = None, algos: Sequence[str] = ()) -> Transfer:
+        """Download url into part and say how it went; part is left in place on failure.
+
+        algos name the digests to compute, when the caller has some to check the file against
+        (metadata_digests()): streamed with checksum, and always for a segmented transfer, whose
+        pieces arrive out of order and so are hashed once the file is complete.
+        """
+        budget = budget or Budget()
+        os.makedirs(os.path.dirname(part) or ".", exist_ok=True)
+        if not self.resume and os.path.exists(part):
+            os.remove(part)
+        # the progress line of reading a file back to hash it
+        hashing = f"[{'+'.join(algos)}] {prefix}"
+        if (self.segments > 1 and size is not None and size >= self.segments * SEGMENT_MIN_BYTES
+                and not os.path.exists(part)):
+            try:
+                received = self.fetch_segmented(url, part, size, prefix, trace, budget)
+            except RangeNotHonored as e:
+                logging.warning(f"{prefix}: {e}; falling back to a single stream")
+            else:
+                if not algos:
+                    return Transfer(received, True)
+                return Transfer(received, True, hash_file(part, algos, self.progress(hashing)), "re-read")
+        hasher = StreamHash(algos, self.progress(hashing)) if algos and self.checksum else None
+        received = self.fetch_file(url, part, size, prefix, timeout, trace, budget, hasher)
+        if hasher is None:
+            return Transfer(received, False)
+        return Transfer(received, False, hasher.hexdigests(), hasher.method)
+
+    def fetch_file(self, url: str, part: str, expected_size: Optional[int], prefix: str,
+                   timeout: float = REQUEST_TIMEOUT, trace: Optional[dict] = None, budget: Optional[Budget] = None,
+                   hasher: Optional[StreamHash] = None) -> int:
+        """Download url into the part file as one stream, resuming what's already there, and return the bytes received.
+
+        hasher, when given, ends up with the digest of the whole part file.
+        """
+        budget = budget or Budget()
+        os.makedirs(os.path.dirname(part) or ".", exist_ok=True)
+        received = 0
+        began = time.time()
+
+        def once(attempt: int) -> int:
+            nonlocal received
+            offset = os.path.getsize(part) if os.path.exists(part) else 0
+            headers = {"Range": f"bytes={offset}-"} if offset else {}
+            progress = self.progress(prefix)
+            try:
+                budget.check()
+                with self.session.get(url, stream=True, timeout=budget.timeout(timeout), headers=headers) as r:
+                    trace_response(r, prefix, trace)
+                    if r.status_code == 416 and offset and offset == expected_size:
+                        # the partial from an earlier run is already complete
+                        progress.end()
+                        if hasher:
+                            hasher.resume(part, offset)
+                        return received
+                    if r.status_code == 206 and offset:
+                        mode = "ab"
+                        if hasher:
+                            hasher.resume(part, offset)
+                    else:
+                        raise_for_status(r)
+                        mode, offset = "wb", 0
+                        if hasher:
+                            hasher.reset()
+                    total = expected_size
+                    if total is None and r.headers.get("Content-Length", "").isdigit():
+                        total = offset + int(r.headers["Content-Length"])
+                    with open(part, mode) as fh, abortable(r):
+                        for chunk in r.iter_content(chunk_size=self.chunk_size):
+                            fh.write(chunk)
+                            if hasher:
+                                hasher.update(chunk)
+                            received += len(chunk)
+                            offset += len(chunk)
+                            count_received(len(chunk))
+                            if self.limiter:
+                                self.limiter.consume(len(chunk))
+                            progress.update(offset, total, received / max(time.time() - began, 1e-6))
+                            # after the write, so whatever arrived is kept in the .part
+                            budget.check()
+                progress.end()
+                if expected_size is not None and offset != expected_size:
+                    raise IOError(f"got {offset} of {expected_size} bytes")
+                return received
+            except (requests.RequestException, OSError) as e:
+                progress.end()
+                if ABORT.is_set() and not isinstance(e, Interrupted):
+                    # the read was cut off by abort_transfers()
+                    raise Interrupted("interrupted") from e
+                raise
+
+        def retrying(attempt: int, e: Exception, delay: float):
+            budget.backoff(delay)
+            logging.warning(f"{prefix}: {e}; retrying in {delay:.1f}s ({attempt}/{self.retries})", extra=retry_fields(url, attempt, e))
+
+        # no max_elapsed: --max-elapsed and --max-elapsed-per-file (the budget) bound a transfer instead
+        return retry_call(once, self.retries, errors=(requests.RequestException, OSError), should_retry=retryable,
+                          max_elapsed=None, on_retry=retrying, sleep=budget.sleep)
+
+    def fetch_segmented(self, url: str, part: str, size: int, prefix: str, trace: Optional[dict] = None,
+                        budget: Optional[Budget] = None) -> int:
+        """Download size bytes as concurrent ranges into a preallocated part file and return the bytes received.
+
+        Raises RangeNotHonored (after removing the part) when the node answers a range with the whole body.
+        """
+        budget = budget or Budget()
+        os.makedirs(os.path.dirname(part) or ".", exist_ok=True)
+        with open(part, "wb") as fh:
+            fh.truncate(size)
+        step = -(-size // self.segments)
+        bounds = [(start, min(start + step, size) - 1) for start in range(0, size, step)]
+        lock = threading.Lock()
+        done = {"bytes": 0}
+        abort = threading.Event()
+        progress = self.progress(prefix)
+        began = time.time()
+
+        def worker(index: int, first: int, last: int) -> int:
+            pos = first
+
+            def once(attempt: int) -> int:
+                nonlocal pos
+                if abort.is_set():
+                    return pos - first
+                try:
+                    budget.check()
+                    with self.session.get(url, stream=True, timeout=budget.timeout(REQUEST_TIMEOUT),
+                                          headers={"Range": f"bytes={pos}-{last}"}) as r:
+                        trace_response(r, f"{prefix} [segment {index + 1}]", trace)
+                        if r.status_code != 206:
+                            raise_for_status(r)
+                            raise RangeNotHonored(f"got HTTP {r.status_code} for a range request")
+                        with open(part, "r+b") as fh, abortable(r):
+                            fh.seek(pos)
+                            for chunk in r.iter_content(chunk_size=self.chunk_size):
+                                if abort.is_set():
+                                    return pos - first
+                                budget.check()
+                                chunk = chunk[: last + 1 - pos]
+                                fh.write(chunk)
+                                pos += len(chunk)
+                                count_received(len(chunk))
+                                if self.limiter:
+                                    self.limiter.consume(len(chunk))
+                                with lock:
+                                    done["bytes"] += len(chunk)
+                                    progress.update(done["bytes"], size, done["bytes"] / max(time.time() - began, 1e-6))
+                    if pos != last + 1:
+                        raise IOError(f"segment {index + 1}: got {pos - first} of {last + 1 - first} bytes")
+                    return pos - first
+                except (requests.RequestException, OSError) as e:
+                    if ABORT.is_set() and not isinstance(e, Interrupted):
+                        raise Interrupted("interrupted") from e
+                    raise
+
+            def retrying(attempt: int, e: Exception, delay: float):
+                budget.backoff(delay)
+                logging.warning(f"{prefix}: segment {index + 1}/{len(bounds)}: {e}; retrying in {delay:.1f}s ({attempt}/{self.retries})",
+                                extra=retry_fields(url, attempt, e))
+
+            return retry_call(once, self.retries, errors=(requests.RequestException, OSError),
+                              should_retry=lambda e: not abort.is_set() and retryable(e), max_elapsed=None,
+                              on_retry=retrying, sleep=budget.sleep)
+
+        logging.debug(f"{prefix}: {len(bounds)} segments of up to {format_size(step)}")
+        try:
+            with ThreadPoolExecutor(max_workers=len(bounds)) as pool:
+                futures = [pool.submit(worker, i, a, b) for i, (a, b) in enumerate(bounds)]
+                try:
+                    received = sum(fut.result() for fut in futures)
+                except BaseException:
+                    abort.set()
+                    raise
+        except BaseException:
+            # a preallocated part already has the full size, so it can't be resumed like a single stream;
+            # that includes an interrupted one, which starts over on the next run
+            if os.path.exists(part):
+                os.remove(part)
+            raise
+        finally:
+            progress.end()
+        return received
@@ -0,0 +1,171 @@
+"""Notifications at the end of a run, shared by the tools: a webhook POST and/or a command, each given a JSON summary.
+
+add_notify_args() adds the flags, which like any other can be set once for every tool at the top of the
+shared config file and turned off for one with notify-on = "never" in its table. A Notifier decides from
+the run's exit status whether this run is worth telling about and sends it; it counts the failures in a
+row (in a small state file when the tool has a place for one, such as its destination directory), so
+--notify-after 2 stays quiet about a single failed cycle and speaks up at the second.
+"""
+import json
+import logging
+import os
+import socket
+import subprocess
+import sys
+import traceback
+from datetime import datetime, timezone
+from typing import Callable, Optional
+
+import requests
+
+NOTIFY_ON = ("failure", "always", "never")
+# what is sent: a run that ended with status 0, one that did not, the first success after a failure that was
+# told about, and an exception that ended the run
+EVENTS = ("finished", "failed", "recovered", "crashed")
+# Kept next to a tool's other state, for the failures in a row across runs
+NOTIFY_STATE = ".ia-notify.json"
+NOTIFY_TIMEOUT = 30
+# the shell's status for SIGINT: a run that was stopped didn't fail, and says nothing
+EXIT_INTERRUPTED = 130
+
+
+def add_notify_args(p):
+    p.add_argument("--notify-url", help="At the end of a run, POST a JSON summary of it here (a webhook)")
+    p.add_argument("--notify-command", help="At the end of a run, run this shell command with the JSON summary on stdin")
+    p.add_argument("--notify-on", choices=NOTIFY_ON, default="failure",
+                   help="failure: only runs that fail, and the first one that succeeds after (default); always: every run; "
+                        "never: turn off what the config file sets")
+    p.add_argument("--notify-after", type=int, default=1, help="Tell about a failure only once this many runs (or --watch cycles) "
+                                                               "in a row have failed (default: 1)")
+
+
+def check_notify_args(p, args):
+    if args.notify_after < 1:
+        p.error("--notify-after must be at least 1")
+
+
+def iso_now() -> str:
+    return datetime.now(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+
+
+class Notifier:
+    """Sends a run's outcome to --notify-url and --notify-command, when --notify-on and --notify-after say so.
+
+    done() is called with each run's (or --watch cycle's) exit status and a summary of the tool's
+    choosing; install() also reports an exception that ends the run. Sending never fails the run:
+    a webhook or command that doesn't work is logged, and that is all.
+    """
+
+    def __init__(self, args, tool: str, user_agent: str, state_dir: Optional[str] = None):
+        self.url = args.notify_url
+        self.command = args.notify_command
+        self.on = args.notify_on
+        self.after = args.notify_after
+        self.tool = tool
+        self.user_agent = user_agent
+        self.state_path = os.path.join(state_dir, NOTIFY_STATE) if state_dir else None
+        self.state = self.load_state()
+
+    @property
+    def enabled(self) -> bool:
+        return self.on != "never" and bool(self.url or self.command)
+
+    def load_state(self) -> dict:
+        if self.state_path:
+            try:
+                with open(self.state_path, encoding="utf-8") as f:
+                    state = json.load(f)
+                if isinstance(state, dict):
+                    return state
+            except FileNotFoundError:
+                pass
+            except (OSError, ValueError) as e:
+                logging.warning(f"Could not read {self.state_path} ({e}); counting failures in a row from 0")
+        return {"failures": 0, "notified": False}
+
+    def save_state(self):
+        if not self.state_path:
+            return
+        tmp = self.state_path + ".tmp"
+        try:
+            with open(tmp, "w", encoding="utf-8") as f:
+                json.dump(self.state, f)
+            os.replace(tmp, self.state_path)
+        except OSError as e:
+            logging.warning(f"Could not save {self.state_path}: {e}")
+
+    def event(self, exit_status: int) -> Optional[str]:
+        """Count this outcome and say what to send about it, if anything."""
+        if exit_status == EXIT_INTERRUPTED:
+            return None
+        if exit_status == 0:
+            told = self.state.get("notified", False)
+            self.state.update(failures=0, notified=False)
+            if self.on == "always":
+                return "recovered" if told else "finished"
+            return "recovered" if told else None
+        self.state["failures"] = self.state.get("failures", 0) + 1
+        if self.state["failures"] < self.after:
+            return "failed" if self.on == "always" else None
+        # once a streak, not at every failure after it
+        if self.state.get("notified") and self.on != "always":
+            return None
+        self.state["notified"] = True
+        return "failed"
+
+    def done(self, exit_status: int, summary: Optional[dict] = None) -> Optional[str]:
+        """The end of a run or cycle: count it and send what --notify-on asks for; the event sent, if any."""
+        if not self.enabled:
+            return None
+        event = self.event(exit_status)
+        self.save_state()
+        if event:
+            self.send(self.payload(event, exit_status, summary))
+        return event
+
+    def payload(self, event: str, exit_status: Optional[int], summary: Optional[dict], error: Optional[str] = None) -> dict:
+        payload = {"tool": self.tool, "event": event, "exit_status": exit_status, "host": socket.gethostname(), "pid": os.getpid(),
+                   "time": iso_now(), "failures_in_a_row": self.state.get("failures", 0), "summary": summary or {}}
+        if error:
+            payload["error"] = error
+        return payload
+
+    def send(self, payload: dict):
+        body = json.dumps(payload, ensure_ascii=False)
+        if self.url:
+            try:
+                r = requests.post(self.url, data=body.encode("utf-8"), timeout=NOTIFY_TIMEOUT,
+                                  headers={"Content-Type": "application/json", "User-Agent": self.user_agent})
+                if r.status_code >= 300:
+                    logging.warning(f"--notify-url answered HTTP {r.status_code} to the {payload['event']} notification")
+            except requests.RequestException as e:
+                logging.warning(f"Could not send the {payload['event']} notification to --notify-url: {e}")
+        if self.command:
+            env = dict(os.environ, IA_NOTIFY_EVENT=payload["event"], IA_NOTIFY_TOOL=self.tool,
+                       IA_NOTIFY_EXIT_STATUS="" if payload["exit_status"] is None else str(payload["exit_status"]))
+            try:
+                done = subprocess.run(self.command, shell=True, input=body, text=True, env=env, timeout=NOTIFY_TIMEOUT,
+                                      capture_output=True)
+                if done.returncode != 0:
+                    logging.warning(f"--notify-command exited with {done.returncode}: {done.stderr.strip()[:200]}")
+            except (OSError, subprocess.SubprocessError) as e:
+                logging.warning(f"Could not run --notify-command: {e}")
+        logging.info(f"Sent the {payload['event']} notification")
+
+    def install(self, summary: Callable[[], dict] = dict) -> "Notifier":
+        """Also tell about an exception that ends the run, before Python prints it."""
+        if not self.enabled:
+            return self
+        previous = sys.excepthook
+
+        def hook(kind, value, tb):
+            if not issubclass(kind, KeyboardInterrupt):
+                self.state["failures"] = self.state.get("failures", 0) + 1
+                self.state["notified"] = True
+                self.save_state()
+                error = "".join(traceback.format_exception_only(kind, value)).strip()
+                self.send(self.payload("crashed", None, summary(), error))
+            previous(kind, value, tb)
+
+        sys.excepthook = hook
+        return self
@@ -0,0 +1,19 @@
+"""Load the hyphen-named CLI scripts as modules so their helpers can be tested."""
+import importlib.util
+import pathlib
+import sys
+
+ROOT = pathlib.Path(__file__).resolve().parent.parent
+# the scripts import ia_common from their own directory
+sys.path.insert(0, str(ROOT))
+
+
+def load_script(filename: str):
+    name = filename[:-len(".py")].replace("-", "_").lower()
+    if name in sys.modules:
+        return sys.modules[name]
+    spec = importlib.util.spec_from_file_location(name, ROOT / filename)
+    module = importlib.util.module_from_spec(spec)
+    sys.modules[name] = module
+    spec.loader.exec_module(module)
+    return module
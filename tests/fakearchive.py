@@ -0,0 +1,521 @@
+"""A fake archive.org for end-to-end tests.
+
+FakeArchive serves advancedsearch, scrape and /metadata from the items added to it,
+/download/<id>/<name> with Range support, the metadata write API (POST /metadata/<id>), and
+an IAS3 endpoint under /s3 that keeps what is PUT to it, whole or in multipart uploads, in uploads,
+and copies a file of one item into another for a PUT with x-amz-copy-source.
+/services/img/<id> answers with the item's image from service_images, or a redirect to a
+generic icon under /images/ as archive.org does for items without one.
+It also stands in for the tasks API, OAI-PMH, full-text search with search inside, and the Wayback
+Machine's CDX server, captures and Save Page Now, answering from the lists a test fills in
+(task_catalog, oai_records, fts_hits, cdx_rows, ...).
+An advanced search page can be held back until a download has begun (hold_search_page), to show a
+downloader reading the search's output starts before the search is over.
+Faults queued for a path are used up one per request to it, so a test can have the first answer be
+a 429 and the retry succeed:
+
+    archive.fail("/metadata/disc", status(429, retry_after=2))
+
+pointed() patches the base URLs in ia_common (and in the scripts that copied one at import time)
+for the duration of a with block.
+"""
+import contextlib
+import hashlib
+import json
+import mimetypes
+import os
+import re
+import signal
+import sys
+import threading
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from typing import Dict, List, Optional
+from unittest import mock
+from urllib.parse import parse_qs, unquote, urlsplit
+
+import _scripts  # noqa: F401  (puts the repository root on sys.path)
+import ia_common
+
+# faults, also usable as fail(path, IGNORE_RANGE, ...)
+IGNORE_RANGE = {"ignore_range": True}
+TRUNCATE = {"truncate": True}
+# Ctrl-C for the tool under test, as the request arrives; it is then answered as usual
+INTERRUPT = {"signal": signal.SIGINT}
+S3_XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+CDX_FIELDS = ("urlkey", "timestamp", "original", "mimetype", "statuscode", "digest", "length")
+# how long a held search page waits for a download before it is answered anyway
+HOLD_TIMEOUT = 20
+
+
+def status(code: int, retry_after: Optional[int] = None, body: bytes = b"") -> dict:
+    headers = {"Retry-After": str(retry_after)} if retry_after is not None else {}
+    return {"status": code, "headers": headers, "body": body}
+
+
+def html_error(code: int = 200) -> dict:
+    """The HTML page a misbehaving front end sends instead of JSON or the file."""
+    return {"status": code, "headers": {"Content-Type": "text/html"},
+            "body": b"<html><body><h1>Internet Archive is temporarily offline</h1></body></html>"}
+
+
+class Handler(BaseHTTPRequestHandler):
+    protocol_version = "HTTP/1.1"
+
+    def log_message(self, *args):
+        pass
+
+    def send(self, code: int, body: bytes = b"", headers: Optional[dict] = None):
+        self.send_response(code)
+        for k, v in (headers or {}).items():
+            self.send_header(k, v)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def send_json(self, data):
+        self.send(200, json.dumps(data).encode(), {"Content-Type": "application/json"})
+
+    def do_GET(self):
+        archive: FakeArchive = self.server.archive
+        url = urlsplit(self.path)
+        path, query = unquote(url.path), parse_qs(url.query)
+        archive.requests.append((path, self.headers.get("Range")))
+        fault = archive.next_fault(path)
+        if fault and "signal" in fault:
+            os.kill(os.getpid(), fault["signal"])
+        if fault and "status" in fault:
+            return self.send(fault["status"], fault["body"], fault["headers"])
+        if path == "/advancedsearch.php":
+            return self.search(query)
+        if path == "/services/search/v1/scrape":
+            return self.scrape(query)
+        if path == "/services/tasks.php":
+            return self.tasks(query)
+        if path == "/services/oai.php":
+            return self.oai(query)
+        if path.startswith("/metadata/"):
+            return self.metadata(path[len("/metadata/"):])
+        if path == "/cdx/search/cdx":
+            return self.cdx(query)
+        if path.startswith("/save/status/"):
+            return self.spn_status(path[len("/save/status/"):])
+        if path == "/wayback/available":
+            return self.available(query)
+        if path.startswith("/web/"):
+            return self.snapshot(path[len("/web/"):] + (f"?{url.query}" if url.query else ""))
+        if path == "/fulltext/inside.php":
+            return self.send_json({"matches": self.server.archive.inside.get(query["item_id"][0], [])})
+        if path.startswith("/download/"):
+            identifier, _, name = path[len("/download/"):].partition("/")
+            return self.download(identifier, name, fault or {})
+        if path.startswith("/services/img/"):
+            image = archive.service_images.get(path[len("/services/img/"):])
+            if image is None:
+                return self.send(302, b"", {"Location": "/images/notfound.png"})
+            return self.send(200, image, {"Content-Type": "image/jpeg"})
+        if path.startswith("/images/"):
+            return self.send(200, b"generic icon", {"Content-Type": "image/png"})
+        self.send(404, b"not found")
+
+    def do_PUT(self):
+        self.s3("PUT")
+
+    def do_POST(self):
+        if self.path.startswith("/metadata/"):
+            return self.write_metadata(unquote(urlsplit(self.path).path)[len("/metadata/"):])
+        if self.path == "/fts":
+            return self.full_text_search()
+        if self.path == "/save":
+            return self.spn_save()
+        self.s3("POST")
+
+    def full_text_search(self):
+        """The FTS API: Elasticsearch hits from fts_hits, size at a time, the next page asked for by _scroll_id."""
+        archive: FakeArchive = self.server.archive
+        query = json.loads(self.rfile.read(int(self.headers.get("Content-Length") or 0)))
+        archive.fts_queries.append(query)
+        fault = archive.next_fault("/fts")
+        if fault and "status" in fault:
+            return self.send(fault["status"], fault["body"], fault["headers"])
+        start, size = int(query.get("scroll_id") or 0), int(query.get("size", 10))
+        hits = archive.fts_hits[start:start + size]
+        self.send_json({"_scroll_id": str(start + size), "hits": {"total": len(archive.fts_hits), "hits": hits}})
+
+    def write_metadata(self, identifier):
+        """The metadata write API: a JSON Patch for "-target" in a form with the IAS3 keys."""
+        archive: FakeArchive = self.server.archive
+        form = parse_qs(self.rfile.read(int(self.headers.get("Content-Length") or 0)).decode())
+        archive.writes.append({k: v[0] for k, v in form.items()})
+        fault = archive.next_fault(f"/metadata/{identifier}")
+        if fault and "status" in fault:
+            return self.send(fault["status"], fault["body"], fault["headers"])
+        item = archive.items.get(identifier)
+        if item is None or not form.get("access") or not form.get("secret"):
+            return self.send(403 if item else 404, json.dumps({"success": False, "error": "not allowed"}).encode())
+        if form["-target"][0] == "metadata":
+            for op in json.loads(form["-patch"][0]):
+                key, _, rest = op["path"][1:].partition("/")
+                if op["op"] == "remove":
+                    del item["metadata"][key]
+                elif rest == "-":
+                    item["metadata"][key].append(op["value"])
+                else:
+                    item["metadata"][key] = op["value"]
+        self.send_json({"success": True, "task_id": 1000 + len(archive.writes), "log": f"{archive.url}/log/1"})
+
+    def do_DELETE(self):
+        self.s3("DELETE")
+
+    def s3(self, method):
+        archive: FakeArchive = self.server.archive
+        url = urlsplit(self.path)
+        path, query = unquote(url.path), parse_qs(url.query, keep_blank_values=True)
+        body = self.rfile.read(int(self.headers.get("Content-Length") or 0))
+        archive.s3_requests.append((method, self.path, dict(self.headers)))
+        fault = archive.next_fault(path)
+        if fault and "signal" in fault:
+            os.kill(os.getpid(), fault["signal"])
+        if fault and "status" in fault:
+            return self.send(fault["status"], fault["body"], fault["headers"])
+        if not path.startswith("/s3/") or not self.headers.get("Authorization", "").startswith("LOW "):
+            return self.send(403, b"<Error><Code>AccessDenied</Code></Error>")
+        key = tuple(path[len("/s3/"):].split("/", 1))
+        with archive.lock:
+            if method == "POST" and "uploads" in query:
+                upload_id = f"upload-{len(archive.s3_requests)}"
+                archive.multipart[upload_id] = {"key": key, "parts": {}, "headers": dict(self.headers)}
+                return self.send(200, f'<InitiateMultipartUploadResult xmlns="{S3_XMLNS}"><UploadId>{upload_id}</UploadId>'
+                                      '</InitiateMultipartUploadResult>'.encode())
+            if method == "PUT" and "uploadId" in query:
+                archive.multipart[query["uploadId"][0]]["parts"][int(query["partNumber"][0])] = body
+                return self.send(200, headers={"ETag": f'"{hashlib.md5(body).hexdigest()}"'})
+            if method == "POST" and "uploadId" in query:
+                upload = archive.multipart.pop(query["uploadId"][0])
+                numbers = [int(n) for n in re.findall(r"<PartNumber>(\d+)</PartNumber>", body.decode())]
+                archive.uploads[key] = {"data": b"".join(upload["parts"][n] for n in numbers), "headers": upload["headers"]}
+                return self.send(200, b"<CompleteMultipartUploadResult/>")
+            if method == "DELETE" and "uploadId" in query:
+                archive.multipart.pop(query["uploadId"][0], None)
+                return self.send(204)
+            if method == "PUT" and self.headers.get("x-amz-copy-source"):
+                src_id, _, src_name = unquote(self.headers["x-amz-copy-source"]).lstrip("/").partition("/")
+                source = archive.items.get(src_id, {}).get("files", {})
+                if src_name not in source:
+                    return self.send(404, b"<Error><Code>NoSuchKey</Code></Error>")
+                archive.uploads[key] = {"data": source[src_name], "headers": dict(self.headers)}
+                # in the destination's metadata at once, as if its task had already run
+                archive.items.setdefault(key[0], {"files": {}, "metadata": {}, "dark": False, "updated": 1700000000})
+                archive.items[key[0]]["files"][key[1]] = source[src_name]
+                return self.send(200, f'<CopyObjectResult xmlns="{S3_XMLNS}"/>'.encode())
+            if method == "PUT":
+                archive.uploads[key] = {"data": body, "headers": dict(self.headers)}
+                return self.send(200, headers={"ETag": f'"{hashlib.md5(body).hexdigest()}"'})
+        self.send(400, b"<Error><Code>InvalidRequest</Code></Error>")
+
+    def search(self, query):
+        archive: FakeArchive = self.server.archive
+        rows, page = int(query.get("rows", ["50"])[0]), int(query.get("page", ["1"])[0])
+        if page == archive.hold_search_page:
+            archive.held_page_released_by_download = archive.download_started.wait(HOLD_TIMEOUT)
+        fields = query.get("fl[]") or ["identifier"]
+        sort = query.get("sort[]", [])
+        bad = next((order for order in sort if order.partition(" ")[2] not in ("asc", "desc")), None)
+        if bad is not None:
+            # what Solr says, in place of the results
+            return self.send_json({"responseHeader": {"status": 400},
+                                   "error": {"msg": f"Can't determine a Sort Order (asc or desc) in sort spec '{bad}'", "code": 400}})
+        docs = self.server.archive.docs(fields, sort)
+        self.send_json({"responseHeader": {"status": 0},
+                        "response": {"numFound": len(docs), "start": (page - 1) * rows,
+                                     "docs": docs[(page - 1) * rows:page * rows]}})
+
+    def scrape(self, query):
+        cursor = query.get("cursor", [None])[0]
+        self.server.archive.scrape_cursors.append(cursor)
+        if cursor in self.server.archive.expired_cursors:
+            return self.send(400, json.dumps({"error": "cursor expired"}).encode(), {"Content-Type": "application/json"})
+        count, start = int(query.get("count", ["100"])[0]), int(cursor or 0)
+        fields = query.get("fields", ["identifier"])[0].split(",")
+        docs = self.server.archive.docs(fields + ["identifier"], [s for s in query.get("sorts", [""])[0].split(",") if s])
+        body = {"items": docs[start:start + count], "count": len(docs[start:start + count]), "total": len(docs)}
+        if start + count < len(docs):
+            body["cursor"] = str(start + count)
+        self.send_json(body)
+
+    def cdx(self, query):
+        """The CDX server with output=json: a header row, then the rows; with showResumeKey, [] and [key] after a page cut short."""
+        archive: FakeArchive = self.server.archive
+        archive.cdx_queries.append({k: v if len(v) > 1 else v[0] for k, v in query.items()})
+        fields = query.get("fl", [",".join(CDX_FIELDS)])[0].split(",")
+        start = int(query.get("resumeKey", ["0"])[0])
+        limit = int(query.get("limit", [str(len(archive.cdx_rows))])[0])
+        rows = archive.cdx_rows[start:start + limit]
+        body = [fields] + [[row[f] for f in fields] for row in rows] if rows else []
+        if "showResumeKey" in query and start + limit < len(archive.cdx_rows):
+            body += [[], [str(start + limit)]]
+        self.send_json(body)
+
+    def snapshot(self, rest):
+        """A Wayback Machine capture, /web/<timestamp>id_/<url>, from the bodies in snapshots."""
+        timestamp, _, original = rest.partition("id_/")
+        body = self.server.archive.snapshots.get((timestamp, original))
+        if body is None:
+            return self.send(404, b"not in the archive")
+        self.send(200, body, {"Content-Type": "text/html"})
+
+    def available(self, query):
+        """The availability API over the captures in snapshots: the closest to timestamp, on the closest side of it."""
+        archive: FakeArchive = self.server.archive
+        archive.availability_queries.append({k: v[0] for k, v in query.items()})
+        url, target = query["url"][0], query.get("timestamp", ["99999999999999"])[0].ljust(14, "0")
+        side = query.get("closest", ["either"])[0]
+        times = sorted(ts for ts, original in archive.snapshots if original == url
+                       and (side != "before" or ts <= target) and (side != "after" or ts >= target))
+        if not times:
+            return self.send_json({"url": url, "archived_snapshots": {}})
+        ts = min(times, key=lambda t: abs(int(t) - int(target)))
+        self.send_json({"url": url, "archived_snapshots": {"closest": {
+            "available": True, "status": "200", "timestamp": ts, "url": f"http://web.archive.org/web/{ts}/{url}"}}})
+
+    def spn_save(self):
+        """Save Page Now: a job per URL, or the refusal queued in spn_refusals; spn_busy submissions are told to wait first."""
+        archive: FakeArchive = self.server.archive
+        form = {k: v[0] for k, v in parse_qs(self.rfile.read(int(self.headers.get("Content-Length") or 0)).decode()).items()}
+        if not self.headers.get("Authorization", "").startswith("LOW "):
+            return self.send(401, json.dumps({"message": "You need to be logged in to use Save Page Now."}).encode())
+        with archive.lock:
+            archive.spn_submissions.append(form)
+            if archive.spn_busy:
+                archive.spn_busy -= 1
+                return self.send_json({"status": "error", "status_ext": "error:user-session-limit", "message": "wait"})
+            refusal = archive.spn_refusals.get(form["url"])
+            if refusal:
+                return self.send_json({"status": "error", "status_ext": refusal, "message": f"refused: {refusal}"})
+            job_id = f"spn2-{len(archive.spn_submissions)}"
+            archive.spn_jobs[job_id] = {"url": form["url"], "polls": 0}
+        self.send_json({"url": form["url"], "job_id": job_id})
+
+    def spn_status(self, job_id):
+        """The account's quota for "user", else a job: pending on the first poll, then its outcome from spn_outcomes."""
+        archive: FakeArchive = self.server.archive
+        if job_id == "user":
+            return self.send_json({"available": archive.spn_available, "processing": 0})
+        with archive.lock:
+            job = archive.spn_jobs[job_id]
+            job["polls"] += 1
+        if job["polls"] == 1:
+            return self.send_json({"status": "pending", "job_id": job_id})
+        outcome = archive.spn_outcomes.get(job["url"], {"status": "success", "timestamp": "20261014120000"})
+        self.send_json(dict({"job_id": job_id, "original_url": job["url"]}, **outcome))
+
+    def oai(self, query):
+        """OAI-PMH ListRecords/ListIdentifiers over oai_records, two a page, the resumption token being the offset."""
+        archive: FakeArchive = self.server.archive
+        q = {k: v[0] for k, v in query.items()}
+        archive.oai_queries.append(q)
+        if "resumptionToken" in q:
+            if not q["resumptionToken"].isdigit():
+                return self.send_oai('<error code="badResumptionToken">expired</error>')
+            # the selection is that of the harvest the token belongs to, the last one started
+            q = dict(next((x for x in reversed(archive.oai_queries) if "resumptionToken" not in x), {}), **q)
+        records = [r for r in archive.oai_records if (not q.get("set") or q["set"] in r["sets"])
+                   and q.get("from", "") <= r["datestamp"] and r["datestamp"] <= q.get("until", "9999")]
+        if not records:
+            return self.send_oai('<error code="noRecordsMatch">nothing</error>')
+        start = int(q.get("resumptionToken", "0"))
+        body = []
+        for r in records[start:start + 2]:
+            deleted = ' status="deleted"' if r.get("deleted") else ""
+            sets = "".join(f"<setSpec>{s}</setSpec>" for s in r["sets"])
+            header = f'<header{deleted}><identifier>{r["identifier"]}</identifier><datestamp>{r["datestamp"]}</datestamp>{sets}</header>'
+            if q["verb"] == "ListIdentifiers" or r.get("deleted"):
+                body.append(header if q["verb"] == "ListIdentifiers" else f"<record>{header}</record>")
+                continue
+            dc = "".join(f"<dc:{k}>{v}</dc:{k}>" for k, values in r.get("dc", {}).items() for v in values)
+            body.append(f'<record>{header}<metadata><oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" '
+                        f'xmlns:dc="http://purl.org/dc/elements/1.1/">{dc}</oai_dc:dc></metadata></record>')
+        more = start + 2 < len(records)
+        token = f'<resumptionToken completeListSize="{len(records)}">{start + 2 if more else ""}</resumptionToken>'
+        self.send_oai(f'<{q["verb"]}>{"".join(body)}{token}</{q["verb"]}>')
+
+    def send_oai(self, inner: str):
+        self.send(200, ('<?xml version="1.0" encoding="UTF-8"?><OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/">'
+                        f'<responseDate>2026-10-14T00:00:00Z</responseDate>{inner}</OAI-PMH>').encode(), {"Content-Type": "text/xml"})
+
+    def tasks(self, query):
+        """Catalog rows from the next of the snapshots queued in task_catalog (the last one stays), history as is."""
+        archive: FakeArchive = self.server.archive
+        if not self.headers.get("Authorization", "").startswith("LOW "):
+            return self.send(403, json.dumps({"success": False, "error": "You must be logged in"}).encode())
+        if "catalog" in query:
+            with archive.lock:
+                rows = archive.task_catalog.pop(0) if len(archive.task_catalog) > 1 else archive.task_catalog[0]
+            return self.send_json({"success": True, "value": {"catalog": rows}})
+        # history comes two rows a page
+        start = int(query.get("cursor", ["0"])[0])
+        body = {"success": True, "value": {"history": archive.task_history[start:start + 2]}}
+        if start + 2 < len(archive.task_history):
+            body["cursor"] = str(start + 2)
+        self.send_json(body)
+
+    def metadata(self, identifier):
+        item = self.server.archive.items.get(identifier)
+        # archive.org answers 200 with an empty object for an identifier that doesn't exist
+        if item is None:
+            return self.send_json({})
+        files = [dict({"name": name, "source": "original", "size": str(len(data)), "md5": hashlib.md5(data).hexdigest()},
+                      **self.server.archive.file_fields.get(identifier, {}).get(name, {}))
+                 for name, data in item["files"].items()]
+        body = {"metadata": dict({"identifier": identifier}, **item["metadata"]), "files": files,
+                "item_last_updated": item["updated"]}
+        if item["dark"]:
+            body["is_dark"] = True
+        if identifier in self.server.archive.reviews:
+            body["reviews"] = self.server.archive.reviews[identifier]
+        self.send_json(body)
+
+    def download(self, identifier, name, fault):
+        self.server.archive.download_started.set()
+        item = self.server.archive.items.get(identifier)
+        if item is None or name not in item["files"]:
+            if item is not None and name in (f"{identifier}_files.xml", f"{identifier}_meta.xml"):
+                return self.send(200, b"<files/>" if name.endswith("_files.xml") else b"<metadata/>")
+            return self.send(404, b"not found")
+        data = item["files"][name]
+        rng = self.headers.get("Range")
+        code, start, end, headers = 200, 0, len(data) - 1, {"Accept-Ranges": "bytes"}
+        content_type = mimetypes.guess_type(name)[0]
+        if content_type and content_type.startswith("image/"):
+            headers["Content-Type"] = content_type
+        if rng and not fault.get("ignore_range"):
+            first, _, last = rng[len("bytes="):].partition("-")
+            start, end = int(first), int(last) if last else len(data) - 1
+            if start >= len(data):
+                return self.send(416, b"", {"Content-Range": f"bytes */{len(data)}"})
+            code, headers["Content-Range"] = 206, f"bytes {start}-{end}/{len(data)}"
+        body = data[start:end + 1]
+        if not fault.get("truncate"):
+            return self.send(code, body, headers)
+        # promise the whole body, send half, hang up
+        self.send_response(code)
+        for k, v in headers.items():
+            self.send_header(k, v)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body[:len(body) // 2])
+        self.close_connection = True
+
+
+class Server(ThreadingHTTPServer):
+    def handle_error(self, request, client_address):
+        # a client that went away before its answer, e.g. a tool stopped by a signal, is not the archive's error
+        if not isinstance(sys.exc_info()[1], ConnectionError):
+            super().handle_error(request, client_address)
+
+
+class FakeArchive:
+    def __init__(self):
+        self.items: Dict[str, dict] = {}
+        # more fields of the file entries /metadata gives (format, source, original...), by identifier and file name
+        self.file_fields: Dict[str, Dict[str, dict]] = {}
+        # the "reviews" array /metadata gives for an item, by identifier
+        self.reviews: Dict[str, List[dict]] = {}
+        self.faults: Dict[str, List[dict]] = {}
+        # the advanced search page answered only once a download has begun (or after HOLD_TIMEOUT), and
+        # whether it was a download that let it go
+        self.hold_search_page: Optional[int] = None
+        self.download_started = threading.Event()
+        self.held_page_released_by_download: Optional[bool] = None
+        # (path, Range header) of every GET, in order
+        self.requests: List[tuple] = []
+        # (method, path with query, headers) of every IAS3 request
+        self.s3_requests: List[tuple] = []
+        # (identifier, name) -> {"data": bytes, "headers": headers of the PUT, or of the multipart POST ?uploads}
+        self.uploads: Dict[tuple, dict] = {}
+        self.multipart: Dict[str, dict] = {}
+        # the form of every POST to the metadata write API
+        self.writes: List[dict] = []
+        # what the tasks API lists: one catalog snapshot per poll, and the finished tasks
+        self.task_catalog: List[List[dict]] = [[]]
+        self.task_history: List[dict] = []
+        # what the full-text search API finds (Elasticsearch hits), the queries sent to it, and the
+        # search-inside matches of each item
+        self.fts_hits: List[dict] = []
+        self.fts_queries: List[dict] = []
+        self.inside: Dict[str, List[dict]] = {}
+        # the captures the CDX server lists (dicts keyed by CDX_FIELDS) and the queries it got
+        self.cdx_rows: List[dict] = []
+        self.cdx_queries: List[dict] = []
+        # the cursor of every scrape request (None for the first page), and those answered as expired
+        self.scrape_cursors: List[Optional[str]] = []
+        self.expired_cursors: set = set()
+        # OAI-PMH records ({identifier, datestamp, sets, dc: {element: [values]}, deleted}) and the queries for them
+        self.oai_records: List[dict] = []
+        self.oai_queries: List[dict] = []
+        # the body of each Wayback capture, by (timestamp, original URL)
+        self.snapshots: Dict[tuple, bytes] = {}
+        self.availability_queries: List[dict] = []
+        # what /services/img/<id> answers with, by identifier; the other items get the generic icon
+        self.service_images: Dict[str, bytes] = {}
+        # Save Page Now: the forms submitted, their jobs, what a job ends in other than success (by URL),
+        # the status_ext submitting a URL is refused with, how many submissions are told the account is busy,
+        # and the captures the account may have running
+        self.spn_submissions: List[dict] = []
+        self.spn_jobs: Dict[str, dict] = {}
+        self.spn_outcomes: Dict[str, dict] = {}
+        self.spn_refusals: Dict[str, str] = {}
+        self.spn_busy = 0
+        self.spn_available = 5
+        self.lock = threading.Lock()
+        self.server = Server(("127.0.0.1", 0), Handler)
+        self.server.daemon_threads = True
+        self.server.archive = self
+        self.url = f"http://127.0.0.1:{self.server.server_address[1]}"
+
+    def add_item(self, identifier: str, files: Dict[str, bytes], dark: bool = False, updated: int = 1700000000, **metadata):
+        self.items[identifier] = {"files": dict(files), "metadata": metadata, "dark": dark, "updated": updated}
+
+    def fail(self, path: str, *faults: dict):
+        """Answer the next requests for path with these faults, one each."""
+        self.faults.setdefault(path, []).extend(faults)
+
+    def next_fault(self, path: str) -> Optional[dict]:
+        with self.lock:
+            queued = self.faults.get(path)
+            return queued.pop(0) if queued else None
+
+    def docs(self, fields: List[str], sort: List[str] = ()) -> List[dict]:
+        """The items as search docs with only fields, by identifier or in the order of sort (["downloads desc", ...])."""
+        docs = [dict({"identifier": ident}, **item["metadata"]) for ident, item in sorted(self.items.items())]
+        for order in reversed(sort):
+            field, _, direction = order.partition(" ")
+            docs.sort(key=lambda d: str(d.get(field, "")), reverse=direction == "desc")
+        return [{k: d[k] for k in fields if k in d} for d in docs]
+
+    def paths(self) -> List[str]:
+        return [path for path, _ in self.requests]
+
+    def start(self):
+        threading.Thread(target=self.server.serve_forever, args=(0.05,), daemon=True).start()
+        return self
+
+    def close(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    @contextlib.contextmanager
+    def pointed(self, *modules):
+        """Send ia_common's requests here, and those of modules holding their own copy of one of its URLs."""
+        urls = {"ARCHIVE_URL": self.url, "S3_URL": f"{self.url}/s3", "TASKS_URL": f"{self.url}/services/tasks.php",
+                "OAI_URL": f"{self.url}/services/oai.php", "AVAILABILITY_URL": f"{self.url}/wayback/available",
+                "WAYBACK_URL": self.url,
+                "FTS_URL": f"{self.url}/fts", "SEARCH_URL": f"{self.url}/advancedsearch.php",
+                "SCRAPE_URL": f"{self.url}/services/search/v1/scrape",
+                "METADATA_BASE_URL": f"{self.url}/metadata/", "DOWNLOAD_BASE_URL": f"{self.url}/download"}
+        with contextlib.ExitStack() as stack:
+            stack.enter_context(mock.patch.multiple(ia_common, **urls))
+            for module in modules:
+                for name, url in urls.items():
+                    if hasattr(module, name):
+                        stack.enter_context(mock.patch.object(module, name, url))
+            yield self
@@ -0,0 +1,307 @@
+import argparse
+import contextlib
+import hashlib
+import io
+import json
+import os
+import shlex
+import tempfile
+import unittest
+
+from _scripts import load_script
+
+dc = load_script("Download-Collections-v2.py")
+
+
+def select_args(**overrides):
+    args = dict(glob=None, min_size=None, max_size=None, keep_unknown_size=True, include_housekeeping=False)
+    args.update(overrides)
+    return argparse.Namespace(**args)
+
+
+class LimitFilesTest(unittest.TestCase):
+    FILES = [{"name": "a", "size": "20"}, {"name": "b"}, {"name": "c", "size": "30"}, {"name": "d", "size": "10"}]
+
+    def names(self, max_files, prefer):
+        return [f["name"] for f in dc.limit_files(self.FILES, max_files, prefer)]
+
+    def test_metadata_order_without_preference(self):
+        self.assertEqual(self.names(2, None), ["a", "b"])
+        self.assertEqual(self.names(None, None), ["a", "b", "c", "d"])
+
+    def test_unknown_sizes_come_last_either_way(self):
+        self.assertEqual(self.names(None, "largest"), ["c", "a", "d", "b"])
+        self.assertEqual(self.names(None, "smallest"), ["d", "a", "c", "b"])
+        self.assertEqual(self.names(3, "largest"), ["c", "a", "d"])
+        self.assertEqual(self.names(3, "smallest"), ["d", "a", "c"])
+
+
+class CurlCommandTest(unittest.TestCase):
+    def test_quotes_path_url_and_user_agent(self):
+        url = dc.download_url("item", "Disk 1/read me.txt")
+        self.assertEqual(url, "https://archive.org/download/item/Disk%201/read%20me.txt")
+        cmd = dc.curl_command(url, "out/item/Disk 1/read me.txt", "tool/1.0 (me@example.org)", 3)
+        self.assertEqual(shlex.split(cmd), [
+            "curl", "--location", "--fail", "--continue-at", "-", "--create-dirs", "--retry", "3",
+            "--user-agent", "tool/1.0 (me@example.org)", "--output", "out/item/Disk 1/read me.txt", url,
+        ])
+
+
+class FileTableTest(unittest.TestCase):
+    FILES = [
+        {"name": "b.iso", "size": "2048", "format": "ISO Image", "source": "original", "md5": "x"},
+        {"name": "a.epub", "format": "EPUB", "source": "derivative", "otf": "true"},
+    ]
+    SUPPRESSED = [{"name": "item_archive.torrent", "size": "10", "format": "Archive BitTorrent", "source": "metadata"}]
+
+    def table(self, output, sort_by=None):
+        out, err = io.StringIO(), io.StringIO()
+        with contextlib.redirect_stdout(out), contextlib.redirect_stderr(err):
+            dc.print_file_table(self.FILES, self.SUPPRESSED, output, sort_by)
+        return out.getvalue().splitlines(), err.getvalue().strip()
+
+    def test_tsv_keeps_raw_sizes_and_totals_on_stderr(self):
+        lines, totals = self.table("tsv")
+        self.assertEqual(lines, [
+            "name\tsize\tformat\tsource\tmd5\tsha1\tnote",
+            "b.iso\t2048\tISO Image\toriginal\tyes\tno\t",
+            "a.epub\t\tEPUB\tderivative\tno\tno\ton-the-fly",
+            "item_archive.torrent\t10\tArchive BitTorrent\tmetadata\tno\tno\texcluded by default",
+        ])
+        self.assertEqual(totals, "2 files, 2.0KB total (1 without size); 1 excluded by default")
+
+    def test_table_sorted_by_size_puts_unknown_last(self):
+        lines, _ = self.table("table", sort_by="size")
+        self.assertEqual([line.split()[0] for line in lines[1:4]], ["b.iso", "a.epub", "item_archive.torrent"])
+        lines, _ = self.table("table", sort_by="name")
+        self.assertEqual([line.split()[0] for line in lines[1:3]], ["a.epub", "b.iso"])
+        self.assertIn("2 files, 2.0KB total", lines[-1])
+
+
+class ExistingActionTest(unittest.TestCase):
+    DATA = b"0123456789"
+
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.path = os.path.join(self.tmp.name, "disc.iso")
+        self.part = self.path + dc.PART_SUFFIX
+        self.meta = {"name": "disc.iso", "size": str(len(self.DATA)), "md5": hashlib.md5(self.DATA).hexdigest()}
+
+    def tearDown(self):
+        self.tmp.cleanup()
+
+    def write(self, path, data):
+        with open(path, "wb") as fh:
+            fh.write(data)
+
+    def action(self, policy, mismatched=False, meta=None):
+        return dc.existing_action(policy, self.path, self.part, meta or self.meta, mismatched)[0]
+
+    def test_new_file(self):
+        for policy in dc.IF_EXISTS_POLICIES:
+            with self.subTest(policy=policy):
+                self.assertEqual(dc.existing_action(policy, self.path, self.part, self.meta, False)[1], "new file")
+                self.assertEqual(self.action(policy), "fresh" if policy == "overwrite" else "fetch")
+
+    def test_partial_resumed_except_with_overwrite(self):
+        self.write(self.part, self.DATA[:4])
+        for policy in dc.IF_EXISTS_POLICIES:
+            with self.subTest(policy=policy):
+                self.assertEqual(self.action(policy), "fresh" if policy == "overwrite" else "fetch")
+
+    def test_skip(self):
+        self.write(self.path, b"anything")
+        self.assertEqual(self.action("skip"), "skip")
+
+    def test_overwrite(self):
+        self.write(self.path, self.DATA)
+        self.assertEqual(self.action("overwrite"), "fresh")
+
+    def test_checksum(self):
+        self.write(self.path, self.DATA)
+        self.assertEqual(self.action("checksum"), "skip")
+        self.assertEqual(self.action("checksum", mismatched=True), "fetch")
+        self.assertIn("no checksum", dc.existing_action("checksum", self.path, self.part, {"name": "disc.iso"}, False)[1])
+
+    def test_resume(self):
+        self.write(self.path, self.DATA)
+        self.assertEqual(self.action("resume"), "skip")
+        self.write(self.path, self.DATA[:3])
+        self.assertEqual(self.action("resume"), "continue")
+        self.write(self.path, self.DATA + b"extra")
+        self.assertEqual(self.action("resume"), "fresh")
+        self.assertEqual(self.action("resume", meta={"name": "disc.iso"}), "skip")
+        self.assertEqual(self.action("resume", meta={"name": "disc.iso", "otf": "true", "size": "1"}), "skip")
+
+
+class IaCompatSkipTest(unittest.TestCase):
+    """The internetarchive library's File.download skip rules, case by case.
+
+    existing file | metadata                     | --checksum | result
+    missing       | any                          | any        | download
+    same size     | same mtime                   | no         | skip (size and mtime match)
+    same size     | different mtime              | no         | download (overwrite)
+    other size    | same mtime                   | no         | download (overwrite)
+    same size     | no mtime                     | no         | download (overwrite)
+    any           | md5 matches                  | yes        | skip (md5 matches)
+    any           | md5 differs or missing       | yes        | download (overwrite)
+    <id>_files.xml| non-empty on disk            | no         | skip
+    <id>_files.xml| empty on disk                | no         | download
+    """
+
+    MTIME = 1600000000
+    DATA = b"iso-bytes"
+
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.path = os.path.join(self.tmp.name, "disc.iso")
+
+    def tearDown(self):
+        self.tmp.cleanup()
+
+    def write(self, data=DATA, mtime=MTIME, path=None):
+        path = path or self.path
+        with open(path, "wb") as fh:
+            fh.write(data)
+        os.utime(path, (mtime, mtime))
+        return path
+
+    def meta(self, **overrides):
+        f = {"name": "disc.iso", "size": str(len(self.DATA)), "mtime": str(self.MTIME), "md5": hashlib.md5(self.DATA).hexdigest()}
+        f.update(overrides)
+        return {k: v for k, v in f.items() if v is not None}
+
+    def test_missing_file_downloads(self):
+        self.assertIsNone(dc.ia_skip_reason(self.path, self.meta(), False))
+        self.assertIsNone(dc.ia_skip_reason(self.path, self.meta(), True))
+
+    def test_size_and_mtime_match_skips(self):
+        self.write()
+        self.assertEqual(dc.ia_skip_reason(self.path, self.meta(), False), "size and mtime match")
+
+    def test_mtime_differs_overwrites(self):
+        self.write(mtime=self.MTIME + 60)
+        self.assertIsNone(dc.ia_skip_reason(self.path, self.meta(), False))
+
+    def test_size_differs_overwrites(self):
+        self.write(data=b"partial")
+        self.assertIsNone(dc.ia_skip_reason(self.path, self.meta(), False))
+
+    def test_no_metadata_mtime_overwrites(self):
+        self.write()
+        self.assertIsNone(dc.ia_skip_reason(self.path, self.meta(mtime=None), False))
+
+    def test_checksum_match_skips_whatever_the_mtime(self):
+        self.write(mtime=self.MTIME + 60)
+        self.assertEqual(dc.ia_skip_reason(self.path, self.meta(), True), "md5 matches")
+
+    def test_checksum_mismatch_or_missing_overwrites(self):
+        self.write()
+        self.assertIsNone(dc.ia_skip_reason(self.path, self.meta(md5="0" * 32), True))
+        self.assertIsNone(dc.ia_skip_reason(self.path, self.meta(md5=None), True))
+
+    def test_files_xml(self):
+        xml = self.write(b"<files/>", mtime=1, path=os.path.join(self.tmp.name, "item_files.xml"))
+        f = self.meta(name="item_files.xml", size="999")
+        self.assertEqual(dc.ia_skip_reason(xml, f, False), "non-empty _files.xml")
+        self.write(b"", path=xml)
+        self.assertIsNone(dc.ia_skip_reason(xml, f, False))
+
+    def test_downloads_stamped_for_the_next_run(self):
+        self.write(mtime=self.MTIME + 60)
+        dc.set_ia_mtime(self.path, self.meta())
+        self.assertEqual(int(os.stat(self.path).st_mtime), self.MTIME)
+        self.assertEqual(dc.ia_skip_reason(self.path, self.meta(), False), "size and mtime match")
+
+
+class NewerOnlyTest(unittest.TestCase):
+    LOCAL = 1600000000
+
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.path = os.path.join(self.tmp.name, "disc.iso")
+        with open(self.path, "wb") as fh:
+            fh.write(b"iso-bytes")
+        os.utime(self.path, (self.LOCAL, self.LOCAL))
+
+    def tearDown(self):
+        self.tmp.cleanup()
+
+    def newer(self, mtime, high_water=None, tolerance=300):
+        f = {"name": "disc.iso"} if mtime is None else {"name": "disc.iso", "mtime": str(mtime)}
+        return dc.newer_reason(self.path, f, high_water, tolerance)[0]
+
+    def test_newer_than_local_copy(self):
+        self.assertTrue(self.newer(self.LOCAL + 3600))
+        self.assertFalse(self.newer(self.LOCAL - 3600))
+
+    def test_within_tolerance_is_not_newer(self):
+        self.assertFalse(self.newer(self.LOCAL + 300))
+        self.assertTrue(self.newer(self.LOCAL + 301))
+        self.assertFalse(self.newer(self.LOCAL + 301, tolerance=600))
+
+    def test_high_water_mark_wins_over_reset_local_mtime(self):
+        self.assertFalse(self.newer(self.LOCAL + 3600, high_water=self.LOCAL + 3600))
+        self.assertTrue(self.newer(self.LOCAL + 7200, high_water=self.LOCAL + 3600))
+
+    def test_no_metadata_mtime_keeps_local_copy(self):
+        self.assertFalse(self.newer(None))
+
+    def test_high_water_round_trip(self):
+        self.assertIsNone(dc.load_high_water(self.tmp.name))
+        dc.save_high_water(self.tmp.name, self.LOCAL)
+        self.assertEqual(dc.load_high_water(self.tmp.name), self.LOCAL)
+
+
+class PlanTotalsTest(unittest.TestCase):
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        os.makedirs(os.path.join(self.tmp.name, "cached"))
+        files = [{"name": "a.iso", "size": "100"}, {"name": "b.iso", "size": "50"}, {"name": "cached_archive.torrent", "size": "1"}]
+        with open(os.path.join(self.tmp.name, "cached", dc.METADATA_CACHE), "w") as fh:
+            json.dump({"etag": "x", "metadata": {"files": files}}, fh)
+
+    def tearDown(self):
+        self.tmp.cleanup()
+
+    def plan(self, groups, **overrides):
+        args = select_args(destdir=self.tmp.name, max_files=None, prefer=None, **overrides)
+        return dc.plan_totals(groups, args)
+
+    def test_counts_selected_files_of_cached_items(self):
+        self.assertEqual(self.plan({"cached": None, "uncached": None}), (2, 150, 1))
+
+    def test_applies_wanted_names_and_filters(self):
+        self.assertEqual(self.plan({"cached": ["b.iso"]}), (1, 50, 0))
+        self.assertEqual(self.plan({"cached": None}, min_size=60), (1, 100, 0))
+
+
+class ExitCodeTest(unittest.TestCase):
+    def test_success(self):
+        self.assertEqual(dc.exit_code(3, 0, 0), dc.EXIT_OK)
+        self.assertEqual(dc.exit_code(0, 0, 0), dc.EXIT_OK)
+
+    def test_download_failures_outrank_verification(self):
+        # a checksum mismatch must not hide that other files failed outright
+        self.assertEqual(dc.exit_code(3, 1, 1), dc.EXIT_SOME_FAILED)
+        self.assertEqual(dc.exit_code(3, 1, 0), dc.EXIT_SOME_FAILED)
+        self.assertEqual(dc.exit_code(3, 0, 1), dc.EXIT_VERIFY_FAILED)
+
+    def test_all_failed(self):
+        self.assertEqual(dc.exit_code(2, 2, 0), dc.EXIT_ALL_FAILED)
+        self.assertEqual(dc.exit_code(2, 1, 1), dc.EXIT_ALL_FAILED)
+        self.assertEqual(dc.exit_code(1, 0, 1), dc.EXIT_ALL_FAILED)
+
+    def test_metadata_errors_and_run_state(self):
+        self.assertEqual(dc.exit_code(3, 1, 0, metadata_errors=1), dc.EXIT_METADATA_ERROR)
+        self.assertEqual(dc.exit_code(3, 0, 0, partial=True), dc.EXIT_PARTIAL)
+        self.assertEqual(dc.exit_code(3, 1, 0, partial=True), dc.EXIT_SOME_FAILED)
+        self.assertEqual(dc.exit_code(3, 3, 0, metadata_errors=1, interrupted=True), dc.EXIT_INTERRUPTED)
+
+    def test_rate_limit_outranks_everything_but_interruption(self):
+        self.assertEqual(dc.exit_code(3, 3, 0, metadata_errors=1, rate_limited=True), dc.EXIT_RATE_LIMITED)
+        self.assertEqual(dc.exit_code(3, 1, 0, rate_limited=True, interrupted=True), dc.EXIT_INTERRUPTED)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,1698 @@
+"""Each tool's main() run against the fake archive.org in fakearchive.py."""
+import contextlib
+import csv
+import gzip
+import hashlib
+import io
+import json
+import os
+import shlex
+import signal
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+import unittest
+import xml.etree.ElementTree as ET
+from unittest import mock
+
+from _scripts import ROOT, load_script
+from fakearchive import IGNORE_RANGE, INTERRUPT, TRUNCATE, FakeArchive, html_error, status
+import ia_common
+import ia_download
+
+search_v1 = load_script("IA-Advanced-Search.py")
+search_v2 = load_script("IA-Advanced-Search-v2.py")
+dfj = load_script("Download-From-JSON.py")
+dc = load_script("Download-Collections-v2.py")
+iam = load_script("IA-Metadata.py")
+ial = load_script("IA-List.py")
+iau = load_script("IA-Upload.py")
+iamm = load_script("IA-Modify-Metadata.py")
+iat = load_script("IA-Tasks.py")
+iav = load_script("IA-Verify.py")
+iamr = load_script("IA-Mirror.py")
+iatt = load_script("IA-Torrents.py")
+iar = load_script("IA-Reviews.py")
+iafts = load_script("IA-FTS.py")
+iaoai = load_script("IA-OAI-Harvest.py")
+iwcdx = load_script("IA-Wayback-CDX.py")
+iwf = load_script("IA-Wayback-Fetch.py")
+iwa = load_script("IA-Wayback-Available.py")
+iac = load_script("IA-Convert.py")
+iad = load_script("IA-Diff.py")
+iadd = load_script("IA-Dedupe.py")
+iaf = load_script("IA-Feed.py")
+iath = load_script("IA-Thumbnail.py")
+iader = load_script("IA-Derivatives.py")
+ias = load_script("IA-Size.py")
+spn = load_script("IA-SPN-Save.py")
+iacd = load_script("IA-ChecksumDB.py")
+iast = load_script("IA-Stats.py")
+iacp = load_script("IA-Copy.py")
+
+# the cassettes contributed with bug reports, which the tests replay with no archive.org at all
+CASSETTES = os.path.join(os.path.dirname(os.path.abspath(__file__)), "cassettes")
+
+# three chunks, so a body cut off halfway has a whole chunk on disk to resume from
+DISC = bytes(range(256)) * (3 * ia_download.CHUNK_SIZE // 256)
+README = b"read me\n"
+
+
+class EndToEndTest(unittest.TestCase):
+    def setUp(self):
+        # no real waiting: not between search pages, not before transport retries, not before download retries
+        self.sleep = self.enterContext(mock.patch("time.sleep"))
+        self.enterContext(mock.patch.object(ia_download.STOP, "wait", return_value=False))
+        self.tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(self.tmp.cleanup)
+        # not the config file of whoever runs the tests
+        self.enterContext(mock.patch.object(ia_common, "CONFIG_FILE", self.path("no-config.toml")))
+        self.enterContext(mock.patch.dict("os.environ"))
+        os.environ.pop("IA_TOOLS_CONFIG", None)
+        self.archive = FakeArchive().start()
+        self.addCleanup(self.archive.close)
+        self.archive.add_item("distro-1.0", {"distro-1.0.iso": DISC, "README.txt": README}, title="Distro 1.0")
+        self.archive.add_item("distro-2.0", {"distro-2.0.img": DISC[:1000]}, title="Distro 2.0")
+        self.enterContext(self.archive.pointed(search_v1, iau, iat, iacp, iaoai, iafts, iwcdx, iwf, iwa, iath, spn))
+        # the tools log to stdout once set up; the tests look at what they log with assertLogs instead
+        for module in (search_v2, dc, iam, ial, iau, iamm, iat, iav, iamr, iatt, iar, iaoai, iafts, iwcdx, iwf, iwa, iac, iad, iadd, iaf, iath, iader, ias, spn, iacd, iast, iacp):
+            self.enterContext(mock.patch.object(module, "setup_logging"))
+        for sig in (signal.SIGINT, signal.SIGTERM):
+            self.addCleanup(signal.signal, sig, signal.getsignal(sig))
+        self.addCleanup(ia_download.STOP.clear)
+        self.addCleanup(ia_download.ABORT.clear)
+
+    def path(self, *parts):
+        return os.path.join(self.tmp.name, *parts)
+
+    def run_main(self, module, *argv):
+        """Run module.main() with argv, returning (exit code, stdout)."""
+        out = io.StringIO()
+        code = 0
+        with mock.patch("sys.argv", [module.__name__, *argv]), contextlib.redirect_stdout(out):
+            try:
+                module.main()
+            except SystemExit as e:
+                code = e.code
+        return code, out.getvalue()
+
+    def run_tool(self, script, *argv, **kwargs):
+        """Start a script in a process of its own, pointed at the fake archive, with its stderr piped."""
+        env = dict(os.environ, IA_BASE_URL=self.archive.url, HOME=self.tmp.name, XDG_CONFIG_HOME=self.path("config"))
+        for name in ("IA_ACCESS_KEY", "IA_SECRET_KEY", "IA_CONFIG_FILE", "IA_TOOLS_CONFIG"):
+            env.pop(name, None)
+        return subprocess.Popen([sys.executable, str(ROOT / script), *argv], cwd=self.tmp.name, env=env,
+                                stderr=subprocess.PIPE, text=True, **kwargs)
+
+    def read_json(self, *parts):
+        with open(self.path(*parts), encoding="utf-8") as f:
+            return json.load(f)
+
+
+class SearchV2Test(EndToEndTest):
+    def search(self, *argv):
+        return self.run_main(search_v2, "--query", "linux", "--sleep", "0", "--out", self.path("found.json"), *argv)
+
+    def test_lists_disc_images_across_pages(self):
+        self.archive.file_fields["distro-1.0"] = {"distro-1.0.iso": {"format": "ISO Image", "sha1": "5a1", "crc32": "c3c", "size": f"{len(DISC)}.0"}}
+        code, out = self.search("--rows", "1")
+        self.assertEqual(code, 0)
+        self.assertIn("Found 2 matching files (.iso, .img, .zip)", out)
+        self.assertEqual(self.read_json("found.json"), [
+            {"identifier": "distro-1.0", "title": "Distro 1.0", "file_name": "distro-1.0.iso",
+             "download_url": f"{self.archive.url}/download/distro-1.0/distro-1.0.iso", "size": len(DISC),
+             "format": "ISO Image", "md5": hashlib.md5(DISC).hexdigest(), "sha1": "5a1", "crc32": "c3c"},
+            {"identifier": "distro-2.0", "title": "Distro 2.0", "file_name": "distro-2.0.img",
+             "download_url": f"{self.archive.url}/download/distro-2.0/distro-2.0.img", "size": 1000,
+             "md5": hashlib.md5(DISC[:1000]).hexdigest()},
+        ])
+        self.assertEqual(self.archive.paths().count("/advancedsearch.php"), 2)
+
+    def test_use_scrape_follows_the_cursor_to_the_last_page(self):
+        with self.assertLogs(level="WARNING") as logs:
+            code, _ = self.search("--use-scrape", "--rows", "1")
+        self.assertEqual(code, 0)
+        self.assertIn("--rows 1 is outside what the scrape API takes; asking for 100 per page", logs.output[0])
+        self.assertEqual([e["file_name"] for e in self.read_json("found.json")], ["distro-1.0.iso", "distro-2.0.img"])
+        self.assertNotIn("/advancedsearch.php", self.archive.paths())
+        # the last page comes without a cursor
+        self.assertEqual(self.archive.scrape_cursors, [None])
+
+    def test_switches_to_the_scrape_api_past_the_depth_limit(self):
+        with mock.patch.object(search_v2, "SEARCH_DEPTH_LIMIT", 1):
+            code, _ = self.search("--rows", "100")
+        self.assertEqual(code, 0)
+        self.assertEqual([e["file_name"] for e in self.read_json("found.json")], ["distro-1.0.iso", "distro-2.0.img"])
+        self.assertEqual(self.archive.paths().count("/advancedsearch.php"), 1)
+        self.assertEqual(self.archive.scrape_cursors, [None])
+        # each item's metadata once: the first page's docs were left for the scrape to give again
+        self.assertEqual(self.archive.paths().count("/metadata/distro-1.0"), 1)
+
+    def test_sigterm_writes_the_entries_found_so_far(self):
+        # the second page never comes; the search is stopped while it waits for it
+        self.archive.hold_search_page = 2
+        self.addCleanup(self.archive.download_started.set)
+        search = self.run_tool("IA-Advanced-Search-v2.py", "--rows", "1", "--sleep", "0", "--out", "found.json",
+                               stdout=subprocess.PIPE)
+        deadline = time.monotonic() + 30
+        while self.archive.paths().count("/advancedsearch.php") < 2 and time.monotonic() < deadline:
+            threading.Event().wait(0.05)
+        search.send_signal(signal.SIGTERM)
+        out, err = search.communicate(timeout=60)
+        self.assertEqual(search.returncode, search_v2.EXIT_INTERRUPTED, err)
+        self.assertEqual([e["identifier"] for e in self.read_json("found.json")], ["distro-1.0"])
+        self.assertIn("Stopped after 1/2 pages, 1/2 items.", out)
+        self.assertIn("Interrupted after 1/2 pages, 1/2 items; the 1 entries found so far are written", out)
+
+    def test_verbose_logs_the_query_with_the_date_range(self):
+        with self.assertLogs(level="INFO") as logs:
+            code, _ = self.search("--since", "2023-01-01", "--date-field", "date", "-v")
+        self.assertEqual(code, 0)
+        self.assertIn("INFO:root:Query: (linux) AND date:[2023-01-01 TO null]", logs.output)
+        with contextlib.redirect_stderr(io.StringIO()) as err:
+            code, _ = self.search("--since", "2024-07-01", "--until", "2024-06-30")
+        self.assertEqual(code, 2)
+        self.assertIn("--since 2024-07-01 is after --until 2024-06-30", err.getvalue())
+
+    def test_collection_and_mediatype_make_the_query_without_one(self):
+        with self.assertLogs(level="INFO") as logs:
+            code, _ = self.run_main(search_v2, "-c", "linuxtracker", "-c", "opensource", "--mediatype", "software", "--sleep", "0",
+                                    "--out", self.path("found.json"), "-v")
+        self.assertEqual(code, 0)
+        self.assertIn("INFO:root:Query: (collection:linuxtracker OR collection:opensource) AND mediatype:software", logs.output)
+
+    def test_sort_is_sent_with_every_page(self):
+        # without it on the second page, that page would hold distro-2.0 again
+        for argv in (["--rows", "1"], ["--use-scrape"]):
+            code, _ = self.search("--sort", "title desc", *argv)
+            self.assertEqual(code, 0)
+            self.assertEqual([e["identifier"] for e in self.read_json("found.json")], ["distro-2.0", "distro-1.0"])
+
+    def test_a_sort_the_index_refuses_fails_with_its_message(self):
+        with self.assertLogs(level="ERROR") as logs:
+            code, _ = self.search("--sort", "downloads, title desc")
+        self.assertEqual(code, search_v2.EXIT_SEARCH_FAILED)
+        self.assertIn("Advanced search refused the request: Can't determine a Sort Order (asc or desc) in sort spec 'downloads'",
+                      logs.output[0])
+
+    def test_rate_limited_page_is_retried_after_the_wait_asked_for(self):
+        self.archive.fail("/advancedsearch.php", status(429, retry_after=4))
+        with self.assertLogs(level="WARNING") as logs:
+            code, _ = self.search()
+        self.assertEqual(code, 0)
+        self.assertIn("HTTP 429; retrying in 4.0s", logs.output[0])
+        self.sleep.assert_any_call(4)
+        self.assertEqual(len(self.read_json("found.json")), 2)
+
+    def test_html_error_page_instead_of_json_fails_the_search(self):
+        self.archive.fail("/advancedsearch.php", html_error())
+        with self.assertLogs(level="ERROR") as logs:
+            code, out = self.search()
+        self.assertEqual(code, search_v2.EXIT_SEARCH_FAILED)
+        self.assertRegex(logs.output[0], "(?s)Search failed after 0/\\? pages, 0/\\? items: Failed to parse JSON.*temporarily offline")
+        self.assertEqual(self.read_json("found.json"), [])
+        self.assertIn("Run again with --resume to carry on.", out)
+
+    def test_item_without_metadata_is_skipped(self):
+        self.archive.fail("/metadata/distro-1.0", status(404, body=b"gone"))
+        code, out = self.search()
+        self.assertEqual(code, 0)
+        self.assertEqual([e["identifier"] for e in self.read_json("found.json")], ["distro-2.0"])
+        self.assertIn("Metadata could not be fetched for 1 item(s).", out)
+
+    def test_workers_keep_the_order_of_the_search_results(self):
+        for n in range(3, 9):
+            self.archive.add_item(f"distro-{n}.0", {f"distro-{n}.0.iso": DISC[:n]}, title=f"Distro {n}.0")
+        self.archive.fail("/metadata/distro-5.0", status(500), status(500))
+        with self.assertLogs(level="WARNING") as logs:
+            code, out = self.search("--workers", "4", "--rows", "3", "--retries", "1")
+        self.assertEqual(code, 0)
+        self.assertIn("Could not fetch metadata for distro-5.0", logs.output[-1])
+        self.assertEqual([e["identifier"] for e in self.read_json("found.json")],
+                         ["distro-1.0", "distro-2.0", "distro-3.0", "distro-4.0", "distro-6.0", "distro-7.0", "distro-8.0"])
+        self.assertIn("Metadata could not be fetched for 1 item(s).", out)
+
+    def test_a_title_set_twice_is_one_string(self):
+        self.archive.add_item("distro-1.0", {"distro-1.0.iso": DISC}, title=["Distro 1.0", "Distro One"])
+        code, _ = self.search()
+        self.assertEqual(code, 0)
+        self.assertEqual(self.read_json("found.json")[0]["title"], "Distro 1.0; Distro One")
+
+    def test_ndjson_to_stdout_with_the_summary_on_stderr(self):
+        stderr = io.StringIO()
+        with contextlib.redirect_stderr(stderr):
+            code, out = self.run_main(search_v2, "--query", "linux", "--sleep", "0", "--output-format", "ndjson", "--out", "-")
+        self.assertEqual(code, 0)
+        self.assertEqual([json.loads(line)["file_name"] for line in out.splitlines()], ["distro-1.0.iso", "distro-2.0.img"])
+        self.assertIn("Found 2 matching files (.iso, .img, .zip). Saved 2 lines to -.", stderr.getvalue())
+
+    def test_ndjson_file_is_written_as_the_entries_are_found(self):
+        lines = []
+
+        def fetch(session, identifier):
+            # what the file holds when the next item's metadata is asked for
+            with open(self.path("found.ndjson"), encoding="utf-8") as f:
+                lines.append(len(f.readlines()))
+            return ia_common.fetch_metadata(session, identifier)
+
+        with mock.patch.object(search_v2, "ia_fetch_metadata", side_effect=fetch):
+            code, out = self.run_main(search_v2, "--query", "linux", "--sleep", "0", "--rows", "1", "--format", "ndjson",
+                                      "--out", self.path("found.ndjson"))
+        self.assertEqual(code, 0)
+        self.assertEqual(lines, [0, 1])
+        self.assertIn("Found 2 matching files (.iso, .img, .zip). Saved 2 lines to", out)
+        with mock.patch.object(dfj, "OUTPUT_DIR", self.path("isos")):
+            code, out = self.run_main(dfj, "-i", self.path("found.ndjson"), "--ascii")
+        self.assertEqual(code, 0)
+        self.assertIn("[2/2 100.0%] [OK] Done: distro-2.0.img", out)
+
+    def test_csv_has_the_header_and_a_row_per_entry(self):
+        self.archive.add_item("distro-1.0", {"distro-1.0.iso": DISC}, title='Distro 1.0, "LTS"\nedition')
+        code, out = self.search("--format", "csv", "--out", self.path("found.csv"))
+        self.assertEqual(code, 0)
+        self.assertIn("Found 2 matching files (.iso, .img, .zip). Saved 2 rows to", out)
+        with open(self.path("found.csv"), encoding="utf-8", newline="") as f:
+            rows = list(csv.reader(f))
+        self.assertEqual(rows, [
+            ["identifier", "title", "file_name", "download_url", "size", "format", "md5", "sha1", "crc32"],
+            ["distro-1.0", 'Distro 1.0, "LTS"\nedition', "distro-1.0.iso", ia_common.download_url("distro-1.0", "distro-1.0.iso"), str(len(DISC)),
+             "", hashlib.md5(DISC).hexdigest(), "", ""],
+            ["distro-2.0", "Distro 2.0", "distro-2.0.img", ia_common.download_url("distro-2.0", "distro-2.0.img"), "1000",
+             "", hashlib.md5(DISC[:1000]).hexdigest(), "", ""],
+        ])
+
+    def test_csv_of_nothing_found_is_the_header(self):
+        self.archive.items.clear()
+        code, _ = self.search("--format", "csv", "--out", self.path("found.csv"))
+        self.assertEqual(code, 0)
+        with open(self.path("found.csv"), encoding="utf-8") as f:
+            self.assertEqual(f.read(), "identifier,title,file_name,download_url,size,format,md5,sha1,crc32\n")
+
+    def test_extensions_match_the_end_of_the_name_in_any_case(self):
+        self.archive.add_item("distro-1.0", {"distro-1.0.iso": DISC, "rootfs.TAR.XZ": b"xz", "disk.qcow2": b"q", "notes.xz": b"n"},
+                              title="Distro 1.0")
+        code, out = self.search("--extensions", "qcow2, .tar.xz")
+        self.assertEqual(code, 0)
+        self.assertEqual([e["file_name"] for e in self.read_json("found.json")], ["rootfs.TAR.XZ", "disk.qcow2"])
+        self.assertIn("Found 2 matching files (.qcow2, .tar.xz)", out)
+
+    def test_size_filter_leaves_files_out_of_the_entries(self):
+        code, out = self.search("--max-size", "1000")
+        self.assertEqual(code, 0)
+        self.assertEqual([e["file_name"] for e in self.read_json("found.json")], ["distro-2.0.img"])
+        self.assertIn("Excluded 1 file(s) by the size filter (at most 1000.0B).", out)
+
+    def test_unknown_sizes_are_kept_unless_asked_not_to(self):
+        self.archive.file_fields["distro-2.0"] = {"distro-2.0.img": {"size": None}}
+        code, out = self.search("--min-size", "2M")
+        self.assertEqual(code, 0)
+        self.assertEqual([e["size"] for e in self.read_json("found.json")], [len(DISC), None])
+        self.assertIn("Excluded 0 file(s) by the size filter (at least 2.0MB).", out)
+        code, out = self.search("--min-size", "2M", "--no-keep-unknown-size")
+        self.assertEqual(code, 0)
+        self.assertEqual([e["file_name"] for e in self.read_json("found.json")], ["distro-1.0.iso"])
+        self.assertIn("Excluded 1 file(s) by the size filter (at least 2.0MB, with a known size).", out)
+
+    def test_star_lists_every_file(self):
+        with self.assertLogs(level="INFO") as logs:
+            code, out = self.search("--extensions", "*")
+        self.assertEqual(code, 0)
+        self.assertEqual([e["file_name"] for e in self.read_json("found.json")], ["distro-1.0.iso", "README.txt", "distro-2.0.img"])
+        self.assertIn("Found 3 matching files (all files)", out)
+        self.assertIn("INFO:root:Files listed: all files", logs.output)
+
+    def test_resume_tries_an_item_whose_metadata_failed_again(self):
+        # the metadata of distro-1.0 fails once, and the second search page isn't JSON
+        self.archive.fail("/metadata/distro-1.0", status(500))
+        self.archive.fail("/advancedsearch.php", {}, html_error())
+        with self.assertLogs(level="WARNING"):
+            code, _ = self.search("--rows", "1", "--retries", "0")
+        self.assertEqual(code, search_v2.EXIT_SEARCH_FAILED)
+        state = self.read_json("found.json.state")
+        self.assertEqual((state["page"], state["done"], state["retry"]), (1, [], {"distro-1.0": "Distro 1.0"}))
+        code, out = self.search("--rows", "1", "--resume")
+        self.assertEqual(code, 0)
+        self.assertEqual([e["identifier"] for e in self.read_json("found.json")], ["distro-1.0", "distro-2.0"])
+        self.assertFalse(os.path.exists(self.path("found.json.state")))
+        self.assertEqual(self.archive.paths().count("/metadata/distro-1.0"), 2)
+        # the first page isn't asked for again
+        self.assertEqual(self.archive.paths().count("/advancedsearch.php"), 3)
+
+    def test_resume_adds_to_ndjson_without_writing_an_item_twice(self):
+        self.archive.fail("/advancedsearch.php", {}, html_error())
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.search("--rows", "1", "--format", "ndjson", "--out", self.path("found.ndjson"))
+        self.assertEqual(code, search_v2.EXIT_SEARCH_FAILED)
+        self.assertEqual(self.read_json("found.ndjson.state")["done"], ["distro-1.0"])
+        code, out = self.search("--rows", "1", "--format", "ndjson", "--out", self.path("found.ndjson"), "--resume")
+        self.assertEqual(code, 0)
+        with open(self.path("found.ndjson"), encoding="utf-8") as f:
+            self.assertEqual([json.loads(line)["file_name"] for line in f], ["distro-1.0.iso", "distro-2.0.img"])
+        self.assertIn("Found 1 matching files (.iso, .img, .zip). Saved 1 lines to", out)
+        self.assertEqual(self.archive.paths().count("/metadata/distro-1.0"), 1)
+
+    def test_resume_of_another_query_needs_force(self):
+        self.archive.fail("/advancedsearch.php", {}, html_error())
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.search("--rows", "1")
+        self.assertEqual(code, search_v2.EXIT_SEARCH_FAILED)
+        with contextlib.redirect_stderr(io.StringIO()) as err:
+            code, _ = self.search("--rows", "1", "--resume", "--query", "distro")
+        self.assertEqual(code, 2)
+        self.assertIn("found.json.state is from a search with another query or --sort; give --force", err.getvalue())
+        with self.assertLogs(level="WARNING") as logs:
+            code, _ = self.search("--rows", "1", "--resume", "--query", "distro", "--force")
+        self.assertEqual(code, 0)
+        self.assertIn("The query or --sort has changed since", logs.output[0])
+        self.assertEqual([e["identifier"] for e in self.read_json("found.json")], ["distro-1.0", "distro-2.0"])
+        # paged from the first page again, but distro-1.0 was done
+        self.assertEqual(self.archive.paths().count("/metadata/distro-1.0"), 1)
+
+    def test_dry_run_only_lists_identifiers(self):
+        code, out = self.search("--dry-run")
+        self.assertEqual(code, 0)
+        self.assertIn("distro-1.0 - Distro 1.0", out)
+        self.assertNotIn("/metadata/distro-1.0", self.archive.paths())
+
+
+class SearchToDownloadPipeTest(EndToEndTest):
+    def test_the_first_download_begins_while_the_search_is_still_paging(self):
+        # the last page is answered only once a file is downloading, or after fakearchive.HOLD_TIMEOUT
+        self.archive.hold_search_page = 2
+        read, write = os.pipe()
+        search = self.run_tool("IA-Advanced-Search-v2.py", "--rows", "1", "--sleep", "0", "--output-format", "ndjson", "--out", "-",
+                               stdout=write)
+        download = self.run_tool("Download-From-JSON.py", "-i", "-", "--ascii", stdin=read, stdout=subprocess.PIPE)
+        os.close(read)
+        os.close(write)
+        out, download_err = download.communicate(timeout=60)
+        _, search_err = search.communicate(timeout=60)
+        self.assertEqual((search.returncode, download.returncode), (0, 0), search_err + download_err)
+        self.assertTrue(self.archive.held_page_released_by_download)
+        self.assertIn("[1] [OK] Done: distro-1.0.iso", out)
+        self.assertIn("[2] [OK] Done: distro-2.0.img", out)
+        with open(self.path("G:", "Linux-ISOs", "distro-2.0.img"), "rb") as f:
+            self.assertEqual(f.read(), DISC[:1000])
+
+    def test_a_search_stopped_partway_through_an_entry_ends_the_download_cleanly(self):
+        line = json.dumps({"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": str(len(DISC)),
+                           "download_url": ia_common.download_url("distro-1.0", "distro-1.0.iso")})
+        download = self.run_tool("Download-From-JSON.py", "-i", "-", "--ascii", stdin=subprocess.PIPE, stdout=subprocess.PIPE)
+        out, err = download.communicate(line + "\n" + line[:20], timeout=60)
+        self.assertEqual(download.returncode, dfj.EXIT_BAD_INPUT)
+        self.assertIn("[1] [OK] Done: distro-1.0.iso", out)
+        self.assertIn("Stopped reading -: invalid JSON", err)
+
+    def test_the_search_stops_quietly_when_its_reader_goes_away(self):
+        self.archive.hold_search_page = 2
+        search = self.run_tool("IA-Advanced-Search-v2.py", "--rows", "1", "--sleep", "0", "--output-format", "ndjson", "--out", "-",
+                               stdout=subprocess.PIPE)
+        search.stdout.readline()
+        search.stdout.close()
+        # the held page goes out now, and the entry it brings finds the pipe closed
+        self.archive.download_started.set()
+        _, err = search.communicate(timeout=60)
+        self.assertEqual(search.returncode, 0, err)
+        # the entry that found the pipe closed is not counted
+        self.assertIn("The reader of stdout went away after 1 entries", err)
+        self.assertNotIn("Traceback", err)
+
+
+class SearchV1Test(EndToEndTest):
+    def test_writes_the_fixed_output_file(self):
+        os.makedirs(self.path("Lists-TODO"))
+        cwd = os.getcwd()
+        os.chdir(self.tmp.name)
+        self.addCleanup(os.chdir, cwd)
+        code, out = self.run_main(search_v1)
+        self.assertEqual(code, 0)
+        self.assertIn("Found 2 ISO-like files", out)
+        self.assertEqual([e["file_name"] for e in self.read_json("Lists-TODO", "pear.json")],
+                         ["distro-1.0.iso", "distro-2.0.img"])
+
+
+class DownloadFromJsonTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        entries = [{"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": str(len(DISC)),
+                    "download_url": ia_common.download_url("distro-1.0", "distro-1.0.iso")}]
+        with open(self.path("misc.json"), "w", encoding="utf-8") as f:
+            json.dump(entries, f)
+        self.out_dir = self.path("isos")
+        self.enterContext(mock.patch.multiple(dfj, INPUT_FILE=self.path("misc.json"), OUTPUT_DIR=self.out_dir))
+
+    def downloaded(self):
+        with open(os.path.join(self.out_dir, "distro-1.0.iso"), "rb") as f:
+            return f.read()
+
+    def test_downloads_the_listed_files(self):
+        code, out = self.run_main(dfj)
+        self.assertEqual(code, 0)
+        self.assertIn("[✔] Done: distro-1.0.iso", out)
+        self.assertEqual(self.downloaded(), DISC)
+        code, out = self.run_main(dfj)
+        self.assertIn("Already exists: distro-1.0.iso", out)
+
+    def test_ascii_status_lines(self):
+        code, out = self.run_main(dfj, "--ascii")
+        self.assertEqual(code, 0)
+        self.assertIn("[1/1 100.0%] [OK] Done: distro-1.0.iso", out)
+        code, out = self.run_main(dfj, "--ascii")
+        self.assertIn("[1/1 100.0%] [SKIP] Already exists: distro-1.0.iso", out)
+        self.assertTrue(out.isascii())
+
+    def test_body_cut_short_is_resumed_with_a_range_request(self):
+        self.archive.fail("/download/distro-1.0/distro-1.0.iso", TRUNCATE)
+        with self.assertLogs(level="WARNING"):
+            self.run_main(dfj)
+        self.assertEqual(self.downloaded(), DISC)
+        self.assertEqual(self.archive.requests[-1], ("/download/distro-1.0/distro-1.0.iso", f"bytes={ia_download.CHUNK_SIZE}-"))
+
+    def test_range_ignored_on_resume_starts_over(self):
+        self.archive.fail("/download/distro-1.0/distro-1.0.iso", TRUNCATE, IGNORE_RANGE)
+        with self.assertLogs(level="WARNING"):
+            self.run_main(dfj)
+        self.assertEqual(self.downloaded(), DISC)
+
+    def test_server_errors_are_retried(self):
+        self.archive.fail("/download/distro-1.0/distro-1.0.iso", status(503, retry_after=1), html_error(502))
+        with self.assertLogs(level="WARNING") as logs:
+            _, out = self.run_main(dfj)
+        self.assertEqual(len(logs.output), 2)
+        self.assertIn("Done: distro-1.0.iso", out)
+        self.assertEqual(self.downloaded(), DISC)
+
+    def test_missing_file_fails_and_keeps_going(self):
+        self.archive.fail("/download/distro-1.0/distro-1.0.iso", status(404))
+        _, out = self.run_main(dfj)
+        self.assertIn("[✗] Failed: distro-1.0.iso", out)
+        self.assertFalse(os.path.exists(os.path.join(self.out_dir, "distro-1.0.iso")))
+
+
+class DownloadCollectionsTest(EndToEndTest):
+    def mirror(self, *argv):
+        return self.run_main(dc, "-o", self.path("mirror"), "--report", self.path("report.json"), *argv)
+
+    def test_mirrors_an_item_and_verifies_it(self):
+        code, _ = self.mirror("distro-1.0", "--checksum")
+        self.assertEqual(code, dc.EXIT_OK)
+        with open(self.path("mirror", "distro-1.0", "distro-1.0.iso"), "rb") as f:
+            self.assertEqual(hashlib.md5(f.read()).hexdigest(), hashlib.md5(DISC).hexdigest())
+        files = {e["name"]: e for e in self.read_json("report.json")["items"]["distro-1.0"]["files"]}
+        self.assertEqual(files["distro-1.0.iso"]["verify"]["ok"], True)
+        self.assertEqual(files["README.txt"]["status"], "downloaded")
+
+    def test_the_report_has_the_user_agent_with_the_contact(self):
+        os.environ["IA_CONTACT"] = "ops@example.org"
+        code, _ = self.mirror("distro-1.0")
+        self.assertEqual(code, dc.EXIT_OK)
+        self.assertRegex(self.read_json("report.json")["user_agent"],
+                         r"^Download-Collections/2\.0\S* \(Internet-Archive-API; \+ops@example\.org\) internetarchive/")
+
+    def test_second_run_revalidates_and_skips(self):
+        self.mirror("distro-1.0")
+        code, _ = self.mirror("distro-1.0")
+        self.assertEqual(code, dc.EXIT_OK)
+        self.assertEqual(self.read_json("report.json")["totals"]["skipped"], 2)
+
+    def test_truncated_download_resumes(self):
+        self.archive.fail("/download/distro-1.0/distro-1.0.iso", TRUNCATE)
+        with self.assertLogs(level="WARNING"):
+            code, _ = self.mirror("distro-1.0", "--checksum")
+        self.assertEqual(code, dc.EXIT_OK)
+        self.assertIn(("/download/distro-1.0/distro-1.0.iso", f"bytes={ia_download.CHUNK_SIZE}-"), self.archive.requests)
+
+    def test_ctrl_c_lets_the_file_in_flight_finish_and_writes_the_report(self):
+        self.archive.fail("/download/distro-1.0/distro-1.0.iso", INTERRUPT)
+        self.archive.fail("/download/distro-1.0/README.txt", INTERRUPT)
+        with self.assertLogs(level="WARNING") as logs:
+            code, out = self.mirror("distro-1.0")
+        self.assertEqual(code, dc.EXIT_INTERRUPTED)
+        self.assertIn("the transfers in flight get 10s to finish", logs.output[0])
+        self.assertIn("Interrupted: completed files are in place", out)
+        report = self.read_json("report.json")
+        self.assertTrue(report["interrupted"])
+        self.assertEqual([e["status"] for e in report["items"]["distro-1.0"]["files"]], ["downloaded"])
+        self.assertEqual(report["items"]["distro-1.0"]["not_started"], 1)
+        self.assertNotIn(("/download/distro-1.0/README.txt", None), self.archive.requests)
+
+    def test_unknown_item_is_a_metadata_error(self):
+        with self.assertLogs(level="ERROR") as logs:
+            code, _ = self.mirror("no-such-item")
+        self.assertEqual(code, dc.EXIT_METADATA_ERROR)
+        self.assertIn("Item 'no-such-item' does not exist", logs.output[0])
+
+    def test_dark_item_is_reported_as_such(self):
+        self.archive.add_item("taken-down", {"x.iso": DISC}, dark=True)
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.mirror("taken-down")
+        self.assertEqual(code, dc.EXIT_METADATA_ERROR)
+        self.assertEqual(self.read_json("report.json")["items"]["taken-down"]["error_kind"], "dark")
+
+    def test_rate_limited_past_the_retries_exits_7(self):
+        self.archive.fail("/metadata/distro-1.0", *[status(429, retry_after=1)] * 3)
+        with self.assertLogs(level="WARNING"):
+            code, out = self.mirror("distro-1.0", "--retries", "2")
+        self.assertEqual(code, dc.EXIT_RATE_LIMITED)
+        self.assertIn("archive.org is rate limiting these requests", out)
+
+    def test_stats_file_ends_with_the_run_totals_and_exit_status(self):
+        with open(self.path("wanted.json"), "w", encoding="utf-8") as f:
+            json.dump([{"identifier": "distro-1.0", "file_name": "distro-1.0.iso"}, {"identifier": "distro-1.0", "file_name": "README.txt"},
+                       {"identifier": "distro-2.0", "file_name": "distro-2.0.img"}], f)
+        self.archive.fail("/download/distro-2.0/distro-2.0.img", *[status(404)] * 10)
+        with self.assertLogs(level="WARNING"):
+            code, _ = self.mirror("--from-json", self.path("wanted.json"), "--retries", "0", "--stats-file", self.path("stats.json"))
+        self.assertEqual(code, dc.EXIT_SOME_FAILED)
+        stats = self.read_json("stats.json")
+        self.assertEqual((stats["finished"], stats["exit_status"], stats["tool"]), (True, dc.EXIT_SOME_FAILED, dc.TOOL_NAME))
+        self.assertEqual((stats["items_done"], stats["items_total"], stats["eta_seconds"]), (2, 2, 0))
+        self.assertEqual((stats["files_downloaded"], stats["files_failed"]), (2, 1))
+        # the item metadata files (_files.xml, _meta.xml) come through the Downloader too
+        self.assertGreaterEqual(stats["bytes"], len(DISC) + len(README))
+        self.assertIn("distro-2.0.img", stats["recent_errors"][-1]["message"])
+
+    def test_refuses_a_destination_another_run_is_writing_to(self):
+        other = ia_download.DirectoryLock(self.path("mirror"), "IA-Mirror")
+        os.makedirs(self.path("mirror"))
+        other.acquire()
+        self.addCleanup(other.release)
+        with self.assertLogs(level="ERROR") as logs:
+            code, _ = self.mirror("distro-1.0")
+        self.assertEqual(code, ia_download.EXIT_LOCKED)
+        self.assertIn("is held by IA-Mirror", logs.output[0])
+        self.assertFalse(os.path.exists(self.path("mirror", "distro-1.0")))
+        # a dry run only reads, so it doesn't wait for the lock
+        code, _ = self.mirror("distro-1.0", "--dry-run")
+        self.assertEqual(code, dc.EXIT_OK)
+        other.release()
+        code, _ = self.mirror("distro-1.0")
+        self.assertEqual(code, dc.EXIT_OK)
+        self.assertFalse(os.path.exists(self.path("mirror", ia_download.LOCK_FILE)))
+
+
+
+class MetadataTest(EndToEndTest):
+    def test_selected_fields_for_each_identifier(self):
+        code, out = self.run_main(iam, "distro-1.0", "distro-2.0", "--fields", "metadata.title,files[].name")
+        self.assertEqual(code, iam.EXIT_OK)
+        self.assertEqual(json.loads(out), [
+            {"identifier": "distro-1.0", "metadata.title": "Distro 1.0", "files[].name": ["distro-1.0.iso", "README.txt"]},
+            {"identifier": "distro-2.0", "metadata.title": "Distro 2.0", "files[].name": ["distro-2.0.img"]},
+        ])
+
+    def test_identifiers_from_stdin_as_ndjson(self):
+        with mock.patch("sys.stdin", io.StringIO("# wanted\ndistro-2.0\n\nno-such-item\n")):
+            with self.assertLogs(level="ERROR") as logs:
+                code, out = self.run_main(iam, "--item-only", "--format", "ndjson")
+        self.assertEqual(code, iam.EXIT_METADATA_ERROR)
+        self.assertEqual([json.loads(line) for line in out.splitlines()],
+                         [{"identifier": "distro-2.0", "title": "Distro 2.0"}])
+        self.assertIn("Item 'no-such-item' does not exist", logs.output[0])
+
+    def test_rate_limited_past_the_retries_exits_7(self):
+        self.archive.fail("/metadata/distro-1.0", *[status(429)] * 2)
+        with self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iam, "distro-1.0", "--retries", "1")
+        self.assertEqual((code, out), (iam.EXIT_RATE_LIMITED, ""))
+
+
+def bencode(value) -> bytes:
+    if isinstance(value, int):
+        return b"i%de" % value
+    if isinstance(value, str):
+        value = value.encode()
+    if isinstance(value, bytes):
+        return b"%d:%s" % (len(value), value)
+    if isinstance(value, list):
+        return b"l" + b"".join(map(bencode, value)) + b"e"
+    return b"d" + b"".join(bencode(k) + bencode(v) for k, v in sorted(value.items())) + b"e"
+
+
+class TorrentsTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.info = {"name": "distro-1.0", "piece length": 16384, "pieces": b"x" * 20, "files": [{"length": 8, "path": ["README.txt"]}]}
+        torrent = bencode({"announce": "http://bt1.archive.org:6969/announce", "info": self.info,
+                           "url-list": ["https://archive.org/download/"]})
+        self.archive.items["distro-1.0"]["files"]["distro-1.0_archive.torrent"] = torrent
+        self.archive.add_item("broken", {"broken_archive.torrent": b"<html>not a torrent</html>"})
+
+    def test_torrents_magnets_and_missing(self):
+        with open(self.path("search.json"), "w", encoding="utf-8") as f:
+            json.dump([{"identifier": "distro-1.0", "file_name": "a.iso"}, {"identifier": "distro-1.0", "file_name": "b.iso"},
+                       {"identifier": "distro-2.0", "file_name": "c.img"}], f)
+        with self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iatt, "broken", "--from-json", self.path("search.json"), "--dest", self.path("t"),
+                                      "--magnets", self.path("magnets.txt"), "--missing", self.path("missing.txt"))
+        self.assertEqual(code, iatt.EXIT_SOME_MISSING)
+        self.assertIn("1 torrent(s)", out)
+        self.assertEqual(os.listdir(self.path("t")), ["distro-1.0_archive.torrent"])
+        with open(self.path("missing.txt"), encoding="utf-8") as f:
+            self.assertEqual(f.read(), "broken\ndistro-2.0\n")
+        with open(self.path("magnets.txt"), encoding="utf-8") as f:
+            magnet = f.read().strip()
+        info_hash = hashlib.sha1(bencode(self.info)).hexdigest()
+        self.assertEqual(magnet, f"magnet:?xt=urn:btih:{info_hash}&dn=distro-1.0&tr=http%3A%2F%2Fbt1.archive.org%3A6969%2Fannounce"
+                                 "&ws=https%3A%2F%2Farchive.org%2Fdownload%2F")
+
+    def test_torrent_on_disk_is_not_downloaded_again(self):
+        self.run_main(iatt, "distro-1.0", "--dest", self.path("t"))
+        requests_before = len(self.archive.requests)
+        code, _ = self.run_main(iatt, "distro-1.0", "--dest", self.path("t"))
+        self.assertEqual((code, len(self.archive.requests)), (iatt.EXIT_OK, requests_before))
+
+
+class SizeTest(EndToEndTest):
+    def test_collection_total_with_filters(self):
+        code, out = self.run_main(ias, "--collection", "distros", "--glob", "*.iso|*.img", "--json", "--per-item")
+        self.assertEqual(code, ias.EXIT_OK)
+        report = json.loads(out)
+        self.assertEqual((report["items"], report["total"]), (2, {"files": 2, "size": len(DISC) + 1000, "unknown_size": 0}))
+        self.assertEqual(report["per_item"]["distro-1.0"], {"files": 1, "size": len(DISC), "unknown_size": 0})
+        self.assertEqual(report["by_source"], {"original": {"files": 2, "size": len(DISC) + 1000}})
+
+    def test_unreadable_item_is_left_out_of_the_total(self):
+        with self.assertLogs(level="ERROR"):
+            code, out = self.run_main(ias, "distro-2.0", "no-such-item")
+        self.assertEqual(code, ias.EXIT_METADATA_ERROR)
+        self.assertTrue(out.startswith("1 item(s), 1 file(s), "))
+        self.assertIn("1 item(s) could not be read and are not counted: no-such-item", out)
+
+
+class StatsTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.add_item("distro-1.0", {"distro-1.0.iso": DISC, "README.txt": README}, title="Distro 1.0",
+                              year="2023", mediatype="software", item_size=len(DISC) + len(README))
+        self.archive.add_item("distro-2.0", {"distro-2.0.img": DISC[:1000]}, title="Distro 2.0", date="2024-05-01",
+                              mediatype="software", item_size=1000)
+
+    def test_counts_come_from_the_scrape_api_without_metadata_requests(self):
+        code, out = self.run_main(iast, "--collection", "distros", "--json")
+        self.assertEqual(code, iast.EXIT_OK)
+        report = json.loads(out)
+        self.assertEqual([(r["key"], r["items_to_date"], r["size_to_date"]) for r in report["groups"]],
+                         [("2023", 1, len(DISC) + len(README)), ("2024", 2, len(DISC) + len(README) + 1000)])
+        self.assertEqual(report["source"], "collection:distros")
+        self.assertEqual([path for path in self.archive.paths() if path != "/services/search/v1/scrape"], [])
+
+    def test_formats_are_counted_from_each_items_files(self):
+        self.archive.file_fields["distro-1.0"] = {"distro-1.0.iso": {"format": "ISO Image"}, "README.txt": {"format": "Text"}}
+        self.archive.file_fields["distro-2.0"] = {"distro-2.0.img": {"format": "ISO Image"}}
+        code, out = self.run_main(iast, "mediatype:software", "--group-by", "format")
+        self.assertEqual(code, iast.EXIT_OK)
+        self.assertEqual(out.splitlines()[:3], ["format     items   size", "ISO Image      2  3.0MB", "Text           1   8.0B"])
+
+    def test_a_catalog_is_counted_by_its_entries(self):
+        with open(self.path("catalog.json"), "w", encoding="utf-8") as f:
+            json.dump([{"identifier": "a", "file_name": "a.iso", "size": 700, "mediatype": "software"},
+                       {"identifier": "a", "file_name": "a.txt", "size": "20", "mediatype": "software"},
+                       {"identifier": "b", "file_name": "b.mp3", "mediatype": "audio"}], f)
+        code, out = self.run_main(iast, "-i", self.path("catalog.json"), "-g", "mediatype", "--json")
+        report = json.loads(out)
+        self.assertEqual([(r["key"], r["items"], r["size"]) for r in report["groups"]], [("software", 1, 720), ("audio", 1, 0)])
+        self.assertEqual((report["items"], report["unknown_size"]), (2, 1))
+
+
+class ConvertTest(EndToEndTest):
+    def test_search_output_to_csv_and_back(self):
+        entries = [{"identifier": "distro-1.0", "title": "Distro", "file_name": "distro-1.0.iso",
+                    "download_url": "https://archive.org/download/distro-1.0/distro-1.0.iso", "size": "3072"}]
+        with open(self.path("results.json"), "w", encoding="utf-8") as f:
+            json.dump(entries, f)
+        code, _ = self.run_main(iac, "-i", self.path("results.json"), "-o", self.path("results.csv"))
+        self.assertEqual(code, 0)
+        code, out = self.run_main(iac, "-i", self.path("results.csv"), "-o", "-", "--to", "ndjson")
+        self.assertEqual(json.loads(out), dict(entries[0], size=3072))
+
+    def test_unknown_output_format(self):
+        with open(self.path("results.json"), "w", encoding="utf-8") as f:
+            f.write("[]")
+        with contextlib.redirect_stderr(io.StringIO()):
+            code, _ = self.run_main(iac, "-i", self.path("results.json"), "-o", self.path("results.xml"))
+        self.assertEqual(code, 2)
+
+
+class DiffTest(EndToEndTest):
+    def write(self, name, text):
+        with open(self.path(name), "w", encoding="utf-8") as f:
+            f.write(text)
+        return self.path(name)
+
+    def test_wrapped_json_against_ndjson(self):
+        old = self.write("old.json", json.dumps({"query": "linux", "files": [
+            {"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": "3072", "md5": "abc"}]}))
+        new = self.write("new.ndjson", '{"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": 3072, "md5": "def"}\n'
+                                       '{"identifier": "distro-2.0", "file_name": "distro-2.0.img", "size": 1000}\n')
+        code, out = self.run_main(iad, old, new, "--format", "json")
+        self.assertEqual(code, iad.EXIT_CHANGED)
+        report = json.loads(out)
+        self.assertEqual(report["summary"], {"old": 1, "new": 2, "added": 1, "removed": 0, "changed": 1})
+        self.assertEqual(report["changed"][0]["changes"], {"md5": ["abc", "def"]})
+
+    def test_no_changes_exits_0(self):
+        old = self.write("old.json", '[{"identifier": "a", "file_name": "a.iso", "size": "1"}]')
+        csv_copy = self.write("old.csv", "identifier,file_name,size\na,a.iso,1\n")
+        self.assertEqual(self.run_main(iad, old, csv_copy), (0, "0 added, 0 removed, 0 changed (1 entries before, 1 after)\n"))
+
+    def test_unreadable_catalog(self):
+        old = self.write("old.json", "[]")
+        with contextlib.redirect_stderr(io.StringIO()) as err:
+            code, _ = self.run_main(iad, old, self.path("missing.json"))
+        self.assertEqual(code, 2)
+        self.assertIn("could not read", err.getvalue())
+
+
+class DedupeTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        for rel in ("distro-1.0/distro-1.0.iso", "incoming/renamed.iso"):
+            os.makedirs(os.path.dirname(self.path("mirror", rel)), exist_ok=True)
+            with open(self.path("mirror", rel), "wb") as f:
+                f.write(DISC)
+        with open(self.path("catalog.json"), "w", encoding="utf-8") as f:
+            json.dump([{"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "md5": hashlib.md5(DISC).hexdigest().upper()}], f)
+
+    def test_link_keeps_the_copy_the_catalog_names(self):
+        args = (self.path("mirror"), "--catalog", self.path("catalog.json"), "--keep", "shortest", "--link")
+        code, out = self.run_main(iadd, *args, "--dry-run")
+        self.assertEqual(code, iadd.EXIT_DUPLICATES)
+        self.assertIn(" * distro-1.0/distro-1.0.iso\n   incoming/renamed.iso\n", out)
+        self.assertEqual(os.stat(self.path("mirror", "incoming", "renamed.iso")).st_nlink, 1)
+
+        code, _ = self.run_main(iadd, *args, "--report", self.path("report.json"))
+        self.assertEqual(code, iadd.EXIT_OK)
+        self.assertEqual(os.stat(self.path("mirror", "incoming", "renamed.iso")).st_ino,
+                         os.stat(self.path("mirror", "distro-1.0", "distro-1.0.iso")).st_ino)
+        group, = self.read_json("report.json")["groups"]
+        self.assertEqual((group["catalog"], group["wasted"], group["action"]), (["distro-1.0/distro-1.0.iso"], len(DISC), "link"))
+        self.assertFalse(os.path.exists(self.path("mirror", ia_download.LOCK_FILE)))
+
+        # linked, they are one copy; and the index spares hashing them again
+        with mock.patch.object(iadd, "hash_file") as hashed:
+            self.assertEqual(self.run_main(iadd, self.path("mirror")), (0, "No duplicates\n"))
+        hashed.assert_not_called()
+
+    def test_a_locked_mirror_is_not_changed(self):
+        other = ia_download.DirectoryLock(self.path("mirror"), "IA-Mirror").acquire()
+        self.addCleanup(other.release)
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.run_main(iadd, self.path("mirror"), "--delete")
+        self.assertEqual(code, ia_download.EXIT_LOCKED)
+        self.assertTrue(os.path.exists(self.path("mirror", "incoming", "renamed.iso")))
+
+
+class ThumbnailTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.items["distro-1.0"]["files"].update({"__ia_thumb.jpg": b"thumb 1.0", "cover.png": b"cover of 1.0"})
+        self.archive.service_images["distro-2.0"] = b"service image 2.0"
+        self.archive.add_item("no-image", {"notes.txt": b"nothing to see"})
+
+    def read(self, name):
+        with open(self.path("thumbs", name), "rb") as f:
+            return f.read()
+
+    def test_thumbnails_with_the_image_service_as_the_fallback(self):
+        args = ("distro-1.0", "distro-2.0", "no-image", "--out-dir", self.path("thumbs"))
+        with self.assertLogs(level="WARNING") as logs:
+            code, out = self.run_main(iath, *args)
+        self.assertEqual(code, iath.EXIT_MISSING)
+        self.assertEqual(out, "2 saved, 0 already there, 1 without a thumbnail, 0 failed\nNo thumbnail: no-image\n")
+        self.assertIn("no-image: no thumbnail", logs.output[0])
+        self.assertEqual((self.read("distro-1.0.jpg"), self.read("distro-2.0.jpg")), (b"thumb 1.0", b"service image 2.0"))
+
+        # the second time, only the item without one is asked for again
+        self.archive.requests.clear()
+        with self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iath, *args)
+        self.assertTrue(out.startswith("0 saved, 2 already there, 1 without a thumbnail"))
+        self.assertFalse([path for path in self.archive.paths() if "distro" in path])
+
+    def test_size_large_takes_the_largest_original_image(self):
+        with open(self.path("catalog.json"), "w", encoding="utf-8") as f:
+            json.dump([{"identifier": "distro-1.0", "file_name": "distro-1.0.iso"}, {"identifier": "distro-1.0", "file_name": "README.txt"}], f)
+        code, out = self.run_main(iath, "--input", self.path("catalog.json"), "--out-dir", self.path("thumbs"), "--size", "large")
+        self.assertEqual((code, out), (0, "1 saved, 0 already there, 0 without a thumbnail, 0 failed\n"))
+        self.assertEqual(self.read("distro-1.0.png"), b"cover of 1.0")
+
+    def test_a_failed_request_is_reported(self):
+        self.archive.fail("/download/distro-1.0/__ia_thumb.jpg", status(403))
+        with self.assertLogs(level="ERROR"):
+            code, out = self.run_main(iath, "distro-1.0", "--out-dir", self.path("thumbs"))
+        self.assertEqual(code, iath.EXIT_FAILED)
+        self.assertIn("Failed: distro-1.0", out)
+
+
+class CassetteTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.enterContext(mock.patch.dict("os.environ", {"IA_ACCESS_KEY": "key", "IA_SECRET_KEY": "hunter2"}))
+        self.cassette = self.path("cassette.json")
+
+    def record(self, module, *argv):
+        """Run module with --record, and write the cassette as the end of the run would."""
+        with mock.patch("atexit.register") as at_exit:
+            result = self.run_main(module, *argv, "--record", self.cassette)
+        for call in at_exit.call_args_list:
+            if isinstance(getattr(call.args[0], "__self__", None), ia_common.Cassette):
+                call.args[0]()
+        return result
+
+    def test_a_recorded_run_replays_without_the_network(self):
+        recorded = self.record(iader, "distro-1.0")
+        with open(self.cassette, encoding="utf-8") as f:
+            text = f.read()
+        self.assertNotIn("hunter2", text)
+        (interaction,) = json.loads(text)["interactions"]
+        self.assertEqual(interaction["request"]["headers"]["Authorization"], "LOW <redacted>")
+        self.assertEqual(interaction["response"]["status"], 200)
+        sent = len(self.archive.requests)
+        self.assertEqual(self.run_main(iader, "distro-1.0", "--replay", self.cassette), recorded)
+        self.assertEqual(len(self.archive.requests), sent)
+
+    def test_a_request_the_cassette_has_no_answer_for_stops_the_tool(self):
+        self.record(iader, "distro-1.0")
+        with self.assertLogs(level="ERROR") as logs, self.assertRaises(ia_common.CassetteMiss):
+            self.run_main(iader, "distro-2.0", "--replay", self.cassette)
+        self.assertIn(f"has no recording for GET {ia_common.metadata_url('distro-2.0')}", logs.output[0])
+        # each recorded answer is given once
+        session = ia_common.build_session(5, 0, 0, "test", cassette=ia_common.Cassette(self.cassette, replay=True))
+        self.assertEqual(session.get(ia_common.metadata_url("distro-1.0")).json()["metadata"]["title"], "Distro 1.0")
+        with self.assertLogs(level="ERROR") as logs, self.assertRaises(ia_common.CassetteMiss):
+            session.get(ia_common.metadata_url("distro-1.0"))
+        self.assertIn("has no more answers for GET", logs.output[0])
+
+    def test_a_streamed_download_is_recorded_and_replayed(self):
+        entries = [{"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": str(len(DISC)),
+                    "download_url": ia_common.download_url("distro-1.0", "distro-1.0.iso")}]
+        with open(self.path("misc.json"), "w", encoding="utf-8") as f:
+            json.dump(entries, f)
+        out_dir = self.path("isos")
+        self.enterContext(mock.patch.multiple(dfj, INPUT_FILE=self.path("misc.json"), OUTPUT_DIR=out_dir))
+        code, _ = self.record(dfj, "--record-max-body", "10M")
+        self.assertEqual(code, 0)
+        os.remove(os.path.join(out_dir, "distro-1.0.iso"))
+        sent = len(self.archive.requests)
+        code, out = self.run_main(dfj, "--replay", self.cassette)
+        self.assertIn("[✔] Done: distro-1.0.iso", out)
+        with open(os.path.join(out_dir, "distro-1.0.iso"), "rb") as f:
+            self.assertEqual(f.read(), DISC)
+        self.assertEqual(len(self.archive.requests), sent)
+
+    def test_bodies_are_cut_at_record_max_body(self):
+        self.record(iam, "distro-1.0", "--record-max-body", "10")
+        (interaction,) = self.read_json("cassette.json")["interactions"]
+        self.assertEqual((len(interaction["response"]["body"]), interaction["response"]["truncated"]), (10, True))
+
+
+@unittest.skipUnless(ia_common.ARCHIVE_URL == "https://archive.org", "the cassettes were recorded against archive.org")
+class ContributedCassetteTest(unittest.TestCase):
+    def setUp(self):
+        self.enterContext(mock.patch.object(iader, "setup_logging"))
+        self.enterContext(mock.patch.object(ia_common, "CONFIG_FILE", os.devnull + "-no-config.toml"))
+
+    def test_derivatives_of_an_original_the_item_does_not_have(self):
+        out = io.StringIO()
+        argv = ["IA-Derivatives", "distro-3.0", "--replay", os.path.join(CASSETTES, "IA-Derivatives-distro-3.0.json")]
+        with mock.patch("sys.argv", argv), contextlib.redirect_stdout(out), self.assertRaises(SystemExit) as exit_:
+            iader.main()
+        self.assertEqual(exit_.exception.code, iader.EXIT_OK)
+        self.assertEqual(out.getvalue().splitlines(), [
+            "cover.png  (PNG, 1.0KB)  [original artwork/cover.tiff is not in the item]",
+            "distro-3.0.iso  (ISO Image, 3.0MB)",
+            "  distro-3.0.iso_files.txt  (Text, 2.0KB)",
+            "distro-3.0_archive.torrent  (Archive BitTorrent, 512.0B)"])
+
+
+class DerivativesTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.items["distro-1.0"]["files"]["distro-1.0.iso_files.txt"] = b"listing"
+        self.archive.file_fields["distro-1.0"] = {
+            "distro-1.0.iso_files.txt": {"source": "derivative", "format": "Text", "original": "distro-1.0.iso"},
+            "distro-1.0.iso": {"format": "ISO Image"}}
+
+    def test_tree_and_leaves(self):
+        code, out = self.run_main(iader, "distro-1.0")
+        self.assertEqual((code, out), (0, "README.txt  (no format, 8.0B)\ndistro-1.0.iso  (ISO Image, 3.0MB)\n  distro-1.0.iso_files.txt  (Text, 7.0B)\n"))
+        code, out = self.run_main(iader, "distro-1.0", "--only-leaves", "--json")
+        self.assertEqual([f["name"] for f in json.loads(out)], ["README.txt", "distro-1.0.iso_files.txt"])
+
+    def test_unknown_item(self):
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.run_main(iader, "no-such-item")
+        self.assertEqual(code, iader.EXIT_METADATA_ERROR)
+
+
+class FeedTest(EndToEndTest):
+    ATOM = "{http://www.w3.org/2005/Atom}"
+
+    def setUp(self):
+        super().setUp()
+        self.archive.items["distro-1.0"]["metadata"]["publicdate"] = "2024-01-01T00:00:00Z"
+        self.archive.items["distro-2.0"]["metadata"]["publicdate"] = "2024-03-01T00:00:00Z"
+        self.archive.add_item("distro-3.0", {}, title="Distro 3.0", publicdate="2024-02-01T00:00:00Z")
+
+    def test_newest_items_first_truncated_to_the_limit(self):
+        code, out = self.run_main(iaf, "--collection", "distros", "--limit", "2", "--title", "Distros",
+                                  "--self-url", "https://example.org/distros.xml")
+        self.assertEqual(code, 0)
+        root = ET.fromstring(out)
+        self.assertEqual(root.findtext(f"{self.ATOM}title"), "Distros")
+        self.assertEqual([e.findtext(f"{self.ATOM}title") for e in root.findall(f"{self.ATOM}entry")], ["Distro 2.0", "Distro 3.0"])
+        self.assertEqual(root.findtext(f"{self.ATOM}updated"), "2024-03-01T00:00:00Z")
+
+    def test_writes_the_file_whole(self):
+        code, _ = self.run_main(iaf, "mediatype:software", "--out", self.path("feed.xml"))
+        self.assertEqual(code, 0)
+        self.assertEqual(len(ET.parse(self.path("feed.xml")).getroot().findall(f"{self.ATOM}entry")), 3)
+        self.assertFalse(os.path.exists(self.path("feed.xml.tmp")))
+
+    def test_failed_search(self):
+        self.archive.fail("/advancedsearch.php", status(400, body=b"bad query"))
+        with self.assertLogs(level="ERROR") as logs:
+            code, out = self.run_main(iaf, "broken:(")
+        self.assertIn("status 400", logs.output[0])
+        self.assertEqual((code, out), (iaf.EXIT_SEARCH_FAILED, ""))
+
+
+class ReviewsTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.reviews["distro-1.0"] = [
+            {"reviewer": "bob", "reviewdate": "2021-05-01 10:00:00", "stars": "2", "reviewtitle": "Meh", "reviewbody": "Slow"},
+            {"reviewer": "ann", "reviewdate": "2020-01-02 09:00:00", "stars": "5", "reviewtitle": "Works", "reviewbody": "md5 matched"},
+        ]
+
+    def test_reviews_oldest_first_with_min_stars(self):
+        code, out = self.run_main(iar, "distro-1.0", "distro-2.0")
+        self.assertEqual(code, iar.EXIT_OK)
+        self.assertEqual([(r["reviewer"], r["stars"]) for r in json.loads(out)], [("ann", 5), ("bob", 2)])
+        code, out = self.run_main(iar, "distro-1.0", "--min-stars", "3", "--format", "csv")
+        self.assertEqual(out.splitlines(), ["identifier,reviewer,date,stars,title,body",
+                                            "distro-1.0,ann,2020-01-02 09:00:00,5,Works,md5 matched"])
+
+    def test_stats_per_item(self):
+        with mock.patch("sys.stdin", io.StringIO("distro-1.0\ndistro-2.0\nno-such-item\n")):
+            with self.assertLogs(level="ERROR"):
+                code, out = self.run_main(iar, "--stats")
+        self.assertEqual(code, iar.EXIT_METADATA_ERROR)
+        self.assertEqual(json.loads(out), [{"identifier": "distro-1.0", "count": 2, "average_stars": 3.5},
+                                           {"identifier": "distro-2.0", "count": 0, "average_stars": None}])
+
+
+class ListTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.add_item("distro-3.0", {"distro-3.0.iso": DISC, "__ia_thumb.jpg": b"jpg", "notes.txt": README})
+
+    def test_table_sorted_by_size_with_total(self):
+        code, out = self.run_main(ial, "distro-3.0", "--sort-by", "size", "--total")
+        self.assertEqual(code, ial.EXIT_OK)
+        lines = out.splitlines()
+        self.assertEqual([line.split()[0] for line in lines[1:3]], ["notes.txt", "distro-3.0.iso"])
+        self.assertIn(hashlib.md5(DISC).hexdigest(), lines[2])
+        self.assertEqual(lines[3], f"2 files, {ia_common.format_size(len(DISC) + len(README))} total; "
+                                   "1 housekeeping file(s) not listed (--include-housekeeping to list them)")
+
+    def test_selects_what_download_collections_would(self):
+        code, out = self.run_main(ial, "distro-3.0", "--glob", "*.iso|*.jpg", "--tsv")
+        self.assertEqual(out.splitlines()[1].split("\t")[:2], ["distro-3.0.iso", str(len(DISC))])
+        self.assertEqual(len(out.splitlines()), 2)
+        with contextlib.redirect_stderr(io.StringIO()):
+            code, listing = self.run_main(dc, "distro-3.0", "--glob", "*.iso|*.jpg", "--dry-run", "--output", "tsv",
+                                          "--destdir", self.path("out"))
+        self.assertEqual(listing.splitlines()[1].split("\t")[0], "distro-3.0.iso")
+
+    def test_json_with_total(self):
+        code, out = self.run_main(ial, "distro-1.0", "--json", "--total", "--max-size", "1K")
+        self.assertEqual(json.loads(out)["count"], 1)
+        self.assertEqual(json.loads(out)["files"][0]["name"], "README.txt")
+
+    def test_missing_item_exits_2(self):
+        with self.assertLogs(level="ERROR"):
+            code, out = self.run_main(ial, "no-such-item")
+        self.assertEqual((code, out), (ial.EXIT_METADATA_ERROR, ""))
+
+
+class VerifyTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.mirror = self.path("mirror")
+        for identifier in ("distro-1.0", "distro-2.0"):
+            code, _ = self.run_main(dc, identifier, "--destdir", self.mirror)
+            self.assertEqual(code, dc.EXIT_OK)
+
+    def test_fresh_mirror_verifies(self):
+        code, out = self.run_main(iav, self.mirror)
+        self.assertEqual(code, iav.EXIT_OK)
+        self.assertEqual(out.splitlines(), ["distro-1.0: 2/2 ok", "distro-2.0: 1/1 ok"])
+
+    def test_reports_missing_corrupt_and_extra_files(self):
+        os.remove(os.path.join(self.mirror, "distro-1.0", "README.txt"))
+        with open(os.path.join(self.mirror, "distro-2.0", "distro-2.0.img"), "r+b") as f:
+            f.write(b"X")
+        with open(os.path.join(self.mirror, "distro-2.0", "stray.txt"), "w") as f:
+            f.write("not from IA")
+        with self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iav, self.mirror, "--report", self.path("report.json"))
+        self.assertEqual(code, iav.EXIT_PROBLEMS)
+        report = self.read_json("report.json")["items"]
+        self.assertEqual(report["distro-1.0"]["missing"], ["README.txt"])
+        self.assertEqual([c["name"] for c in report["distro-2.0"]["corrupt"]], ["distro-2.0.img"])
+        self.assertIn("md5", report["distro-2.0"]["corrupt"][0]["reason"])
+        self.assertEqual(report["distro-2.0"]["extra"], ["stray.txt"])
+
+    def test_size_only_skips_hashing(self):
+        with open(os.path.join(self.mirror, "distro-2.0", "distro-2.0.img"), "r+b") as f:
+            f.write(b"X")
+        code, _ = self.run_main(iav, self.mirror, "--size-only")
+        self.assertEqual(code, iav.EXIT_OK)
+
+    def test_fix_downloads_again(self):
+        os.remove(os.path.join(self.mirror, "distro-1.0", "README.txt"))
+        with open(os.path.join(self.mirror, "distro-1.0", "distro-1.0.iso"), "wb") as f:
+            f.write(b"short")
+        with self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iav, "--map", self.write_map(), "--fix")
+        self.assertEqual(code, iav.EXIT_OK)
+        self.assertEqual(out.strip(), "distro-1.0: 0/2 ok, 2 fixed")
+        with open(os.path.join(self.mirror, "distro-1.0", "distro-1.0.iso"), "rb") as f:
+            self.assertEqual(f.read(), DISC)
+
+    def test_from_db_reads_only_the_files_changed_since_they_were_hashed(self):
+        db = self.path("checksums.sqlite")
+        code, _ = self.run_main(dc, "distro-1.0", "--destdir", self.path("checked"), "--checksum", "--checksum-db", db)
+        self.assertEqual(code, dc.EXIT_OK)
+        with open(os.path.join(self.path("checked"), "distro-1.0", "README.txt"), "r+b") as f:
+            f.write(b"X")
+        with mock.patch.object(iav, "hash_file", wraps=iav.hash_file) as hashed, self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iav, self.path("checked"), "--checksum-db", db, "--from-db")
+        self.assertEqual((code, out.strip()), (iav.EXIT_PROBLEMS, "distro-1.0: 1/2 ok, 0 missing, 1 corrupt, 0 extra"))
+        self.assertEqual([os.path.basename(c.args[0]) for c in hashed.call_args_list], ["README.txt"])
+
+    def write_map(self):
+        with open(self.path("mirror.map"), "w", encoding="utf-8") as f:
+            f.write(f"# one item\ndistro-1.0 {os.path.join(self.mirror, 'distro-1.0')}\n")
+        return self.path("mirror.map")
+
+
+class ChecksumDBTest(EndToEndTest):
+    def test_export_and_import(self):
+        db = self.path("checksums.sqlite")
+        code, _ = self.run_main(dc, "distro-2.0", "--destdir", self.path("mirror"), "--checksum", "--checksum-db", db)
+        self.assertEqual(code, dc.EXIT_OK)
+        code, out = self.run_main(iacd, "export", "--checksum-db", db)
+        records = json.loads(out)
+        self.assertEqual(([os.path.basename(r["path"]) for r in records], records[0]["md5"], records[0]["identifier"]),
+                         (["distro-2.0.img"], hashlib.md5(DISC[:1000]).hexdigest(), "distro-2.0"))
+        with open(self.path("export.json"), "w", encoding="utf-8") as f:
+            json.dump(records, f)
+        code, out = self.run_main(iacd, "import", self.path("export.json"), "--checksum-db", self.path("copy.sqlite"))
+        self.assertEqual((code, out.strip()), (iacd.EXIT_OK, f"1 record(s) imported into {self.path('copy.sqlite')}"))
+        with open(self.path("bad.json"), "w", encoding="utf-8") as f:
+            f.write('{"path": "x"}')
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.run_main(iacd, "import", self.path("bad.json"), "--checksum-db", self.path("copy.sqlite"))
+        self.assertEqual(code, iacd.EXIT_BAD_INPUT)
+
+
+class MirrorTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.mirror = self.path("mirror")
+
+    def sync(self, *argv):
+        return self.run_main(iamr, "sync", "--collection", "distros", "--dest", self.mirror, "--sleep", "0", *argv)
+
+    def downloads(self):
+        return [path for path, _ in self.archive.requests if path.startswith("/download/")]
+
+    def test_second_run_downloads_only_what_changed(self):
+        code, out = self.sync()
+        self.assertEqual((code, out.strip()), (iamr.EXIT_OK, "2 item(s) checked, 3 file(s) downloaded, 0 failed"))
+        self.archive.requests.clear()
+        code, out = self.sync()
+        self.assertEqual((code, self.downloads()), (iamr.EXIT_OK, []))
+
+        self.archive.add_item("distro-1.0", {"distro-1.0.iso": DISC, "README.txt": b"new readme"}, title="Distro 1.0",
+                              updated=1800000000)
+        code, out = self.sync()
+        self.assertEqual(self.downloads(), ["/download/distro-1.0/README.txt"])
+        with open(os.path.join(self.mirror, "distro-1.0", "README.txt"), "rb") as f:
+            self.assertEqual(f.read(), b"new readme")
+
+    def test_failed_item_stays_pending_until_it_syncs(self):
+        self.archive.fail("/download/distro-2.0/distro-2.0.img", *[status(404)] * 10)
+        with self.assertLogs(level="ERROR"):
+            code, out = self.sync("--retries", "0")
+        self.assertEqual(code, iamr.EXIT_SOME_FAILED)
+        self.archive.faults.clear()
+        code, status_out = self.run_main(iamr, "status", "--collection", "distros", "--dest", self.mirror)
+        self.assertEqual((code, status_out.splitlines()[0]),
+                         (iamr.EXIT_SOME_FAILED, "distros: 2 item(s) live, 1 mirrored (50.0%), 1 pending, 0 withdrawn"))
+        code, out = self.sync()
+        self.assertEqual((code, out.strip()), (iamr.EXIT_OK, "2 item(s) checked, 1 file(s) downloaded, 0 failed"))
+
+    def test_prune_removes_items_that_left_the_collection(self):
+        self.sync()
+        del self.archive.items["distro-2.0"]
+        code, out = self.sync("--prune", "--dry-run")
+        self.assertIn("would prune distro-2.0/", out)
+        self.assertTrue(os.path.isdir(os.path.join(self.mirror, "distro-2.0")))
+        with self.assertLogs(level="WARNING"):
+            code, out = self.sync("--prune")
+        self.assertEqual(code, iamr.EXIT_OK)
+        self.assertFalse(os.path.exists(os.path.join(self.mirror, "distro-2.0")))
+        code, status_out = self.run_main(iamr, "status", "--collection", "distros", "--dest", self.mirror)
+        self.assertEqual(status_out.splitlines()[:2], ["distros: 1 item(s) live, 1 mirrored (100.0%), 0 pending, 1 withdrawn",
+                                                      f"files: 2 ({ia_common.format_size(len(DISC) + len(README))})"])
+
+    def test_files_the_checksum_db_knows_are_not_downloaded_again(self):
+        db = self.path("checksums.sqlite")
+        self.sync("--checksum-db", db)
+        os.remove(os.path.join(self.mirror, iamr.STATE_FILE))
+        self.archive.requests.clear()
+        code, out = self.sync("--checksum-db", db)
+        self.assertEqual((code, out.strip()), (iamr.EXIT_OK, "2 item(s) checked, 0 file(s) downloaded, 0 failed"))
+        self.assertEqual(self.downloads(), [])
+
+    def test_dry_run_downloads_nothing(self):
+        code, out = self.sync("--dry-run", "--glob", "*.iso")
+        self.assertEqual(out.splitlines()[0], f"would download distro-1.0/distro-1.0.iso ({ia_common.format_size(len(DISC))})")
+        self.assertEqual(self.downloads(), [])
+
+    def test_watch_syncs_each_cycle_until_sigterm(self):
+        waits = []
+
+        def wait(timeout):
+            waits.append(timeout)
+            if len(waits) == 1:
+                # an outage for the second cycle's search, then a new item for the third
+                self.archive.fail("/advancedsearch.php", *[status(503)] * 10)
+            elif len(waits) == 2:
+                self.archive.faults.clear()
+                self.archive.add_item("distro-3.0", {"distro-3.0.iso": b"three"}, title="Distro 3.0")
+            else:
+                os.kill(os.getpid(), signal.SIGTERM)
+            return ia_download.STOP.is_set()
+
+        self.enterContext(mock.patch.object(ia_download.STOP, "wait", side_effect=wait))
+        with self.assertLogs(level="INFO") as logs:
+            code, out = self.sync("--watch", "--interval", "30m", "--retries", "0", "--drain", "0")
+        self.assertEqual((code, waits), (iamr.EXIT_OK, [1800.0] * 3))
+        cycles = [line for line in logs.output if "Cycle" in line and "done" in line]
+        self.assertIn("Cycle 1 done", cycles[0])
+        self.assertIn("search failed", cycles[1])
+        self.assertIn("in sync; 3 item(s) mirrored", cycles[2])
+        self.assertTrue(os.path.isfile(os.path.join(self.mirror, "distro-3.0", "distro-3.0.iso")))
+
+    def test_watch_is_not_for_dry_runs(self):
+        with contextlib.redirect_stderr(io.StringIO()) as err:
+            code, _ = self.sync("--watch", "--dry-run")
+        self.assertEqual(code, 2)
+        self.assertIn("--watch does not go with --dry-run", err.getvalue())
+
+    def test_another_collection_in_the_same_directory_is_refused(self):
+        self.sync()
+        with contextlib.redirect_stderr(io.StringIO()) as err:
+            code, _ = self.run_main(iamr, "sync", "--collection", "other", "--dest", self.mirror)
+        self.assertEqual(code, 2)
+        self.assertIn("mirrors distros, not other", err.getvalue())
+        # the refused run let go of the lock it took
+        self.assertFalse(os.path.exists(os.path.join(self.mirror, ia_download.LOCK_FILE)))
+
+    def test_watch_keeps_the_stats_file_across_cycles(self):
+        waits = []
+
+        def wait(timeout):
+            waits.append(timeout)
+            if len(waits) == 2:
+                os.kill(os.getpid(), signal.SIGTERM)
+            return ia_download.STOP.is_set()
+
+        self.enterContext(mock.patch.object(ia_download.STOP, "wait", side_effect=wait))
+        with self.assertLogs(level="INFO"):
+            # no drain timer left running into the tests after this one
+            code, _ = self.sync("--watch", "--interval", "1m", "--stats-file", self.path("stats.json"), "--drain", "0")
+        self.assertEqual(code, iamr.EXIT_OK)
+        stats = self.read_json("stats.json")
+        self.assertEqual((stats["finished"], stats["exit_status"], stats["cycle"]), (True, iamr.EXIT_OK, 2))
+        # the counts are those of the last cycle, which had nothing new to download
+        self.assertEqual(stats["items_done"], stats["items_total"])
+        self.assertEqual((stats["files_downloaded"], stats["files_failed"], stats["eta_seconds"]), (0, 0, 0))
+
+    def test_notifies_at_the_second_failed_sync_in_a_row_and_at_the_recovery(self):
+        sent = self.path("sent.ndjson")
+        script = f"import sys; open({sent!r}, 'a').write(sys.stdin.read() + '\\n')"
+        notify = ["--notify-command", f"{shlex.quote(sys.executable)} -c {shlex.quote(script)}", "--notify-after", "2"]
+        self.archive.fail("/advancedsearch.php", *[status(503)] * 10)
+        for _ in range(3):
+            with self.assertLogs(level="ERROR"):
+                code, _ = self.sync("--retries", "0", *notify)
+            self.assertEqual(code, iamr.EXIT_SEARCH_FAILED)
+        self.archive.faults.clear()
+        with self.assertLogs(level="INFO"):
+            code, _ = self.sync(*notify)
+        self.assertEqual(code, iamr.EXIT_OK)
+        with open(sent, encoding="utf-8") as f:
+            payloads = [json.loads(line) for line in f]
+        self.assertEqual([(n["event"], n["exit_status"], n["failures_in_a_row"]) for n in payloads],
+                         [("failed", iamr.EXIT_SEARCH_FAILED, 2), ("recovered", iamr.EXIT_OK, 0)])
+        self.assertEqual((payloads[1]["summary"]["collection"], payloads[1]["summary"]["synced"]), ("distros", 2))
+
+    def test_waits_for_the_run_holding_the_mirror_then_syncs(self):
+        other = ia_download.DirectoryLock(self.mirror, "Download-Collections")
+        os.makedirs(self.mirror)
+        other.acquire()
+        self.addCleanup(other.release)
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.sync("--lock-wait", "0")
+        self.assertEqual(code, ia_download.EXIT_LOCKED)
+        self.assertFalse(os.path.exists(os.path.join(self.mirror, iamr.STATE_FILE)))
+        # the other run finishes while this one waits
+        ia_download.STOP.wait.side_effect = lambda timeout: other.release()
+        with self.assertLogs(level="WARNING") as logs:
+            code, _ = self.sync("--lock-wait", "5m")
+        self.assertEqual(code, iamr.EXIT_OK)
+        self.assertIn("waiting up to 300s for it", logs.output[0])
+
+
+class OAIHarvestTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.oai_records = [
+            {"identifier": f"oai:archive.org:film-{n}", "datestamp": f"2024-0{n}-01", "sets": ["collection:prelinger"],
+             "dc": {"title": [f"Film {n}"], "subject": ["history", "film"]}} for n in range(1, 6)]
+        self.archive.oai_records[4].update(deleted=True, dc={})
+
+    def test_records_across_resumption_tokens(self):
+        code, out = self.run_main(iaoai, "--set", "collection:prelinger", "--from", "2024-02-01")
+        self.assertEqual(code, iaoai.EXIT_OK)
+        records = [json.loads(line) for line in out.splitlines()]
+        self.assertEqual([r["identifier"] for r in records], [f"oai:archive.org:film-{n}" for n in range(2, 6)])
+        self.assertEqual(records[0]["dc"], {"title": ["Film 2"], "subject": ["history", "film"]})
+        self.assertEqual((records[-1]["deleted"], "dc" in records[-1]), (True, False))
+        self.assertEqual(self.archive.oai_queries[0], {"verb": "ListRecords", "metadataPrefix": "oai_dc",
+                                                       "set": "collection:prelinger", "from": "2024-02-01"})
+        self.assertEqual(self.archive.oai_queries[1], {"verb": "ListRecords", "resumptionToken": "2"})
+
+    def test_stored_token_resumes_and_is_cleared_when_done(self):
+        state = self.path("harvest.json")
+        with open(state, "w", encoding="utf-8") as f:
+            json.dump({"params": {"verb": "ListIdentifiers", "metadataPrefix": "oai_dc"}, "token": "4"}, f)
+        code, out = self.run_main(iaoai, "--verb", "ListIdentifiers", "--state", state)
+        self.assertEqual(code, iaoai.EXIT_OK)
+        self.assertEqual([json.loads(line)["identifier"] for line in out.splitlines()], ["oai:archive.org:film-5"])
+        self.assertFalse(os.path.exists(state))
+
+    def test_failure_keeps_the_token_of_the_next_page(self):
+        state = self.path("harvest.json")
+        # the first page comes through, the second is gone
+        self.archive.fail("/services/oai.php", None, status(404))
+        with self.assertLogs(level="ERROR"):
+            code, out = self.run_main(iaoai, "--state", state, "--out-dir", self.path("records"))
+        self.assertEqual(code, iaoai.EXIT_HARVEST_FAILED)
+        self.assertEqual(self.read_json("harvest.json")["token"], "2")
+        self.assertEqual(sorted(os.listdir(self.path("records"))), ["film-1.xml", "film-2.xml"])
+
+    def test_no_records_match_is_not_an_error(self):
+        code, out = self.run_main(iaoai, "--set", "collection:nothing")
+        self.assertEqual((code, out), (iaoai.EXIT_OK, ""))
+
+
+class FullTextSearchTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.fts_hits = [
+            {"_id": f"book-{n}", "_score": 1.0 / n, "_source": {"identifier": f"book-{n}", "title": f"Book {n}"},
+             "highlight": {"text": [f"a {{{{{{kernel panic}}}}}} on page {n}"]}} for n in range(1, 4)]
+
+    def test_hits_across_scroll_pages_scoped_to_collections(self):
+        code, out = self.run_main(iafts, '"kernel panic"', "-c", "books", "-c", "manuals", "--rows", "2")
+        self.assertEqual(code, iafts.EXIT_OK)
+        hits = json.loads(out)
+        self.assertEqual([h["identifier"] for h in hits], ["book-1", "book-2", "book-3"])
+        self.assertEqual(hits[0]["snippets"], ["a **kernel panic** on page 1"])
+        self.assertEqual(self.archive.fts_queries[0],
+                         {"q": '("kernel panic") AND (collection:books OR collection:manuals)', "size": 2, "scroll": True})
+        self.assertEqual(self.archive.fts_queries[1], {"scroll_id": "2", "scroll": True})
+
+    def test_pages_from_search_inside(self):
+        self.archive.add_item("book-1", {"book-1_djvu.xml": b"<x/>"})
+        self.archive.inside["book-1"] = [{"text": "the {{{kernel panic}}} again", "par": [{"page": 12}, {"page": 11}]}]
+        code, out = self.run_main(iafts, "kernel panic", "--limit", "1", "--pages", "--highlight", "", "--format", "ndjson")
+        self.assertEqual(json.loads(out)["matches"], [{"pages": [11, 12], "text": "the kernel panic again"}])
+
+    def test_post_is_retried(self):
+        self.archive.fail("/fts", status(503))
+        with self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iafts, "kernel panic", "--limit", "1")
+        self.assertEqual((code, len(json.loads(out))), (iafts.EXIT_OK, 1))
+
+    def test_no_hits_exits_1(self):
+        self.archive.fts_hits = []
+        code, out = self.run_main(iafts, "nothing like this")
+        self.assertEqual((code, json.loads(out)), (iafts.EXIT_NO_HITS, []))
+
+
+class WaybackCDXTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.cdx_rows = [
+            {"urlkey": "org,example)/", "timestamp": f"2024010{n}000000", "original": "https://example.org/", "mimetype": "text/html",
+             "statuscode": "200", "digest": f"DIGEST{n}", "length": str(1000 + n)} for n in range(1, 6)]
+
+    def test_follows_the_resume_key(self):
+        code, out = self.run_main(iwcdx, "example.org", "--page-size", "2", "--status", "200", "--mime", "text/html",
+                                  "--filter", "!digest:X", "--from", "2024-01-01")
+        self.assertEqual(code, iwcdx.EXIT_OK)
+        rows = [json.loads(line) for line in out.splitlines()]
+        self.assertEqual([r["digest"] for r in rows], [f"DIGEST{n}" for n in range(1, 6)])
+        self.assertEqual([q.get("resumeKey") for q in self.archive.cdx_queries], [None, "2", "4"])
+        self.assertEqual(self.archive.cdx_queries[0]["filter"], ["!digest:X", "statuscode:200", "mimetype:text/html"])
+        self.assertEqual(self.archive.cdx_queries[0]["from"], "20240101")
+
+    def test_resume_key_and_limit(self):
+        code, out = self.run_main(iwcdx, "example.org", "--page-size", "2", "--resume-key", "1", "--limit", "3")
+        self.assertEqual(code, iwcdx.EXIT_OK)
+        self.assertEqual([json.loads(line)["digest"] for line in out.splitlines()], ["DIGEST2", "DIGEST3", "DIGEST4"])
+        self.assertEqual([q["limit"] for q in self.archive.cdx_queries], ["2", "1"])
+
+    def test_csv_to_a_file(self):
+        code, _ = self.run_main(iwcdx, "example.org/", "--match-type", "prefix", "--format", "csv", "--out", self.path("caps.csv"))
+        with open(self.path("caps.csv"), encoding="utf-8") as f:
+            lines = f.read().splitlines()
+        self.assertEqual(lines[0], ",".join(iwcdx.FIELDS))
+        self.assertEqual(len(lines), 6)
+        self.assertEqual(self.archive.cdx_queries[0]["matchType"], "prefix")
+
+    def test_not_json_exits_2(self):
+        self.archive.fail("/cdx/search/cdx", html_error(200))
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.run_main(iwcdx, "example.org")
+        self.assertEqual(code, iwcdx.EXIT_QUERY_FAILED)
+
+
+class WaybackFetchTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.snapshots = {("20240101000000", "https://example.org/"): b"<html>home</html>",
+                                  ("20240301000000", "https://example.org/a?b=1"): b"<html>a</html>"}
+        rows = [{"timestamp": "20240101000000", "original": "https://example.org/", "mimetype": "text/html", "digest": "HOME"},
+                {"timestamp": "20240201000000", "original": "https://example.org/", "mimetype": "text/html", "digest": "HOME"},
+                {"timestamp": "20240301000000", "original": "https://example.org/a?b=1", "mimetype": "text/html", "digest": "A"}]
+        with open(self.path("caps.ndjson"), "w", encoding="utf-8") as f:
+            f.writelines(json.dumps(row) + "\n" for row in rows)
+
+    def fetch(self, *argv):
+        return self.run_main(iwf, self.path("caps.ndjson"), "--dest", self.path("web"), *argv)
+
+    def test_host_path_timestamp_layout_without_duplicates(self):
+        code, out = self.fetch()
+        self.assertEqual(code, iwf.EXIT_OK)
+        self.assertIn("2 capture(s) downloaded, 0 already there, 1 duplicate(s) skipped, 0 failed", out)
+        with open(self.path("web", "example.org", "20240101000000"), "rb") as f:
+            self.assertEqual(f.read(), b"<html>home</html>")
+        self.assertTrue(os.path.exists(self.path("web", "example.org", "a?b=1", "20240301000000")))
+        self.assertNotIn(("/web/20240201000000id_/https://example.org/", None), self.archive.requests)
+        code, out = self.fetch()
+        self.assertIn("0 capture(s) downloaded, 2 already there", out)
+
+    def test_warc_records(self):
+        self.fetch("--warc", self.path("out.warc.gz"))
+        with gzip.open(self.path("out.warc.gz"), "rb") as f:
+            warc = f.read()
+        self.assertEqual(warc.count(b"WARC/1.0\r\n"), 3)
+        self.assertIn(b"WARC-Type: warcinfo", warc)
+        self.assertIn(b"WARC-Target-URI: https://example.org/a?b=1\r\n", warc)
+        self.assertIn(b"WARC-Date: 2024-01-01T00:00:00Z\r\n", warc)
+        self.assertIn(b"Content-Length: 17\r\n\r\n<html>home</html>\r\n\r\n", warc)
+
+    def test_missing_capture_exits_3(self):
+        del self.archive.snapshots[("20240301000000", "https://example.org/a?b=1")]
+        with self.assertLogs(level="ERROR"):
+            code, out = self.fetch()
+        self.assertEqual(code, iwf.EXIT_SOME_FAILED)
+        self.assertIn("1 failed", out)
+
+
+class WaybackAvailableTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.archive.snapshots = {("20190101000000", "https://example.org/"): b"", ("20240101000000", "https://example.org/"): b""}
+
+    def results(self, *argv):
+        code, out = self.run_main(iwa, "https://example.org/", "https://gone.example/", *argv)
+        return code, [json.loads(line) for line in out.splitlines()]
+
+    def test_closest_capture_or_not_archived(self):
+        code, results = self.results()
+        self.assertEqual(code, iwa.EXIT_OK)
+        self.assertEqual(results, [
+            {"url": "https://example.org/", "archived": True, "timestamp": "20240101000000",
+             "snapshot": "http://web.archive.org/web/20240101000000/https://example.org/", "status": "200"},
+            {"url": "https://gone.example/", "archived": False}])
+
+    def test_before_and_after(self):
+        _, results = self.results("--before", "2020")
+        self.assertEqual(results[0]["timestamp"], "20190101000000")
+        self.assertIn({"url": "https://example.org/", "timestamp": "2020", "closest": "before"}, self.archive.availability_queries)
+        _, results = self.results("--after", "2019-06", "--before", "2023")
+        self.assertFalse(results[0]["archived"])
+
+    def test_csv_and_a_failed_lookup(self):
+        self.archive.fail("/wayback/available", status(404))
+        with self.assertLogs(level="ERROR"):
+            code, _ = self.run_main(iwa, "https://example.org/", "https://gone.example/", "--format", "csv", "--workers", "1",
+                                    "--out", self.path("out.csv"))
+        self.assertEqual(code, iwa.EXIT_SOME_FAILED)
+        with open(self.path("out.csv"), encoding="utf-8") as f:
+            rows = list(csv.DictReader(f))
+        self.assertEqual([(r["url"], r["archived"], r["error"] != "") for r in rows],
+                         [("https://example.org/", "", True), ("https://gone.example/", "False", False)])
+
+
+class SavePageNowTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.enterContext(mock.patch.dict("os.environ", {"IA_ACCESS_KEY": "key", "IA_SECRET_KEY": "hunter2"}))
+
+    def results(self, out):
+        return {r["url"]: r for r in map(json.loads, out.splitlines())}
+
+    def test_saves_and_reports_each_url(self):
+        self.archive.spn_refusals["https://blocked.example/"] = "error:blocked-url"
+        self.archive.spn_outcomes["https://robots.example/"] = {"status": "error", "status_ext": "error:robots-txt", "message": "robots"}
+        with mock.patch("sys.stdin", io.StringIO("https://blocked.example/\nhttps://robots.example/\n")):
+            code, out = self.run_main(spn, "https://example.org/", "--urls-file", "-", "--capture-outlinks")
+        self.assertEqual(code, spn.EXIT_SOME_FAILED)
+        results = self.results(out)
+        self.assertEqual(results["https://example.org/"]["snapshot"], f"{self.archive.url}/web/20261014120000/https://example.org/")
+        self.assertEqual(results["https://blocked.example/"]["status_ext"], "error:blocked-url")
+        self.assertEqual((results["https://robots.example/"]["status"], results["https://robots.example/"]["status_ext"]),
+                         ("error", "error:robots-txt"))
+        self.assertEqual(self.archive.spn_submissions[0]["capture_outlinks"], "1")
+
+    def test_waits_while_the_account_is_busy(self):
+        self.archive.spn_busy = 2
+        code, out = self.run_main(spn, "https://example.org/", "--format", "text")
+        self.assertEqual((code, out), (spn.EXIT_OK, f"{self.archive.url}/web/20261014120000/https://example.org/\n"))
+        self.assertEqual(len(self.archive.spn_submissions), 3)
+
+    def test_daily_quota_stops_the_rest(self):
+        self.archive.spn_refusals["https://a.example/"] = spn.DAILY_LIMIT
+        code, out = self.run_main(spn, "https://a.example/", "https://b.example/", "--concurrency", "1")
+        self.assertEqual(code, spn.EXIT_RATE_LIMITED)
+        self.assertEqual([r["status_ext"] for r in self.results(out).values()], [spn.DAILY_LIMIT] * 2)
+        self.assertEqual(len(self.archive.spn_submissions), 1)
+
+    def test_needs_the_keys(self):
+        environ = self.enterContext(mock.patch.dict("os.environ", {"HOME": self.tmp.name}))
+        for name in ("IA_ACCESS_KEY", "IA_SECRET_KEY", "IA_CONFIG_FILE"):
+            environ.pop(name, None)
+        with contextlib.redirect_stderr(io.StringIO()) as err:
+            code, _ = self.run_main(spn, "https://example.org/")
+        self.assertEqual(code, 2)
+        self.assertIn("needs your IAS3 keys", err.getvalue())
+        self.assertEqual(self.archive.spn_submissions, [])
+
+
+class UploadTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.enterContext(mock.patch.dict("os.environ", {"IA_ACCESS_KEY": "key", "IA_SECRET_KEY": "hunter2"}))
+        self.files = []
+        for name, data in (("disc.iso", DISC), ("notes.txt", README)):
+            with open(self.path(name), "wb") as f:
+                f.write(data)
+            self.files.append(self.path(name))
+
+    def upload(self, *argv):
+        return self.run_main(iau, "new-item", *self.files, "-m", "title=New item", "-m", "subject=linux", "-m", "subject=iso", *argv)
+
+    def test_uploads_each_file_with_the_metadata_on_the_first(self):
+        code, out = self.upload("--no-derive")
+        self.assertEqual(code, iau.EXIT_OK)
+        self.assertIn("2 of 2 file(s) uploaded", out)
+        first, second = self.archive.uploads[("new-item", "disc.iso")], self.archive.uploads[("new-item", "notes.txt")]
+        self.assertEqual((first["data"], second["data"]), (DISC, README))
+        self.assertEqual(first["headers"]["Authorization"], "LOW key:hunter2")
+        self.assertEqual(first["headers"]["x-archive-meta02-subject"], "iso")
+        self.assertEqual(first["headers"]["x-archive-size-hint"], str(len(DISC) + len(README)))
+        self.assertNotIn("x-archive-meta-title", second["headers"])
+        self.assertEqual(second["headers"]["x-archive-queue-derive"], "0")
+
+    def test_slow_down_is_retried(self):
+        self.archive.fail("/s3/new-item/disc.iso", status(503, retry_after=3, body=b"<Error><Code>SlowDown</Code></Error>"))
+        with self.assertLogs(level="WARNING") as logs:
+            code, _ = self.upload()
+        self.assertEqual(code, iau.EXIT_OK)
+        self.assertIn("HTTP 503; retrying in 3.0s (1/5)", logs.output[0])
+        self.assertEqual(self.archive.uploads[("new-item", "disc.iso")]["data"], DISC)
+
+    def test_large_file_goes_in_parts(self):
+        code, _ = self.upload("--multipart-size", "1M", "--part-size", "5M")
+        self.assertEqual(code, iau.EXIT_OK)
+        self.assertEqual(self.archive.uploads[("new-item", "disc.iso")]["data"], DISC)
+        requests_sent = [(method, path.partition("?")[2].partition("=")[0]) for method, path, _ in self.archive.s3_requests]
+        self.assertEqual(requests_sent[:3], [("POST", "uploads"), ("PUT", "partNumber"), ("POST", "uploadId")])
+
+    def test_dry_run_sends_nothing_and_hides_the_secret(self):
+        code, out = self.upload("--dry-run")
+        self.assertEqual(code, 0)
+        self.assertEqual(self.archive.s3_requests, [])
+        self.assertIn(f"PUT {self.archive.url}/s3/new-item/disc.iso", out)
+        self.assertIn("Authorization: LOW key:<secret>", out)
+        self.assertIn("x-archive-meta-title: New item", out)
+        self.assertNotIn("hunter2", out)
+
+    def test_no_keys_no_upload(self):
+        os.environ.pop("IA_ACCESS_KEY")
+        self.enterContext(mock.patch.object(iau, "s3_credentials", return_value=None))
+        with contextlib.redirect_stderr(io.StringIO()) as err:
+            code, _ = self.upload()
+        self.assertEqual(code, 2)
+        self.assertIn("uploading needs IAS3 keys", err.getvalue())
+        self.assertEqual(self.archive.s3_requests, [])
+
+
+
+class CopyTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.enterContext(mock.patch.dict("os.environ", {"IA_ACCESS_KEY": "key", "IA_SECRET_KEY": "hunter2"}))
+
+    def test_copies_the_matching_files_waits_and_verifies(self):
+        self.archive.task_catalog = [[{"task_id": 1, "identifier": "distros-all", "cmd": "archive.php", "wait_admin": 1}], []]
+        code, out = self.run_main(iacp, "distro-1.0/*.iso", "distros-all/isos/", "--interval", "5")
+        self.assertEqual(code, iacp.EXIT_OK)
+        self.assertEqual(out.splitlines(), [f"[1/1] distro-1.0/distro-1.0.iso -> distros-all/isos/distro-1.0.iso ({ia_common.format_size(len(DISC))})",
+                                            "1 of 1 file(s) copied to " + f"{ia_common.ARCHIVE_URL}/details/distros-all",
+                                            "1 of 1 copies verified against distros-all's metadata"])
+        (method, path, headers), = self.archive.s3_requests
+        self.assertEqual((method, path, headers["x-amz-copy-source"], headers["Authorization"]),
+                         ("PUT", "/s3/distros-all/isos/distro-1.0.iso", "/distro-1.0/distro-1.0.iso", "LOW key:hunter2"))
+        self.assertEqual(self.sleep.call_args_list, [mock.call(5)])
+
+    def test_a_file_can_be_renamed_and_a_missing_copy_fails_verification(self):
+        code, out = self.run_main(iacp, "distro-2.0", "distro-2.0/copy.img", "--glob", "*.img", "--no-derive")
+        self.assertEqual(code, iacp.EXIT_OK)
+        self.assertEqual(self.archive.uploads[("distro-2.0", "copy.img")]["headers"]["x-archive-queue-derive"], "0")
+        self.archive.fail("/metadata/distro-2.0", status(200, body=json.dumps({"metadata": {"identifier": "distro-2.0"}, "files": []}).encode()))
+        with self.assertLogs(level="ERROR") as logs:
+            code, out = self.run_main(iacp, "distro-1.0/README.txt", "distro-2.0")
+        self.assertEqual(code, iacp.EXIT_VERIFY_FAILED)
+        self.assertIn("0 of 1 copies verified", out)
+        self.assertIn("Not verified: README.txt: not in distro-2.0's metadata", logs.output[0])
+
+    def test_unfinished_tasks_exit_6_without_verifying(self):
+        self.archive.task_catalog = [[{"task_id": 1, "identifier": "new-item", "cmd": "archive.php", "wait_admin": 1}]]
+        with self.assertLogs(level="WARNING") as logs:
+            code, out = self.run_main(iacp, "distro-1.0/README.txt", "new-item", "--wait-timeout", "0", "--interval", "1")
+        self.assertEqual(code, iacp.EXIT_WAIT_TIMEOUT)
+        self.assertNotIn("verified", out)
+        self.assertIn("not waiting any longer", logs.output[-1])
+        self.assertNotIn("/metadata/new-item", self.archive.paths())
+
+    def test_dry_run_prints_the_requests_and_sends_none(self):
+        code, out = self.run_main(iacp, "distro-1.0", "renamed", "--glob", "*.iso|*.txt", "--dry-run", "--no-derive")
+        self.assertEqual(code, 0)
+        self.assertIn("PUT " + ia_common.S3_URL, out)
+        self.assertIn("  x-amz-copy-source: /distro-1.0/README.txt\n", out)
+        self.assertIn("  Authorization: LOW key:<secret>", out)
+        self.assertNotIn("hunter2", out)
+        self.assertEqual(self.archive.s3_requests, [])
+
+
+class ModifyMetadataTest(EndToEndTest):
+    def setUp(self):
+        super().setUp()
+        self.enterContext(mock.patch.dict("os.environ", {"IA_ACCESS_KEY": "key", "IA_SECRET_KEY": "hunter2"}))
+
+    def test_patch_is_applied_and_the_task_reported(self):
+        code, out = self.run_main(iamm, "distro-1.0", "--set", "title=Distro 1.0.1", "--append", "subject=linux")
+        self.assertEqual(code, 0)
+        self.assertIn("distro-1.0: 2 change(s) accepted, task 1001 queued", out)
+        self.assertEqual(self.archive.items["distro-1.0"]["metadata"], {"title": "Distro 1.0.1", "subject": ["linux"]})
+        self.assertEqual((self.archive.writes[0]["-target"], self.archive.writes[0]["access"]), ("metadata", "key"))
+
+    def test_dry_run_prints_the_patch(self):
+        code, out = self.run_main(iamm, "distro-1.0", "--remove", "title", "--dry-run")
+        self.assertEqual(code, 0)
+        self.assertEqual(json.loads(out.split("\n", 1)[1]), [{"op": "remove", "path": "/title"}])
+        self.assertEqual(self.archive.writes, [])
+
+    def test_refused_patch_exits_3(self):
+        # the read goes through, the write is refused
+        self.archive.fail("/metadata/distro-1.0", None, status(400, body=b'{"success": false, "error": "bad value"}'))
+        with self.assertLogs(level="ERROR") as logs:
+            code, _ = self.run_main(iamm, "distro-1.0", "--set", "title=x")
+        self.assertEqual(code, iamm.EXIT_WRITE_FAILED)
+        self.assertIn("archive.org refused the patch: bad value", logs.output[0])
+
+
+
+class TasksTest(EndToEndTest):
+    DERIVE = {"task_id": 11, "identifier": "distro-1.0", "cmd": "derive.php", "submitter": "me@example.org",
+              "submittime": "2024-05-01 10:00:00"}
+
+    def setUp(self):
+        super().setUp()
+        self.enterContext(mock.patch.dict("os.environ", {"IA_ACCESS_KEY": "key", "IA_SECRET_KEY": "hunter2"}))
+
+    def test_history_is_followed_across_pages(self):
+        self.archive.task_catalog = [[dict(self.DERIVE, wait_admin=1)]]
+        self.archive.task_history = [dict(self.DERIVE, task_id=n, finished="2024-04-01 10:00:00") for n in range(1, 4)]
+        code, out = self.run_main(iat, "distro-1.0", "--history", "--json")
+        self.assertEqual(code, iat.EXIT_OK)
+        self.assertEqual([(t["task_id"], t["status"]) for t in json.loads(out)],
+                         [(11, "running"), (1, "finished"), (2, "finished"), (3, "finished")])
+
+    def test_wait_polls_until_the_queue_is_empty(self):
+        self.archive.task_catalog = [[dict(self.DERIVE, wait_admin=0)], [dict(self.DERIVE, wait_admin=1)], []]
+        code, out = self.run_main(iat, "distro-1.0", "--wait", "--interval", "5")
+        self.assertEqual((code, out.strip()), (iat.EXIT_OK, "No tasks"))
+        self.assertEqual(self.sleep.call_args_list, [mock.call(5), mock.call(5)])
+
+    def test_errored_task_exits_3(self):
+        self.archive.task_catalog = [[dict(self.DERIVE, wait_admin=2)]]
+        code, out = self.run_main(iat, "distro-1.0")
+        self.assertEqual(code, iat.EXIT_TASK_ERROR)
+        self.assertIn("error", out.splitlines()[1])
+
+    def test_wait_gives_up_at_the_timeout(self):
+        self.archive.task_catalog = [[dict(self.DERIVE, wait_admin=0)]]
+        with self.assertLogs(level="WARNING"):
+            code, out = self.run_main(iat, "distro-1.0", "--wait", "--wait-timeout", "10s", "--interval", "30s")
+        self.assertEqual(code, iat.EXIT_WAIT_TIMEOUT)
+        self.assertIn("queued", out)
+        self.sleep.assert_not_called()
+
+
+if __name__ == "__main__":
+    unittest.main()
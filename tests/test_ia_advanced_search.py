@@ -0,0 +1,100 @@
+import argparse
+import unittest
+
+from _scripts import load_script
+
+ias = load_script("IA-Advanced-Search-v2.py")
+ias_v1 = load_script("IA-Advanced-Search.py")
+
+BASE = "https://archive.org/download"
+
+
+class DownloadUrlTest(unittest.TestCase):
+    CASES = [
+        ("plain.iso", f"{BASE}/item/plain.iso"),
+        ("Disk 1 (50%).img", f"{BASE}/item/Disk%201%20%2850%25%29.img"),
+        ("a#b.iso", f"{BASE}/item/a%23b.iso"),
+        ("what?.iso", f"{BASE}/item/what%3F.iso"),
+        ("c++ tools.zip", f"{BASE}/item/c%2B%2B%20tools.zip"),
+        ("Ünïcode-日本.iso", f"{BASE}/item/%C3%9Cn%C3%AFcode-%E6%97%A5%E6%9C%AC.iso"),
+        ("disk1/read me.txt", f"{BASE}/item/disk1/read%20me.txt"),
+    ]
+
+    def test_escapes_each_segment(self):
+        for name, want in self.CASES:
+            with self.subTest(name=name):
+                self.assertEqual(ias.download_url("item", name), want)
+
+    def test_v1_matches_v2(self):
+        for name, want in self.CASES:
+            with self.subTest(name=name):
+                self.assertEqual(ias_v1.download_url("item", name), want)
+
+    def test_escapes_identifier(self):
+        self.assertEqual(ias.download_url("odd id#1", "f.iso"), f"{BASE}/odd%20id%231/f.iso")
+
+
+class ExtensionListTest(unittest.TestCase):
+    def test_dots_case_and_spaces_do_not_matter(self):
+        self.assertEqual(ias.extension_list("ISO, .img,tar.XZ"), (".iso", ".img", ".tar.xz"))
+
+    def test_empty_or_star_is_every_file(self):
+        for value in ("", "*", " * "):
+            with self.subTest(value=value):
+                self.assertEqual(ias.extension_list(value), ())
+
+    def test_only_commas_is_refused(self):
+        with self.assertRaises(argparse.ArgumentTypeError):
+            ias.extension_list(", .,")
+
+
+class FileEntryTest(unittest.TestCase):
+    def test_size_is_a_number_in_any_form_the_metadata_gives(self):
+        for size, want in (("734003200", 734003200), (7.342e8, 734200000), ("7.342E8", 734200000), (None, None), ("n/a", None)):
+            with self.subTest(size=size):
+                self.assertEqual(ias.file_entry("item", "Item", {"name": "a.iso", "size": size})["size"], want)
+
+    def test_format_and_checksums_only_when_the_metadata_has_them(self):
+        entry = ias.file_entry("item", "Item", {"name": "a.iso", "format": "ISO Image", "md5": "d41d", "sha1": "", "crc32": None})
+        self.assertEqual({k: entry[k] for k in entry if k in ias.FILE_FIELDS}, {"format": "ISO Image", "md5": "d41d"})
+
+
+class SearchQueryTest(unittest.TestCase):
+    def query(self, **kwargs):
+        return ias.search_query(argparse.Namespace(**dict({"query": "mediatype:software", "collection": [], "mediatype": None,
+                                                           "since": None, "until": None, "date_field": "publicdate"}, **kwargs)))
+
+    def test_range_is_anded_onto_the_query(self):
+        self.assertEqual(self.query(since="2023-01-01", until="2024-06-30"),
+                         "(mediatype:software) AND publicdate:[2023-01-01 TO 2024-06-30]")
+
+    def test_one_end_leaves_the_other_open(self):
+        self.assertEqual(self.query(since="2023-01-01", date_field="addeddate"), "(mediatype:software) AND addeddate:[2023-01-01 TO null]")
+        self.assertEqual(self.query(until="2024-06-30"), "(mediatype:software) AND publicdate:[null TO 2024-06-30]")
+
+    def test_without_dates_the_query_is_left_alone(self):
+        self.assertEqual(self.query(), "mediatype:software")
+
+    def test_collections_are_any_of_them_and_the_mediatype_and_the_query(self):
+        self.assertEqual(self.query(collection=["librivoxaudio", "opensource_audio"], mediatype="audio", query="poe"),
+                         "(collection:librivoxaudio OR collection:opensource_audio) AND mediatype:audio AND (poe)")
+        self.assertEqual(self.query(collection=["librivoxaudio"], query="poe", until="2024-06-30"),
+                         "collection:librivoxaudio AND (poe) AND publicdate:[null TO 2024-06-30]")
+
+    def test_collection_or_mediatype_alone_is_the_query(self):
+        self.assertEqual(self.query(query=None, mediatype="audio"), "mediatype:audio")
+        self.assertEqual(self.query(query="", collection=["librivoxaudio"]), "collection:librivoxaudio")
+
+    def test_without_any_the_default_query(self):
+        self.assertEqual(self.query(query=None), ias.DEFAULT_QUERY)
+        self.assertEqual(self.query(query=None, since="2023-01-01"), f"({ias.DEFAULT_QUERY}) AND publicdate:[2023-01-01 TO null]")
+
+    def test_day_must_be_a_date(self):
+        self.assertEqual(ias.day("2024-02-29"), "2024-02-29")
+        for value in ("2023-02-29", "2024-6-30", "30/06/2024", "2024-06-30T00:00:00Z"):
+            with self.subTest(value=value), self.assertRaises(argparse.ArgumentTypeError):
+                ias.day(value)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,1304 @@
+import argparse
+import contextlib
+import io
+import itertools
+import json
+import logging
+import os
+import random
+import shutil
+import subprocess
+import tempfile
+import threading
+import time
+import unittest
+from email.utils import formatdate
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from unittest import mock
+
+import requests
+
+import _scripts  # noqa: F401  (puts the repository root on sys.path)
+from fakearchive import FakeArchive, status
+import ia_common
+
+
+class ParseHumanSizeTest(unittest.TestCase):
+    def test_units_are_1024_based(self):
+        self.assertEqual(ia_common.parse_human_size("1024"), 1024)
+        self.assertEqual(ia_common.parse_human_size("300MB"), 300 * 1024 ** 2)
+        self.assertEqual(ia_common.parse_human_size("5g"), 5 * 1024 ** 3)
+        self.assertEqual(ia_common.parse_human_size("1.5GiB"), int(1.5 * 1024 ** 3))
+        self.assertEqual(ia_common.parse_human_size(" 2 K "), 2048)
+
+    def test_rejects_garbage(self):
+        for value in ("", "MB", "5X", "-1M", "1e3"):
+            with self.subTest(value=value), self.assertRaises(argparse.ArgumentTypeError):
+                ia_common.parse_human_size(value)
+
+
+class ParseSizeTest(unittest.TestCase):
+    def test_metadata_spellings(self):
+        self.assertEqual(ia_common.parse_size("1234"), 1234)
+        self.assertEqual(ia_common.parse_size(1234), 1234)
+        self.assertEqual(ia_common.parse_size("1234.0"), 1234)
+
+    def test_unknown(self):
+        for value in (None, "", "n/a", "inf", "1e400"):
+            with self.subTest(value=value):
+                self.assertIsNone(ia_common.parse_size(value))
+
+
+class SizeInRangeTest(unittest.TestCase):
+    def test_bounds(self):
+        self.assertTrue(ia_common.size_in_range(10, None, None, False))
+        self.assertTrue(ia_common.size_in_range(10, 10, 10, False))
+        self.assertFalse(ia_common.size_in_range(9, 10, None, True))
+        self.assertFalse(ia_common.size_in_range(11, None, 10, True))
+
+    def test_unknown_follows_keep_unknown(self):
+        self.assertTrue(ia_common.size_in_range(None, 10, 20, True))
+        self.assertFalse(ia_common.size_in_range(None, 10, 20, False))
+
+
+class FormatSizeTest(unittest.TestCase):
+    def test_units(self):
+        self.assertEqual(ia_common.format_size(None), "?")
+        self.assertEqual(ia_common.format_size(512), "512.0B")
+        self.assertEqual(ia_common.format_size(1536), "1.5KB")
+        self.assertEqual(ia_common.format_size(3 * 1024 ** 5), "3072.0TB")
+
+
+class WaybackTimestampTest(unittest.TestCase):
+    def test_dates_become_digits(self):
+        self.assertEqual(ia_common.wayback_timestamp("2024"), "2024")
+        self.assertEqual(ia_common.wayback_timestamp("2024-05-01"), "20240501")
+        self.assertEqual(ia_common.wayback_timestamp("2024-05-01T12:30:00"), "20240501123000")
+
+    def test_rejects_anything_else(self):
+        for value in ("May 2024", "202405011230001", ""):
+            with self.assertRaises(argparse.ArgumentTypeError):
+                ia_common.wayback_timestamp(value)
+
+
+class VersionTest(unittest.TestCase):
+    def setUp(self):
+        ia_common.build_info.cache_clear()
+        self.addCleanup(ia_common.build_info.cache_clear)
+
+    def test_revision_from_git_or_the_packaging_step(self):
+        rev, _ = ia_common.build_info()
+        self.assertRegex(rev, r"^[0-9a-f]{12}$")
+        self.assertTrue(ia_common.full_version("1.0").startswith(f"1.0+g{rev}"))
+        ia_common.build_info.cache_clear()
+        with mock.patch.object(ia_common, "BUILD_REVISION", "abc123"):
+            self.assertEqual(ia_common.full_version("1.0"), "1.0+gabc123")
+            self.assertIn("revision abc123\n", ia_common.version_text("IA-Thing", "1.0"))
+        ia_common.build_info.cache_clear()
+        with mock.patch.object(ia_common.subprocess, "run", side_effect=FileNotFoundError("git")):
+            self.assertEqual(ia_common.full_version("1.0"), "1.0")
+            self.assertIn("revision unknown", ia_common.version_text("IA-Thing", "1.0"))
+
+    def test_version_flag(self):
+        with mock.patch.object(ia_common, "BUILD_REVISION", "abc123"), contextlib.redirect_stdout(io.StringIO()) as out:
+            with self.assertRaises(SystemExit) as cm:
+                ia_common.parse_args(argparse.ArgumentParser(), "/x/IA-Thing.py", ["--version"], version="1.2")
+        self.assertEqual(cm.exception.code, 0)
+        self.assertTrue(out.getvalue().startswith("IA-Thing 1.2+gabc123\nrevision abc123\nPython "))
+
+
+class UserAgentTest(unittest.TestCase):
+    def test_name_version_and_contact(self):
+        with mock.patch.object(ia_common, "full_version", return_value="1.0+gabc123"), mock.patch.dict("os.environ"):
+            os.environ.pop("IA_CONTACT", None)
+            self.assertEqual(ia_common.default_user_agent("IA-Size", "1.0"), "IA-Size/1.0+gabc123 (Internet-Archive-API) Python-requests")
+            os.environ["IA_CONTACT"] = "ops@example.org"
+            self.assertEqual(ia_common.default_user_agent("IA-Size", "1.0", "internetarchive/5.0"),
+                             "IA-Size/1.0+gabc123 (Internet-Archive-API; +ops@example.org) internetarchive/5.0")
+
+    def test_a_run_without_a_contact_is_reminded_once_past_the_threshold(self):
+        self.enterContext(mock.patch.object(ia_common, "CONTACT_WARN_REQUESTS", 3))
+        self.enterContext(mock.patch.object(ia_common, "_UNIDENTIFIED_REQUESTS", itertools.count(1)))
+        request = ia_common._contact_reminder(lambda method, url, **kwargs: url)
+        with self.assertLogs(level="WARNING") as logs:
+            self.assertEqual([request("GET", f"u{n}") for n in range(5)], [f"u{n}" for n in range(5)])
+        self.assertEqual(len(logs.output), 1)
+        self.assertIn("3 requests so far with no contact in the User-Agent; set $IA_CONTACT", logs.output[0])
+
+    def test_only_the_default_user_agent_of_a_real_run_without_a_contact_is_counted(self):
+        self.enterContext(mock.patch.dict("os.environ"))
+        os.environ.pop("IA_CONTACT", None)
+        reminded = self.enterContext(mock.patch.object(ia_common, "_contact_reminder", side_effect=lambda request: request))
+        for args in (argparse.Namespace(anonymous=True), argparse.Namespace(anonymous=True, user_agent="bot/1 (+me@example.org)"),
+                     argparse.Namespace(anonymous=True, dry_run=True)):
+            ia_common.session_from_args(args, "tool/1.0").close()
+        os.environ["IA_CONTACT"] = "ops@example.org"
+        ia_common.session_from_args(argparse.Namespace(anonymous=True), "tool/1.0").close()
+        self.assertEqual(reminded.call_count, 1)
+
+
+class CompletionTest(unittest.TestCase):
+    def parser(self):
+        p = argparse.ArgumentParser()
+        p.add_argument("--format", choices=["ndjson", "csv"])
+        p.add_argument("--dest", "-d")
+        commands = p.add_subparsers(dest="command", required=True)
+        run = commands.add_parser("run", help="Run it")
+        run.add_argument("--log-file")
+        run.add_argument("--odd", action="store_true", help="[odd] help: with 'quotes'")
+        run.add_argument("identifier")
+        commands.add_parser("status", help="Show it")
+        return p
+
+    def test_hints_come_from_the_flags(self):
+        actions = {a.dest: a for a in self.parser()._actions}
+        self.assertEqual(ia_common.complete_hint(actions["format"]), ("choices", "ndjson", "csv"))
+        self.assertEqual(ia_common.complete_hint(actions["dest"]), ("dir",))
+        self.assertIsNone(ia_common.complete_hint(actions["help"]))
+        run = ia_common._commands(self.parser())[0][2]
+        self.assertEqual([ia_common.complete_hint(a) for a in run._actions if a.dest in ("log_file", "identifier")], [("file",), ("value",)])
+
+    @unittest.skipUnless(shutil.which("bash"), "needs bash")
+    def test_bash_script_completes(self):
+        script = ia_common.completion_script(self.parser(), "IA-Thing.py", "bash")
+
+        def complete(*words):
+            line = " ".join(f"'{w}'" for w in words)
+            run = subprocess.run(["bash", "-c", f'{script}\nCOMP_WORDS=(IA-Thing.py {line}); COMP_CWORD={len(words)}; _IA_Thing_py; echo "${{COMPREPLY[*]}}"'],
+                                 capture_output=True, text=True, check=True)
+            return run.stdout.split()
+
+        self.assertEqual(complete(""), ["run", "status"])
+        self.assertEqual(complete("--format", ""), ["ndjson", "csv"])
+        self.assertEqual(complete("run", "--l"), ["--log-file"])
+        self.assertEqual(complete("status", "--l"), [])
+
+    def test_every_shell_and_the_flag(self):
+        for shell in ia_common.SHELLS:
+            script = ia_common.completion_script(self.parser(), "IA-Thing.py", shell)
+            self.assertIn("IA-Thing.py", script)
+            self.assertIn("run", script)
+        self.assertIn("'--odd[\\[odd\\] help\\: with '\\''quotes'\\'']'", ia_common.completion_script(self.parser(), "IA-Thing.py", "zsh"))
+        self.assertIn("-l odd -d '[odd] help: with \\'quotes\\''", ia_common.completion_script(self.parser(), "IA-Thing.py", "fish"))
+        # the subcommand and identifier it requires are not needed
+        with contextlib.redirect_stdout(io.StringIO()) as out, self.assertRaises(SystemExit) as cm:
+            ia_common.parse_args(self.parser(), "/x/IA-Thing.py", ["--generate-completion", "fish"])
+        self.assertEqual(cm.exception.code, 0)
+        self.assertIn("complete -c IA-Thing.py -n '__fish_use_subcommand' -l generate-completion -x -a 'bash zsh fish'", out.getvalue())
+
+
+class ParseArgsTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.config = os.path.join(tmp.name, "config.toml")
+        with open(self.config, "w", encoding="utf-8") as f:
+            f.write('retries = 9\nuser-agent = "from-config"\nmax_rps = 2.5\ndest = "ignored"\n\n[IA-Thing]\ntimeout = 99\n\n[IA-Other]\ntimeout = 1\n')
+        self.enterContext(mock.patch.dict("os.environ", {"IA_TOOLS_CONFIG": self.config}))
+        os.environ.pop("IA_USER_AGENT", None)
+
+    def parser(self):
+        p = argparse.ArgumentParser()
+        p.add_argument("--retries", type=int, default=5)
+        p.add_argument("--timeout", type=int, default=30)
+        p.add_argument("--user-agent", default=os.environ.get("IA_USER_AGENT"))
+        ia_common.add_request_rate_args(p)
+        return p
+
+    def test_flags_then_environment_then_config_then_defaults(self):
+        args = ia_common.parse_args(self.parser(), "/x/IA-Thing.py", ["--retries", "1"])
+        self.assertEqual((args.retries, args.timeout, args.user_agent, args.max_rps), (1, 99, "from-config", 2.5))
+        os.environ["IA_USER_AGENT"] = "from-env"
+        args = ia_common.parse_args(self.parser(), "IA-Other.py", [])
+        self.assertEqual((args.retries, args.timeout, args.user_agent), (9, 1, "from-env"))
+
+    def test_unknown_key_in_the_tools_own_table(self):
+        with open(self.config, "a", encoding="utf-8") as f:
+            f.write("[IA-Third]\nretires = 3\n")
+        with contextlib.redirect_stderr(io.StringIO()) as err, self.assertRaises(SystemExit):
+            ia_common.parse_args(self.parser(), "IA-Third.py", [])
+        self.assertIn("[IA-Third] sets retires", err.getvalue())
+
+    def test_print_config(self):
+        with contextlib.redirect_stdout(io.StringIO()) as out, self.assertRaises(SystemExit) as exit:
+            ia_common.parse_args(self.parser(), "IA-Thing.py", ["--print-config", "--retries=2"])
+        self.assertEqual(exit.exception.code, 0)
+        lines = out.getvalue().splitlines()
+        self.assertEqual(lines[0], f"# config file: {self.config}")
+        self.assertIn("retries = 2  # command line", lines)
+        self.assertIn('user_agent = "from-config"  # config file', lines)
+        self.assertIn("rps_burst = null  # default", lines)
+
+    def test_subcommand_defaults(self):
+        p = argparse.ArgumentParser()
+        commands = p.add_subparsers(dest="command", required=True)
+        commands.add_parser("sync").add_argument("--retries", type=int, default=5)
+        self.assertEqual(ia_common.parse_args(p, "IA-Sub.py", ["sync"]).retries, 9)
+
+
+class ReadListTest(unittest.TestCase):
+    def test_arguments_then_the_file(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            path = os.path.join(tmp, "list.txt")
+            with open(path, "w", encoding="utf-8") as f:
+                f.write("# wanted\nb  # trailing comment\n\n  c\n")
+            self.assertEqual(list(ia_common.read_list(["a"], path)), ["a", "b", "c"])
+
+    def test_stdin_only_when_nothing_else_was_given(self):
+        with mock.patch("sys.stdin", io.StringIO("x\ny\n")):
+            self.assertEqual(list(ia_common.read_list(["a"], None)), ["a"])
+            self.assertEqual(list(ia_common.read_list([], None)), ["x", "y"])
+
+
+class MatchesGlobTest(unittest.TestCase):
+    def test_no_pattern_matches_everything(self):
+        self.assertTrue(ia_common.matches_glob("scans/page001.jpg", None))
+        self.assertTrue(ia_common.matches_glob("scans/page001.jpg", ""))
+
+    def test_plain_pattern_matches_base_name(self):
+        self.assertTrue(ia_common.matches_glob("page001.jpg", "*.jpg"))
+        self.assertTrue(ia_common.matches_glob("scans/page001.jpg", "*.jpg"))
+        self.assertTrue(ia_common.matches_glob("a/b/c/page001.jpg", "page???.jpg"))
+        self.assertFalse(ia_common.matches_glob("scans/page001.jpg.txt", "*.jpg"))
+        self.assertFalse(ia_common.matches_glob("scans.jpg/readme.txt", "*.jpg"))
+
+    def test_pattern_with_separator_matches_full_path(self):
+        self.assertTrue(ia_common.matches_glob("scans/page001.jpg", "scans/*.jpg"))
+        self.assertFalse(ia_common.matches_glob("scans/extra/page001.jpg", "scans/*.jpg"))
+        self.assertFalse(ia_common.matches_glob("other/scans/page001.jpg", "scans/*.jpg"))
+
+    def test_double_star(self):
+        for name in ("scans/page001.jpg", "scans/a/page001.jpg", "scans/a/b/page001.jpg"):
+            with self.subTest(name=name):
+                self.assertTrue(ia_common.matches_glob(name, "scans/**/*.jpg"))
+        self.assertTrue(ia_common.matches_glob("x/y/z.jpg", "**/*.jpg"))
+        self.assertTrue(ia_common.matches_glob("z.jpg", "**/*.jpg"))
+        self.assertTrue(ia_common.matches_glob("scans/a/b", "scans/**"))
+        self.assertFalse(ia_common.matches_glob("other/page001.jpg", "scans/**/*.jpg"))
+
+    def test_windows_separators(self):
+        self.assertTrue(ia_common.matches_glob("scans\\page001.jpg", "*.jpg"))
+        self.assertTrue(ia_common.matches_glob("scans\\sub\\page001.jpg", "scans/**/*.jpg"))
+        self.assertTrue(ia_common.matches_glob("scans/page001.jpg", "scans\\*.jpg"))
+
+    def test_case_insensitive(self):
+        self.assertTrue(ia_common.matches_glob("Scans/PAGE001.JPG", "*.jpg"))
+        self.assertTrue(ia_common.matches_glob("scans/page001.jpg", "SCANS/*.JPG"))
+
+    def test_alternatives_and_classes(self):
+        self.assertTrue(ia_common.matches_glob("disk.img", "*.iso|*.img"))
+        self.assertFalse(ia_common.matches_glob("disk.bin", "*.iso|*.img"))
+        self.assertTrue(ia_common.matches_glob("page1.jpg", "page[0-9].jpg"))
+        self.assertFalse(ia_common.matches_glob("pagex.jpg", "page[0-9].jpg"))
+        self.assertTrue(ia_common.matches_glob("pagex.jpg", "page[!0-9].jpg"))
+
+    def test_regex_characters_are_literal(self):
+        self.assertTrue(ia_common.matches_glob("a+b (1).txt", "a+b (1).txt"))
+        self.assertFalse(ia_common.matches_glob("axb.txt", "a.b.txt"))
+
+
+def select_args(**overrides):
+    args = dict(glob=None, min_size=None, max_size=None, keep_unknown_size=True, include_housekeeping=False)
+    args.update(overrides)
+    return argparse.Namespace(**args)
+
+
+class DefaultExcludesTest(unittest.TestCase):
+    FILES = [{"name": n, "size": "10"} for n in (
+        "disc.iso", "__ia_thumb.jpg", "item_archive.torrent", "item_meta.sqlite",
+        "item.thumbs/item_000001.jpg", "scans_thumbs/page001.jpg", "scans/page001.jpg", "other_archive.torrent",
+    )]
+
+    def names(self, files):
+        return [f["name"] for f in files]
+
+    def test_housekeeping_suppressed_after_user_filters(self):
+        selected, suppressed = ia_common.select_files(self.FILES, select_args(), "item")
+        self.assertEqual(self.names(selected), ["disc.iso", "scans/page001.jpg", "other_archive.torrent"])
+        self.assertEqual(self.names(suppressed), ["__ia_thumb.jpg", "item_archive.torrent", "item_meta.sqlite",
+                                                  "item.thumbs/item_000001.jpg", "scans_thumbs/page001.jpg"])
+
+    def test_suppressed_only_lists_files_the_user_selected(self):
+        selected, suppressed = ia_common.select_files(self.FILES, select_args(glob="*.jpg"), "item")
+        self.assertEqual(self.names(selected), ["scans/page001.jpg"])
+        self.assertEqual(self.names(suppressed), ["__ia_thumb.jpg", "item.thumbs/item_000001.jpg", "scans_thumbs/page001.jpg"])
+
+    def test_include_housekeeping(self):
+        selected, suppressed = ia_common.select_files(self.FILES, select_args(include_housekeeping=True), "item")
+        self.assertEqual(self.names(selected), self.names(self.FILES))
+        self.assertEqual(suppressed, [])
+
+    def test_patterns_name_the_item(self):
+        self.assertIn("item_archive.torrent", ia_common.default_excludes("item"))
+
+
+class SelectFilesTest(unittest.TestCase):
+    FILES = [
+        {"name": "small.iso", "size": "100"},
+        {"name": "big.iso", "size": "5000"},
+        {"name": "notes.txt", "size": "300"},
+        {"name": "unknown.iso"},
+    ]
+
+    def names(self, **overrides):
+        return [f["name"] for f in ia_common.select_files(self.FILES, select_args(**overrides), "item")[0]]
+
+    def test_size_bounds_are_inclusive(self):
+        self.assertEqual(self.names(min_size=300), ["big.iso", "notes.txt", "unknown.iso"])
+        self.assertEqual(self.names(max_size=300), ["small.iso", "notes.txt", "unknown.iso"])
+        self.assertEqual(self.names(min_size=100, max_size=300), ["small.iso", "notes.txt", "unknown.iso"])
+
+    def test_unknown_sizes_can_be_dropped(self):
+        self.assertEqual(self.names(min_size=1, keep_unknown_size=False), ["small.iso", "big.iso", "notes.txt"])
+        self.assertEqual(self.names(keep_unknown_size=False), ["small.iso", "big.iso", "notes.txt"])
+
+    def test_glob_and_size_combine(self):
+        self.assertEqual(self.names(glob="*.iso", max_size=1000), ["small.iso", "unknown.iso"])
+        self.assertEqual(self.names(glob="*.iso", max_size=1000, keep_unknown_size=False), ["small.iso"])
+
+
+class FakeResponse:
+    def __init__(self, status_code=200, data=None, text=None):
+        self.status_code = status_code
+        self.text = text if text is not None else json.dumps(data)
+
+    def json(self):
+        return json.loads(self.text)
+
+
+class FakeSearchSession:
+    """Serves advancedsearch pages of docs; pages listed in fail answer with a 503."""
+
+    def __init__(self, identifiers, fail=()):
+        self.identifiers = identifiers
+        self.fail = fail
+        self.requested = []
+
+    def get(self, url, params=None):
+        page, rows = params["page"], params["rows"]
+        self.requested.append(page)
+        if page in self.fail:
+            return FakeResponse(503, text="busy")
+        docs = [{"identifier": i} for i in self.identifiers[(page - 1) * rows: page * rows]]
+        return FakeResponse(data={"response": {"numFound": len(self.identifiers), "start": (page - 1) * rows, "docs": docs}})
+
+
+class RedactTest(unittest.TestCase):
+    def test_credential_headers_keep_only_their_scheme(self):
+        self.assertEqual(ia_common.redact_header("Authorization", "LOW key:hunter2"), "LOW <redacted>")
+        self.assertEqual(ia_common.redact_header("Cookie", "logged-in-sig=abc; logged-in-user=me"), "<redacted>")
+        self.assertEqual(ia_common.redact_header("User-Agent", "IA-Size/1.0"), "IA-Size/1.0")
+
+    def test_keys_in_a_form_body(self):
+        self.assertEqual(ia_common.redact_form(b"-target=metadata&access=key&secret=hunter2&-patch=%5B%5D"),
+                         b"-target=metadata&access=<redacted>&secret=<redacted>&-patch=%5B%5D")
+
+
+class StatusOfTest(unittest.TestCase):
+    def test_wait_admin_codes(self):
+        self.assertEqual([ia_common.status_of({"wait_admin": code}) for code in (0, "1", 2, 9, 5)],
+                         ["queued", "running", "error", "paused", "unknown"])
+
+    def test_finished_rows(self):
+        self.assertEqual(ia_common.status_of({"wait_admin": 0, "finished": "2024-05-01 10:00:00"}), "finished")
+        self.assertEqual(ia_common.status_of({}), "unknown")
+
+
+@mock.patch("ia_common.time.sleep")
+class SearchResultsTest(unittest.TestCase):
+    IDS = [f"item{n}" for n in range(5)]
+
+    def test_iterates_docs_across_pages(self, sleep):
+        session = FakeSearchSession(self.IDS)
+        results = ia_common.SearchResults(session, "q", ["identifier"], rows=2, sleep=0.5)
+        self.assertEqual([d["identifier"] for d in results], self.IDS)
+        self.assertEqual((results.num_found, results.total_pages), (5, 3))
+        self.assertEqual(session.requested, [1, 2, 3])
+        self.assertEqual(sleep.call_args_list, [mock.call(0.5)] * 2)
+
+    def test_pages_and_max_pages(self, sleep):
+        results = ia_common.SearchResults(FakeSearchSession(self.IDS), "q", ["identifier"], rows=2, max_pages=2)
+        self.assertEqual([(page, len(docs)) for page, docs in results.pages()], [(1, 2), (2, 2)])
+
+    def test_first_page_starts_further_in(self, sleep):
+        session = FakeSearchSession(self.IDS)
+        results = ia_common.SearchResults(session, "q", ["identifier"], rows=2, sleep=0.5, max_pages=1, first_page=2)
+        self.assertEqual([(page, [d["identifier"] for d in docs]) for page, docs in results.pages()], [(2, ["item2", "item3"])])
+        self.assertEqual((session.requested, results.total_pages), ([2], 2))
+        sleep.assert_not_called()
+
+    def test_failed_page_raises_from_the_loop(self, sleep):
+        results = ia_common.SearchResults(FakeSearchSession(self.IDS, fail={2}), "q", ["identifier"], rows=2)
+        seen = []
+        with self.assertRaisesRegex(ia_common.SearchError, "status 503"):
+            for doc in results:
+                seen.append(doc["identifier"])
+        self.assertEqual(seen, ["item0", "item1"])
+
+    def test_error_object_instead_of_response(self, sleep):
+        session = FakeSearchSession(self.IDS)
+        session.get = lambda url, params=None: FakeResponse(data={"error": "bad sort"})
+        with self.assertRaisesRegex(ia_common.SearchError, "bad sort"):
+            list(ia_common.SearchResults(session, "q", ["identifier"]))
+
+
+class SearchDocTest(unittest.TestCase):
+    def test_fields_in_one_shape(self):
+        doc = ia_common.SearchDoc.from_doc({"identifier": "film-1", "title": ["Film", "Film (restored)"], "creator": "Ann",
+                                            "collection": ["films", "movies"], "downloads": "1204", "year": "1999-05",
+                                            "mediatype": "movies"})
+        self.assertEqual(doc, ia_common.SearchDoc("film-1", "Film; Film (restored)", "", ["Ann"], ["films", "movies"], 1204, 1999,
+                                                  {"mediatype": "movies"}))
+
+    def test_missing_and_unreadable_fields(self):
+        doc = ia_common.SearchDoc.from_doc({"identifier": "x", "downloads": "n/a", "year": [], "creator": ""})
+        self.assertEqual((doc.title, doc.creator, doc.downloads, doc.year, doc.extra), ("", [], None, None, {}))
+
+    def test_int_value(self):
+        self.assertEqual([ia_common.int_value(v) for v in (7, 7.9, " 12 ", ["1980", "1981"], True, None)], [7, 7, 12, 1980, None, None])
+
+
+class FakeScrapeSession:
+    """Serves scrape pages of `per_page` docs with "c<start>" cursors; a cursor in `expired` answers 400, one in `fail` 503."""
+
+    def __init__(self, identifiers, per_page=2, expired=(), fail=()):
+        self.identifiers = identifiers
+        self.per_page = per_page
+        self.expired = expired
+        self.fail = fail
+        self.requested = []
+
+    def get(self, url, params=None):
+        cursor = params.get("cursor")
+        self.requested.append((cursor, params["count"], params["fields"]))
+        if cursor in self.expired:
+            return FakeResponse(400, {"error": "cursor expired"})
+        if cursor in self.fail:
+            return FakeResponse(503, text="busy")
+        start = int(cursor[1:]) if cursor else 0
+        body = {"items": [{"identifier": i} for i in self.identifiers[start:start + self.per_page]], "total": len(self.identifiers)}
+        if start + self.per_page < len(self.identifiers):
+            body["cursor"] = f"c{start + self.per_page}"
+        return FakeResponse(data=body)
+
+
+@mock.patch("ia_common.time.sleep")
+class ScrapeResultsTest(unittest.TestCase):
+    IDS = [f"item{n}" for n in range(5)]
+
+    def test_follows_the_cursor_to_the_end(self, sleep):
+        session = FakeScrapeSession(self.IDS)
+        results = ia_common.ScrapeResults(session, "q", ["identifier", "title"], sleep=0.5)
+        self.assertEqual([d["identifier"] for d in results], self.IDS)
+        self.assertEqual([c for c, _, _ in session.requested], [None, "c2", "c4"])
+        self.assertEqual(session.requested[0][1:], (ia_common.SCRAPE_MAX_COUNT, "identifier,title"))
+        self.assertEqual((results.total, results.cursor), (5, None))
+        self.assertEqual(sleep.call_args_list, [mock.call(0.5)] * 2)
+
+    def test_count_is_kept_within_what_the_api_takes(self, sleep):
+        for count, sent in ((1, ia_common.SCRAPE_MIN_COUNT), (500, 500), (10 ** 6, ia_common.SCRAPE_MAX_COUNT)):
+            with self.subTest(count=count):
+                session = FakeScrapeSession(self.IDS, per_page=5)
+                list(ia_common.ScrapeResults(session, "q", ["identifier"], count=count))
+                self.assertEqual(session.requested[0][1], sent)
+
+    def test_cursor_checkpoints_each_page_and_resumes(self, sleep):
+        results = ia_common.ScrapeResults(FakeScrapeSession(self.IDS), "q", ["identifier"], max_pages=1)
+        self.assertEqual([len(docs) for _, docs in results.pages()], [2])
+        # the cursor of the page not yet fetched, which a caller saves to carry on later
+        self.assertEqual(results.cursor, "c2")
+        session = FakeScrapeSession(self.IDS)
+        resumed = ia_common.ScrapeResults(session, "q", ["identifier"], cursor=results.cursor)
+        self.assertEqual([d["identifier"] for d in resumed], self.IDS[2:])
+        self.assertEqual([c for c, _, _ in session.requested], ["c2", "c4"])
+
+    def test_expired_cursor(self, sleep):
+        results = ia_common.ScrapeResults(FakeScrapeSession(self.IDS, expired={"c2"}), "q", ["identifier"])
+        seen = []
+        with self.assertRaisesRegex(ia_common.CursorExpired, "c2 was refused.*cursor expired") as caught:
+            for doc in results:
+                seen.append(doc["identifier"])
+        self.assertEqual((seen, caught.exception.cursor), (self.IDS[:2], "c2"))
+
+    def test_server_error_mid_scrape_keeps_the_cursor_to_resume_from(self, sleep):
+        results = ia_common.ScrapeResults(FakeScrapeSession(self.IDS, fail={"c2"}), "q", ["identifier"])
+        with self.assertRaisesRegex(ia_common.SearchError, "status 503") as caught:
+            list(results)
+        self.assertNotIsInstance(caught.exception, ia_common.CursorExpired)
+        self.assertEqual(results.cursor, "c2")
+
+    def test_error_on_the_first_page_is_not_an_expired_cursor(self, sleep):
+        session = FakeScrapeSession(self.IDS)
+        session.get = lambda url, params=None: FakeResponse(400, {"error": "bad query"})
+        with self.assertRaisesRegex(ia_common.SearchError, "status 400: bad query") as caught:
+            list(ia_common.ScrapeResults(session, "q", ["identifier"]))
+        self.assertNotIsInstance(caught.exception, ia_common.CursorExpired)
+
+
+class FakeCatalogSession:
+    """Answers advancedsearch pages and whole scrape pages from canned docs by query, e.g. {"collection:a": [...]}."""
+
+    def __init__(self, catalog):
+        self.catalog = catalog
+        self.requested = []
+
+    def get(self, url, params=None):
+        docs = self.catalog.get(params["q"], [])
+        if url == ia_common.SCRAPE_URL:
+            self.requested.append(("scrape", params["q"]))
+            return FakeResponse(data={"items": docs, "total": len(docs)})
+        self.requested.append((params["page"], params["q"]))
+        start = (params["page"] - 1) * params["rows"]
+        return FakeResponse(data={"response": {"numFound": len(docs), "start": start, "docs": docs[start:start + params["rows"]]}})
+
+
+def docs(*identifiers, mediatype="texts"):
+    return [{"identifier": i, "mediatype": mediatype} for i in identifiers]
+
+
+@mock.patch("ia_common.time.sleep")
+class CollectionMembersTest(unittest.TestCase):
+    def members(self, session, *args, **kwargs):
+        return [d["identifier"] for d in ia_common.collection_members(session, *args, rows=2, **kwargs)]
+
+    def test_pages_through_the_collection_with_the_fields_asked_for(self, sleep):
+        session = FakeCatalogSession({"collection:top": docs("a", "b", "c", "d", "e")})
+        found = list(ia_common.collection_members(session, "top", fields=["mediatype", "item_size"], rows=2))
+        self.assertEqual([d["identifier"] for d in found], ["a", "b", "c", "d", "e"])
+        self.assertEqual(found[0]["mediatype"], "texts")
+        self.assertEqual(session.requested, [(1, "collection:top"), (2, "collection:top"), (3, "collection:top")])
+
+    def test_where_narrows_the_query(self, sleep):
+        session = FakeCatalogSession({"collection:top AND (year:1999)": docs("a")})
+        self.assertEqual(self.members(session, "top", where="year:1999"), ["a"])
+
+    def test_sub_collections_only_with_recursive(self, sleep):
+        catalog = {
+            "collection:top": docs("a") + docs("sub", mediatype="collection") + docs("b"),
+            "collection:top AND mediatype:collection": docs("sub", mediatype="collection"),
+            "collection:sub": docs("b", "c"),
+            "collection:sub AND mediatype:collection": docs("subsub", "top", mediatype="collection"),
+            "collection:subsub": docs("d", "a"),
+        }
+        self.assertEqual(self.members(FakeCatalogSession(catalog), "top"), ["a", "sub", "b"])
+        session = FakeCatalogSession(catalog)
+        # an item in several of them comes once, and a collection holding its parent is not listed again
+        self.assertEqual(self.members(session, "top", recursive=True), ["a", "sub", "b", "c", "d"])
+        self.assertEqual([q for _, q in session.requested].count("collection:top"), 2)
+
+    def test_sub_collections_are_found_whatever_where_says(self, sleep):
+        catalog = {"collection:top AND mediatype:collection": docs("sub", mediatype="collection"),
+                   "collection:sub AND (year:1999)": docs("old")}
+        self.assertEqual(self.members(FakeCatalogSession(catalog), "top", recursive=True, where="year:1999"), ["old"])
+
+    def test_huge_collection_switches_to_the_scrape_api(self, sleep):
+        session = FakeCatalogSession({"collection:top": docs("a", "b", "c", "d", "e")})
+        with mock.patch.object(ia_common, "SEARCH_DEPTH_LIMIT", 3):
+            self.assertEqual(self.members(session, "top"), ["a", "b", "c", "d", "e"])
+        self.assertEqual(session.requested, [(1, "collection:top"), ("scrape", "collection:top")])
+
+    def test_failure_raises(self, sleep):
+        session = FakeCatalogSession({})
+        session.get = lambda url, params=None: FakeResponse(503, text="busy")
+        with self.assertRaisesRegex(ia_common.SearchError, "status 503"):
+            self.members(session, "top")
+
+
+@mock.patch("time.sleep")
+class ScrapeAgainstFakeArchiveTest(unittest.TestCase):
+    """ScrapeResults over a real session, whose retries see the 5xx answers."""
+
+    def setUp(self):
+        self.archive = FakeArchive().start()
+        self.addCleanup(self.archive.close)
+        for n in range(250):
+            self.archive.add_item(f"item{n:03}", {}, title=f"Item {n}")
+        self.enterContext(self.archive.pointed())
+        self.retried = []
+        self.session = ia_common.build_session(5, 3, 1.0, "test", on_retry=lambda *event: self.retried.append(event[4]))
+
+    def scrape(self, **kwargs):
+        return ia_common.ScrapeResults(self.session, "q", ["identifier", "title"], count=100, sleep=0, **kwargs)
+
+    def test_mid_scrape_server_errors_are_retried(self, sleep):
+        results = self.scrape()
+        pages = results.pages()
+        self.assertEqual(len(next(pages)[1]), 100)
+        self.archive.fail("/services/search/v1/scrape", status(503), status(502))
+        docs = [d for _, page in pages for d in page]
+        self.assertEqual([d["identifier"] for d in docs], [f"item{n:03}" for n in range(100, 250)])
+        self.assertEqual(self.archive.scrape_cursors, [None, "100", "200"])
+        self.assertEqual(self.retried, ["HTTP 503", "HTTP 502"])
+
+    def test_resuming_after_an_expired_cursor_fails_cleanly(self, sleep):
+        self.archive.expired_cursors.add("100")
+        results = self.scrape()
+        with self.assertRaises(ia_common.CursorExpired):
+            list(results)
+        # a 400 is not retried
+        self.assertEqual((results.cursor, self.archive.scrape_cursors, self.retried), ("100", [None, "100"], []))
+
+
+class ClassifyTest(unittest.TestCase):
+    def answer(self, status, headers=None):
+        response = requests.Response()
+        response.status_code = status
+        response.url = "https://archive.org/metadata/item"
+        response.headers.update(headers or {})
+        return response
+
+    def test_mapping(self):
+        for status, kind in ((404, ia_common.NotFound), (410, ia_common.NotFound), (401, ia_common.Forbidden),
+                             (403, ia_common.Forbidden), (429, ia_common.RateLimited), (500, ia_common.Transient),
+                             (502, ia_common.Transient), (503, ia_common.Transient), (504, ia_common.Transient)):
+            with self.subTest(status=status):
+                error = ia_common.classify(self.answer(status))
+                self.assertIs(type(error), kind)
+                self.assertEqual(error.response.status_code, status)
+                self.assertIsInstance(error, requests.HTTPError)
+
+    def test_success_and_other_failures(self):
+        self.assertIsNone(ia_common.classify(self.answer(200)))
+        self.assertIsNone(ia_common.classify(self.answer(304)))
+        for status in (400, 501):
+            with self.subTest(status=status):
+                self.assertIs(type(ia_common.classify(self.answer(status))), ia_common.ArchiveError)
+
+    def test_rate_limited_carries_retry_after(self):
+        error = ia_common.classify(self.answer(429, {"Retry-After": "30"}))
+        self.assertEqual(error.retry_after, 30)
+        self.assertIn("retry after 30s", str(error))
+        self.assertIsNone(ia_common.classify(self.answer(429)).retry_after)
+
+    def test_raise_for_status(self):
+        ia_common.raise_for_status(self.answer(206))
+        with self.assertRaises(ia_common.NotFound):
+            ia_common.raise_for_status(self.answer(404))
+
+    def test_check_metadata(self):
+        self.assertEqual(ia_common.check_metadata("item", {"files": []}), {"files": []})
+        with self.assertRaisesRegex(ia_common.NotFound, "does not exist"):
+            ia_common.check_metadata("item", {})
+        with self.assertRaises(ia_common.Dark):
+            ia_common.check_metadata("item", {"is_dark": True, "metadata": {}})
+
+
+class JsonLogTest(unittest.TestCase):
+    def setUp(self):
+        self.out = io.StringIO()
+        handler = logging.StreamHandler(self.out)
+        handler.addFilter(ia_common.ContextFilter())
+        handler.setFormatter(ia_common.JsonFormatter())
+        self.logger = logging.getLogger("test_ia_common.json")
+        self.logger.propagate = False
+        self.logger.addHandler(handler)
+        self.addCleanup(self.logger.removeHandler, handler)
+
+    def lines(self):
+        return [json.loads(line) for line in self.out.getvalue().splitlines()]
+
+    def test_context_and_extra_fields(self):
+        with ia_common.log_context(identifier="item"):
+            with ia_common.log_context(file="a.iso"):
+                self.logger.warning("first", extra={"url": "https://x/a.iso", "attempt": 2, "status": None})
+            self.logger.error("second", extra={"file": "b.iso"})
+        self.logger.warning("third")
+        first, second, third = self.lines()
+        self.assertEqual({k: first[k] for k in ("level", "message", "identifier", "file", "url", "attempt")},
+                         {"level": "warning", "message": "first", "identifier": "item", "file": "a.iso",
+                          "url": "https://x/a.iso", "attempt": 2})
+        self.assertNotIn("status", first)
+        self.assertRegex(first["time"], r"^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}\+00:00$")
+        self.assertEqual((second["identifier"], second["file"]), ("item", "b.iso"))
+        self.assertEqual(set(third), {"time", "level", "message"})
+
+    def test_retries_carry_url_attempt_and_status(self):
+        with self.assertLogs(level="WARNING") as logs:
+            ia_common.log_retry("GET", "/metadata/x", 2, 5, "HTTP 503", 1.0)
+            ia_common.log_retry("GET", "/metadata/x", 3, 5, "Read timed out", 2.0)
+        self.assertEqual([(r.url, r.attempt, r.status) for r in logs.records], [("/metadata/x", 2, 503), ("/metadata/x", 3, None)])
+
+    def test_traceback_as_error(self):
+        try:
+            raise ValueError("broken")
+        except ValueError:
+            self.logger.exception("failed")
+        self.assertIn("ValueError: broken", self.lines()[0]["error"])
+
+
+class RequestLimiterTest(unittest.TestCase):
+    def test_burst_then_paced(self):
+        limiter = ia_common.RequestLimiter(2, burst=3)
+        waits = []
+        with mock.patch.object(ia_common.time, "sleep", side_effect=waits.append):
+            for _ in range(5):
+                limiter.acquire()
+        # three go out at once, then each waits its turn at 2 per second
+        self.assertEqual(len(waits), 2)
+        self.assertAlmostEqual(waits[0], 0.5, places=1)
+        self.assertAlmostEqual(waits[1], 1.0, places=1)
+
+    def test_default_burst_is_one_seconds_worth(self):
+        self.assertEqual(ia_common.RequestLimiter(5).burst, 5)
+        self.assertEqual(ia_common.RequestLimiter(0.2).burst, 1)
+        self.assertIsNone(ia_common.request_limiter(None))
+
+    def test_flags_default_to_the_environment(self):
+        with mock.patch.dict(ia_common.os.environ, {"IA_MAX_RPS": "2.5", "IA_RPS_BURST": "4"}):
+            parser = argparse.ArgumentParser()
+            ia_common.add_request_rate_args(parser)
+            args = parser.parse_args([])
+        self.assertEqual((args.max_rps, args.rps_burst), (2.5, 4))
+        self.assertEqual(parser.parse_args(["--max-rps", "1"]).max_rps, 1.0)
+        with self.assertRaises(SystemExit), contextlib.redirect_stderr(io.StringIO()):
+            parser.parse_args(["--max-rps", "0"])
+
+
+class CircuitBreakerTest(unittest.TestCase):
+    def setUp(self):
+        self.now = 1000.0
+        self.breaker = ia_common.CircuitBreaker(threshold=0.5, window=4, cooldown=60, clock=lambda: self.now)
+
+    def record(self, *outcomes):
+        for ok in outcomes:
+            self.breaker.record(ok)
+
+    def test_opens_once_the_window_is_full_and_enough_failed(self):
+        self.record(False, False, False)
+        self.assertEqual(self.breaker.state, "closed")
+        with self.assertLogs(level="WARNING") as logs:
+            self.record(True)
+        self.assertEqual(self.breaker.state, "open")
+        self.assertIn("3 of the last 4 requests to archive.org failed; pausing every request for 60s", logs.output[0])
+        self.assertEqual(logs.records[0].circuit_breaker["state"], "open")
+
+    def test_a_failure_share_under_the_threshold_keeps_it_closed(self):
+        self.record(False, True, True, True, False, True, True)
+        self.assertEqual(self.breaker.state, "closed")
+        self.assertFalse(self.breaker.allow())
+
+    def test_requests_wait_out_the_cooldown_then_one_probes(self):
+        with self.assertLogs(level="WARNING"):
+            self.record(False, False, True, True)
+        self.assertIsNone(self.breaker.allow())
+        self.now += 60
+        self.assertTrue(self.breaker.allow())
+        self.assertEqual(self.breaker.state, "half-open")
+        # the others wait for the probe
+        self.assertIsNone(self.breaker.allow())
+        self.now += 2
+        with self.assertLogs(level="WARNING") as logs:
+            self.breaker.record(True)
+        self.assertIn("archive.org answers again; resuming after 62s paused", logs.output[0])
+        self.assertEqual(self.breaker.status(), {"state": "closed", "failed": 0, "window": 4, "paused_until": None,
+                                                 "pauses": 1, "paused_seconds": 62})
+        self.assertFalse(self.breaker.allow())
+
+    def test_a_failed_probe_opens_it_for_another_cooldown(self):
+        with self.assertLogs(level="WARNING"):
+            self.record(False, False, False, False)
+        self.now += 60
+        self.assertTrue(self.breaker.allow())
+        with self.assertLogs(level="WARNING") as logs:
+            self.breaker.record(False)
+        self.assertIn("the request sent to check archive.org failed too", logs.output[0])
+        self.assertEqual(self.breaker.state, "open")
+        self.now += 59
+        self.assertIsNone(self.breaker.allow())
+        self.now += 1
+        self.assertTrue(self.breaker.allow())
+
+    def test_a_probe_without_an_answer_hands_over_to_another_request(self):
+        with self.assertLogs(level="WARNING"):
+            self.record(False, False, False, False)
+        self.now += 60
+        self.assertTrue(self.breaker.allow())
+        self.breaker.release()
+        self.assertTrue(self.breaker.allow())
+
+    def test_outcomes_while_open_change_nothing(self):
+        with self.assertLogs(level="WARNING"):
+            self.record(False, False, False, False)
+        self.record(True, True, False)
+        self.assertEqual(self.breaker.state, "open")
+
+    def test_flags(self):
+        parser = argparse.ArgumentParser()
+        ia_common.add_breaker_args(parser)
+        breaker = ia_common.circuit_breaker(parser.parse_args(["--breaker-threshold", "0.8", "--breaker-window", "50",
+                                                               "--breaker-cooldown", "5m"]))
+        self.assertEqual((breaker.threshold, breaker.outcomes.maxlen, breaker.cooldown), (0.8, 50, 300))
+        self.assertIsNone(ia_common.circuit_breaker(parser.parse_args(["--no-breaker"])))
+        self.assertIsNone(ia_common.circuit_breaker(argparse.Namespace()))
+        with self.assertRaises(SystemExit), contextlib.redirect_stderr(io.StringIO()):
+            ia_common.check_breaker_args(parser, parser.parse_args(["--breaker-threshold", "1.5"]))
+
+
+class MetadataDigestsTest(unittest.TestCase):
+    def test_the_digests_metadata_gives(self):
+        self.assertEqual(ia_common.metadata_digests({"md5": "ABC", "sha1": "def", "crc32": "1234"}), {"md5": "abc", "sha1": "def"})
+        self.assertEqual(ia_common.metadata_digests({"sha1": "def"}), {"sha1": "def"})
+        self.assertEqual(ia_common.metadata_digests({"md5": "abc", "otf": "true"}), {})
+        self.assertEqual(ia_common.metadata_digests({"md5": ""}), {})
+
+    def test_mismatch_names_the_first_digest_that_differs(self):
+        expected = {"md5": "abc", "sha1": "def"}
+        self.assertIsNone(ia_common.digest_mismatch(expected, {"md5": "abc", "sha1": "def"}))
+        self.assertEqual(ia_common.digest_mismatch(expected, {"md5": "abc", "sha1": "000"}), "sha1 000, metadata says def")
+        self.assertEqual(ia_common.digest_mismatch(expected, {"md5": "abc"}), "sha1 None, metadata says def")
+
+
+class RetryDelayTest(unittest.TestCase):
+    class Answer:
+        def __init__(self, retry_after):
+            self.headers = {"Retry-After": retry_after} if retry_after is not None else {}
+
+    def test_backoff_doubles_up_to_cap(self):
+        self.assertEqual([ia_common.retry_delay(n, jitter=False) for n in range(7)], [1, 2, 4, 8, 16, 30, 30])
+        self.assertEqual(ia_common.retry_delay(2, backoff=0.5, cap=10, jitter=False), 2)
+
+    def test_jitter_stays_between_zero_and_the_backoff(self):
+        rng = random.Random(725)
+        for _ in range(2000):
+            attempt, backoff, cap = rng.randrange(12), rng.uniform(0.1, 5), rng.uniform(1, 60)
+            delay = ia_common.retry_delay(attempt, backoff=backoff, cap=cap)
+            self.assertTrue(0 <= delay <= min(backoff * 2 ** attempt, cap), (attempt, backoff, cap, delay))
+        # spread out, not stuck at either end
+        delays = [ia_common.retry_delay(3) for _ in range(200)]
+        self.assertLess(min(delays), 2)
+        self.assertGreater(max(delays), 6)
+
+    def test_retry_after_wins(self):
+        self.assertEqual(ia_common.retry_delay(4, self.Answer("7")), 7)
+        self.assertAlmostEqual(ia_common.retry_delay(0, self.Answer(formatdate(time.time() + 60, usegmt=True))), 60, delta=2)
+        self.assertEqual(ia_common.retry_delay(3, self.Answer("soon"), jitter=False), 8)
+        self.assertEqual(ia_common.retry_delay(3, self.Answer(None), jitter=False), 8)
+
+
+def http_error(status, retry_after=None):
+    response = requests.Response()
+    response.status_code = status
+    if retry_after is not None:
+        response.headers["Retry-After"] = retry_after
+    return requests.HTTPError(f"HTTP {status}", response=response)
+
+
+class RetryCallTest(unittest.TestCase):
+    def call(self, failures, retries=3, **kwargs):
+        """retry_call() of a call that raises failures in turn, then returns the attempt it got to."""
+        failures = list(failures)
+        self.attempts, self.sleeps, self.retried = [], [], []
+
+        def call(attempt):
+            self.attempts.append(attempt)
+            if failures:
+                raise failures.pop(0)
+            return attempt
+        kwargs.setdefault("on_retry", lambda *event: self.retried.append(event))
+        return ia_common.retry_call(call, retries, sleep=self.sleeps.append, **kwargs)
+
+    def test_transient_failures_are_retried_until_success(self):
+        self.assertEqual(self.call([http_error(503), requests.ConnectionError("reset")]), 2)
+        self.assertEqual(self.attempts, [0, 1, 2])
+        self.assertEqual([event[0] for event in self.retried], [1, 2])
+        self.assertEqual([event[2] for event in self.retried], self.sleeps)
+
+    def test_the_last_failure_is_raised_once_the_retries_are_used_up(self):
+        last = http_error(502)
+        with self.assertRaises(requests.HTTPError) as caught:
+            self.call([http_error(503), http_error(500), last], retries=2)
+        self.assertIs(caught.exception, last)
+        self.assertEqual((self.attempts, len(self.sleeps)), ([0, 1, 2], 2))
+
+    def test_permanent_failures_and_other_errors_are_not_retried(self):
+        with self.assertRaises(requests.HTTPError):
+            self.call([http_error(404)])
+        with self.assertRaises(ValueError):
+            self.call([ValueError("bad JSON")])
+        self.assertEqual((self.attempts, self.sleeps), ([0], []))
+
+    def test_should_retry_and_errors_widen_or_narrow_what_is_retried(self):
+        self.assertEqual(self.call([OSError("short read")], errors=(OSError,)), 1)
+        with self.assertRaises(requests.ConnectionError):
+            self.call([requests.ConnectionError("reset")], should_retry=lambda e: False)
+
+    def test_retry_after_is_slept(self):
+        self.call([http_error(429, "7")])
+        self.assertEqual(self.sleeps, [7])
+
+    def test_elapsed_budget_gives_up_before_a_wait_that_would_pass_it(self):
+        with self.assertRaises(requests.HTTPError):
+            self.call([http_error(503, "3600")], max_elapsed=300)
+        self.assertEqual((self.attempts, self.sleeps, self.retried), ([0], [], []))
+        self.assertEqual(self.call([http_error(503, "3600")], max_elapsed=None), 1)
+
+    def test_elapsed_budget_counts_from_the_first_failure(self):
+        clock = iter([1000.0, 1000.0, 1200.0])
+        with mock.patch("ia_common.time.monotonic", side_effect=lambda: next(clock)), self.assertRaises(requests.HTTPError):
+            self.call([http_error(503, "60"), http_error(503, "60")], max_elapsed=250)
+        # the first wait fits (1000 + 60), the second doesn't (1200 + 60 > 1000 + 250)
+        self.assertEqual((self.attempts, self.sleeps), ([0, 1], [60]))
+
+    def test_on_retry_may_give_up(self):
+        def refuse(attempt, error, delay):
+            raise TimeoutError("no time left")
+        with self.assertRaises(TimeoutError):
+            self.call([http_error(503)], on_retry=refuse)
+        self.assertEqual(self.sleeps, [])
+
+    def test_budgets_hold_for_any_schedule(self):
+        rng = random.Random(7250)
+        for _ in range(300):
+            retries, backoff = rng.randrange(6), rng.uniform(0.1, 3)
+            failures = [http_error(rng.choice((429, 500, 502, 503, 504))) for _ in range(rng.randrange(8))]
+            try:
+                self.call(failures, retries, backoff=backoff)
+                self.assertLessEqual(len(self.retried), retries)
+            except requests.HTTPError:
+                self.assertEqual(len(self.attempts), retries + 1)
+            self.assertEqual(len(self.sleeps), len(self.attempts) - 1)
+            for n, delay in enumerate(self.sleeps):
+                self.assertTrue(0 <= delay <= min(backoff * 2 ** n, ia_common.RETRY_BACKOFF_CAP), (n, backoff, delay))
+
+    def test_default_hook_logs_the_request(self):
+        with self.assertLogs(level="WARNING") as logs:
+            ia_common.retry_call(lambda attempt: attempt or self.fail_once(), 2, 1.0, "POST", "https://example.org/fts",
+                                 sleep=lambda delay: None)
+        self.assertRegex(logs.output[0], r"POST https://example.org/fts: HTTP 503; retrying in \d\.\ds \(1/2\)")
+
+    @staticmethod
+    def fail_once():
+        raise http_error(503)
+
+
+class ScriptedServer(ThreadingHTTPServer):
+    """Answers requests from a list of (status, headers) in order, then 200; "drop" closes the connection unanswered."""
+
+    def __init__(self, script):
+        super().__init__(("127.0.0.1", 0), ScriptedHandler)
+        self.script = list(script)
+        self.seen = []
+        self.paths = []
+        self.thread = threading.Thread(target=self.serve_forever, args=(0.05,), daemon=True)
+        self.thread.start()
+
+    @property
+    def url(self):
+        return f"http://127.0.0.1:{self.server_address[1]}/metadata/item"
+
+    def stop(self):
+        self.shutdown()
+        self.server_close()
+
+
+class ScriptedHandler(BaseHTTPRequestHandler):
+    def log_message(self, *args):
+        pass
+
+    def answer(self):
+        self.server.seen.append(self.command)
+        self.server.paths.append(self.path)
+        status, headers = self.server.script.pop(0) if self.server.script else (200, {})
+        if status == "drop":
+            self.close_connection = True
+            return
+        body = b"{}" if status == 200 else b"busy"
+        self.send_response(status)
+        for k, v in headers.items():
+            self.send_header(k, v)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    do_GET = do_POST = answer
+
+
+# the upper end of the jittered backoff, so the waits are known
+@mock.patch("ia_common.random.uniform", new=lambda low, high: high)
+@mock.patch("urllib3.util.retry.time.sleep")
+class RetryPolicyTest(unittest.TestCase):
+    def session(self, script, retries=3, **kwargs):
+        self.server = ScriptedServer(script)
+        self.addCleanup(self.server.stop)
+        self.events = []
+        hook = lambda *event: self.events.append(event)  # noqa: E731
+        session = ia_common.build_session(5, retries, 1.0, "test", on_retry=hook)
+        if kwargs:
+            adapter = requests.adapters.HTTPAdapter(max_retries=ia_common.retry_policy(retries, 1.0, hook, **kwargs))
+            session.mount("http://", adapter)
+        return session
+
+    def test_transient_status_then_success(self, sleep):
+        session = self.session([(503, {}), (500, {})])
+        self.assertEqual(session.get(self.server.url).status_code, 200)
+        self.assertEqual(self.server.seen, ["GET"] * 3)
+        self.assertEqual([(e[2], e[3], e[4]) for e in self.events], [(1, 3, "HTTP 503"), (2, 3, "HTTP 500")])
+        # backoff, then backoff * 2, as retry_call() waits
+        self.assertEqual([e[5] for e in self.events], [1.0, 2.0])
+        self.assertEqual(sleep.call_args_list, [mock.call(1.0), mock.call(2.0)])
+
+    def test_retry_after_is_honored(self, sleep):
+        session = self.session([(429, {"Retry-After": "7"})])
+        self.assertEqual(session.get(self.server.url).status_code, 200)
+        self.assertEqual(self.events[0][4:], ("HTTP 429", 7))
+        sleep.assert_called_once_with(7)
+
+    def test_dropped_connection_is_retried(self, sleep):
+        session = self.session([("drop", {})])
+        # urllib3 logs its own warning too; the tools silence it in setup_logging
+        with self.assertLogs("urllib3", "WARNING"):
+            self.assertEqual(session.get(self.server.url).status_code, 200)
+        self.assertEqual(len(self.server.seen), 2)
+        self.assertEqual(len(self.events), 1)
+
+    def test_attempts_are_capped_and_the_last_answer_returned(self, sleep):
+        session = self.session([(503, {})] * 5, retries=2)
+        self.assertEqual(session.get(self.server.url).status_code, 503)
+        self.assertEqual(len(self.server.seen), 3)
+
+    def test_elapsed_cap_gives_up_on_a_long_retry_after(self, sleep):
+        session = self.session([(503, {"Retry-After": "3600"})], max_elapsed=300)
+        self.assertEqual(session.get(self.server.url).status_code, 503)
+        self.assertEqual((len(self.server.seen), self.events), (1, []))
+        sleep.assert_not_called()
+
+    def test_permanent_status_and_post_are_not_retried(self, sleep):
+        session = self.session([(404, {}), (503, {})])
+        self.assertEqual(session.get(self.server.url).status_code, 404)
+        self.assertEqual(session.post(self.server.url).status_code, 503)
+        self.assertEqual((self.server.seen, self.events), (["GET", "POST"], []))
+
+    def test_default_hook_logs_a_warning(self, sleep):
+        self.server = ScriptedServer([(502, {})])
+        self.addCleanup(self.server.stop)
+        session = ia_common.build_session(5, 3, 1.0, "test")
+        with self.assertLogs(level="WARNING") as logs:
+            session.get(self.server.url)
+        self.assertIn("HTTP 502; retrying in 1.0s (1/3)", logs.output[0])
+
+    def test_every_attempt_counts_for_the_breaker_and_an_open_one_holds_requests_back(self, sleep):
+        self.server = ScriptedServer([(503, {})] * 4)
+        self.addCleanup(self.server.stop)
+        breaker = ia_common.CircuitBreaker(threshold=1, window=4, cooldown=0.2)
+        session = ia_common.build_session(5, 1, 1.0, "test", on_retry=None, breaker=breaker)
+        with self.assertLogs(level="WARNING") as logs:
+            self.assertEqual(session.get(self.server.url).status_code, 503)
+            self.assertEqual(breaker.state, "closed")
+            self.assertEqual(session.get(self.server.url).status_code, 503)
+            self.assertEqual(breaker.state, "open")
+            started = time.monotonic()
+            # the probe, sent once the cooldown is over
+            self.assertEqual(session.get(self.server.url).status_code, 200)
+        self.assertGreaterEqual(time.monotonic() - started, 0.15)
+        self.assertEqual((breaker.state, len(self.server.seen)), ("closed", 5))
+        self.assertEqual([r.circuit_breaker["state"] for r in logs.records], ["open", "closed"])
+
+
+
+class SessionFromArgsTest(unittest.TestCase):
+    def build(self, args, *a, **kw):
+        with mock.patch.object(ia_common, "build_session") as build, \
+                mock.patch.object(ia_common, "s3_auth", return_value=None):
+            ia_common.session_from_args(args, "tool/1.0", *a, **kw)
+        (timeout, retries, backoff, user_agent, session), kwargs = build.call_args
+        return timeout, retries, backoff, user_agent, kwargs["limiter"]
+
+    def test_missing_flags_keep_the_defaults(self):
+        self.assertEqual(self.build(argparse.Namespace()), (30, 5, 1.0, "tool/1.0", None))
+
+    def test_flags_then_overrides(self):
+        args = argparse.Namespace(timeout=10, retries=2, backoff=0.5, user_agent=None, max_rps=4.0, rps_burst=None)
+        timeout, retries, backoff, user_agent, limiter = self.build(args, retries=0)
+        self.assertEqual((timeout, retries, backoff, user_agent), (10, 0, 0.5, "tool/1.0"))
+        self.assertEqual((limiter.rps, limiter.burst), (4.0, 4))
+        args.user_agent = "mirror-bot/2"
+        self.assertEqual(self.build(args)[3], "mirror-bot/2")
+
+    def test_pool_is_sized_by_what_runs_at_once(self):
+        sizes = [ia_common.pool_size(argparse.Namespace(**flags))
+                 for flags in ({}, {"workers": 4}, {"workers": 16}, {"workers": 4, "segments": 8}, {"concurrency": 12})]
+        self.assertEqual(sizes, [10, 10, 16, 32, 12])
+
+    def test_insecure_skip_verify_warns_and_turns_checks_off(self):
+        args = argparse.Namespace(insecure_skip_verify=True, anonymous=True)
+        with self.assertLogs(level="WARNING") as logs:
+            session = ia_common.session_from_args(args, "tool/1.0")
+        self.assertIn("TLS certificates are not checked", logs.output[0])
+        self.assertFalse(session.verify)
+        self.assertTrue(ia_common.session_from_args(argparse.Namespace(anonymous=True), "tool/1.0").verify)
+
+
+class TransportTest(unittest.TestCase):
+    def wrapped(self, connect_timeout):
+        calls = []
+        request = ia_common._timeout_wrapper(lambda method, url, **kw: calls.append(kw["timeout"]), 30, None, connect_timeout)
+        return request, calls
+
+    def test_connect_timeout_goes_with_every_read_timeout(self):
+        request, calls = self.wrapped(10)
+        request("GET", "u")
+        request("GET", "u", timeout=60)
+        request("GET", "u", timeout=4)
+        request("GET", "u", timeout=None)
+        self.assertEqual(calls, [(10, 30), (10, 60), (4, 4), None])
+
+    def test_without_it_timeouts_are_left_alone(self):
+        request, calls = self.wrapped(None)
+        request("GET", "u")
+        request("GET", "u", timeout=60)
+        self.assertEqual(calls, [30, 60])
+
+    def test_pool_size_reaches_the_adapter(self):
+        session = ia_common.build_session(30, 0, 1.0, "test", pool_size=24)
+        self.assertEqual(session.get_adapter("https://archive.org/").poolmanager.connection_pool_kw["maxsize"], 24)
+
+    def test_transport_flags(self):
+        parser = argparse.ArgumentParser()
+        ia_common.add_transport_args(parser)
+        self.assertEqual(vars(parser.parse_args([])), {"proxy": None, "ca_cert": None, "connect_timeout": 10, "insecure_skip_verify": False,
+                                                       "record": None, "replay": None, "record_max_body": ia_common.RECORD_MAX_BODY})
+        args = parser.parse_args(["--connect-timeout", "2.5", "--insecure-skip-verify"])
+        self.assertEqual((args.connect_timeout, args.insecure_skip_verify), (2.5, True))
+        with self.assertRaises(SystemExit), contextlib.redirect_stderr(io.StringIO()):
+            parser.parse_args(["--connect-timeout", "0"])
+        with self.assertRaises(SystemExit), contextlib.redirect_stderr(io.StringIO()):
+            parser.parse_args(["--record", "a.json", "--replay", "b.json"])
+
+    def test_proxy_urls(self):
+        for url in ("http://proxy:3128", "https://user:pw@proxy.example.org", "socks5h://127.0.0.1:1080"):
+            self.assertEqual(ia_common.proxy_url(url), url)
+        for url in ("proxy:3128", "ftp://proxy", "http://"):
+            with self.assertRaises(argparse.ArgumentTypeError):
+                ia_common.proxy_url(url)
+
+    def test_ca_cert_must_exist_and_not_go_with_insecure(self):
+        with tempfile.NamedTemporaryFile(suffix=".pem") as pem:
+            self.assertEqual(ia_common.ca_bundle(pem.name), pem.name)
+            for argv in (["--ca-cert", pem.name + ".missing"], ["--ca-cert", pem.name, "--insecure-skip-verify"]):
+                parser = argparse.ArgumentParser()
+                ia_common.add_transport_args(parser)
+                with self.assertRaises(SystemExit), contextlib.redirect_stderr(io.StringIO()) as err:
+                    ia_common.parse_args(parser, "IA-Thing.py", argv)
+                self.assertRegex(err.getvalue(), "no such file|contradict")
+
+    def test_ca_cert_wins_over_the_environment(self):
+        session = ia_common.build_session(30, 0, 1.0, "test", verify="/etc/private-ca.pem")
+        with mock.patch.dict(os.environ, {"REQUESTS_CA_BUNDLE": "/etc/other.pem"}):
+            self.assertEqual(session.merge_environment_settings("https://archive.org/", {}, False, None, None)["verify"], "/etc/private-ca.pem")
+        insecure = ia_common.build_session(30, 0, 1.0, "test", verify=False)
+        with mock.patch.dict(os.environ, {"REQUESTS_CA_BUNDLE": "/etc/other.pem"}):
+            self.assertIs(insecure.merge_environment_settings("https://archive.org/", {}, False, None, None)["verify"], False)
+
+    def test_certificate_failures_point_at_ca_cert(self):
+        def fail(method, url, **kwargs):
+            raise requests.exceptions.SSLError("[SSL: CERTIFICATE_VERIFY_FAILED] certificate verify failed: self-signed certificate in chain")
+        with self.assertRaises(requests.exceptions.SSLError) as caught:
+            ia_common._timeout_wrapper(fail, 30)("GET", "https://archive.org/")
+        self.assertIn("--ca-cert", str(caught.exception))
+
+    def test_requests_go_through_the_proxy_except_no_proxy_hosts(self):
+        proxy, target = ScriptedServer([]), ScriptedServer([])
+        for server in (proxy, target):
+            self.addCleanup(server.stop)
+        proxy_url = f"http://127.0.0.1:{proxy.server_address[1]}"
+        session = ia_common.build_session(5, 0, 1.0, "test", proxy=proxy_url)
+        with mock.patch.dict(os.environ, {"NO_PROXY": "", "no_proxy": ""}):
+            session.get(target.url)
+        # a proxy is sent the whole URL
+        self.assertEqual((proxy.paths, target.paths), ([target.url], []))
+        with mock.patch.dict(os.environ, {"NO_PROXY": "127.0.0.1", "no_proxy": "127.0.0.1"}):
+            session.get(target.url)
+        self.assertEqual((proxy.paths, target.paths), ([target.url], ["/metadata/item"]))
+
+
+class MetadataPairTest(unittest.TestCase):
+    def test_splits_on_the_first_equals(self):
+        self.assertEqual(ia_common.metadata_pair("Description=a=b"), ("description", "a=b"))
+
+    def test_rejects_odd_keys(self):
+        for value in ("title", "=x", "ti tle=x", "x-archive-meta-title:x"):
+            with self.subTest(value=value), self.assertRaises(argparse.ArgumentTypeError):
+                ia_common.metadata_pair(value)
+
+
+class S3AuthTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.home = tmp.name
+        self.environ = self.enterContext(mock.patch.dict("os.environ", {"HOME": self.home}))
+        for name in ("IA_ACCESS_KEY", "IA_SECRET_KEY", "IA_CONFIG_FILE"):
+            self.environ.pop(name, None)
+
+    def write_config(self, *parts, text="[s3]\naccess = ini-access\nsecret = ini-secret\n"):
+        os.makedirs(os.path.join(self.home, *parts[:-1]), exist_ok=True)
+        with open(os.path.join(self.home, *parts), "w", encoding="utf-8") as f:
+            f.write(text)
+
+    def test_keys_from_the_environment_win_over_ia_ini(self):
+        self.write_config(".config", "internetarchive", "ia.ini")
+        self.assertEqual(ia_common.s3_credentials(), ("ini-access", "ini-secret"))
+        self.environ.update(IA_ACCESS_KEY="env-access", IA_SECRET_KEY="env-secret")
+        self.assertEqual(ia_common.s3_credentials(), ("env-access", "env-secret"))
+
+    def test_first_config_file_found_is_the_one_read(self):
+        self.write_config(".config", "ia.ini", text="[general]\nscreenname = someone\n")
+        self.write_config(".ia")
+        self.assertIsNone(ia_common.s3_credentials())
+        self.environ["IA_CONFIG_FILE"] = os.path.join(self.home, ".ia")
+        self.assertEqual(ia_common.s3_credentials(), ("ini-access", "ini-secret"))
+
+    def test_a_config_file_that_cant_be_used_is_an_error(self):
+        self.write_config(".ia", text="access = no section\n")
+        with self.assertRaisesRegex(ia_common.CredentialsError, "not a valid ia config file"):
+            ia_common.s3_credentials()
+        self.write_config(".ia", text="[s3]\naccess = ini-access\n")
+        with self.assertRaisesRegex(ia_common.CredentialsError, r"\[s3\] has access but no secret"):
+            ia_common.s3_credentials()
+        self.environ["IA_CONFIG_FILE"] = os.path.join(self.home, "missing.ini")
+        with self.assertRaisesRegex(ia_common.CredentialsError, "does not exist"):
+            ia_common.s3_credentials()
+
+    def test_ia_config_file_flag_is_checked_before_anything_is_sent(self):
+        self.write_config("broken.ini", text="[s3\n")
+        p = argparse.ArgumentParser()
+        ia_common.add_auth_args(p)
+        with contextlib.redirect_stderr(io.StringIO()) as err, self.assertRaises(SystemExit):
+            ia_common.parse_args(p, "IA-Thing.py", ["--ia-config-file", os.path.join(self.home, "broken.ini")])
+        self.assertIn("broken.ini is not a valid ia config file", err.getvalue())
+        p = argparse.ArgumentParser()
+        ia_common.add_auth_args(p)
+        args = ia_common.parse_args(p, "IA-Thing.py", ["--ia-config-file", os.path.join(self.home, "broken.ini"), "--anonymous"])
+        self.assertTrue(args.anonymous)
+
+    def test_login_cookies_go_to_archive_org(self):
+        self.write_config(".config", "internetarchive", "ia.ini", text=(
+            "[s3]\naccess = a\nsecret = s\n[cookies]\nlogged-in-user = me%40example.org; path=/; domain=.archive.org\n"
+            "logged-in-sig = 123abc; expires=Sat, 01-Jan-2028 00:00:00 GMT; path=/; domain=.archive.org\n"))
+        self.assertEqual(ia_common.ia_cookies(), {"logged-in-user": "me%40example.org", "logged-in-sig": "123abc"})
+        session = ia_common.session_from_args(argparse.Namespace(), "test")
+        self.assertEqual(session.cookies.get_dict(domain=".archive.org"), {"logged-in-user": "me%40example.org", "logged-in-sig": "123abc"})
+        prepared = session.prepare_request(requests.Request("GET", "https://example.com/x"))
+        self.assertNotIn("Cookie", prepared.headers)
+        prepared = session.prepare_request(requests.Request("GET", "https://archive.org/metadata/x"))
+        self.assertIn("logged-in-sig=123abc", prepared.headers["Cookie"])
+        self.assertFalse(ia_common.session_from_args(argparse.Namespace(anonymous=True), "test").cookies)
+
+    def test_only_archive_org_is_signed_and_the_secret_never_shows(self):
+        auth = ia_common.S3Auth("key", "hunter2")
+        signed = auth(requests.Request("GET", "https://ia800100.us.archive.org/x").prepare())
+        self.assertEqual(signed.headers["Authorization"], "LOW key:hunter2")
+        self.assertNotIn("Authorization", auth(requests.Request("GET", "https://example.com/x").prepare()).headers)
+        self.assertNotIn("hunter2", repr(auth))
+
+    def test_redirect_to_a_storage_node_stays_signed(self):
+        session = ia_common.build_session(5, 0, 1.0, "test", auth=ia_common.S3Auth("key", "hunter2"))
+        response = requests.Response()
+        response.request = requests.Request("GET", "https://archive.org/download/x/y.iso").prepare()
+        for url, signed in (("https://ia800100.us.archive.org/0/items/x/y.iso", True), ("https://example.com/y.iso", False)):
+            prepared = requests.Request("GET", url, headers={"Authorization": "LOW key:hunter2"}).prepare()
+            session.rebuild_auth(prepared, response)
+            self.assertEqual("Authorization" in prepared.headers, signed, url)
+
+if __name__ == "__main__":
+    unittest.main()
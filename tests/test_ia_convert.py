@@ -0,0 +1,122 @@
+import io
+import json
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from _scripts import load_script
+import ia_catalog
+
+iac = load_script("IA-Convert.py")
+
+ENTRIES = [
+    {"identifier": "distro-1.0", "file_name": "iso/distro 1.0.iso", "md5": "0123456789abcdef0123456789abcdef",
+     "download_url": "https://archive.org/download/distro-1.0/iso/distro%201.0.iso", "size": 734003200, "title": "Distro, \"1.0\""},
+    {"identifier": "tools", "file_name": "tools.zip", "download_url": "https://archive.org/download/tools/tools.zip",
+     "size": 0, "md5": "fedcba9876543210fedcba9876543210"},
+]
+
+
+class RoundTripTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.tmp = tmp.name
+
+    def convert(self, catalog, fmt):
+        path = os.path.join(self.tmp, f"catalog.{fmt}")
+        with self.assertNoLogs(level="WARNING") if fmt != "aria2" else self.assertLogs(level="WARNING"):
+            iac.write_catalog(catalog, fmt, path)
+        with open(path, "rb") as f:
+            data = f.read()
+        self.assertEqual(ia_catalog.detect(data), fmt)
+        return ia_catalog.read_catalog(data, fmt, path)
+
+    def test_core_fields_survive_every_format(self):
+        for fmt in ("json", "ndjson", "csv", "sqlite"):
+            with self.subTest(fmt=fmt):
+                self.assertEqual(self.convert(ia_catalog.Catalog(ENTRIES), fmt).entries, ENTRIES)
+
+    def test_aria2_keeps_what_it_can(self):
+        entries = self.convert(ia_catalog.Catalog(ENTRIES), "aria2").entries
+        self.assertEqual(entries, [{k: e[k] for k in ("identifier", "file_name", "download_url", "md5")} for e in ENTRIES])
+
+    def test_chained_conversions(self):
+        catalog = ia_catalog.Catalog(ENTRIES)
+        for fmt in ("csv", "sqlite", "ndjson", "json"):
+            catalog = self.convert(catalog, fmt)
+        self.assertEqual(catalog.entries, ENTRIES)
+
+    def test_provenance_is_kept_by_json_and_sqlite(self):
+        data = b'{"query": "mediatype:software", "generated": "2026-10-14", "files": [{"identifier": "a", "file_name": "a.iso"}]}'
+        catalog = ia_catalog.read_catalog(data, ia_catalog.detect(data), "in.json")
+        self.assertEqual((catalog.provenance, catalog.entry_key), ({"query": "mediatype:software", "generated": "2026-10-14"}, "files"))
+        again = self.convert(catalog, "sqlite")
+        self.assertEqual((again.entries, again.provenance, again.entry_key), (catalog.entries, catalog.provenance, "files"))
+        with self.assertLogs(level="WARNING") as logs:
+            iac.write_catalog(catalog, "ndjson", os.path.join(self.tmp, "out.ndjson"))
+        self.assertIn("provenance (query, generated)", logs.output[0])
+
+
+class DetectTest(unittest.TestCase):
+    def test_shapes(self):
+        self.assertEqual(ia_catalog.detect(b'\xef\xbb\xbf[{"identifier": "a"}]'), "json")
+        self.assertEqual(ia_catalog.detect(b'{"identifier": "a"}\n{"identifier": "b"}\n'), "ndjson")
+        self.assertEqual(ia_catalog.detect(b"identifier,file_name\na,a.iso\n"), "csv")
+        self.assertEqual(ia_catalog.detect(b"https://archive.org/download/a/a.iso\n  out=a.iso\n"), "aria2")
+        with self.assertRaises(ValueError):
+            ia_catalog.detect(b"hello")
+
+
+class StreamTest(unittest.TestCase):
+    def setUp(self):
+        # a buffer shorter than an entry, so values, numbers and escapes are cut across reads
+        self.enterContext(mock.patch.object(ia_catalog, "STREAM_CHUNK", 7))
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.tmp = tmp.name
+
+    def write(self, text, name="catalog.json"):
+        path = os.path.join(self.tmp, name)
+        with open(path, "w", encoding="utf-8") as f:
+            f.write(text)
+        return path
+
+    def test_array_entries_are_decoded_one_at_a_time(self):
+        text = json.dumps(ENTRIES + [{"identifier": "é \\\"x\"", "size": 12345678901234567890}], indent=2)
+        stream = ia_catalog.JsonStream(io.StringIO(text))
+        entries = stream.array()
+        self.assertEqual(next(entries), ENTRIES[0])
+        self.assertLess(stream.f.tell(), len(text) / 2)
+        self.assertEqual(list(entries), ENTRIES[1:] + [{"identifier": "é \\\"x\"", "size": 12345678901234567890}])
+
+    def test_shapes_as_load_catalog_reads_them(self):
+        wrapped = json.dumps({"query": "q", "files": ENTRIES}, indent=2)
+        ndjson = "".join(json.dumps(e) + "\n" for e in ENTRIES)
+        for text, fmt in (("\ufeff" + json.dumps(ENTRIES), "json"), (wrapped, "json"), (ndjson, "ndjson"),
+                          (json.dumps(ENTRIES[0]), "json"), ("[ ]", "json")):
+            with self.subTest(text=text[:20]):
+                path = self.write(text)
+                catalog, detected = ia_catalog.load_catalog(path)
+                expected = [] if text == "[ ]" else ENTRIES[:1] if text == json.dumps(ENTRIES[0]) else ENTRIES
+                self.assertEqual((catalog.entries, detected), (expected, fmt))
+                self.assertEqual(list(ia_catalog.iter_entries(path)), expected)
+        self.assertEqual(ia_catalog.load_catalog(self.write(wrapped))[0].provenance, {"query": "q"})
+
+    def test_other_formats_and_stdin(self):
+        path = self.write("identifier,file_name,size\na,a.iso,1\n", "catalog.csv")
+        self.assertEqual(list(ia_catalog.iter_entries(path)), [{"identifier": "a", "file_name": "a.iso", "size": 1}])
+        stdin = io.TextIOWrapper(io.BytesIO(json.dumps(ENTRIES).encode()))
+        with mock.patch("sys.stdin", stdin):
+            self.assertEqual(ia_catalog.load_catalog("-")[0].entries, ENTRIES)
+        self.assertFalse(stdin.closed)
+
+    def test_broken_json(self):
+        for text in ('[{"identifier": "a"} {"identifier": "b"}]', '[{"identifier": "a"}, {"identif', "[1, 2]", "5"):
+            with self.subTest(text=text), self.assertRaises(ValueError):
+                list(ia_catalog.iter_entries(self.write(text)))
+
+
+if __name__ == "__main__":
+    unittest.main()
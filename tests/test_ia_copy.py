@@ -0,0 +1,52 @@
+import argparse
+import unittest
+
+from _scripts import load_script
+
+iacp = load_script("IA-Copy.py")
+
+
+def filters(**kwargs):
+    return argparse.Namespace(**dict({"glob": None, "include_housekeeping": False, "min_size": None, "max_size": None,
+                                      "keep_unknown_size": True}, **kwargs))
+
+
+class SplitPathTest(unittest.TestCase):
+    def test_identifier_and_file(self):
+        self.assertEqual(iacp.split_path("distro-1.0/isos/disc.iso"), ("distro-1.0", "isos/disc.iso"))
+        self.assertEqual(iacp.split_path("distro-1.0"), ("distro-1.0", ""))
+        with self.assertRaises(argparse.ArgumentTypeError):
+            iacp.split_path("/")
+
+
+class DestinationNamesTest(unittest.TestCase):
+    def test_a_trailing_slash_copies_under_it(self):
+        self.assertEqual(iacp.destination_names(["a.iso", "b.iso"], "isos/"), {"a.iso": "isos/a.iso", "b.iso": "isos/b.iso"})
+        self.assertEqual(iacp.destination_names(["a.iso"], ""), {"a.iso": "a.iso"})
+
+    def test_only_a_single_file_can_be_renamed(self):
+        self.assertEqual(iacp.destination_names(["a.iso"], "renamed.iso"), {"a.iso": "renamed.iso"})
+        with self.assertRaises(ValueError):
+            iacp.destination_names(["a.iso", "b.iso"], "renamed.iso")
+
+
+class SourceFilesTest(unittest.TestCase):
+    METADATA = {"files": [{"name": "disc.iso", "source": "original", "size": "100"},
+                          {"name": "notes.txt", "source": "original", "size": "10"},
+                          {"name": "item_meta.xml", "source": "metadata"}]}
+
+    def names(self, pattern, **kwargs):
+        return [f["name"] for f in iacp.source_files(self.METADATA, "item", pattern, filters(**kwargs))]
+
+    def test_the_files_archive_org_makes_are_not_copied(self):
+        self.assertEqual(self.names(""), ["disc.iso", "notes.txt"])
+        self.assertEqual(self.names("*.xml"), [])
+
+    def test_an_exact_name_wins_over_the_glob_and_filters(self):
+        self.assertEqual(self.names("item_meta.xml"), ["item_meta.xml"])
+        self.assertEqual(self.names("*.iso", min_size=50), ["disc.iso"])
+        self.assertEqual(self.names("", glob="*.txt"), ["notes.txt"])
+
+
+if __name__ == "__main__":
+    unittest.main()
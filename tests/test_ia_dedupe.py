@@ -0,0 +1,102 @@
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from _scripts import load_script
+
+iadd = load_script("IA-Dedupe.py")
+
+ISO = b"disc image\n" * 100
+
+
+class DedupeTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.root = tmp.name
+        self.write("distro-1.0/distro-1.0.iso", ISO)
+        self.write("old/distro.iso", ISO)
+        self.write("old/copy.iso", ISO)
+        # the same size, other content
+        self.write("other/other.iso", ISO[::-1])
+        self.write("distro-1.0/.checksums.json", b"{}")
+        self.write("empty-1", b"")
+        self.write("empty-2", b"")
+        os.link(self.path("old/copy.iso"), self.path("old/copy-link.iso"))
+
+    def path(self, rel):
+        return os.path.join(self.root, *rel.split("/"))
+
+    def write(self, rel, data):
+        os.makedirs(os.path.dirname(self.path(rel)), exist_ok=True)
+        with open(self.path(rel), "wb") as f:
+            f.write(data)
+
+    def groups(self, index=None):
+        files = iadd.scan(self.root, 1)
+        return iadd.find_duplicates(self.root, files, index or iadd.HashIndex(None)), files
+
+    def test_copies_are_grouped_by_content_and_hard_links_are_one_copy(self):
+        (group,), _ = self.groups()
+        self.assertEqual(group.copies, [["distro-1.0/distro-1.0.iso"], ["old/copy-link.iso", "old/copy.iso"], ["old/distro.iso"]])
+        self.assertEqual((group.size, group.wasted), (len(ISO), 2 * len(ISO)))
+
+    def test_a_rerun_takes_unchanged_files_from_the_index(self):
+        index_path = os.path.join(self.root, iadd.INDEX_FILE)
+        index = iadd.HashIndex(index_path)
+        self.groups(index)
+        index.save()
+        with mock.patch.object(iadd, "hash_file", wraps=iadd.hash_file) as hashed:
+            self.groups(iadd.HashIndex(index_path))
+            self.assertEqual(hashed.call_count, 0)
+            with open(self.path("other/other.iso"), "ab") as f:
+                f.write(b"!")
+            self.write("other/other-2.iso", ISO)
+            (group,), _ = self.groups(iadd.HashIndex(index_path))
+        # only the new file; the changed one no longer shares a size with anything
+        self.assertEqual([c.args[0] for c in hashed.call_args_list], [self.path("other/other-2.iso")])
+        self.assertEqual(len(group.copies), 4)
+
+    def test_the_catalog_picks_the_copy_to_keep(self):
+        (group,), files = self.groups()
+        self.assertEqual(iadd.choose_keep(group, "shortest", files), "old/copy.iso")
+        group.catalog = ["distro-1.0/distro-1.0.iso"]
+        self.assertEqual(iadd.choose_keep(group, "shortest", files), "distro-1.0/distro-1.0.iso")
+
+    def test_link_replaces_the_other_copies(self):
+        (group,), files = self.groups()
+        group.keep = "distro-1.0/distro-1.0.iso"
+        self.assertTrue(iadd.resolve(self.root, group, files, iadd.HashIndex(None), link=True, dry_run=False))
+        inode = os.stat(self.path(group.keep)).st_ino
+        self.assertEqual({os.stat(self.path(rel)).st_ino for rel in group.paths}, {inode})
+        self.assertEqual(os.stat(self.path(group.keep)).st_nlink, 4)
+
+    def test_delete_leaves_the_kept_copy_and_its_hard_links(self):
+        (group,), files = self.groups()
+        group.keep = "old/copy.iso"
+        self.assertTrue(iadd.resolve(self.root, group, files, iadd.HashIndex(None), link=False, dry_run=False))
+        self.assertEqual([rel for rel in group.paths if os.path.exists(self.path(rel))], ["old/copy-link.iso", "old/copy.iso"])
+
+    def test_a_copy_changed_since_it_was_hashed_is_left_alone(self):
+        (group,), files = self.groups()
+        group.keep = "distro-1.0/distro-1.0.iso"
+        self.write("old/distro.iso", ISO.upper())
+        with self.assertLogs(level="WARNING"):
+            self.assertFalse(iadd.resolve(self.root, group, files, iadd.HashIndex(None), link=False, dry_run=False))
+        self.assertTrue(os.path.exists(self.path("old/distro.iso")))
+        self.assertFalse(os.path.exists(self.path("old/copy.iso")))
+
+    def test_ask_keep(self):
+        (group,), _ = self.groups()
+        with mock.patch("builtins.input", side_effect=["9", "3"]), mock.patch("builtins.print"):
+            self.assertEqual(iadd.ask_keep(group, "old/distro.iso"), "old/copy.iso")
+        with mock.patch("builtins.input", side_effect=["", "s", "q"]), mock.patch("builtins.print"):
+            self.assertEqual(iadd.ask_keep(group, "old/distro.iso"), "old/distro.iso")
+            self.assertIsNone(iadd.ask_keep(group, "old/distro.iso"))
+            with self.assertRaises(EOFError):
+                iadd.ask_keep(group, "old/distro.iso")
+
+
+if __name__ == "__main__":
+    unittest.main()
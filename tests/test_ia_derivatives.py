@@ -0,0 +1,51 @@
+import unittest
+
+from _scripts import load_script
+
+iader = load_script("IA-Derivatives.py")
+
+FILES = [
+    {"name": "talk.mp4", "source": "original", "format": "MPEG4", "size": "9000"},
+    {"name": "talk.ogv", "source": "derivative", "format": "Ogg Video", "original": "talk.mp4", "size": "4000"},
+    {"name": "talk.gif", "source": "derivative", "format": "Animated GIF", "original": "talk.mp4"},
+    {"name": "talk.thumbs/talk_000001.jpg", "source": "derivative", "format": "Thumbnail", "original": "talk.ogv"},
+    {"name": "captions.srt", "source": "derivative", "format": "SubRip", "original": ["gone.vtt", "talk.mp4"]},
+    {"name": "lost.txt", "source": "derivative", "format": "Text", "original": "deleted.pdf"},
+]
+
+
+def names(nodes):
+    return [n["file"]["name"] for n in nodes]
+
+
+class BuildTreeTest(unittest.TestCase):
+    def test_derivatives_under_their_originals(self):
+        roots = iader.build_tree(FILES)
+        self.assertEqual(names(roots), ["lost.txt", "talk.mp4"])
+        self.assertEqual(names(roots[1]["children"]), ["captions.srt", "talk.gif", "talk.ogv"])
+        self.assertEqual(names(roots[1]["children"][2]["children"]), ["talk.thumbs/talk_000001.jpg"])
+        # a derivative whose original is gone is a root, and says so
+        self.assertTrue(roots[0].get("orphan"))
+        self.assertEqual(iader.text_tree(roots), [
+            "lost.txt  (Text, size unknown)  [original deleted.pdf is not in the item]",
+            "talk.mp4  (MPEG4, 8.8KB)",
+            "  captions.srt  (SubRip, size unknown)",
+            "  talk.gif  (Animated GIF, size unknown)",
+            "  talk.ogv  (Ogg Video, 3.9KB)",
+            "    talk.thumbs/talk_000001.jpg  (Thumbnail, size unknown)",
+        ])
+
+    def test_a_loop_of_originals_is_still_listed(self):
+        files = [{"name": "a", "original": "b"}, {"name": "b", "original": "a"}, {"name": "c"}]
+        with self.assertLogs(level="WARNING"):
+            roots = iader.build_tree(files)
+        self.assertEqual(sorted(names(iader.flatten(roots))), ["a", "b", "c"])
+
+    def test_json_nests_the_derivatives(self):
+        tree = iader.json_tree(iader.build_tree(FILES[:2]))
+        self.assertEqual(tree[0]["derivatives"][0]["name"], "talk.ogv")
+        self.assertEqual(tree[0]["derivatives"][0]["derivatives"], [])
+
+
+if __name__ == "__main__":
+    unittest.main()
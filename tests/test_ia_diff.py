@@ -0,0 +1,71 @@
+import unittest
+
+from _scripts import load_script
+import ia_catalog
+
+iad = load_script("IA-Diff.py")
+
+OLD = [
+    {"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": "1000", "md5": "AAAA"},
+    {"identifier": "distro-1.0", "file_name": "README.txt", "size": "8"},
+    {"identifier": "gone", "file_name": "gone.iso", "size": "5"},
+]
+NEW = [
+    {"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": 1000, "md5": "aaaa", "title": "renamed"},
+    {"identifier": "distro-1.0", "file_name": "README.txt", "size": "9"},
+    {"identifier": "distro-2.0", "file_name": "distro-2.0.img", "size": "2048"},
+]
+
+
+def keyed(entries):
+    return iad.keyed(ia_catalog.Catalog(entries), "catalog.json")
+
+
+class DiffTest(unittest.TestCase):
+    def test_added_removed_and_changed(self):
+        result = iad.diff(keyed(OLD), keyed(NEW))
+        self.assertEqual([e["identifier"] for e in result["added"]], ["distro-2.0"])
+        self.assertEqual([e["identifier"] for e in result["removed"]], ["gone"])
+        # a size given as text and as a number, or an md5 in another case, is no change; nor is another title
+        self.assertEqual(result["changed"], [{"identifier": "distro-1.0", "file_name": "README.txt", "changes": {"size": ["8", "9"]}}])
+
+    def test_same_catalogs(self):
+        self.assertEqual(iad.diff(keyed(OLD), keyed(OLD)), {"added": [], "removed": [], "changed": []})
+
+    def test_md5_appearing_is_a_change(self):
+        result = iad.diff(keyed(OLD[2:]), keyed([dict(OLD[2], md5="beef")]))
+        self.assertEqual(result["changed"][0]["changes"], {"md5": [None, "beef"]})
+
+    def test_entries_without_a_key_are_left_out(self):
+        with self.assertLogs(level="WARNING") as logs:
+            entries = keyed([{"identifier": "a"}, {"file_name": "b"}, {"identifier": "a", "file_name": "x", "size": 1},
+                             {"identifier": "a", "file_name": "x", "size": 2}])
+        self.assertEqual(entries, {("a", "x"): {"identifier": "a", "file_name": "x", "size": 2}})
+        self.assertEqual(len(logs.output), 3)
+
+
+class ReportTest(unittest.TestCase):
+    def setUp(self):
+        self.result = iad.diff(keyed(OLD), keyed(NEW))
+        self.counts = iad.summary(self.result, len(OLD), len(NEW))
+
+    def test_text(self):
+        self.assertEqual(iad.text_report(self.result, self.counts).splitlines(), [
+            "1 added, 1 removed, 1 changed (3 entries before, 3 after)",
+            "+ distro-2.0/distro-2.0.img (2.0KB)",
+            "- gone/gone.iso (5.0B)",
+            "~ distro-1.0/README.txt: size 8.0B -> 9.0B",
+        ])
+
+    def test_markdown_tables(self):
+        report = iad.markdown_report(self.result, self.counts, "old.json", "new.json")
+        self.assertIn("### Added\n\n| identifier | file | size |\n|---|---|---|\n| distro-2.0 | distro-2.0.img | 2.0KB |", report)
+        self.assertIn("| distro-1.0 | README.txt | size 8.0B -> 9.0B |", report)
+        self.assertNotIn("### Removed\n\n| identifier | file | size |\n|---|---|---|\n\n", report)
+
+    def test_markdown_escapes_the_cell_separator(self):
+        self.assertEqual(iad.cell("a|b"), "a\\|b")
+
+
+if __name__ == "__main__":
+    unittest.main()
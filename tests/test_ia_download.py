@@ -0,0 +1,704 @@
+import hashlib
+import io
+import json
+import logging
+import os
+import signal
+import socket
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+import unittest
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from unittest import mock
+
+import requests
+
+import _scripts  # noqa: F401  (puts the repository root on sys.path)
+import ia_common
+import ia_download
+
+
+class SafeRelpathTest(unittest.TestCase):
+    def test_separators_normalized(self):
+        for windows in (False, True):
+            with self.subTest(windows=windows):
+                self.assertEqual(ia_download.safe_relpath("disk1/readme.txt", windows), "disk1/readme.txt")
+                self.assertEqual(ia_download.safe_relpath("disk1\\sub/readme.txt", windows), "disk1/sub/readme.txt")
+                self.assertEqual(ia_download.safe_relpath("/disk1//./readme.txt", windows), "disk1/readme.txt")
+
+    def test_stays_inside_item_directory(self):
+        for windows in (False, True):
+            with self.subTest(windows=windows):
+                self.assertEqual(ia_download.safe_relpath("../../etc/passwd", windows), "_/_/etc/passwd")
+                self.assertEqual(ia_download.safe_relpath("/", windows), "_")
+
+    def test_posix_keeps_windows_only_characters(self):
+        self.assertEqual(ia_download.safe_relpath("what?/aux/file.", False), "what?/aux/file.")
+
+    def test_windows_reserved_names(self):
+        self.assertEqual(ia_download.safe_relpath("aux", True), "_aux")
+        self.assertEqual(ia_download.safe_relpath("disk/CON.txt", True), "disk/_CON.txt")
+        self.assertEqual(ia_download.safe_relpath("lpt9/com1.tar.gz", True), "_lpt9/_com1.tar.gz")
+        self.assertEqual(ia_download.safe_relpath("console.txt", True), "console.txt")
+        self.assertEqual(ia_download.safe_relpath("com0.txt", True), "com0.txt")
+
+    def test_windows_invalid_characters_and_trailing_dots(self):
+        self.assertEqual(ia_download.safe_relpath('a<b>:c"d|e?f*.txt', True), "a_b__c_d_e_f_.txt")
+        self.assertEqual(ia_download.safe_relpath("notes.../readme. ", True), "notes/readme")
+        self.assertEqual(ia_download.safe_relpath("dir/... /x", True), "dir/_/x")
+
+
+class LocalNamesTest(unittest.TestCase):
+    def test_unchanged_names_win_collisions(self):
+        files = [{"name": "a?.txt"}, {"name": "a_.txt"}, {"name": "b.txt"}]
+        self.assertEqual(ia_download.local_names(files, True), {"a?.txt": "a_ (2).txt", "a_.txt": "a_.txt", "b.txt": "b.txt"})
+
+    def test_sanitized_names_disambiguated_in_order(self):
+        files = [{"name": "x/a?.txt"}, {"name": "x/a*.txt"}, {"name": "x\\a|.txt"}]
+        self.assertEqual(ia_download.local_names(files, True), {"x/a?.txt": "x/a_.txt", "x/a*.txt": "x/a_ (2).txt", "x\\a|.txt": "x/a_ (3).txt"})
+
+    def test_windows_collisions_ignore_case(self):
+        files = [{"name": "Readme.txt"}, {"name": "README.TXT."}]
+        self.assertEqual(ia_download.local_names(files, True), {"Readme.txt": "Readme.txt", "README.TXT.": "README (2).TXT"})
+        self.assertEqual(ia_download.local_names(files, False), {"Readme.txt": "Readme.txt", "README.TXT.": "README.TXT."})
+
+    def test_mixed_separators_collide(self):
+        files = [{"name": "disk1/readme.txt"}, {"name": "disk1\\readme.txt"}]
+        self.assertEqual(ia_download.local_names(files, False), {"disk1/readme.txt": "disk1/readme.txt", "disk1\\readme.txt": "disk1/readme (2).txt"})
+
+
+@unittest.skipUnless(os.name == "nt", "Windows path handling")
+class WindowsLongPathTest(unittest.TestCase):
+    def test_long_paths_prefixed(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            path = ia_download.long_path(os.path.join(tmp, *(["d" * 50] * 6), "file.txt"))
+            self.assertTrue(path.startswith("\\\\?\\"))
+            os.makedirs(os.path.dirname(path))
+            with open(path, "w") as fh:
+                fh.write("ok")
+            self.assertTrue(os.path.isfile(path))
+
+    def test_short_paths_untouched(self):
+        self.assertEqual(ia_download.long_path("C:/x/y.txt"), "C:/x/y.txt")
+
+
+class LongPathOutsideWindowsTest(unittest.TestCase):
+    @unittest.skipIf(os.name == "nt", "POSIX only")
+    def test_untouched(self):
+        path = "/x/" + "d" * 300
+        self.assertEqual(ia_download.long_path(path), path)
+
+
+class StreamHashTest(unittest.TestCase):
+    DATA = b"0123456789" * 100
+
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.part = os.path.join(self.tmp.name, "disc.iso.part")
+        with open(self.part, "wb") as fh:
+            fh.write(self.DATA[:400])
+
+    def tearDown(self):
+        self.tmp.cleanup()
+
+    def test_streamed_resume_needs_no_re_read(self):
+        h = ia_download.StreamHash(["md5"])
+        h.update(self.DATA[:400])
+        h.resume(self.part, 400)
+        h.update(self.DATA[400:])
+        self.assertEqual(h.method, "streamed")
+        self.assertEqual(h.hexdigests(), {"md5": hashlib.md5(self.DATA).hexdigest()})
+
+    def test_partial_from_earlier_run_is_re_read(self):
+        h = ia_download.StreamHash(["md5"])
+        h.resume(self.part, 400)
+        h.update(self.DATA[400:])
+        self.assertEqual(h.method, "re-read")
+        self.assertEqual(h.hexdigests(), {"md5": hashlib.md5(self.DATA).hexdigest()})
+
+    def test_every_digest_in_one_pass(self):
+        h = ia_download.StreamHash(["md5", "sha1"])
+        for start in range(0, len(self.DATA), 300):
+            h.update(self.DATA[start:start + 300])
+        self.assertEqual(h.hexdigests(), {"md5": hashlib.md5(self.DATA).hexdigest(), "sha1": hashlib.sha1(self.DATA).hexdigest()})
+        self.assertEqual(h.seen, len(self.DATA))
+
+    def test_hash_file_reads_the_file_once_for_all(self):
+        with mock.patch("builtins.open", wraps=open) as opened:
+            digests = ia_download.hash_file(self.part, ["sha1", "md5"])
+        self.assertEqual(opened.call_count, 1)
+        self.assertEqual(digests, {"sha1": hashlib.sha1(self.DATA[:400]).hexdigest(), "md5": hashlib.md5(self.DATA[:400]).hexdigest()})
+
+    def test_restart_discards_what_was_seen(self):
+        h = ia_download.StreamHash(["md5"])
+        h.update(b"stale")
+        h.reset()
+        h.update(self.DATA)
+        self.assertEqual(h.hexdigests(), {"md5": hashlib.md5(self.DATA).hexdigest()})
+
+
+class ChecksumDBTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.dir = tmp.name
+        self.db = ia_download.ChecksumDB(os.path.join(self.dir, "checksums.sqlite"))
+        self.addCleanup(self.db.close)
+        self.file = os.path.join(self.dir, "disc.iso")
+        with open(self.file, "wb") as f:
+            f.write(b"disc")
+
+    def test_digests_hold_until_the_file_changes(self):
+        self.db.record(self.file, {"md5": "a" * 32}, "distro-1.0")
+        self.db.record(self.file, {"sha1": "b" * 40})
+        self.assertEqual(self.db.digests(self.file, ["md5", "sha1"]), {"md5": "a" * 32, "sha1": "b" * 40})
+        self.assertEqual(self.db.known(self.file)["identifier"], "distro-1.0")
+        with open(self.file, "ab") as f:
+            f.write(b"!")
+        self.assertIsNone(self.db.digests(self.file, ["md5"]))
+        self.db.record(self.file, {"md5": "c" * 32})
+        # the sha1 was of the old content
+        self.assertIsNone(self.db.digests(self.file, ["md5", "sha1"]))
+
+    def test_export_load_and_prune(self):
+        self.db.record(self.file, {"md5": "a" * 32})
+        records = self.db.export()
+        self.assertEqual([r["path"] for r in records], [os.path.abspath(self.file)])
+        other = ia_download.ChecksumDB(os.path.join(self.dir, "other.sqlite"))
+        self.addCleanup(other.close)
+        gone = dict(records[0], path=os.path.join(self.dir, "gone.iso"))
+        self.assertEqual(other.load(records + [gone]), 2)
+        self.assertEqual(other.digests(self.file, ["md5"]), {"md5": "a" * 32})
+        self.assertEqual(other.prune(), 1)
+        self.assertEqual(len(other.export()), 1)
+        with self.assertRaises(ValueError):
+            other.load([{"path": self.file}])
+
+    def test_threads_share_one_database(self):
+        paths = []
+        for n in range(8):
+            paths.append(os.path.join(self.dir, f"{n}.iso"))
+            with open(paths[-1], "wb") as f:
+                f.write(bytes([n]))
+        threads = [threading.Thread(target=self.db.record, args=(path, {"md5": f"{n:032d}"})) for n, path in enumerate(paths)]
+        for t in threads:
+            t.start()
+        for t in threads:
+            t.join()
+        self.assertEqual([self.db.digests(path, ["md5"]) for path in paths], [{"md5": f"{n:032d}"} for n in range(8)])
+
+
+class StatusLineTest(unittest.TestCase):
+    def test_glyphs(self):
+        self.assertEqual(ia_download.status_line("[1/2 50.0%]", "done", "Done: a.iso"), "[1/2 50.0%] [✔] Done: a.iso")
+        self.assertEqual(ia_download.status_line("[2/2 100.0%]", "failed", "Failed: b.iso - boom"), "[2/2 100.0%] [✗] Failed: b.iso - boom")
+        self.assertEqual((ia_download.status_tag("exists"), ia_download.status_tag("download")), ("[✓]", "[↓]"))
+
+    def test_ascii(self):
+        self.assertEqual(ia_download.status_line("[1/2 50.0%]", "done", "Done: a.iso", ascii_only=True), "[1/2 50.0%] [OK] Done: a.iso")
+        self.assertEqual(ia_download.status_line("[2/2 100.0%]", "failed", "Failed: b.iso - boom", ascii_only=True),
+                         "[2/2 100.0%] [FAIL] Failed: b.iso - boom")
+        for kind in ia_download.STATUS_GLYPHS:
+            with self.subTest(kind=kind):
+                self.assertTrue(ia_download.status_tag(kind, ascii_only=True).isascii())
+
+    def test_consoles_that_cannot_print_the_glyphs_fall_back(self):
+        for encoding, glyphs in (("utf-8", True), ("cp1252", False), ("cp437", False), ("ascii", False), ("no-such-codec", False)):
+            with self.subTest(encoding=encoding):
+                stream = mock.Mock(encoding=encoding)
+                self.assertEqual(ia_download.supports_glyphs(stream), glyphs)
+        self.assertTrue(ia_download.supports_glyphs(io.StringIO()))
+
+
+class RateLimiterTest(unittest.TestCase):
+    def test_chunk_larger_than_bucket_only_delays(self):
+        limiter = ia_download.RateLimiter(1000)
+        with mock.patch.object(ia_download.time, "sleep") as sleep:
+            limiter.consume(5000)
+        (wait,), _ = sleep.call_args
+        self.assertAlmostEqual(wait, 5.0, places=1)
+
+    def test_shared_debt_paces_every_transfer(self):
+        limiter = ia_download.RateLimiter(1000)
+        waits = []
+        with mock.patch.object(ia_download.time, "sleep", side_effect=waits.append):
+            limiter.consume(500)
+            limiter.consume(500)
+        # the second transfer also owes for the first one's bytes
+        self.assertGreater(waits[1], waits[0])
+        self.assertAlmostEqual(waits[1], 1.0, places=1)
+
+    def test_chunk_size_follows_rate(self):
+        self.assertEqual(ia_download.RateLimiter(100).chunk_size, 16 * 1024)
+        self.assertEqual(ia_download.RateLimiter(1024 ** 3).chunk_size, ia_download.CHUNK_SIZE)
+
+
+class FakeResponse:
+    def __init__(self, status_code, body=b"", headers=None, cut=None):
+        self.status_code = status_code
+        self.body = body
+        self.headers = headers or {}
+        # raise after this many bytes, like a connection dropped mid-body
+        self.cut = cut
+        self.history = []
+        self.url = "https://ia800100.us.archive.org/x"
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        return False
+
+    def raise_for_status(self):
+        if self.status_code >= 400:
+            raise requests.HTTPError(f"{self.status_code} error", response=self)
+
+    def iter_content(self, chunk_size):
+        sent = 0
+        for i in range(0, len(self.body), chunk_size):
+            chunk = self.body[i:i + chunk_size]
+            if self.cut is not None and sent + len(chunk) > self.cut:
+                yield chunk[: self.cut - sent]
+                raise requests.ConnectionError("connection reset")
+            sent += len(chunk)
+            yield chunk
+
+
+class FakeFileSession:
+    """Serves DATA, honoring Range headers; answers lists responses to hand out first, by attempt."""
+
+    def __init__(self, data, answers=()):
+        self.data = data
+        self.answers = list(answers)
+        self.ranges = []
+
+    def get(self, url, stream=False, timeout=None, headers=None):
+        rng = (headers or {}).get("Range")
+        self.ranges.append(rng)
+        if self.answers:
+            return self.answers.pop(0)
+        if not rng:
+            return FakeResponse(200, self.data, {"Content-Length": str(len(self.data))})
+        first, _, last = rng[len("bytes="):].partition("-")
+        first, last = int(first), int(last) if last else len(self.data) - 1
+        if first >= len(self.data):
+            return FakeResponse(416)
+        return FakeResponse(206, self.data[first:last + 1])
+
+
+class RecordingProgress(ia_download.Progress):
+    def __init__(self, events, prefix):
+        self.events = events
+        self.prefix = prefix
+
+    def update(self, done, total, rate):
+        self.events.append((self.prefix, done, total))
+
+    def end(self):
+        self.events.append((self.prefix, "end"))
+
+
+@mock.patch.object(ia_download.STOP, "wait", return_value=False)
+class DownloaderTest(unittest.TestCase):
+    DATA = bytes(range(256)) * 40
+
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.part = os.path.join(self.tmp.name, "disc.iso.part")
+        self.events = []
+
+    def tearDown(self):
+        self.tmp.cleanup()
+
+    def downloader(self, session, **kwargs):
+        return ia_download.Downloader(session, progress=lambda prefix: RecordingProgress(self.events, prefix), **kwargs)
+
+    def read_part(self):
+        with open(self.part, "rb") as fh:
+            return fh.read()
+
+    def test_progress_events_for_one_stream(self, wait):
+        d = self.downloader(FakeFileSession(self.DATA))
+        d.chunk_size = 4096
+        transfer = d.fetch("u", self.part, len(self.DATA), "disc.iso")
+        self.assertEqual(transfer, ia_download.Transfer(len(self.DATA), False))
+        self.assertEqual(self.events, [("disc.iso", 4096, 10240), ("disc.iso", 8192, 10240),
+                                       ("disc.iso", 10240, 10240), ("disc.iso", "end")])
+        self.assertEqual(self.read_part(), self.DATA)
+
+    def test_retry_resumes_with_a_range_request(self, wait):
+        session = FakeFileSession(self.DATA, [FakeResponse(200, self.DATA, cut=3000)])
+        d = self.downloader(session, checksum=True)
+        with self.assertLogs(level="WARNING") as logs:
+            transfer = d.fetch("u", self.part, len(self.DATA), "disc.iso", algos=["md5"])
+        self.assertRegex(logs.output[0], r"connection reset; retrying in [01]\.\ds \(1/3\)")
+        self.assertEqual(session.ranges, [None, "bytes=3000-"])
+        self.assertEqual(transfer.received, len(self.DATA))
+        self.assertEqual((transfer.digests, transfer.method), ({"md5": hashlib.md5(self.DATA).hexdigest()}, "streamed"))
+        # the failed attempt's line is ended before the retry warning
+        self.assertEqual(self.events.count(("disc.iso", "end")), 2)
+        self.assertEqual(self.read_part(), self.DATA)
+
+    def test_streamed_digests_are_the_ones_asked_for(self, wait):
+        d = self.downloader(FakeFileSession(self.DATA), checksum=True)
+        transfer = d.fetch("u", self.part, len(self.DATA), "disc.iso", algos=["md5", "sha1"])
+        self.assertEqual(transfer.digests, {"md5": hashlib.md5(self.DATA).hexdigest(), "sha1": hashlib.sha1(self.DATA).hexdigest()})
+        self.assertEqual(transfer.method, "streamed")
+        self.assertIsNone(self.downloader(FakeFileSession(self.DATA), checksum=True).fetch("u", self.part, len(self.DATA), "disc.iso").digests)
+
+    def test_complete_partial_from_earlier_run(self, wait):
+        with open(self.part, "wb") as fh:
+            fh.write(self.DATA)
+        d = self.downloader(FakeFileSession(self.DATA), checksum=True)
+        transfer = d.fetch("u", self.part, len(self.DATA), "disc.iso", algos=["md5"])
+        self.assertEqual(transfer, ia_download.Transfer(0, False, {"md5": hashlib.md5(self.DATA).hexdigest()}, "re-read"))
+        self.assertIn(("[md5] disc.iso", len(self.DATA), len(self.DATA)), self.events)
+
+    def test_resume_off_starts_over(self, wait):
+        with open(self.part, "wb") as fh:
+            fh.write(b"stale")
+        session = FakeFileSession(self.DATA)
+        self.downloader(session, resume=False).fetch("u", self.part, len(self.DATA), "disc.iso")
+        self.assertEqual(session.ranges, [None])
+        self.assertEqual(self.read_part(), self.DATA)
+
+    def test_not_found_is_not_retried(self, wait):
+        session = FakeFileSession(self.DATA, [FakeResponse(404)])
+        with self.assertRaises(ia_common.NotFound):
+            self.downloader(session, retries=3).fetch("u", self.part, None, "disc.iso")
+        self.assertEqual(len(session.ranges), 1)
+
+    def test_rate_limit_waits_as_asked(self, wait):
+        session = FakeFileSession(self.DATA, [FakeResponse(429, headers={"Retry-After": "12"})])
+        with self.assertLogs(level="WARNING"):
+            self.downloader(session).fetch("u", self.part, len(self.DATA), "disc.iso")
+        wait.assert_called_once_with(12)
+        self.assertEqual(self.read_part(), self.DATA)
+
+    @mock.patch.object(ia_download, "SEGMENT_MIN_BYTES", 1024)
+    def test_segments_are_hashed_once_complete(self, wait):
+        session = FakeFileSession(self.DATA)
+        transfer = self.downloader(session, segments=4).fetch("u", self.part, len(self.DATA), "disc.iso", algos=["md5"])
+        self.assertEqual(sorted(session.ranges), ["bytes=0-2559", "bytes=2560-5119", "bytes=5120-7679", "bytes=7680-10239"])
+        self.assertEqual(transfer, ia_download.Transfer(len(self.DATA), True, {"md5": hashlib.md5(self.DATA).hexdigest()}, "re-read"))
+        done = [e[1] for e in self.events if e[0] == "disc.iso" and e[1] != "end"]
+        self.assertEqual(done[-1], len(self.DATA))
+
+    @mock.patch.object(ia_download, "SEGMENT_MIN_BYTES", 1024)
+    def test_ignored_range_falls_back_to_one_stream(self, wait):
+        session = FakeFileSession(self.DATA, [FakeResponse(200, self.DATA)] * 4)
+        with self.assertLogs(level="WARNING") as logs:
+            transfer = self.downloader(session, segments=4).fetch("u", self.part, len(self.DATA), "disc.iso")
+        self.assertIn("falling back to a single stream", logs.output[0])
+        self.assertFalse(transfer.segmented)
+        self.assertEqual(session.ranges[-1], None)
+        self.assertEqual(self.read_part(), self.DATA)
+
+
+
+class StallingHandler(BaseHTTPRequestHandler):
+    """Sends the headers and the first 1000 of 10000 bytes, then nothing until the test ends."""
+
+    def log_message(self, *args):
+        pass
+
+    def do_GET(self):
+        self.send_response(200)
+        self.send_header("Content-Length", "10000")
+        self.end_headers()
+        self.wfile.write(b"x" * 1000)
+        self.wfile.flush()
+        self.server.release.wait(30)
+
+
+class StopAbortsStalledReadTest(unittest.TestCase):
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.part = os.path.join(self.tmp.name, "disc.iso.part")
+
+    def tearDown(self):
+        ia_download.STOP.clear()
+        ia_download.ABORT.clear()
+        self.tmp.cleanup()
+
+    def serve(self, protocol):
+        handler = type("Handler", (StallingHandler,), {"protocol_version": protocol})
+        server = ThreadingHTTPServer(("127.0.0.1", 0), handler)
+        server.release = threading.Event()
+        threading.Thread(target=server.serve_forever, args=(0.05,), daemon=True).start()
+        self.addCleanup(server.server_close)
+        self.addCleanup(server.shutdown)
+        self.addCleanup(server.release.set)
+        return f"http://127.0.0.1:{server.server_address[1]}/disc.iso"
+
+    def stop_mid_read(self, url, drain=0.0):
+        started = threading.Event()
+
+        class Started(ia_download.Progress):
+            def update(self, done, total, rate):
+                started.set()
+
+        downloader = ia_download.Downloader(requests.Session(), retries=3, progress=lambda prefix: Started())
+        # reads block until a whole chunk has arrived
+        downloader.chunk_size = 500
+        outcome = []
+
+        def transfer():
+            try:
+                downloader.fetch(url, self.part, 10000, "disc.iso", timeout=60)
+            except Exception as e:
+                outcome.append(e)
+
+        worker = threading.Thread(target=transfer, daemon=True)
+        worker.start()
+        self.assertTrue(started.wait(5))
+        stopped = time.monotonic()
+        with self.assertLogs(level="WARNING"):
+            ia_download.Shutdown(drain).handle(signal.SIGINT, None)
+        worker.join(5)
+        self.assertFalse(worker.is_alive())
+        self.assertGreaterEqual(time.monotonic() - stopped, drain)
+        self.assertLess(time.monotonic() - stopped, drain + 2)
+        self.assertIsInstance(outcome[0], ia_download.Interrupted)
+        # what arrived stays for the next run
+        self.assertEqual(os.path.getsize(self.part), 1000)
+
+    def test_keep_alive_connection(self):
+        self.stop_mid_read(self.serve("HTTP/1.1"))
+
+    def test_connection_closed_after_the_response(self):
+        # http.client hands the socket over to the response in this case
+        self.stop_mid_read(self.serve("HTTP/1.0"))
+
+    def test_transfers_in_flight_get_the_drain_time(self):
+        self.stop_mid_read(self.serve("HTTP/1.1"), drain=0.5)
+
+
+class ShutdownTest(unittest.TestCase):
+    def tearDown(self):
+        ia_download.STOP.clear()
+        ia_download.ABORT.clear()
+
+    def test_hooks_run_once_and_a_failing_one_does_not_stop_the_others(self):
+        calls = []
+        shutdown = ia_download.Shutdown()
+        shutdown.on_exit(lambda: calls.append("report"))
+        shutdown.on_exit(lambda: 1 / 0)
+        shutdown.on_exit(lambda: calls.append("warc"))
+        with self.assertLogs(level="ERROR") as logs:
+            shutdown.finish()
+        shutdown.finish()
+        self.assertEqual(calls, ["report", "warc"])
+        self.assertIn("ZeroDivisionError", logs.output[0])
+
+    def test_first_signal_stops_new_work_and_the_second_exits_after_the_hooks(self):
+        calls = []
+        shutdown = ia_download.Shutdown(drain=30)
+        shutdown.on_exit(lambda: calls.append("report"))
+        with self.assertLogs(level="WARNING"):
+            shutdown.handle(signal.SIGTERM, None)
+        self.assertTrue(ia_download.STOP.is_set())
+        self.assertFalse(ia_download.ABORT.is_set())
+        with self.assertLogs(level="WARNING") as logs, mock.patch.object(ia_download.os, "_exit", side_effect=SystemExit) as exit_:
+            with self.assertRaises(SystemExit):
+                shutdown.handle(signal.SIGINT, None)
+        exit_.assert_called_once_with(ia_download.EXIT_INTERRUPTED)
+        self.assertTrue(ia_download.ABORT.is_set())
+        self.assertEqual(calls, ["report"])
+        self.assertIn("SIGINT received again: quitting now", logs.output[0])
+        self.assertTrue(shutdown.timer.finished.is_set())
+
+    def test_signal_delivered_to_the_process(self):
+        shutdown = ia_download.Shutdown(drain=0).install()
+        for sig in (signal.SIGINT, signal.SIGTERM):
+            self.addCleanup(signal.signal, sig, signal.SIG_DFL if sig == signal.SIGTERM else signal.default_int_handler)
+        with self.assertLogs(level="WARNING"):
+            os.kill(os.getpid(), signal.SIGTERM)
+            # the handler runs in the main thread at the next bytecode
+            time.sleep(0.01)
+        self.assertTrue(ia_download.ABORT.is_set())
+        self.assertIsNone(shutdown.timer)
+
+
+class DirectoryLockTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.dir = tmp.name
+        self.path = os.path.join(self.dir, ia_download.LOCK_FILE)
+
+    def lock(self, tool="first") -> ia_download.DirectoryLock:
+        lock = ia_download.DirectoryLock(self.dir, tool)
+        self.addCleanup(lock.release)
+        return lock
+
+    def write_owner(self, **owner):
+        with open(self.path, "w", encoding="utf-8") as f:
+            json.dump(owner, f)
+
+    def test_second_run_is_refused_while_the_first_holds_the_lock(self):
+        first = self.lock().acquire()
+        with open(self.path, encoding="utf-8") as f:
+            owner = json.load(f)
+        self.assertEqual((owner["pid"], owner["host"], owner["tool"]), (os.getpid(), socket.gethostname(), "first"))
+        with self.assertRaises(ia_download.LockHeld) as caught:
+            self.lock("second").acquire()
+        self.assertIn(f"held by first (pid {os.getpid()}", str(caught.exception))
+        first.release()
+        self.assertFalse(os.path.exists(self.path))
+        self.lock("second").acquire()
+
+    def test_waits_for_the_lock_until_the_timeout(self):
+        self.lock().acquire()
+        with mock.patch.object(ia_download.STOP, "wait", return_value=False) as wait, \
+                mock.patch.object(ia_download.time, "monotonic", side_effect=[0, 0, 1, 2, 3]), self.assertLogs(level="WARNING") as logs:
+            with self.assertRaises(ia_download.LockHeld):
+                self.lock("second").acquire(wait=2.5)
+        self.assertEqual([c.args[0] for c in wait.call_args_list], [1.0, 1.0, 0.5])
+        self.assertIn("waiting up to 2.5s for it", logs.output[0])
+
+    def test_gets_the_lock_once_the_holder_lets_go(self):
+        first = self.lock().acquire()
+        second = self.lock("second")
+        with mock.patch.object(ia_download.STOP, "wait", side_effect=lambda timeout: first.release()), self.assertLogs(level="WARNING"):
+            second.acquire(wait=60)
+        self.assertTrue(second.held)
+
+    def test_stale_lock_of_a_process_gone_is_taken_over(self):
+        done = subprocess.run([sys.executable, "-c", "import os; print(os.getpid())"], capture_output=True, text=True, check=True)
+        self.write_owner(pid=int(done.stdout), host=socket.gethostname(), tool="crashed", started="2024-01-01T00:00:00Z")
+        with self.assertLogs(level="WARNING") as logs:
+            lock = self.lock().acquire()
+        self.assertIn("crashed (pid", logs.output[0])
+        self.assertIn("is no longer running", logs.output[0])
+        self.assertTrue(lock.held)
+        self.assertEqual(os.listdir(self.dir), [ia_download.LOCK_FILE])
+
+    def test_lock_of_another_host_is_never_stale(self):
+        self.write_owner(pid=1, host="elsewhere.example", tool="remote")
+        with self.assertRaises(ia_download.LockHeld) as caught:
+            self.lock().acquire()
+        self.assertIn("on elsewhere.example", str(caught.exception))
+
+    def test_unreadable_lock_is_stale_only_once_it_is_old(self):
+        with open(self.path, "w") as f:
+            f.write("")
+        with self.assertRaises(ia_download.LockHeld):
+            self.lock().acquire()
+        old = time.time() - ia_download.LOCK_UNREADABLE_STALE - 1
+        os.utime(self.path, (old, old))
+        with self.assertLogs(level="WARNING"):
+            self.lock().acquire()
+
+    def test_release_leaves_a_lock_taken_over_by_another_run(self):
+        lock = self.lock().acquire()
+        self.write_owner(pid=os.getpid(), host="elsewhere.example", tool="other")
+        lock.release()
+        lock.release()
+        self.assertTrue(os.path.exists(self.path))
+
+    def test_stop_while_waiting_is_an_interruption(self):
+        self.lock().acquire()
+        with mock.patch.object(ia_download.STOP, "wait", return_value=True), self.assertLogs(level="WARNING"):
+            with self.assertRaises(ia_download.Interrupted):
+                self.lock("second").acquire(wait=60)
+
+
+
+class StatsFileTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.path = os.path.join(tmp.name, "stats.json")
+
+    def stats_file(self, interval=3600) -> ia_download.StatsFile:
+        stats_file = ia_download.StatsFile(self.path, interval, "test").start()
+        self.addCleanup(stats_file.finish, None)
+        return stats_file
+
+    def read(self) -> dict:
+        with open(self.path, encoding="utf-8") as f:
+            return json.load(f)
+
+    def test_first_write_at_the_start_and_the_last_marked_finished(self):
+        stats_file = self.stats_file()
+        first = self.read()
+        self.assertEqual((first["tool"], first["pid"], first["finished"], first["exit_status"]), ("test", os.getpid(), False, None))
+        stats_file.begin(4)
+        stats_file.item_done()
+        ia_download.count_received(1000)
+        stats_file.update(files_failed=1)
+        stats_file.finish(3)
+        stats_file.finish(0)
+        last = self.read()
+        self.assertEqual((last["finished"], last["exit_status"]), (True, 3))
+        self.assertEqual((last["items_done"], last["items_total"], last["items_remaining"]), (1, 4, 3))
+        self.assertEqual((last["bytes"], last["files_failed"], last["active_transfers"]), (1000, 1, 0))
+        self.assertFalse(os.path.exists(self.path + ".tmp"))
+
+    def test_eta_from_the_items_done_so_far(self):
+        stats_file = ia_download.StatsFile(None, 30, "test")
+        with mock.patch.object(ia_download.time, "time", return_value=100.0):
+            stats_file.begin(5)
+        self.assertIsNone(stats_file.snapshot()["eta_seconds"])
+        stats_file.item_done()
+        stats_file.item_done()
+        with mock.patch.object(ia_download.time, "time", return_value=160.0):
+            self.assertEqual(stats_file.snapshot()["eta_seconds"], 90)
+
+    def test_rewritten_every_interval_from_its_own_thread(self):
+        stats_file = self.stats_file(interval=0.01)
+        stats_file.begin(2)
+        stats_file.item_done()
+        deadline = time.time() + 5
+        while self.read()["items_done"] != 1 and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertEqual(self.read()["items_done"], 1)
+        stats_file.finish(0)
+        stats_file.thread.join(5)
+        self.assertFalse(stats_file.thread.is_alive())
+
+    def test_recent_errors_are_the_last_warnings_logged(self):
+        # the stats file as the only handler, so the warnings aren't printed too
+        self.enterContext(mock.patch.object(logging.getLogger(), "handlers", []))
+        stats_file = self.stats_file()
+        logging.info("not an error")
+        for n in range(ia_download.StatsFile.RECENT_ERRORS + 2):
+            logging.warning(f"retrying {n}")
+        stats_file.record("x.iso: md5 mismatch")
+        stats_file.finish(3)
+        errors = self.read()["recent_errors"]
+        self.assertEqual(len(errors), ia_download.StatsFile.RECENT_ERRORS)
+        self.assertEqual(errors[-1]["message"], "x.iso: md5 mismatch")
+        self.assertEqual(errors[0]["message"], "retrying 3")
+
+    def test_the_circuit_breaker_state_is_noted(self):
+        self.enterContext(mock.patch.object(logging.getLogger(), "handlers", []))
+        stats_file = self.stats_file()
+        breaker = ia_common.CircuitBreaker(threshold=1, window=1, cooldown=30)
+        breaker.record(False)
+        stats_file.finish(0)
+        stats = self.read()
+        self.assertEqual((stats["circuit_breaker"]["state"], stats["circuit_breaker"]["pauses"]), ("open", 1))
+        self.assertIn("pausing every request for 30s", stats["recent_errors"][0]["message"])
+
+    def test_a_write_that_fails_is_logged_once_and_the_run_goes_on(self):
+        stats_file = ia_download.StatsFile(os.path.join(self.path, "no", "such", "dir.json"), 30, "test")
+        with self.assertLogs(level="WARNING") as logs:
+            stats_file.write()
+            stats_file.write()
+        self.assertEqual(len(logs.output), 1)
+        self.assertIn("could not write it", logs.output[0])
+
+    def test_without_a_path_nothing_is_written(self):
+        stats_file = ia_download.StatsFile(None, 30, "test").start()
+        stats_file.finish(0)
+        self.assertIsNone(stats_file.thread)
+        self.assertFalse(os.path.exists(self.path))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,77 @@
+import argparse
+import unittest
+import xml.etree.ElementTree as ET
+from datetime import datetime, timezone
+
+from _scripts import load_script
+
+iaf = load_script("IA-Feed.py")
+
+A = "{http://www.w3.org/2005/Atom}"
+DOCS = [
+    {"identifier": "new-item", "title": "New", "publicdate": "2024-05-02T10:00:00Z", "creator": ["Ann", "Bo"],
+     "description": "<p>a &amp; b</p>", "mediatype": "software"},
+    {"identifier": "old-item", "publicdate": "2024-05-01T09:30:00Z"},
+    {"title": "no identifier"},
+]
+
+
+def feed(docs=DOCS, **kwargs):
+    args = dict(title="Feed", feed_id="https://example.org/feed.xml", self_url="https://example.org/feed.xml",
+                alternate="https://archive.org/search?query=x", now=datetime(2024, 6, 1, tzinfo=timezone.utc))
+    args.update(kwargs)
+    return iaf.build_feed(docs, **args)
+
+
+class BuildFeedTest(unittest.TestCase):
+    def test_feed_has_what_atom_requires(self):
+        root = feed()
+        self.assertEqual(root.tag, f"{A}feed")
+        for tag in ("title", "id", "updated", "author"):
+            self.assertIsNotNone(root.find(f"{A}{tag}"), tag)
+        # the newest entry's time, not the time it was made
+        self.assertEqual(root.findtext(f"{A}updated"), "2024-05-02T10:00:00Z")
+        self.assertEqual(root.find(f"{A}link[@rel='self']").get("href"), "https://example.org/feed.xml")
+
+    def test_entries_in_order_with_stable_ids(self):
+        entries = feed().findall(f"{A}entry")
+        self.assertEqual([e.findtext(f"{A}id") for e in entries], ["tag:archive.org,2005:new-item", "tag:archive.org,2005:old-item"])
+        first, second = entries
+        self.assertEqual(first.find(f"{A}link").get("href"), "https://archive.org/details/new-item")
+        self.assertEqual((first.findtext(f"{A}published"), first.findtext(f"{A}updated")), ("2024-05-02T10:00:00Z",) * 2)
+        self.assertEqual([a.findtext(f"{A}name") for a in first.findall(f"{A}author")], ["Ann", "Bo"])
+        self.assertEqual(first.find(f"{A}summary").get("type"), "html")
+        self.assertEqual(first.findtext(f"{A}summary"), "<p>a &amp; b</p>")
+        self.assertEqual(first.find(f"{A}category").get("term"), "software")
+        # no title: the identifier; no creator: the feed's author stands in
+        self.assertEqual((second.findtext(f"{A}title"), second.find(f"{A}author")), ("old-item", None))
+
+    def test_the_xml_parses_back(self):
+        text = ET.tostring(feed(), encoding="unicode")
+        self.assertEqual(len(ET.fromstring(text).findall(f"{A}entry")), 2)
+
+    def test_empty_feed_is_updated_now(self):
+        root = feed([])
+        self.assertEqual(root.findtext(f"{A}updated"), "2024-06-01T00:00:00Z")
+        self.assertEqual(root.findall(f"{A}entry"), [])
+
+    def test_entry_without_a_date_takes_the_feed_time(self):
+        entry = feed([{"identifier": "a", "publicdate": "sometime"}]).find(f"{A}entry")
+        self.assertEqual((entry.findtext(f"{A}updated"), entry.find(f"{A}published")), ("2024-06-01T00:00:00Z", None))
+
+
+class QueryTest(unittest.TestCase):
+    def test_parts_are_anded(self):
+        self.assertEqual(iaf.feed_query("format:ISO", ["a", "b"], "2024-05-01T00:00:00Z"),
+                         "(format:ISO) AND collection:a AND collection:b AND publicdate:[2024-05-01T00:00:00Z TO null]")
+        self.assertEqual(iaf.feed_query(None, ["a"], None), "collection:a")
+
+    def test_since_date(self):
+        self.assertEqual(iaf.since_date("2024-05-01"), "2024-05-01T00:00:00Z")
+        self.assertEqual(iaf.since_date("2024-05-01T14:00:00+02:00"), "2024-05-01T12:00:00Z")
+        with self.assertRaises(argparse.ArgumentTypeError):
+            iaf.since_date("last week")
+
+
+if __name__ == "__main__":
+    unittest.main()
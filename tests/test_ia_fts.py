@@ -0,0 +1,34 @@
+import unittest
+
+from _scripts import load_script
+
+iafts = load_script("IA-FTS.py")
+
+
+class HighlightTest(unittest.TestCase):
+    def test_both_match_markers(self):
+        self.assertEqual(iafts.highlight("a {{{b}}} c <em>d</em>", "**"), "a **b** c **d**")
+        self.assertEqual(iafts.highlight("a {{{b}}}", ""), "a b")
+
+
+class ScopedQueryTest(unittest.TestCase):
+    def test_collections_are_alternatives(self):
+        self.assertEqual(iafts.scoped_query("x", []), "x")
+        self.assertEqual(iafts.scoped_query("x OR y", ["a"]), "(x OR y) AND (collection:a)")
+
+
+class DescribeTest(unittest.TestCase):
+    def test_fields_lists_and_missing_highlight(self):
+        hit = {"_id": "id-from-es", "fields": {"identifier": ["book"], "title": ["Title"]}}
+        self.assertEqual(iafts.describe(hit, "**"), {"identifier": "book", "title": "Title", "score": None, "snippets": []})
+        self.assertEqual(iafts.describe({"_id": "only-id"}, "**")["identifier"], "only-id")
+
+
+class TextDocTest(unittest.TestCase):
+    def test_stem_of_the_ocr_file(self):
+        self.assertEqual(iafts.text_doc("item", [{"name": "x.pdf"}, {"name": "vol1_djvu.xml"}]), "vol1")
+        self.assertEqual(iafts.text_doc("item", [{"name": "x.pdf"}]), "item")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,21 @@
+import unittest
+
+from _scripts import load_script
+
+ial = load_script("IA-List.py")
+
+
+class FileRowsTest(unittest.TestCase):
+    FILES = [{"name": "disc.iso", "size": "2048", "format": "ISO Image", "source": "original", "md5": "abc"}, {"name": "x"}]
+
+    def test_table_sizes_are_human_tsv_sizes_are_bytes(self):
+        self.assertEqual(ial.file_rows(self.FILES, tsv=False)[0], ["disc.iso", "2.0KB", "ISO Image", "original", "abc", ""])
+        self.assertEqual(ial.file_rows(self.FILES, tsv=True)[0][1], "2048")
+        self.assertEqual(ial.file_rows(self.FILES, tsv=True)[1], ["x", "", "", "", "", ""])
+
+    def test_totals_line_counts_unknown_sizes(self):
+        self.assertEqual(ial.totals_line(self.FILES, []), "2 files, 2.0KB total (1 without size)")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,45 @@
+import argparse
+import unittest
+
+from _scripts import load_script
+
+iam = load_script("IA-Metadata.py")
+
+METADATA = {
+    "metadata": {"identifier": "distro", "title": "Distro", "subject": ["linux", "iso"]},
+    "files": [{"name": "distro.iso", "md5": "abc"}, {"name": "README.txt"}],
+}
+
+
+class SelectTest(unittest.TestCase):
+    def test_keys(self):
+        self.assertEqual(iam.select(METADATA, "metadata.title"), "Distro")
+        self.assertEqual(iam.select(METADATA, "metadata"), METADATA["metadata"])
+
+    def test_every_element(self):
+        self.assertEqual(iam.select(METADATA, "files[].name"), ["distro.iso", "README.txt"])
+        self.assertEqual(iam.select(METADATA, "files[].md5"), ["abc", None])
+        self.assertEqual(iam.select(METADATA, "metadata.subject[]"), ["linux", "iso"])
+
+    def test_one_element(self):
+        self.assertEqual(iam.select(METADATA, "files[1].name"), "README.txt")
+        self.assertIsNone(iam.select(METADATA, "files[5].name"))
+
+    def test_missing_parts_give_none(self):
+        self.assertIsNone(iam.select(METADATA, "metadata.nope.deeper"))
+        self.assertIsNone(iam.select(METADATA, "metadata.title[]"))
+        self.assertIsNone(iam.select({}, "files[].name"))
+
+
+class FieldPathsTest(unittest.TestCase):
+    def test_splits_on_commas(self):
+        self.assertEqual(iam.field_paths("metadata.title,files[].name,"), ["metadata.title", "files[].name"])
+
+    def test_rejects_bad_brackets(self):
+        for value in ("files[.name", "files[x].name", "files]"):
+            with self.subTest(value=value), self.assertRaises(argparse.ArgumentTypeError):
+                iam.field_paths(value)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,55 @@
+import argparse
+import os
+import tempfile
+import unittest
+
+from _scripts import load_script
+
+iamr = load_script("IA-Mirror.py")
+
+
+class CollectionQueryTest(unittest.TestCase):
+    def test_since_reaches_back_by_the_overlap(self):
+        self.assertEqual(iamr.collection_query("distros"), "collection:distros")
+        since = 1714564800 + iamr.SINCE_OVERLAP
+        self.assertEqual(iamr.collection_query("distros", since),
+                         "collection:distros AND oai_updatedate:[2024-05-01T12:00:00Z TO null]")
+
+    def test_since_time(self):
+        self.assertEqual(iamr.since_time("2024-05-01").timestamp(), 1714521600)
+        self.assertEqual(iamr.since_time("2024-05-01T12:00:00Z").timestamp(), 1714564800)
+        with self.assertRaises(argparse.ArgumentTypeError):
+            iamr.since_time("last tuesday")
+
+
+class MirrorStateTest(unittest.TestCase):
+    def setUp(self):
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.path = os.path.join(tmp.name, iamr.STATE_FILE)
+        self.state = iamr.MirrorState(self.path)
+        self.addCleanup(self.state.db.close)
+
+    def test_pending_keeps_what_the_last_sync_recorded(self):
+        self.state.set_item("x", "synced", 100, 5.0)
+        self.state.set_item("x", "pending")
+        row = self.state.item("x")
+        self.assertEqual((row["state"], row["updated"], row["synced"]), ("pending", 100, 5.0))
+        self.assertEqual(self.state.identifiers("pending"), ["x"])
+
+    def test_totals(self):
+        self.state.set_item("x", "synced")
+        self.state.set_item("y", "withdrawn")
+        self.state.set_file("x", "a.iso", "x/a.iso", 10, None)
+        self.state.set_file("x", "b.iso", "x/b.iso", None, None)
+        self.assertEqual(self.state.totals(), {"synced": 1, "pending": 0, "withdrawn": 1, "files": 2, "bytes": 10})
+
+    def test_dry_run_writes_nothing(self):
+        dry = iamr.MirrorState(self.path, dry_run=True)
+        self.addCleanup(dry.db.close)
+        dry.set_item("x", "synced")
+        self.assertIsNone(self.state.item("x"))
+
+
+if __name__ == "__main__":
+    unittest.main()
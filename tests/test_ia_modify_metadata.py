@@ -0,0 +1,45 @@
+import unittest
+
+from _scripts import load_script
+
+iamm = load_script("IA-Modify-Metadata.py")
+
+CURRENT = {"identifier": "distro", "title": "Distro", "subject": ["linux"], "creator": "someone"}
+
+
+class BuildPatchTest(unittest.TestCase):
+    def test_set_adds_or_replaces_and_skips_no_ops(self):
+        patch = iamm.build_patch(CURRENT, [("set", "title", "Distro 2"), ("set", "year", "2024"), ("set", "creator", "someone")])
+        self.assertEqual(patch, [{"op": "replace", "path": "/title", "value": "Distro 2"},
+                                 {"op": "add", "path": "/year", "value": "2024"}])
+
+    def test_append_extends_or_starts_a_list(self):
+        patch = iamm.build_patch(CURRENT, [("append", "subject", "iso"), ("append", "creator", "another"),
+                                           ("append", "language", "eng")])
+        self.assertEqual(patch, [{"op": "add", "path": "/subject/-", "value": "iso"},
+                                 {"op": "replace", "path": "/creator", "value": ["someone", "another"]},
+                                 {"op": "add", "path": "/language", "value": ["eng"]}])
+
+    def test_ops_see_the_earlier_ones(self):
+        patch = iamm.build_patch({}, [("set", "note", "a"), ("set", "note", "b"), ("remove", "note", None)])
+        self.assertEqual([op["op"] for op in patch], ["add", "replace", "remove"])
+
+    def test_removing_a_missing_key_is_skipped(self):
+        with self.assertLogs(level="WARNING"):
+            self.assertEqual(iamm.build_patch(CURRENT, [("remove", "nope", None)]), [])
+
+    def test_key_is_escaped_in_the_pointer(self):
+        self.assertEqual(iamm.pointer("a/b~c"), "/a~1b~0c")
+
+
+class TargetMetadataTest(unittest.TestCase):
+    ITEM = {"metadata": CURRENT, "files": [{"name": "disc.iso", "format": "ISO Image"}]}
+
+    def test_file_target(self):
+        self.assertEqual(iamm.target_metadata(self.ITEM, "files/disc.iso")["format"], "ISO Image")
+        with self.assertRaisesRegex(LookupError, "no file named 'other.iso'"):
+            iamm.target_metadata(self.ITEM, "files/other.iso")
+
+
+if __name__ == "__main__":
+    unittest.main()
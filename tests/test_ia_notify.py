@@ -0,0 +1,135 @@
+import argparse
+import json
+import os
+import shlex
+import sys
+import tempfile
+import threading
+import unittest
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from unittest import mock
+
+import _scripts  # noqa: F401  (puts the repository root on sys.path)
+import ia_notify
+
+
+def notify_args(**overrides) -> argparse.Namespace:
+    p = argparse.ArgumentParser()
+    ia_notify.add_notify_args(p)
+    args = p.parse_args([])
+    for key, value in overrides.items():
+        setattr(args, key, value)
+    return args
+
+
+class EventTest(unittest.TestCase):
+    def notifier(self, **overrides) -> ia_notify.Notifier:
+        notifier = ia_notify.Notifier(notify_args(notify_url="http://hooks.example/x", **overrides), "test", "test/1.0")
+        notifier.send = mock.Mock()
+        return notifier
+
+    def events(self, notifier, *statuses):
+        return [notifier.done(status) for status in statuses]
+
+    def test_failures_are_told_once_a_streak_and_the_recovery_after(self):
+        notifier = self.notifier()
+        self.assertEqual(self.events(notifier, 0, 3, 3, 0, 0), [None, "failed", None, "recovered", None])
+
+    def test_notify_after_waits_for_that_many_failures_in_a_row(self):
+        notifier = self.notifier(notify_after=2)
+        self.assertEqual(self.events(notifier, 3, 0, 3, 2, 2), [None, None, None, "failed", None])
+        self.assertEqual(notifier.send.call_args.args[0]["failures_in_a_row"], 2)
+
+    def test_always_tells_about_every_run(self):
+        notifier = self.notifier(notify_on="always")
+        self.assertEqual(self.events(notifier, 0, 3, 3, 0), ["finished", "failed", "failed", "recovered"])
+
+    def test_an_interrupted_run_neither_fails_nor_recovers(self):
+        notifier = self.notifier(notify_after=2)
+        self.assertEqual(self.events(notifier, 3, ia_notify.EXIT_INTERRUPTED, 3), [None, None, "failed"])
+
+    def test_never_and_no_target_send_nothing(self):
+        for notifier in (self.notifier(notify_on="never"), ia_notify.Notifier(notify_args(), "test", "test/1.0")):
+            self.assertFalse(notifier.enabled)
+            self.assertEqual(notifier.done(3), None)
+
+    def test_failures_in_a_row_are_counted_across_runs_in_the_state_dir(self):
+        with tempfile.TemporaryDirectory() as state_dir:
+            args = notify_args(notify_command="true", notify_after=2)
+            for expected in (None, "failed"):
+                notifier = ia_notify.Notifier(args, "test", "test/1.0", state_dir)
+                notifier.send = mock.Mock()
+                self.assertEqual(notifier.done(3), expected)
+            with open(os.path.join(state_dir, ia_notify.NOTIFY_STATE), encoding="utf-8") as f:
+                self.assertEqual(json.load(f), {"failures": 2, "notified": True})
+
+
+class RecordingHandler(BaseHTTPRequestHandler):
+    received = []
+
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers["Content-Length"]))
+        self.received.append((self.headers["Content-Type"], self.headers["User-Agent"], json.loads(body)))
+        self.send_response(204 if self.path == "/ok" else 500)
+        self.send_header("Content-Length", "0")
+        self.end_headers()
+
+    def log_message(self, *args):
+        pass
+
+
+class SendTest(unittest.TestCase):
+    def setUp(self):
+        RecordingHandler.received = []
+        self.server = ThreadingHTTPServer(("127.0.0.1", 0), RecordingHandler)
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+        self.addCleanup(self.server.server_close)
+        self.addCleanup(self.server.shutdown)
+        self.url = f"http://127.0.0.1:{self.server.server_address[1]}"
+        tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(tmp.cleanup)
+        self.tmp = tmp.name
+
+    def test_webhook_gets_the_summary_as_json(self):
+        notifier = ia_notify.Notifier(notify_args(notify_url=self.url + "/ok"), "test", "test/1.0")
+        with self.assertLogs(level="INFO"):
+            notifier.done(3, {"failed": 2})
+        content_type, user_agent, payload = RecordingHandler.received[0]
+        self.assertEqual((content_type, user_agent), ("application/json", "test/1.0"))
+        self.assertEqual((payload["tool"], payload["event"], payload["exit_status"], payload["summary"]), ("test", "failed", 3, {"failed": 2}))
+
+    def test_command_gets_the_summary_on_stdin(self):
+        out = os.path.join(self.tmp, "out.json")
+        script = f"import os, sys; open({out!r}, 'w').write(os.environ['IA_NOTIFY_EVENT'] + ' ' + sys.stdin.read())"
+        command = f"{shlex.quote(sys.executable)} -c {shlex.quote(script)}"
+        notifier = ia_notify.Notifier(notify_args(notify_command=command, notify_on="always"), "test", "test/1.0")
+        with self.assertLogs(level="INFO"):
+            notifier.done(0, {"items": 4})
+        with open(out, encoding="utf-8") as f:
+            event, body = f.read().split(" ", 1)
+        self.assertEqual((event, json.loads(body)["summary"]), ("finished", {"items": 4}))
+
+    def test_a_broken_webhook_or_command_is_only_logged(self):
+        notifier = ia_notify.Notifier(notify_args(notify_url=self.url + "/broken", notify_command="exit 4"), "test", "test/1.0")
+        with self.assertLogs(level="WARNING") as logs:
+            self.assertEqual(notifier.done(3), "failed")
+        self.assertIn("answered HTTP 500", logs.output[0])
+        self.assertIn("--notify-command exited with 4", logs.output[1])
+
+    def test_an_exception_that_ends_the_run_is_told_about(self):
+        notifier = ia_notify.Notifier(notify_args(notify_url=self.url + "/ok"), "test", "test/1.0", self.tmp)
+        self.addCleanup(setattr, sys, "excepthook", sys.excepthook)
+        with mock.patch.object(sys, "excepthook") as previous:
+            notifier.install(lambda: {"items": 1})
+            try:
+                raise RuntimeError("disk on fire")
+            except RuntimeError:
+                with self.assertLogs(level="INFO"):
+                    sys.excepthook(*sys.exc_info())
+        previous.assert_called_once()
+        payload = RecordingHandler.received[0][2]
+        self.assertEqual((payload["event"], payload["error"], payload["summary"]), ("crashed", "RuntimeError: disk on fire", {"items": 1}))
+
+
+if __name__ == "__main__":
+    unittest.main()
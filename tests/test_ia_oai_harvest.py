@@ -0,0 +1,57 @@
+import argparse
+import os
+import tempfile
+import unittest
+import xml.etree.ElementTree as ET
+
+from _scripts import load_script
+
+iaoai = load_script("IA-OAI-Harvest.py")
+
+RECORD = """<record xmlns="http://www.openarchives.org/OAI/2.0/">
+  <header><identifier>oai:archive.org:film</identifier><datestamp>2024-01-01</datestamp>
+    <setSpec>collection:prelinger</setSpec><setSpec>mediatype:movies</setSpec></header>
+  <metadata><oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title> Film </dc:title><dc:subject>a</dc:subject><dc:subject>b</dc:subject><dc:description/>
+  </oai_dc:dc></metadata>
+</record>"""
+
+
+class OaiDateTest(unittest.TestCase):
+    def test_days_and_seconds(self):
+        self.assertEqual(iaoai.oai_date("2024-05-01"), "2024-05-01")
+        self.assertEqual(iaoai.oai_date("2024-05-01T12:00:00Z"), "2024-05-01T12:00:00Z")
+        for value in ("2024", "2024-05-01 12:00", "01/05/2024"):
+            with self.assertRaises(argparse.ArgumentTypeError):
+                iaoai.oai_date(value)
+
+
+class ParseRecordTest(unittest.TestCase):
+    def test_header_and_dublin_core(self):
+        record = iaoai.parse_record(ET.fromstring(RECORD))
+        self.assertEqual(record, {"identifier": "oai:archive.org:film", "datestamp": "2024-01-01",
+                                  "sets": ["collection:prelinger", "mediatype:movies"], "deleted": False,
+                                  "dc": {"title": ["Film"], "subject": ["a", "b"], "description": [""]}})
+
+
+class RecordFileTest(unittest.TestCase):
+    def test_named_after_the_item(self):
+        self.assertEqual(iaoai.record_file("out", "oai:archive.org:film"), os.path.join("out", "film.xml"))
+        self.assertEqual(iaoai.record_file("out", "oai:other:a/b"), os.path.join("out", "oai:other:a_b.xml"))
+
+
+class StateTest(unittest.TestCase):
+    def test_token_only_for_the_same_harvest(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            path = os.path.join(tmp, "state.json")
+            self.assertIsNone(iaoai.load_state(path, {"verb": "ListRecords"}))
+            iaoai.save_state(path, {"verb": "ListRecords"}, "abc")
+            self.assertEqual(iaoai.load_state(path, {"verb": "ListRecords"}), "abc")
+            with self.assertRaises(ValueError):
+                iaoai.load_state(path, {"verb": "ListRecords", "set": "collection:other"})
+            iaoai.save_state(path, {"verb": "ListRecords"}, None)
+            self.assertFalse(os.path.exists(path))
+
+
+if __name__ == "__main__":
+    unittest.main()
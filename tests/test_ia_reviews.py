@@ -0,0 +1,22 @@
+import unittest
+
+from _scripts import load_script
+
+iar = load_script("IA-Reviews.py")
+
+
+class ReviewRowsTest(unittest.TestCase):
+    def test_unrated_reviews_and_createdate(self):
+        rows = iar.review_rows("item", [{"reviewer": "x", "createdate": "2019-01-01", "stars": ""}])
+        self.assertEqual(rows, [{"identifier": "item", "reviewer": "x", "date": "2019-01-01", "stars": None, "title": "", "body": ""}])
+        self.assertEqual(iar.review_rows("item", [{"stars": ""}, {"stars": "0"}], min_stars=0)[0]["stars"], 0)
+
+
+class ItemStatsTest(unittest.TestCase):
+    def test_average_of_the_rated(self):
+        rows = [{"stars": 4}, {"stars": None}, {"stars": 3}]
+        self.assertEqual(iar.item_stats("item", rows), {"identifier": "item", "count": 3, "average_stars": 3.5})
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,110 @@
+import argparse
+import threading
+import unittest
+from unittest import mock
+
+import requests
+
+from _scripts import load_script
+from fakearchive import FakeArchive
+import ia_common
+
+ias = load_script("IA-Serve.py")
+
+ENTRIES = [
+    {"identifier": "distro-2.0", "file_name": "distro-2.0.img", "size": "1000", "date": "2024-05-01", "collection": ["distros"]},
+    {"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": 3000, "date": "2023-01-01", "title": "Distro <One>",
+     "collection": "distros"},
+    {"identifier": "distro-1.0", "file_name": "README.txt", "size": "unknown"},
+    {"identifier": "", "file_name": "orphan.iso"},
+]
+
+
+class ListenAddressTest(unittest.TestCase):
+    def test_host_and_port(self):
+        self.assertEqual(ias.listen_address("127.0.0.1:8080"), ("127.0.0.1", 8080))
+        self.assertEqual(ias.listen_address(":8080"), ("", 8080))
+        self.assertEqual(ias.listen_address("[::1]:9000"), ("::1", 9000))
+
+    def test_bad_addresses(self):
+        for value in ("8080", "host:", "host:http", ":70000"):
+            with self.assertRaises(argparse.ArgumentTypeError):
+                ias.listen_address(value)
+
+
+class IndexTest(unittest.TestCase):
+    def setUp(self):
+        self.index = ias.Index(ENTRIES)
+
+    def names(self, **kwargs):
+        return [e["file_name"] for e in self.index.select(**kwargs)]
+
+    def test_entries_without_an_identifier_are_left_out(self):
+        self.assertEqual(len(self.index.entries), 3)
+        self.assertEqual((self.index.extensions, self.index.collections), (["img", "iso", "txt"], ["distros"]))
+
+    def test_search_filters_and_sorts(self):
+        self.assertEqual(self.names(q="ONE"), ["distro-1.0.iso"])
+        self.assertEqual(self.names(ext="iso"), ["distro-1.0.iso"])
+        self.assertEqual(self.names(collection="distros"), ["distro-1.0.iso", "distro-2.0.img"])
+        self.assertEqual(self.names(), ["README.txt", "distro-1.0.iso", "distro-2.0.img"])
+        self.assertEqual(self.names(sort="size", descending=True), ["distro-1.0.iso", "distro-2.0.img", "README.txt"])
+        self.assertEqual(self.names(sort="date"), ["distro-1.0.iso", "distro-2.0.img", "README.txt"])
+
+
+class RenderPageTest(unittest.TestCase):
+    def test_rows_are_escaped_and_linked(self):
+        page = ias.render_page(ias.Index(ENTRIES), {"q": "<one>"}, "My <catalog>", relay=False, page_size=10)
+        self.assertIn("<title>My &lt;catalog&gt;</title>", page)
+        self.assertIn('value="&lt;one&gt;"', page)
+        self.assertIn('title="Distro &lt;One&gt;"', page)
+        self.assertIn("https://archive.org/download/distro-1.0/distro-1.0.iso", page)
+        self.assertIn("1 of 3 file(s), 2.9KB", page)
+
+    def test_relay_links_point_at_the_server(self):
+        page = ias.render_page(ias.Index(ENTRIES[:1]), {}, "t", relay=True, page_size=10)
+        self.assertIn('href="/files/distro-2.0/distro-2.0.img"', page)
+
+    def test_pages_link_to_each_other_and_keep_the_filter(self):
+        page = ias.render_page(ias.Index(ENTRIES), {"sort": "size", "page": "2"}, "t", relay=False, page_size=1)
+        self.assertIn("showing 2–2", page)
+        self.assertIn('href="/?sort=size&amp;order=asc&amp;page=1"', page)
+        self.assertIn('href="/?sort=size&amp;order=asc&amp;page=3"', page)
+        # the sorted column's heading sorts the other way
+        self.assertIn('href="/?sort=size&amp;order=desc">Size ▲</a>', page)
+
+
+class ServerTest(unittest.TestCase):
+    def setUp(self):
+        self.archive = FakeArchive().start()
+        self.addCleanup(self.archive.close)
+        self.archive.add_item("distro-1.0", {"distro-1.0.iso": bytes(range(256)) * 40})
+        self.enterContext(self.archive.pointed(ias))
+        entries = [{"identifier": "distro-1.0", "file_name": "distro-1.0.iso", "size": 10240}]
+        session = ia_common.build_session(5, 0, 0, "test")
+        self.addCleanup(session.close)
+        self.server = ias.make_server(("127.0.0.1", 0), ias.Index(entries), session, "t", True, 10)
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+        self.addCleanup(self.server.server_close)
+        self.addCleanup(self.server.shutdown)
+        self.url = f"http://127.0.0.1:{self.server.server_address[1]}"
+        self.enterContext(mock.patch.object(ias.logging, "info"))
+
+    def test_page_and_relayed_file_with_range(self):
+        with requests.get(self.url + "/?q=distro") as r:
+            self.assertEqual((r.status_code, r.headers["Content-Type"]), (200, "text/html; charset=utf-8"))
+            self.assertIn("/files/distro-1.0/distro-1.0.iso", r.text)
+        with requests.get(self.url + "/files/distro-1.0/distro-1.0.iso") as r:
+            self.assertEqual((r.status_code, r.content), (200, bytes(range(256)) * 40))
+        with requests.get(self.url + "/files/distro-1.0/distro-1.0.iso", headers={"Range": "bytes=256-511"}) as r:
+            self.assertEqual((r.status_code, r.headers["Content-Range"], r.content), (206, "bytes 256-511/10240", bytes(range(256))))
+        self.assertIn(("/download/distro-1.0/distro-1.0.iso", "bytes=256-511"), self.archive.requests)
+
+    def test_only_files_in_the_catalog_are_relayed(self):
+        with mock.patch.object(ias.Handler, "log_error"), requests.get(self.url + "/files/other/secret.iso") as r:
+            self.assertEqual(r.status_code, 404)
+        self.assertEqual([path for path, _ in self.archive.requests if path.startswith("/download/")], [])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,26 @@
+import unittest
+
+from _scripts import load_script
+
+ias = load_script("IA-Size.py")
+
+
+class TallyTest(unittest.TestCase):
+    def test_breakdowns(self):
+        tally = ias.Tally()
+        tally.add("a", [{"name": "a.iso", "format": "ISO Image", "source": "original", "size": "700"},
+                        {"name": "a.torrent", "format": "Archive BitTorrent", "source": "metadata", "size": "20"}])
+        tally.add("b", [{"name": "b.iso", "format": "ISO Image", "source": "original", "size": "300"},
+                        {"name": "b.txt", "source": "derivative"}])
+        report = tally.report(["c"])
+        self.assertEqual(report["total"], {"files": 4, "size": 1020, "unknown_size": 1})
+        self.assertEqual(list(report["by_format"].items()),
+                         [("ISO Image", {"files": 2, "size": 1000}), ("Archive BitTorrent", {"files": 1, "size": 20}),
+                          ("(none)", {"files": 1, "size": 0})])
+        self.assertEqual(report["by_source"]["derivative"], {"files": 1, "size": 0})
+        self.assertEqual(report["per_item"]["b"], {"files": 2, "size": 300, "unknown_size": 1})
+        self.assertEqual((report["items"], report["failed"]), (2, ["c"]))
+
+
+if __name__ == "__main__":
+    unittest.main()
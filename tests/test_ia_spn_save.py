@@ -0,0 +1,27 @@
+import argparse
+import unittest
+
+from _scripts import load_script
+
+spn = load_script("IA-SPN-Save.py")
+
+
+class CaptureOptionsTest(unittest.TestCase):
+    def args(self, **kw):
+        base = dict(capture_outlinks=False, capture_screenshot=False, capture_all=False, if_not_archived_within=None)
+        return argparse.Namespace(**dict(base, **kw))
+
+    def test_only_the_flags_given(self):
+        self.assertEqual(spn.capture_options(self.args()), {})
+        self.assertEqual(spn.capture_options(self.args(capture_screenshot=True, if_not_archived_within=5400.0)),
+                         {"capture_screenshot": "1", "if_not_archived_within": "5400s"})
+
+
+class SPNErrorTest(unittest.TestCase):
+    def test_message_is_optional(self):
+        self.assertEqual(str(spn.SPNError("error:blocked-url")), "error:blocked-url")
+        self.assertEqual(str(spn.SPNError("error:robots-txt", "robots.txt says no")), "error:robots-txt: robots.txt says no")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,43 @@
+import unittest
+
+from _scripts import load_script
+
+iast = load_script("IA-Stats.py")
+
+
+class GroupKeysTest(unittest.TestCase):
+    def test_year_falls_back_to_the_date(self):
+        self.assertEqual(iast.group_keys({"year": "1999"}, "year"), ["1999"])
+        self.assertEqual(iast.group_keys({"date": "2004-05-01"}, "year"), ["2004"])
+        self.assertEqual(iast.group_keys({}, "year"), [iast.UNKNOWN])
+
+    def test_a_repeated_field_is_one_group_per_value(self):
+        self.assertEqual(iast.group_keys({"collection": ["distros", "software", "distros"]}, "collection"), ["distros", "software"])
+        self.assertEqual(iast.group_keys({"mediatype": ""}, "mediatype"), [iast.UNKNOWN])
+
+
+class StatsTest(unittest.TestCase):
+    def test_years_in_order_with_the_totals_to_date(self):
+        stats = iast.Stats("year")
+        stats.add("b", ["2021"], 300)
+        stats.add("a", ["2019"], 700)
+        stats.add("c", ["2021"], None)
+        stats.add("d", [iast.UNKNOWN], 5)
+        report = stats.report("collection:distros", "item_size", [])
+        self.assertEqual([(r["key"], r["items"], r["size"], r.get("size_to_date")) for r in report["groups"]],
+                         [("2019", 1, 700, 700), ("2021", 2, 300, 1000), (iast.UNKNOWN, 1, 5, None)])
+        self.assertEqual((report["items"], report["size"], report["unknown_size"]), (4, 1005, 1))
+
+    def test_an_item_counts_once_per_group_and_once_in_the_total(self):
+        stats = iast.Stats("format")
+        stats.add("a", ["ISO Image"], 700)
+        stats.add("a", ["ISO Image"], 10)
+        stats.add("a", ["Text"], 1)
+        stats.add("b", ["Text"], 2)
+        report = stats.report("x", "metadata", [])
+        self.assertEqual([(r["key"], r["items"], r["size"]) for r in report["groups"]], [("ISO Image", 1, 710), ("Text", 2, 3)])
+        self.assertEqual((report["items"], report["size"]), (2, 713))
+
+
+if __name__ == "__main__":
+    unittest.main()
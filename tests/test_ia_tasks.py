@@ -0,0 +1,21 @@
+import contextlib
+import io
+import unittest
+
+from _scripts import load_script
+
+iat = load_script("IA-Tasks.py")
+
+
+class PrintTableTest(unittest.TestCase):
+    def test_aligned_columns(self):
+        out = io.StringIO()
+        with contextlib.redirect_stdout(out):
+            iat.print_table([{"task_id": 7, "status": "queued", "cmd": "derive.php", "identifier": "x"}])
+        header, row = out.getvalue().splitlines()
+        self.assertEqual(header.index("status"), row.index("queued"))
+        self.assertTrue(row.startswith("7        queued"))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,37 @@
+import os
+import tempfile
+import unittest
+
+from _scripts import load_script
+
+iath = load_script("IA-Thumbnail.py")
+
+
+class LargestImageTest(unittest.TestCase):
+    def test_the_largest_original_image(self):
+        metadata = {"files": [
+            {"name": "__ia_thumb.jpg", "source": "original", "format": "Item Tile", "size": "9000"},
+            {"name": "cover.jpg", "source": "original", "format": "JPEG", "size": "2000"},
+            {"name": "back.png", "source": "original", "format": "PNG", "size": "3000"},
+            {"name": "back_thumb.jpg", "source": "derivative", "format": "JPEG Thumb", "size": "100"},
+            {"name": "scan.jpg", "source": "derivative", "format": "JPEG", "size": "50000"},
+            {"name": "disc.iso", "source": "original", "format": "ISO Image", "size": "90000"},
+        ]}
+        self.assertEqual(iath.largest_image(metadata)["name"], "back.png")
+
+    def test_entries_without_a_format_go_by_name(self):
+        metadata = {"files": [{"name": "cover.JPG", "source": "original", "size": "10"}, {"name": "readme.txt", "source": "original"}]}
+        self.assertEqual(iath.largest_image(metadata)["name"], "cover.JPG")
+        self.assertIsNone(iath.largest_image({"files": metadata["files"][1:]}))
+
+
+class ExistingTest(unittest.TestCase):
+    def test_an_image_of_any_type_counts(self):
+        with tempfile.TemporaryDirectory() as out_dir:
+            self.assertIsNone(iath.existing(out_dir, "distro-1.0"))
+            open(os.path.join(out_dir, "distro-1.0.png"), "wb").close()
+            self.assertEqual(iath.existing(out_dir, "distro-1.0"), os.path.join(out_dir, "distro-1.0.png"))
+
+
+if __name__ == "__main__":
+    unittest.main()
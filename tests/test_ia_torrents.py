@@ -0,0 +1,35 @@
+import unittest
+
+from _scripts import load_script
+
+iatt = load_script("IA-Torrents.py")
+
+
+class BdecodeTest(unittest.TestCase):
+    def test_values(self):
+        self.assertEqual(iatt.bdecode(b"i-42e"), (-42, 5))
+        self.assertEqual(iatt.bdecode(b"4:spam"), (b"spam", 6))
+        self.assertEqual(iatt.bdecode(b"l4:spami1ee"), ([b"spam", 1], 11))
+        self.assertEqual(iatt.bdecode(b"d3:cow3:mooe"), ({b"cow": b"moo"}, 12))
+
+    def test_malformed(self):
+        for data in (b"i12", b"10:short", b"l4:spam", b"di1e3:mooe", b"x", b""):
+            with self.subTest(data=data), self.assertRaises(ValueError):
+                iatt.bdecode(data)
+
+
+class ParseTorrentTest(unittest.TestCase):
+    INFO = b"d6:lengthi5e4:name3:iso12:piece lengthi16384e6:pieces0:e"
+
+    def test_single_file_torrent(self):
+        torrent = iatt.parse_torrent(b"d8:announce3:url8:url-list5:seed14:info" + self.INFO + b"e")
+        self.assertEqual((torrent["name"], torrent["size"], torrent["trackers"], torrent["webseeds"]), ("iso", 5, ["url"], ["seed1"]))
+
+    def test_needs_an_info_dictionary_and_nothing_after_it(self):
+        for data in (b"d8:announce3:urle", b"d4:info" + self.INFO + b"ee", b"<html>"):
+            with self.subTest(data=data), self.assertRaises(ValueError):
+                iatt.parse_torrent(data)
+
+
+if __name__ == "__main__":
+    unittest.main()
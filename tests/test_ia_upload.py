@@ -0,0 +1,46 @@
+import os
+import tempfile
+import unittest
+
+from _scripts import load_script
+
+iau = load_script("IA-Upload.py")
+
+
+class MetaHeadersTest(unittest.TestCase):
+    def test_one_value_per_key(self):
+        self.assertEqual(iau.meta_headers([("title", "Distro 1.0"), ("mediatype", "software")]),
+                         {"x-archive-meta-title": "Distro 1.0", "x-archive-meta-mediatype": "software"})
+
+    def test_repeated_key_becomes_a_numbered_list(self):
+        self.assertEqual(iau.meta_headers([("subject", "linux"), ("title", "t"), ("subject", "iso")]),
+                         {"x-archive-meta01-subject": "linux", "x-archive-meta02-subject": "iso", "x-archive-meta-title": "t"})
+
+    def test_underscores_and_non_ascii(self):
+        self.assertEqual(iau.meta_headers([("release_date", "2024"), ("creator", "Jürgen")]),
+                         {"x-archive-meta-release--date": "2024", "x-archive-meta-creator": "uri(J%C3%BCrgen)"})
+
+
+class ExpandFilesTest(unittest.TestCase):
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(self.tmp.cleanup)
+        for name in ("b.iso", "a.iso", "notes.txt"):
+            open(os.path.join(self.tmp.name, name), "w").close()
+
+    def path(self, name):
+        return os.path.join(self.tmp.name, name)
+
+    def test_globs_sorted_and_each_file_once(self):
+        self.assertEqual(iau.expand_files([self.path("*.iso"), self.path("a.iso"), self.path("notes.txt")]),
+                         [self.path("a.iso"), self.path("b.iso"), self.path("notes.txt")])
+
+    def test_nothing_to_upload_is_an_error(self):
+        with self.assertRaisesRegex(FileNotFoundError, "no file matches"):
+            iau.expand_files([self.path("*.img")])
+        with self.assertRaisesRegex(FileNotFoundError, "not a file"):
+            iau.expand_files([self.tmp.name])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,52 @@
+import os
+import tempfile
+import unittest
+
+from _scripts import load_script
+
+iav = load_script("IA-Verify.py")
+
+
+class LoadMapTest(unittest.TestCase):
+    def test_pairs_comments_and_spaces_in_directories(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            path = os.path.join(tmp, "map")
+            with open(path, "w", encoding="utf-8") as f:
+                f.write("# mirror\ndistro-1.0 /mnt/isos/Distro 1.0\n\ndistro-2.0\t/mnt/other  # moved\n")
+            self.assertEqual(iav.load_map(path), [("distro-1.0", "/mnt/isos/Distro 1.0"), ("distro-2.0", "/mnt/other")])
+
+    def test_line_without_directory(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            path = os.path.join(tmp, "map")
+            with open(path, "w", encoding="utf-8") as f:
+                f.write("distro-1.0\n")
+            with self.assertRaisesRegex(ValueError, ":1: expected"):
+                iav.load_map(path)
+
+
+class CheckFileTest(unittest.TestCase):
+    def setUp(self):
+        self.tmp = tempfile.TemporaryDirectory()
+        self.addCleanup(self.tmp.cleanup)
+        self.path = os.path.join(self.tmp.name, "disc.iso")
+        with open(self.path, "wb") as f:
+            f.write(b"0123456789")
+
+    def check(self, size_only=False, **meta):
+        return iav.check_file(self.path, dict({"name": "disc.iso"}, **meta), size_only, "")
+
+    def test_size_then_digest(self):
+        self.assertIsNone(self.check(size="10", md5="781e5e245d69b566979b86e28d23f2c7"))
+        self.assertEqual(self.check(size="11"), "size 10, metadata says 11")
+        self.assertIn("md5", self.check(size="10", md5="0" * 32))
+        self.assertIn("sha1", self.check(size="10", md5="781e5e245d69b566979b86e28d23f2c7", sha1="0" * 40))
+        self.assertIsNone(self.check(size_only=True, size="10", md5="0" * 32))
+
+    def test_on_the_fly_and_missing(self):
+        self.assertIsNone(self.check(size="1", otf="true"))
+        os.remove(self.path)
+        self.assertEqual(self.check(size="10"), "missing")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,25 @@
+import unittest
+
+from _scripts import load_script
+
+iwa = load_script("IA-Wayback-Available.py")
+
+
+class InRangeTest(unittest.TestCase):
+    def test_bounds_to_the_digits_given(self):
+        self.assertTrue(iwa.in_range("20240501120000", "2024", None))
+        self.assertFalse(iwa.in_range("20240501120000", "202404", None))
+        self.assertTrue(iwa.in_range("20240501120000", None, "20240501"))
+        self.assertFalse(iwa.in_range("20240501120000", "2025", "20240502"))
+        self.assertTrue(iwa.in_range("20240501120000", None, None))
+
+
+class AvailabilityParamsTest(unittest.TestCase):
+    def test_side_of_the_timestamp(self):
+        self.assertEqual(iwa.availability_params("a.org", None, None), {"url": "a.org"})
+        self.assertEqual(iwa.availability_params("a.org", None, "2020"), {"url": "a.org", "timestamp": "2020", "closest": "after"})
+        self.assertEqual(iwa.availability_params("a.org", "2022", "2020"), {"url": "a.org", "timestamp": "2022", "closest": "before"})
+
+
+if __name__ == "__main__":
+    unittest.main()
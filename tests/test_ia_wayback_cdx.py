@@ -0,0 +1,25 @@
+import argparse
+import unittest
+
+from _scripts import load_script
+
+iwcdx = load_script("IA-Wayback-CDX.py")
+
+
+class CdxParamsTest(unittest.TestCase):
+    def args(self, **kw):
+        base = dict(url="example.org", match_type="exact", from_=None, to=None, filter=[], status=None, mime=None, collapse=[])
+        return argparse.Namespace(**dict(base, **kw))
+
+    def test_only_what_was_asked_for(self):
+        self.assertEqual(iwcdx.cdx_params(self.args()),
+                         {"url": "example.org", "output": "json", "fl": ",".join(iwcdx.FIELDS), "matchType": "exact"})
+
+    def test_status_and_mime_are_filters(self):
+        params = iwcdx.cdx_params(self.args(status="200", mime="text/html", collapse=["digest"], to="2023"))
+        self.assertEqual(params["filter"], ["statuscode:200", "mimetype:text/html"])
+        self.assertEqual((params["collapse"], params["to"]), (["digest"], "2023"))
+
+
+if __name__ == "__main__":
+    unittest.main()
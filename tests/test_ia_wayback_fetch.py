@@ -0,0 +1,46 @@
+import unittest
+
+from _scripts import load_script
+
+iwf = load_script("IA-Wayback-Fetch.py")
+
+
+class ReadCapturesTest(unittest.TestCase):
+    def test_each_format(self):
+        want = {"timestamp": "20240101000000", "original": "https://example.org/"}
+        ndjson = ['\n', '{"timestamp": "20240101000000", "original": "https://example.org/"}\n']
+        csv = ["timestamp,original\n", "20240101000000,https://example.org/\n"]
+        cdx_json = ['[["timestamp", "original"],\n', '["20240101000000", "https://example.org/"],\n', '[], ["resume"]]\n']
+        for lines in (ndjson, csv, cdx_json):
+            self.assertEqual(list(iwf.read_captures(lines)), [want])
+        text = ["org,example)/ 20240101000000 https://example.org/ text/html 200 DIGEST 1234\n", "short line\n"]
+        self.assertEqual(list(iwf.read_captures(text))[0]["digest"], "DIGEST")
+        self.assertEqual(len(list(iwf.read_captures(text))), 1)
+        self.assertEqual(list(iwf.read_captures([])), [])
+
+
+class CapturePathTest(unittest.TestCase):
+    def test_host_path_and_query(self):
+        self.assertEqual(iwf.capture_path("https://Example.org/docs/", "2024"), "example.org/docs/2024")
+        self.assertEqual(iwf.capture_path("example.org", "2024"), "example.org/2024")
+        self.assertEqual(iwf.capture_path("http://example.org/a?b=1", "2024"), "example.org/a?b=1/2024")
+        self.assertEqual(iwf.capture_path("http://example.org/../../etc", "2024"), "example.org/_/_/etc/2024")
+
+
+class UniqueCapturesTest(unittest.TestCase):
+    def test_first_of_each_digest(self):
+        rows = [{"timestamp": "1", "original": "u", "digest": "A"}, {"timestamp": "2", "original": "u", "digest": "A"},
+                {"timestamp": "3", "original": "u", "digest": "-"}, {"timestamp": "4", "original": "u", "digest": "-"},
+                {"timestamp": "", "original": "u", "digest": "B"}]
+        todo, dropped = iwf.unique_captures(rows)
+        self.assertEqual(([r["timestamp"] for r in todo], dropped), (["1", "3", "4"], 1))
+
+
+class WarcDateTest(unittest.TestCase):
+    def test_short_timestamps_are_padded(self):
+        self.assertEqual(iwf.warc_date("20240501123000"), "2024-05-01T12:30:00Z")
+        self.assertEqual(iwf.warc_date("202405"), "2024-05-00T00:00:00Z")
+
+
+if __name__ == "__main__":
+    unittest.main()